@@ -0,0 +1,119 @@
+package ffcgiclient
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 网关层的准入控制，限制同时转发到后端的请求数
+// 后端（如php-fpm）的子进程都在忙时，新的请求在网关排队等待，而不是全部压到后端导致其返回statusOverloaded；
+// 排队的请求数或等待时间超过限制时直接返回503
+//
+//	admission := &ffcgiclient.Admission{MaxInFlight: 32, MaxQueue: 128, MaxWait: 2 * time.Second}
+//	handler := ffcgiclient.Chain(admission.Middleware(), ffcgiclient.NewPHPFS("/srv"))(ffcgiclient.BasicHandler)
+
+// Admission 并发请求的准入控制，MaxInFlight为0时不做限制
+type Admission struct {
+
+	// MaxInFlight 同时处理的最大请求数，从转发请求开始到读取完stdout为止
+	MaxInFlight int
+
+	// MaxQueue 排队等待的最大请求数，超过时直接返回503，0表示不排队
+	MaxQueue int
+
+	// MaxWait 排队等待的最长时间，超过时返回503，0表示一直等待到请求的上下文结束
+	MaxWait time.Duration
+
+	once     sync.Once
+	slots    chan struct{}
+	queued   int64 // 排队的请求数，原子操作
+	rejected int64 // 被拒绝的请求数，原子操作
+}
+
+// AdmissionStats 准入控制的统计信息
+type AdmissionStats struct {
+	InFlight int   // 正在处理的请求数
+	Queued   int64 // 排队等待的请求数
+	Rejected int64 // 被拒绝（返回503）的请求数
+}
+
+// init 创建名额
+func (a *Admission) init() {
+	a.once.Do(func() {
+		a.slots = make(chan struct{}, a.MaxInFlight)
+	})
+}
+
+// acquire 获取一个名额，排队已满、等待超时或请求的上下文结束时返回false
+func (a *Admission) acquire(req *Request) bool {
+	select {
+	case a.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if atomic.AddInt64(&a.queued, 1) > int64(a.MaxQueue) {
+		atomic.AddInt64(&a.queued, -1)
+		return false
+	}
+	defer atomic.AddInt64(&a.queued, -1)
+
+	var timeout <-chan time.Time
+	if a.MaxWait > 0 {
+		timer := time.NewTimer(a.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case a.slots <- struct{}{}:
+		return true
+	case <-timeout:
+	case <-req.Context().Done():
+	}
+	return false
+}
+
+// release 释放一个名额
+func (a *Admission) release() {
+	<-a.slots
+}
+
+// Stats 返回准入控制的统计信息
+func (a *Admission) Stats() AdmissionStats {
+	a.init()
+	return AdmissionStats{
+		InFlight: len(a.slots),
+		Queued:   atomic.LoadInt64(&a.queued),
+		Rejected: atomic.LoadInt64(&a.rejected),
+	}
+}
+
+// Middleware 返回执行准入控制的中间件
+func (a *Admission) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if a.MaxInFlight <= 0 {
+				return inner(client, req)
+			}
+			a.init()
+			if !a.acquire(req) {
+				atomic.AddInt64(&a.rejected, 1)
+				return newStatusResponse(http.StatusServiceUnavailable), nil
+			}
+
+			// stdout读取结束时释放名额，WriteTo出错时也会读取完剩余的输出
+			var once sync.Once
+			finish := func() {
+				once.Do(a.release)
+			}
+			resp, err := inner(client, req)
+			if err != nil || resp == nil {
+				finish()
+				return resp, err
+			}
+			resp.stdOutReader = &countingReader{r: resp.stdOutReader, n: new(int64), done: finish}
+			return resp, nil
+		}
+	}
+}
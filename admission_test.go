@@ -0,0 +1,81 @@
+package ffcgiclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	stub := &stubClient{recorded: map[string][]byte{
+		"": []byte("Content-Type: text/plain\r\n\r\nok"),
+	}}
+	a := &Admission{MaxInFlight: 1, MaxQueue: 1, MaxWait: 50 * time.Millisecond}
+	handler := a.Middleware()(BasicHandler)
+	serve := func(ctx context.Context, read bool) (*ResponsePipe, int) {
+		r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		resp, err := handler(stub, NewRequest(r))
+		if err != nil {
+			t.Error(err)
+			return nil, 0
+		}
+		if !read {
+			return resp, 0
+		}
+		rec := httptest.NewRecorder()
+		resp.WriteTo(rec, io.Discard)
+		return resp, rec.Code
+	}
+
+	// 未读取完的响应占用名额，排队的请求等待超时后返回503
+	pending, _ := serve(context.Background(), false)
+	start := time.Now()
+	if _, code := serve(context.Background(), true); code != http.StatusServiceUnavailable {
+		t.Fatalf("wait: status = %d", code)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("rejected after %v, want at least MaxWait", elapsed)
+	}
+	// 请求的上下文结束时不再等待
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, code := serve(ctx, true); code != http.StatusServiceUnavailable {
+		t.Fatalf("canceled: status = %d", code)
+	}
+
+	// 排队的请求在名额释放后继续处理，排队已满的请求立即返回503
+	queued := make(chan int, 1)
+	go func() {
+		_, code := serve(context.Background(), true)
+		queued <- code
+	}()
+	for a.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, code := serve(context.Background(), true); code != http.StatusServiceUnavailable {
+		t.Fatalf("queue full: status = %d", code)
+	}
+	pending.WriteTo(httptest.NewRecorder(), io.Discard)
+	if code := <-queued; code != http.StatusOK {
+		t.Fatalf("queued: status = %d", code)
+	}
+
+	if stats := a.Stats(); stats != (AdmissionStats{Rejected: 3}) {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestAdmissionUnlimited(t *testing.T) {
+	stub := &stubClient{recorded: map[string][]byte{
+		"": []byte("Content-Type: text/plain\r\n\r\nok"),
+	}}
+	handler := (&Admission{}).Middleware()(BasicHandler)
+	for i := 0; i < 3; i++ {
+		if _, err := handler(stub, NewRequest(httptest.NewRequest("GET", "/", nil))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
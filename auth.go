@@ -0,0 +1,216 @@
+package ffcgiclient
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// HTTP Basic认证，认证通过后映射REMOTE_USER和AUTH_TYPE参数
+
+// BasicAuthVerifier 校验用户名和密码
+type BasicAuthVerifier interface {
+	Verify(user, password string) bool
+}
+
+// BasicAuthFunc 是BasicAuthVerifier接口的快捷函数实现
+type BasicAuthFunc func(user, password string) bool
+
+// Verify 实现BasicAuthVerifier
+func (f BasicAuthFunc) Verify(user, password string) bool {
+	return f(user, password)
+}
+
+// BasicAuth Basic认证配置
+type BasicAuth struct {
+
+	// Realm 认证域，显示在浏览器的登录框中
+	Realm string
+
+	// Verifier 校验用户名和密码，例如*Htpasswd或BasicAuthFunc
+	Verifier BasicAuthVerifier
+}
+
+// Middleware 返回Basic认证的中间件
+// 认证通过时设置REMOTE_USER和AUTH_TYPE参数，否则直接返回401和WWW-Authenticate，不转发到后端
+// 没有原始请求时无法认证，同样返回401
+func (a *BasicAuth) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if req.Raw == nil {
+				return a.unauthorized(), nil
+			}
+			user, password, ok := req.Raw.BasicAuth()
+			if !ok || a.Verifier == nil || !a.Verifier.Verify(user, password) {
+				return a.unauthorized(), nil
+			}
+			req.Params.Set("REMOTE_USER", user)
+			req.Params.Set("AUTH_TYPE", "Basic")
+			return inner(client, req)
+		}
+	}
+}
+
+// unauthorized 返回401响应
+func (a *BasicAuth) unauthorized() *ResponsePipe {
+	code := http.StatusUnauthorized
+	header := make(http.Header)
+	header.Set("Status", fmt.Sprintf("%d %s", code, http.StatusText(code)))
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, a.Realm))
+	return newStaticResponse(header, strings.NewReader(http.StatusText(code)+"\n"))
+}
+
+// Htpasswd 基于Apache htpasswd文件的BasicAuthVerifier
+// 支持{SHA}、$apr1$（MD5）、bcrypt及明文格式的密码，其他格式（例如crypt的$6$、{SSHA}）的用户无法通过认证
+type Htpasswd struct {
+
+	// BcryptCompare 校验bcrypt（$2y$）格式密码的函数，为nil时此类用户无法通过认证
+	// 例如golang.org/x/crypto/bcrypt.CompareHashAndPassword
+	BcryptCompare func(hash, password []byte) error
+
+	// AllowPlain 是否接受明文格式的密码，默认不接受
+	// 以"$"或"{"开头的未知格式始终视为hash，不作为明文比较
+	AllowPlain bool
+
+	users map[string]string // 用户名到密码hash的映射
+}
+
+// LoadHtpasswd 读取htpasswd文件
+func LoadHtpasswd(filename string) (*Htpasswd, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseHtpasswd(f)
+}
+
+// ParseHtpasswd 解析htpasswd格式的内容，每行为"用户名:密码hash"，忽略空行和#开头的注释
+func ParseHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{users: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("htpasswd: malformed line %d", line)
+		}
+		h.users[parts[0]] = parts[1]
+	}
+	return h, scanner.Err()
+}
+
+// Verify 实现BasicAuthVerifier
+func (h *Htpasswd) Verify(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return secureCompare(hash[len("{SHA}"):], base64.StdEncoding.EncodeToString(sum[:]))
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(hash[len("$apr1$"):], "$", 2)[0]
+		return secureCompare(hash, apr1(password, salt))
+	case isBcrypt(hash):
+		return h.BcryptCompare != nil && h.BcryptCompare([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$") || strings.HasPrefix(hash, "{"):
+		// 不支持的hash格式
+		return false
+	default:
+		return h.AllowPlain && secureCompare(hash, password)
+	}
+}
+
+// isBcrypt 检查是否为bcrypt格式（$2a$、$2b$、$2x$或$2y$）的密码hash
+func isBcrypt(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2x$", "$2y$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// secureCompare 常量时间比较两个字符串
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// apr1 计算Apache的$apr1$ MD5密码hash
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	// 1000轮迭代
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	// 编码
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[idx[0]])<<16|uint32(final[idx[1]])<<8|uint32(final[idx[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return b.String()
+}
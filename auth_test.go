@@ -0,0 +1,150 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testHtpasswd 各种格式密码的htpasswd内容
+const testHtpasswd = `
+# comment
+plain:secret
+sha:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+md5:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/
+bcrypt:$2y$05$hash
+sha512:$6$salt$hash
+ssha:{SSHA}hash
+
+colon:pa:ss
+`
+
+func TestParseHtpasswd(t *testing.T) {
+	h, err := ParseHtpasswd(strings.NewReader(testHtpasswd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.users) != 7 {
+		t.Fatalf("users = %v", h.users)
+	}
+	if got := h.users["colon"]; got != "pa:ss" {
+		t.Errorf("colon = %q, want pa:ss", got)
+	}
+
+	_, err = ParseHtpasswd(strings.NewReader("plain:secret\nmalformed\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("err = %v, want malformed line 2", err)
+	}
+}
+
+func TestApr1(t *testing.T) {
+	// openssl passwd -apr1 -salt r31..... myPassword
+	if got := apr1("myPassword", "r31....."); got != "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/" {
+		t.Errorf("apr1 = %q", got)
+	}
+}
+
+func TestHtpasswdVerify(t *testing.T) {
+	h, err := ParseHtpasswd(strings.NewReader(testHtpasswd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.BcryptCompare = func(hash, password []byte) error {
+		if !bytes.Equal(hash, []byte("$2y$05$hash")) || string(password) != "bcrypt" {
+			return errors.New("mismatch")
+		}
+		return nil
+	}
+	tests := []struct {
+		user, password string
+		allowPlain     bool
+		want           bool
+	}{
+		{"plain", "secret", true, true},
+		{"plain", "Secret", true, false},
+		{"plain", "secret", false, false}, // 默认不接受明文密码
+		{"sha", "password", false, true},
+		{"sha", "passwor", false, false},
+		{"md5", "myPassword", false, true},
+		{"md5", "mypassword", false, false},
+		{"bcrypt", "bcrypt", false, true},
+		{"bcrypt", "other", false, false},
+		{"colon", "pa:ss", true, true},
+		{"nobody", "secret", true, false},
+		// 不支持的格式不作为明文比较
+		{"sha512", "$6$salt$hash", true, false},
+		{"ssha", "{SSHA}hash", true, false},
+	}
+	for _, tt := range tests {
+		h.AllowPlain = tt.allowPlain
+		if got := h.Verify(tt.user, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) with AllowPlain %v = %v, want %v", tt.user, tt.password, tt.allowPlain, got, tt.want)
+		}
+	}
+
+	// 没有设置BcryptCompare时bcrypt用户无法通过认证
+	h.BcryptCompare = nil
+	if h.Verify("bcrypt", "bcrypt") {
+		t.Error("bcrypt user verified without BcryptCompare")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	h, err := ParseHtpasswd(strings.NewReader(testHtpasswd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &BasicAuth{Realm: "admin", Verifier: h}
+	tests := []struct {
+		user, password string
+		set            bool
+		code           int
+	}{
+		{"md5", "myPassword", true, http.StatusOK},
+		{"md5", "wrong", true, http.StatusUnauthorized},
+		{"", "", false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		var params map[string]string
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.set {
+			r.SetBasicAuth(tt.user, tt.password)
+		}
+		resp := mustDo(t, auth.Middleware()(recordHandler(&params)), NewRequest(r))
+		rec := httptest.NewRecorder()
+		if err := resp.WriteTo(rec, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tt.code {
+			t.Errorf("%s:%s: status %d, want %d", tt.user, tt.password, rec.Code, tt.code)
+			continue
+		}
+		if tt.code == http.StatusOK {
+			if params["REMOTE_USER"] != tt.user || params["AUTH_TYPE"] != "Basic" {
+				t.Errorf("params = %v", params)
+			}
+			continue
+		}
+		if params != nil {
+			t.Errorf("unauthorized request reached the backend: %v", params)
+		}
+		if got := rec.Header().Get("WWW-Authenticate"); got != `Basic realm="admin", charset="UTF-8"` {
+			t.Errorf("WWW-Authenticate = %q", got)
+		}
+		if got := rec.Body.String(); got != "Unauthorized\n" {
+			t.Errorf("body = %q", got)
+		}
+	}
+
+	// 没有原始请求时无法认证
+	var params map[string]string
+	rec := httptest.NewRecorder()
+	mustDo(t, auth.Middleware()(recordHandler(&params)), NewRequest(nil)).WriteTo(rec, io.Discard)
+	if rec.Code != http.StatusUnauthorized || params != nil {
+		t.Errorf("without raw request: status %d, params = %v", rec.Code, params)
+	}
+}
@@ -0,0 +1,149 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// 相同的负载分别经过以下路径处理，比较 go test -bench 的结果：
+//  FastCGI 本包的Handler + Client池，后端为同进程的net/http/fcgi
+//  CGI     net/http/cgi，每个请求启动一次子进程，作为基准
+//  Stub    本包的Handler，Client直接返回预先录制的响应，只包含本包自身的开销
+// gofast等第三方实现需要额外的依赖，没有包含在内
+
+// benchWorkload 一种负载
+type benchWorkload struct {
+	name   string
+	method string
+	body   int // 请求体大小
+	size   int // 响应体大小
+}
+
+// benchWorkloads 所有的负载
+var benchWorkloads = []benchWorkload{
+	{"small", "GET", 0, 16},
+	{"post64k", "POST", 64 * 1024, 16},
+	{"large", "GET", 0, 1024 * 1024},
+}
+
+// benchApp 后端应用，读取全部请求体后返回size参数指定大小的响应体
+var benchApp = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.Write(bytes.Repeat([]byte("x"), size))
+})
+
+// benchCGIEnv 设置此环境变量时测试程序作为CGI子进程运行
+const benchCGIEnv = "FFCGI_BENCH_CGI"
+
+// TestBenchCGIChild 作为BenchmarkCGI的CGI子进程运行，直接执行时跳过
+func TestBenchCGIChild(t *testing.T) {
+	if os.Getenv(benchCGIEnv) != "1" {
+		t.Skip("only runs as a CGI child of BenchmarkCGI")
+	}
+	cgi.Serve(benchApp)
+	os.Exit(0)
+}
+
+// runBenchmark 对每种负载执行handler
+func runBenchmark(b *testing.B, handler http.Handler) {
+	for _, w := range benchWorkloads {
+		w := w
+		b.Run(w.name, func(b *testing.B) {
+			body := bytes.Repeat([]byte("y"), w.body)
+			target := fmt.Sprintf("/index.php?size=%d", w.size)
+			b.SetBytes(int64(w.body + w.size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r := httptest.NewRequest(w.method, target, bytes.NewReader(body))
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, r)
+				if rec.Code != http.StatusOK || rec.Body.Len() != w.size {
+					b.Fatalf("status %d, %d bytes", rec.Code, rec.Body.Len())
+				}
+			}
+		})
+	}
+}
+
+// benchParams 基准测试使用的参数映射
+var benchParams = Chain(BasicParamsMapMiddleware, NewPHPFS("/var/www"))
+
+func BenchmarkFastCGI(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go fcgi.Serve(ln, benchApp)
+
+	pool := NewClientPoolConfig(SimpleClientFactoryNoConn(SimpleConnFactory("tcp", ln.Addr().String()), 0), PoolConfig{MaxActive: 4})
+	runBenchmark(b, NewHandler(benchParams(BasicHandler), pool.CreateClient))
+}
+
+func BenchmarkCGI(b *testing.B) {
+	runBenchmark(b, &cgi.Handler{
+		Path: os.Args[0],
+		Args: []string{"-test.run=^TestBenchCGIChild$"},
+		Env:  []string{benchCGIEnv + "=1"},
+	})
+}
+
+func BenchmarkStub(b *testing.B) {
+	// 录制每种负载的CGI响应
+	recorded := make(map[string][]byte)
+	for _, w := range benchWorkloads {
+		header := make(http.Header)
+		header.Set("Content-Type", "text/plain")
+		header.Set("Content-Length", strconv.Itoa(w.size))
+		var buf bytes.Buffer
+		writeCGIHeader(&buf, header)
+		buf.Write(bytes.Repeat([]byte("x"), w.size))
+		recorded[strconv.Itoa(w.size)] = buf.Bytes()
+	}
+	factory := func() (Client, error) {
+		return &stubClient{recorded: recorded}, nil
+	}
+	runBenchmark(b, NewHandler(benchParams(BasicHandler), factory))
+}
+
+// stubClient 不连接后端，按请求的size参数返回录制的响应
+type stubClient struct {
+	recorded map[string][]byte
+}
+
+// Do 实现Client
+func (c *stubClient) Do(req *Request) (*ResponsePipe, error) {
+	if req.Stdin != nil {
+		io.Copy(io.Discard, req.Stdin)
+		req.Stdin.Close()
+	}
+	out := c.recorded[req.Raw.URL.Query().Get("size")]
+	p := NewResponsePipe()
+	go func() {
+		p.stdOutWriter.Write(out)
+		p.Close()
+	}()
+	return p, nil
+}
+
+// NewConn 实现Client
+func (c *stubClient) NewConn() error { return nil }
+
+// CloseConn 实现Client
+func (c *stubClient) CloseConn() error { return nil }
+
+// Close 实现Client
+func (c *stubClient) Close() error { return nil }
@@ -0,0 +1,137 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// 全局的内存预算，限制网关在内存中缓冲的字节总数（缓冲的请求体/响应体、缓存等）
+// 预算耗尽时各处降级处理（不缓冲、不缓存），Middleware拒绝新的请求，避免异常流量导致OOM
+
+// ByteBudget 在内存中缓冲的字节数的预算，对nil的*ByteBudget调用Acquire总是成功
+type ByteBudget struct {
+	limit int64
+	used  int64 // 已占用的字节数，原子操作
+	shed  int64 // 因预算不足被拒绝的次数，原子操作
+
+	// Events 发布预算耗尽（EventBudgetExceeded）事件，可以为nil
+	Events *EventBus
+}
+
+// BudgetStats 预算的统计信息
+type BudgetStats struct {
+	Limit int64 // 预算上限
+	InUse int64 // 已占用的字节数
+	Shed  int64 // 因预算不足被拒绝的次数
+}
+
+// NewByteBudget 创建上限为limit字节的预算
+func NewByteBudget(limit int64) *ByteBudget {
+	return &ByteBudget{limit: limit}
+}
+
+// Acquire 占用n字节，超过预算时返回false且不占用
+func (b *ByteBudget) Acquire(n int64) bool {
+	if b == nil || n <= 0 {
+		return true
+	}
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if used+n > b.limit {
+			atomic.AddInt64(&b.shed, 1)
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+// Release 释放Acquire占用的n字节
+func (b *ByteBudget) Release(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+	atomic.AddInt64(&b.used, -n)
+}
+
+// Exhausted 返回预算是否已耗尽
+func (b *ByteBudget) Exhausted() bool {
+	return b != nil && atomic.LoadInt64(&b.used) >= b.limit
+}
+
+// Stats 返回预算的统计信息
+func (b *ByteBudget) Stats() BudgetStats {
+	if b == nil {
+		return BudgetStats{}
+	}
+	return BudgetStats{
+		Limit: b.limit,
+		InUse: atomic.LoadInt64(&b.used),
+		Shed:  atomic.LoadInt64(&b.shed),
+	}
+}
+
+// Middleware 返回在预算耗尽时直接返回503的中间件，已在处理的请求不受影响
+func (b *ByteBudget) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if !b.Exhausted() {
+				return inner(client, req)
+			}
+			atomic.AddInt64(&b.shed, 1)
+			b.Events.Publish(Event{
+				Type:    EventBudgetExceeded,
+				Source:  "budget",
+				Message: fmt.Sprintf("%d of %d bytes in use, request shed", atomic.LoadInt64(&b.used), b.limit),
+			})
+			return newStatusResponse(http.StatusServiceUnavailable), nil
+		}
+	}
+}
+
+// readAllBudget 在预算内读取r的全部内容
+// 成功时ok为true，返回的数据占用预算，由调用方释放len(data)字节；
+// 预算不足时ok为false，不占用预算，data为已读取的部分，r中剩余的数据未读取
+func readAllBudget(b *ByteBudget, r io.Reader) (data []byte, ok bool, err error) {
+	var buf bytes.Buffer
+	chunk := make([]byte, 32*1024)
+	for {
+		n, rerr := r.Read(chunk)
+		if n > 0 {
+			if !b.Acquire(int64(n)) {
+				b.Release(int64(buf.Len()))
+				buf.Write(chunk[:n])
+				return buf.Bytes(), false, nil
+			}
+			buf.Write(chunk[:n])
+		}
+		if rerr == io.EOF {
+			return buf.Bytes(), true, nil
+		}
+		if rerr != nil {
+			b.Release(int64(buf.Len()))
+			return nil, false, rerr
+		}
+	}
+}
+
+// budgetReader 读取结束（rewriteResponse调用Close）时释放占用的预算
+type budgetReader struct {
+	io.Reader
+	budget *ByteBudget
+	n      int64
+	once   sync.Once
+}
+
+// Close 释放占用的预算
+func (r *budgetReader) Close() error {
+	r.once.Do(func() {
+		r.budget.Release(r.n)
+	})
+	return nil
+}
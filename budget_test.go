@@ -0,0 +1,51 @@
+package ffcgiclient
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestByteBudget(t *testing.T) {
+	b := NewByteBudget(10)
+	if !b.Acquire(6) || b.Acquire(5) {
+		t.Fatal("expected second acquire to exceed budget")
+	}
+
+	// 预算不足时readAllBudget不占用预算，已读取的部分和剩余数据可以拼接
+	r := strings.NewReader("0123456789")
+	data, ok, err := readAllBudget(b, io.LimitReader(r, 5))
+	if err != nil || ok || string(data) != "01234" {
+		t.Fatalf("readAllBudget = %q, %v, %v", data, ok, err)
+	}
+	if stats := b.Stats(); stats.InUse != 6 || stats.Shed != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	b.Release(6)
+	data, ok, _ = readAllBudget(b, r)
+	if !ok || string(data) != "56789" || b.Stats().InUse != 5 {
+		t.Fatalf("readAllBudget = %q, %v, in use %d", data, ok, b.Stats().InUse)
+	}
+
+	// 预算耗尽时拒绝新的请求
+	b.Acquire(5)
+	called := false
+	handler := b.Middleware()(func(client Client, req *Request) (*ResponsePipe, error) {
+		called = true
+		return nil, nil
+	})
+	resp, _ := handler(nil, NewRequest(httptest.NewRequest("GET", "/", nil)))
+	rec := httptest.NewRecorder()
+	resp.WriteTo(rec, io.Discard)
+	if called || rec.Code != 503 {
+		t.Fatalf("called = %v, status = %d", called, rec.Code)
+	}
+
+	// nil预算不做限制
+	var none *ByteBudget
+	if !none.Acquire(1<<40) || none.Exhausted() {
+		t.Fatal("nil budget should not limit")
+	}
+}
@@ -0,0 +1,316 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 抽样记录请求参数和响应内容，用于排查问题
+
+// DefaultCaptureRedact 默认隐藏值的参数名和响应头
+var DefaultCaptureRedact = []string{
+	"HTTP_AUTHORIZATION",
+	"HTTP_PROXY_AUTHORIZATION",
+	"HTTP_COOKIE",
+	"PHP_AUTH_PW",
+	"SSL_CLIENT_CERT",
+	"Set-Cookie",
+}
+
+// redacted 替换隐藏值的文本
+const redacted = "[REDACTED]"
+
+// CaptureEntry 一条记录
+type CaptureEntry struct {
+	Time      time.Time         `json:"time"`      // 请求时间
+	Duration  time.Duration     `json:"duration"`  // 从请求到响应体读取结束的耗时
+	Method    string            `json:"method"`    // 请求方法
+	URI       string            `json:"uri"`       // 请求URI
+	Params    map[string]string `json:"params"`    // 发送给后端的参数
+	Status    int               `json:"status"`    // 响应状态码
+	Header    http.Header       `json:"header"`    // 响应头
+	Body      string            `json:"body"`      // 响应体，最多MaxBody字节
+	Truncated bool              `json:"truncated"` // 响应体是否被截断
+
+	// Output 开启Interleave时按接收顺序记录的stdout和stderr
+	// stdout不包含CGI响应头，响应头只记录在隐藏了敏感值的Header中
+	Output []CaptureChunk `json:"output,omitempty"`
+}
+
+// CaptureChunk 后端输出的一个片段（对应一个stdout或stderr消息）
+type CaptureChunk struct {
+	Seq     int           `json:"seq"`     // 序号，从0开始
+	Stream  string        `json:"stream"`  // stdout或stderr
+	Offset  int64         `json:"offset"`  // 此前已收到的stdout字节数（包含CGI响应头），用于定位stderr对应的输出位置
+	Elapsed time.Duration `json:"elapsed"` // 距请求开始的时间
+	Data    string        `json:"data"`    // 内容
+}
+
+// Capture 按比例抽样或按条件记录请求参数和响应，保存在固定大小的环形缓冲区中
+type Capture struct {
+
+	// SampleRate 抽样比例，0到1之间
+	SampleRate float64
+
+	// Filter 不论是否抽中，返回true时都记录，例如只记录Status>=500的请求；可以为nil
+	// 启用后所有请求都需要经过记录处理，响应结束后才决定是否保存
+	Filter func(entry *CaptureEntry) bool
+
+	// MaxBody 每条记录保存的响应体的最大字节数，0表示默认的4096
+	MaxBody int
+
+	// Size 保存的记录数，0表示默认的100
+	Size int
+
+	// Redact 隐藏值的参数名和响应头，为nil时使用DefaultCaptureRedact
+	Redact []string
+
+	// Rand 抽样使用的随机数来源，为nil时使用GlobalRand
+	Rand Rand
+
+	// Interleave 是否按接收顺序记录stdout和stderr到CaptureEntry.Output，
+	// 以便将PHP的警告与触发它的输出位置对应起来；记录的内容总共最多MaxBody字节
+	Interleave bool
+
+	mutex   sync.Mutex
+	entries []CaptureEntry // 环形缓冲区
+	next    int            // 下一条记录写入的位置
+}
+
+// redact 返回name的值是否需要隐藏
+func (c *Capture) redact(name string) bool {
+	redact := c.Redact
+	if redact == nil {
+		redact = DefaultCaptureRedact
+	}
+	for _, r := range redact {
+		if strings.EqualFold(r, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// store 保存一条记录，缓冲区已满时覆盖最早的记录
+func (c *Capture) store(entry CaptureEntry) {
+	size := c.Size
+	if size <= 0 {
+		size = 100
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.entries) < size {
+		c.entries = append(c.entries, entry)
+		return
+	}
+	c.entries[c.next] = entry
+	c.next = (c.next + 1) % len(c.entries)
+}
+
+// Entries 返回保存的记录，按时间从早到晚排列
+func (c *Capture) Entries() []CaptureEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entries := make([]CaptureEntry, 0, len(c.entries))
+	entries = append(entries, c.entries[c.next:]...)
+	return append(entries, c.entries[:c.next]...)
+}
+
+// Handler 返回以JSON格式输出保存的记录的http.Handler，用于挂载到管理端口
+func (c *Capture) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(c.Entries())
+	})
+}
+
+// Middleware 返回记录请求和响应的中间件
+func (c *Capture) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			sampled := c.SampleRate > 0 && randOr(c.Rand).Float64() < c.SampleRate
+			if !sampled && c.Filter == nil {
+				return inner(client, req)
+			}
+			maxBody := c.MaxBody
+			if maxBody <= 0 {
+				maxBody = 4096
+			}
+			start := time.Now()
+			var output *captureOutput
+			if c.Interleave {
+				output = &captureOutput{start: start, max: maxBody}
+				req.onOutput = output.add
+			}
+			resp, err := inner(client, req)
+			if err != nil {
+				return resp, err
+			}
+
+			// 后端已收到请求，此时的参数即为发送的参数
+			entry := CaptureEntry{
+				Time:   start,
+				Params: make(map[string]string, req.Params.Len()),
+			}
+			if req.Raw != nil {
+				entry.Method, entry.URI = req.Raw.Method, req.Raw.RequestURI
+			}
+			req.Params.Range(func(k, v string) bool {
+				if c.redact(k) {
+					v = redacted
+				}
+				entry.Params[k] = v
+				return true
+			})
+
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+				entry.Status = captureStatus(header)
+				entry.Header = make(http.Header, len(header))
+				for k, vv := range header {
+					if c.redact(k) {
+						vv = []string{redacted}
+					}
+					entry.Header[k] = append([]string(nil), vv...)
+				}
+				return &captureReader{r: body, max: maxBody, done: func(cr *captureReader) {
+					entry.Duration = time.Since(start)
+					entry.Body = cr.buf.String()
+					entry.Truncated = cr.truncated
+					if output != nil {
+						entry.Output = output.chunks()
+						entry.Truncated = entry.Truncated || output.truncated
+					}
+					if sampled || c.Filter(&entry) {
+						c.store(entry)
+					}
+				}}, nil
+			}), nil
+		}
+	}
+}
+
+// captureStatus 返回CGI响应头表示的状态码
+func captureStatus(header http.Header) int {
+	if status := header.Get("Status"); len(status) >= 3 {
+		if code, err := strconv.Atoi(status[:3]); err == nil {
+			return code
+		}
+	}
+	if header.Get("Location") != "" {
+		return http.StatusFound
+	}
+	return http.StatusOK
+}
+
+// captureReader 读取时保存最多max字节的副本，读取结束时调用done
+type captureReader struct {
+	r         io.Reader
+	max       int
+	buf       bytes.Buffer
+	truncated bool
+	finished  bool
+	done      func(cr *captureReader)
+}
+
+// Read 实现io.Reader
+func (cr *captureReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if rest := cr.max - cr.buf.Len(); n > rest {
+		if rest > 0 {
+			cr.buf.Write(p[:rest])
+		}
+		cr.truncated = true
+	} else {
+		cr.buf.Write(p[:n])
+	}
+	if err != nil && !cr.finished {
+		cr.finished = true
+		cr.done(cr)
+	}
+	return n, err
+}
+
+// captureOutput 按接收顺序记录stdout和stderr
+type captureOutput struct {
+	start     time.Time
+	max       int // 记录的内容的最大字节数
+	mutex     sync.Mutex
+	list      []CaptureChunk
+	size      int   // 已记录的内容字节数
+	offset    int64 // 已收到的stdout字节数
+	truncated bool
+	inBody    bool   // 已读到CGI响应头之后的空行
+	tail      []byte // 响应头中最后收到的最多3个字节，用于识别跨消息的空行
+}
+
+// add 记录一个片段，超出max的内容被截断
+func (o *captureOutput) add(stream string, p []byte) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	offset := o.offset
+	if stream == "stdout" {
+		o.offset += int64(len(p))
+		// 跳过CGI响应头，其中的Set-Cookie等值不能原样记录
+		if !o.inBody {
+			end := o.headerEnd(p)
+			if end < 0 {
+				return
+			}
+			o.inBody = true
+			offset += int64(end)
+			p = p[end:]
+		}
+	}
+	if rest := o.max - o.size; len(p) > rest {
+		p = p[:rest]
+		o.truncated = true
+	}
+	if len(p) == 0 {
+		return
+	}
+	o.size += len(p)
+	o.list = append(o.list, CaptureChunk{
+		Seq:     len(o.list),
+		Stream:  stream,
+		Offset:  offset,
+		Elapsed: time.Since(o.start),
+		Data:    string(p),
+	})
+}
+
+// headerEnd 返回p中CGI响应头之后的空行结束的位置，响应头没有结束时返回-1
+func (o *captureOutput) headerEnd(p []byte) int {
+	buf := append(o.tail, p...)
+	end := -1
+	if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+		end = i + 4
+	}
+	if i := bytes.Index(buf, []byte("\n\n")); i >= 0 && (end < 0 || i+2 < end) {
+		end = i + 2
+	}
+	if end < 0 {
+		if len(buf) > 3 {
+			buf = buf[len(buf)-3:]
+		}
+		o.tail = append([]byte(nil), buf...)
+		return -1
+	}
+	if end -= len(o.tail); end < 0 {
+		end = 0
+	}
+	return end
+}
+
+// chunks 返回已记录的片段
+func (o *captureOutput) chunks() []CaptureChunk {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]CaptureChunk(nil), o.list...)
+}
@@ -0,0 +1,154 @@
+package ffcgiclient
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCaptureOutputSkipsHeader(t *testing.T) {
+	// 响应头跨越多个stdout消息，空行被拆开
+	factory := recordBackend(func(sc *conn, reqID uint16, _ []byte) {
+		sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\nSet-Cookie: sid=secret\r\n"))
+		sc.writeRecord(typeStderr, reqID, []byte("PHP Notice"))
+		sc.writeRecord(typeStdout, reqID, []byte("\r"))
+		sc.writeRecord(typeStdout, reqID, []byte("\nhello"))
+		sc.writeRecord(typeStdout, reqID, []byte(" world"))
+		sc.writeEndRequest(reqID, 0, statusRequestComplete)
+	})
+	c := &Capture{SampleRate: 1, Interleave: true}
+	h := NewHandler(c.Middleware()(BasicHandler), SimpleClientFactory(factory, 0))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != "hello world" {
+		t.Fatalf("body = %q", rec.Body.String())
+	}
+
+	entries := c.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("%d entries", len(entries))
+	}
+	var stdout strings.Builder
+	for _, chunk := range entries[0].Output {
+		if strings.Contains(chunk.Data, "secret") || strings.Contains(chunk.Data, "Set-Cookie") {
+			t.Fatalf("Set-Cookie recorded in output: %q", chunk.Data)
+		}
+		if chunk.Stream == "stdout" {
+			stdout.WriteString(chunk.Data)
+		}
+	}
+	if stdout.String() != "hello world" {
+		t.Fatalf("stdout output = %q", stdout.String())
+	}
+	if got := entries[0].Header.Get("Set-Cookie"); got != redacted {
+		t.Fatalf("Set-Cookie header = %q", got)
+	}
+	if first := entries[0].Output[1]; first.Stream != "stdout" || first.Offset != int64(len("Content-Type: text/plain\r\nSet-Cookie: sid=secret\r\n\r\n")) {
+		t.Fatalf("first stdout chunk = %+v", first)
+	}
+}
+
+// floatRand Float64返回固定值的Rand
+type floatRand float64
+
+func (r floatRand) Float64() float64     { return float64(r) }
+func (r floatRand) Int63n(n int64) int64 { return 0 }
+
+func TestCapture(t *testing.T) {
+	stub := &stubClient{recorded: map[string][]byte{
+		"":    []byte("Content-Type: text/plain\r\nSet-Cookie: sid=secret\r\n\r\nhello world"),
+		"500": []byte("Status: 500 Internal Server Error\r\nContent-Type: text/plain\r\n\r\nboom"),
+	}}
+	errorsOnly := func(e *CaptureEntry) bool { return e.Status >= 500 }
+	tests := []struct {
+		name    string
+		capture *Capture
+		size    string
+		stored  bool
+	}{
+		{"sampled", &Capture{SampleRate: 0.5, Rand: floatRand(0.1)}, "", true},
+		{"not sampled", &Capture{SampleRate: 0.5, Rand: floatRand(0.9)}, "", false},
+		{"filter rejects", &Capture{Filter: errorsOnly}, "", false},
+		{"filter accepts", &Capture{Filter: errorsOnly}, "500", true},
+	}
+	for _, tt := range tests {
+		h := NewHandler(Chain(MapHeaderMiddleware, tt.capture.Middleware())(BasicHandler), func() (Client, error) { return stub, nil })
+		r := httptest.NewRequest("GET", "/?size="+tt.size, nil)
+		r.Header.Set("Cookie", "sid=secret")
+		r.Header.Set("Accept", "text/plain")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		entries := tt.capture.Entries()
+		if !tt.stored {
+			if len(entries) != 0 {
+				t.Errorf("%s: %d entries, want none", tt.name, len(entries))
+			}
+			continue
+		}
+		if len(entries) != 1 {
+			t.Errorf("%s: %d entries, want 1", tt.name, len(entries))
+			continue
+		}
+		e := entries[0]
+		if e.Method != "GET" || e.URI != "/?size="+tt.size {
+			t.Errorf("%s: request = %s %s", tt.name, e.Method, e.URI)
+		}
+		if e.Params["HTTP_COOKIE"] != redacted || e.Params["HTTP_ACCEPT"] != "text/plain" {
+			t.Errorf("%s: params = %v", tt.name, e.Params)
+		}
+		if e.Status != rec.Code || e.Body != rec.Body.String() {
+			t.Errorf("%s: entry = %d %q, response = %d %q", tt.name, e.Status, e.Body, rec.Code, rec.Body.String())
+		}
+		if v := e.Header.Get("Set-Cookie"); tt.size == "" && v != redacted {
+			t.Errorf("%s: Set-Cookie = %q", tt.name, v)
+		}
+	}
+}
+
+// TestCaptureNoRaw 测试没有原始请求时只记录参数和响应
+func TestCaptureNoRaw(t *testing.T) {
+	c := &Capture{SampleRate: 1, Rand: floatRand(0)}
+	req := NewRequest(nil)
+	req.Params.Set("SCRIPT_NAME", "/index.php")
+	resp, err := c.Middleware()(BasicHandler)(&contextClient{}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.WriteTo(httptest.NewRecorder(), io.Discard)
+	entries := c.Entries()
+	if len(entries) != 1 || entries[0].Method != "" || entries[0].Params["SCRIPT_NAME"] != "/index.php" || entries[0].Body != "ok" {
+		t.Fatalf("entries = %+v", entries)
+	}
+}
+
+func TestCaptureRing(t *testing.T) {
+	c := &Capture{SampleRate: 1, Size: 2, MaxBody: 5}
+	stub := &stubClient{recorded: map[string][]byte{"": []byte("Content-Type: text/plain\r\n\r\nhello world")}}
+	h := NewHandler(c.Middleware()(BasicHandler), func() (Client, error) { return stub, nil })
+	for _, uri := range []string{"/a", "/b", "/c"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", uri, nil))
+		if rec.Body.String() != "hello world" {
+			t.Fatalf("%s: body = %q", uri, rec.Body.String())
+		}
+	}
+
+	// 缓冲区已满时覆盖最早的记录
+	rec := httptest.NewRecorder()
+	c.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/captures", nil))
+	var entries []CaptureEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Header().Get("Content-Type") != "application/json" || len(entries) != 2 {
+		t.Fatalf("entries = %+v", entries)
+	}
+	for i, uri := range []string{"/b", "/c"} {
+		if e := entries[i]; e.URI != uri || e.Body != "hello" || !e.Truncated || e.Status != http.StatusOK {
+			t.Errorf("entry %d = %+v", i, e)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package ffcgiclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"suilz/ffcgi-client/fcgiproto"
+)
+
+// 录制与后端之间的FastCGI消息并在测试中回放，CI中不需要运行php-fpm
+//
+//	// 录制：连接真实的后端，把双方的消息写入文件
+//	f, _ := os.Create("testdata/index.jsonl")
+//	rec := ffcgiclient.NewRecorder(f)
+//	factory := rec.ConnFactory(ffcgiclient.SimpleConnFactory("tcp", "127.0.0.1:9000"))
+//
+//	// 回放：按请求的参数和请求体找到录制的响应
+//	f, _ := os.Open("testdata/index.jsonl")
+//	replayer, err := ffcgiclient.NewReplayer(f)
+//	factory := replayer.ConnFactory()
+
+// cassetteRecord 录制文件中的一行，对应一个消息
+type cassetteRecord struct {
+	Conn    int    `json:"conn"`              // 连接序号，从1开始
+	Dir     string `json:"dir"`               // send为客户端发出，recv为后端发出
+	Type    uint8  `json:"type"`              // 消息类型
+	ID      uint16 `json:"id"`                // 请求ID
+	Content []byte `json:"content,omitempty"` // 消息内容，不包含填充
+}
+
+// 消息的方向
+const (
+	cassetteSend = "send"
+	cassetteRecv = "recv"
+)
+
+// Recorder 将经过连接的FastCGI消息按JSON Lines格式写入w
+type Recorder struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+	conns int
+	err   error
+}
+
+// NewRecorder 创建写入w的Recorder，w由调用者关闭
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// ConnFactory 返回包装factory的ConnFactory，录制每个连接上双方的消息
+func (r *Recorder) ConnFactory(factory ConnFactory) ConnFactory {
+	return func() (net.Conn, error) {
+		conn, err := factory()
+		if err != nil {
+			return nil, err
+		}
+		r.mutex.Lock()
+		r.conns++
+		id := r.conns
+		r.mutex.Unlock()
+		rc := &recordingConn{Conn: conn}
+		rc.send.emit = func(h header, content []byte) { r.write(id, cassetteSend, h, content) }
+		rc.recv.emit = func(h header, content []byte) { r.write(id, cassetteRecv, h, content) }
+		return rc, nil
+	}
+}
+
+// Err 返回写入录制文件时发生的第一个错误
+func (r *Recorder) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+// write 写入一个消息
+func (r *Recorder) write(conn int, dir string, h header, content []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(cassetteRecord{
+		Conn:    conn,
+		Dir:     dir,
+		Type:    uint8(h.Type),
+		ID:      h.RequestID,
+		Content: content,
+	})
+}
+
+// recordingConn 把读写的数据按消息边界拆分后录制
+type recordingConn struct {
+	net.Conn
+	send, recv recordSplitter
+}
+
+// Read 实现net.Conn
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.recv.feed(p[:n])
+	return n, err
+}
+
+// Write 实现net.Conn
+func (c *recordingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.send.feed(p[:n])
+	return n, err
+}
+
+// recordSplitter 从字节流中拆分出完整的消息
+type recordSplitter struct {
+	mutex sync.Mutex
+	buf   []byte
+	emit  func(h header, content []byte)
+}
+
+// feed 追加数据，每得到一个完整的消息调用一次emit
+func (s *recordSplitter) feed(p []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.buf = append(s.buf, p...)
+	for len(s.buf) >= headerLen {
+		// 只按长度拆分，不检查版本
+		h, _ := fcgiproto.DecodeHeader(s.buf)
+		total := headerLen + int(h.ContentLength) + int(h.PaddingLength)
+		if len(s.buf) < total {
+			return
+		}
+		content := append([]byte(nil), s.buf[headerLen:headerLen+int(h.ContentLength)]...)
+		s.emit(h, content)
+		s.buf = append(s.buf[:0], s.buf[total:]...)
+	}
+}
+
+// DefaultReplayIgnore 回放时默认不参与匹配的参数，每次请求都可能不同
+var DefaultReplayIgnore = []string{"REMOTE_PORT", "REQUEST_TIME", "REQUEST_TIME_FLOAT"}
+
+// Replayer 回放录制的响应：按参数和请求体匹配录制的请求，返回对应的响应消息
+// 相同的请求按录制的顺序依次匹配，用完后重复最后一个；没有匹配时返回502响应
+type Replayer struct {
+
+	// Ignore 不参与匹配的参数，默认为DefaultReplayIgnore
+	Ignore []string
+
+	mutex        sync.Mutex
+	interactions []*interaction
+	misses       []map[string]string
+}
+
+// interaction 一次录制的请求和响应
+type interaction struct {
+	params map[string]string
+	stdin  []byte
+	resp   []cassetteRecord // 响应消息，最后一个是FCGI_END_REQUEST
+	used   bool
+}
+
+// NewReplayer 读取Recorder录制的内容，只保留收到了FCGI_END_REQUEST的请求
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	type key struct {
+		conn int
+		id   uint16
+	}
+	rp := &Replayer{Ignore: DefaultReplayIgnore}
+	open := make(map[key]*interaction)
+	params := make(map[key][]byte)
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var rec cassetteRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cassette record %d: %w", line, err)
+		}
+		if rec.ID == 0 {
+			continue
+		}
+		k := key{rec.Conn, rec.ID}
+		it := open[k]
+		switch {
+		case rec.Dir == cassetteSend && recType(rec.Type) == typeBeginRequest:
+			it = &interaction{}
+			open[k] = it
+			params[k] = nil
+		case it == nil:
+		case rec.Dir == cassetteSend && recType(rec.Type) == typeParams:
+			params[k] = append(params[k], rec.Content...)
+		case rec.Dir == cassetteSend && recType(rec.Type) == typeStdin:
+			it.stdin = append(it.stdin, rec.Content...)
+		case rec.Dir == cassetteRecv:
+			it.resp = append(it.resp, rec)
+			if recType(rec.Type) == typeEndRequest {
+				it.params, _ = DecodePairs(params[k])
+				rp.interactions = append(rp.interactions, it)
+				delete(open, k)
+				delete(params, k)
+			}
+		}
+	}
+	return rp, nil
+}
+
+// Misses 返回没有匹配到录制的请求的参数
+func (rp *Replayer) Misses() []map[string]string {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	return append([]map[string]string(nil), rp.misses...)
+}
+
+// match 返回与请求匹配的录制，优先使用未回放过的
+func (rp *Replayer) match(params map[string]string, stdin []byte) *interaction {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	k := rp.key(params, stdin)
+	var last *interaction
+	for _, it := range rp.interactions {
+		if rp.key(it.params, it.stdin) != k {
+			continue
+		}
+		if !it.used {
+			it.used = true
+			return it
+		}
+		last = it
+	}
+	if last == nil {
+		rp.misses = append(rp.misses, params)
+	}
+	return last
+}
+
+// key 由参数（除去Ignore）和请求体得到匹配用的键
+func (rp *Replayer) key(params map[string]string, stdin []byte) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		if rp.ignored(name) {
+			continue
+		}
+		fmt.Fprintf(&b, "%q=%q\n", name, params[name])
+	}
+	b.Write(stdin)
+	return b.String()
+}
+
+// ignored 参数是否不参与匹配
+func (rp *Replayer) ignored(name string) bool {
+	for _, ignore := range rp.Ignore {
+		if ignore == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnFactory 返回连接到回放后端的ConnFactory，每次调用创建一个内存中的连接
+func (rp *Replayer) ConnFactory() ConnFactory {
+	return func() (net.Conn, error) {
+		cli, srv := net.Pipe()
+		go rp.serve(srv)
+		return cli, nil
+	}
+}
+
+// serve 读取请求并写出匹配的响应，直到连接关闭
+func (rp *Replayer) serve(rwc net.Conn) {
+	defer rwc.Close()
+	c := newConn(rwc)
+	defer c.Close()
+	type pending struct {
+		params []byte
+		stdin  []byte
+	}
+	reqs := make(map[uint16]*pending)
+	var rec record
+	for {
+		if err := c.readRecord(&rec); err != nil {
+			return
+		}
+		id := rec.h.RequestID
+		switch rec.h.Type {
+		case typeGetValues:
+			c.writeRecord(typeGetValuesResult, 0, nil)
+		case typeBeginRequest:
+			reqs[id] = &pending{}
+		case typeParams:
+			if p := reqs[id]; p != nil {
+				p.params = append(p.params, rec.content()...)
+			}
+		case typeStdin:
+			p := reqs[id]
+			if p == nil {
+				continue
+			}
+			if len(rec.content()) > 0 {
+				p.stdin = append(p.stdin, rec.content()...)
+				continue
+			}
+			delete(reqs, id)
+			params, _ := DecodePairs(p.params)
+			it := rp.match(params, p.stdin)
+			if it == nil {
+				c.writeRecord(typeStdout, id, []byte("Status: 502 Bad Gateway\r\nContent-Type: text/plain\r\n\r\nno recorded response"))
+				c.writeRecord(typeStdout, id, nil)
+				c.writeRecord(typeStderr, id, []byte(fmt.Sprintf("replay: no recorded response for %s", params["REQUEST_URI"])))
+				c.writeEndRequest(id, 0, statusRequestComplete)
+				continue
+			}
+			for _, resp := range it.resp {
+				c.writeRecord(recType(resp.Type), id, resp.Content)
+			}
+		case typeAbortRequest:
+			if reqs[id] != nil {
+				delete(reqs, id)
+				c.writeEndRequest(id, 0, statusRequestComplete)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	// 响应包含请求体和调用次数，回放时应返回录制时的内容
+	calls := 0
+	backend := recordBackend(func(sc *conn, reqID uint16, stdin []byte) {
+		calls++
+		sc.writeRecord(typeStderr, reqID, []byte("notice"))
+		sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\n"))
+		sc.writeRecord(typeStdout, reqID, append(stdin, byte('0'+calls)))
+		sc.writeRecord(typeStdout, reqID, nil)
+		sc.writeEndRequest(reqID, 0, statusRequestComplete)
+	})
+	do := func(factory ConnFactory, target, body string) string {
+		h := NewHandler(NewPHPFS("/srv")(BasicHandler), SimpleClientFactory(factory, 0))
+		h.SetLogger(log.New(io.Discard, "", 0))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", target, strings.NewReader(body)))
+		return rec.Body.String()
+	}
+
+	var cassette bytes.Buffer
+	recorder := NewRecorder(&cassette)
+	factory := recorder.ConnFactory(backend)
+	for _, target := range []string{"/a.php", "/a.php", "/b.php"} {
+		do(factory, target, "x")
+	}
+	if err := recorder.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := NewReplayer(&cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target, body, want string
+	}{
+		{"/a.php", "x", "x1"},
+		{"/a.php", "x", "x2"},
+		// 录制用完后重复最后一个
+		{"/a.php", "x", "x2"},
+		{"/b.php", "x", "x3"},
+		// 请求体不同时不匹配
+		{"/b.php", "y", "no recorded response"},
+	}
+	for _, tt := range tests {
+		if body := do(replayer.ConnFactory(), tt.target, tt.body); body != tt.want {
+			t.Errorf("%s %q: body = %q, want %q", tt.target, tt.body, body, tt.want)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("backend called %d times, want 3", calls)
+	}
+	if misses := replayer.Misses(); len(misses) != 1 || misses[0]["SCRIPT_NAME"] != "/b.php" {
+		t.Errorf("misses = %v", misses)
+	}
+}
+
+func TestRecordSplitter(t *testing.T) {
+	var buf bytes.Buffer
+	c := newConn(nopWriteCloser{&buf})
+	c.writeRecord(typeStdout, 1, []byte("hello"))
+	c.writeRecord(typeStdout, 1, nil)
+	c.writeEndRequest(1, 0, statusRequestComplete)
+
+	var got []string
+	s := recordSplitter{emit: func(h header, content []byte) {
+		got = append(got, strconv.Itoa(int(h.Type))+":"+string(content))
+	}}
+	// 逐字节写入，消息跨越多次写入
+	for _, b := range buf.Bytes() {
+		s.feed([]byte{b})
+	}
+	if len(got) != 3 || got[0] != "6:hello" || got[1] != "6:" || got[2][:2] != "3:" {
+		t.Fatalf("records = %q", got)
+	}
+}
@@ -0,0 +1,160 @@
+package ffcgiclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// CGI响应头的解析，基于textproto.Reader，支持已废弃的折行（obs-fold），限制总字节数、行数和单行长度
+
+// 响应头解析错误
+var (
+	// ErrHeaderTooLarge 响应头超过限制
+	ErrHeaderTooLarge = errors.New("response header too large")
+	// ErrNoHeaders 响应没有以空行结束的响应头
+	ErrNoHeaders = errors.New("no headers")
+)
+
+// HeaderLimits 响应头的限制，为0的字段使用默认值
+// 应用程序输出较大的Set-Cookie、Content-Security-Policy等响应头时需要调大
+type HeaderLimits struct {
+
+	// MaxBytes 响应头的总字节数，默认DefaultMaxHeaderBytes
+	MaxBytes int
+
+	// MaxCount 响应头的行数，默认DefaultMaxHeaderCount
+	MaxCount int
+
+	// MaxLineBytes 单行（包括折行）的长度，默认DefaultMaxHeaderLineBytes
+	MaxLineBytes int
+}
+
+// 默认的响应头限制
+const (
+	DefaultMaxHeaderBytes     = 64 * 1024
+	DefaultMaxHeaderCount     = 256
+	DefaultMaxHeaderLineBytes = 8 * 1024
+)
+
+// withDefaults 返回为0的字段替换为默认值后的限制
+func (l HeaderLimits) withDefaults() HeaderLimits {
+	if l.MaxBytes <= 0 {
+		l.MaxBytes = DefaultMaxHeaderBytes
+	}
+	if l.MaxCount <= 0 {
+		l.MaxCount = DefaultMaxHeaderCount
+	}
+	if l.MaxLineBytes <= 0 {
+		l.MaxLineBytes = DefaultMaxHeaderLineBytes
+	}
+	return l
+}
+
+// headerReadBuffer 读取响应头的缓冲大小
+const headerReadBuffer = 4096
+
+// HeaderError 解析CGI响应头失败，Line为出错的行（过长时被截断）
+type HeaderError struct {
+	Line string
+	Err  error
+}
+
+// Error 实现error接口
+func (e *HeaderError) Error() string {
+	if e.Line == "" {
+		return "cgi header: " + e.Err.Error()
+	}
+	return fmt.Sprintf("cgi header: %v: %q", e.Err, e.Line)
+}
+
+// Unwrap 返回原始错误
+func (e *HeaderError) Unwrap() error {
+	return e.Err
+}
+
+// newHeaderError 创建HeaderError，截断过长的行
+func newHeaderError(line string, err error) *HeaderError {
+	const max = 128
+	if len(line) > max {
+		line = line[:max] + "..."
+	}
+	return &HeaderError{Line: line, Err: err}
+}
+
+// headerLimitReader 读取响应头期间限制从底层读取的字节数，避免超长的行占用过多内存
+type headerLimitReader struct {
+	r      io.Reader
+	n      int  // 剩余可读取的字节数
+	active bool // 为false时不再限制
+}
+
+// Read 实现io.Reader
+func (l *headerLimitReader) Read(p []byte) (int, error) {
+	if !l.active {
+		return l.r.Read(p)
+	}
+	if l.n <= 0 {
+		return 0, ErrHeaderTooLarge
+	}
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= n
+	return n, err
+}
+
+// readCGIHeader 从r读取CGI响应头，返回响应头和用于继续读取响应体的reader
+// Status等CGI响应头原样保留在返回的header中
+func readCGIHeader(r io.Reader, limits HeaderLimits) (http.Header, *bufio.Reader, error) {
+	limits = limits.withDefaults()
+	lr := &headerLimitReader{r: r, n: limits.MaxBytes + headerReadBuffer, active: true}
+	br := bufio.NewReaderSize(lr, headerReadBuffer)
+	tp := textproto.NewReader(br)
+	header := make(http.Header)
+	total, count := 0, 0
+	for {
+		// 读取一行，以空白开头的后续行被合并（obs-fold）
+		line, err := tp.ReadContinuedLine()
+		if err == io.EOF {
+			return nil, br, &HeaderError{Err: ErrNoHeaders}
+		}
+		if err != nil {
+			if errors.Is(err, ErrHeaderTooLarge) {
+				return nil, br, &HeaderError{Err: ErrHeaderTooLarge}
+			}
+			return nil, br, newHeaderError(line, err)
+		}
+		// 空行结束
+		if line == "" {
+			break
+		}
+		total += len(line) + 2
+		count++
+		if len(line) > limits.MaxLineBytes {
+			return nil, br, newHeaderError(line, fmt.Errorf("%w: line longer than %d bytes", ErrHeaderTooLarge, limits.MaxLineBytes))
+		}
+		if total > limits.MaxBytes {
+			return nil, br, newHeaderError(line, fmt.Errorf("%w: more than %d bytes", ErrHeaderTooLarge, limits.MaxBytes))
+		}
+		if count > limits.MaxCount {
+			return nil, br, newHeaderError(line, fmt.Errorf("%w: more than %d lines", ErrHeaderTooLarge, limits.MaxCount))
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, br, newHeaderError(line, errors.New("bogus header line"))
+		}
+		header.Add(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+	if len(header) == 0 {
+		return nil, br, &HeaderError{Err: ErrNoHeaders}
+	}
+	// 响应头读取完毕，响应体不受限制
+	lr.active = false
+	return header, br, nil
+}
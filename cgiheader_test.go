@@ -0,0 +1,105 @@
+package ffcgiclient
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCGIHeader(t *testing.T) {
+	limits := HeaderLimits{MaxBytes: 256, MaxCount: 4, MaxLineBytes: 64}
+
+	// 折行被合并，响应体不受限制
+	body := strings.Repeat("x", 1024)
+	header, br, err := readCGIHeader(strings.NewReader("Status: 404 Not Found\r\nX-Long: a\r\n  b\r\n\r\n"+body), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Status") != "404 Not Found" || header.Get("X-Long") != "a b" {
+		t.Fatalf("header = %v", header)
+	}
+	if b, _ := io.ReadAll(br); string(b) != body {
+		t.Fatalf("body = %d bytes", len(b))
+	}
+
+	cases := []struct {
+		name, input string
+		want        error
+	}{
+		{"no blank line", "Content-Type: text/plain\r\n", ErrNoHeaders},
+		{"empty", "\r\nbody", ErrNoHeaders},
+		{"long line", "X: " + strings.Repeat("a", 100) + "\r\n\r\n", ErrHeaderTooLarge},
+		{"too many", strings.Repeat("X: a\r\n", 5) + "\r\n", ErrHeaderTooLarge},
+		{"too large", strings.Repeat("X: "+strings.Repeat("a", 60)+"\r\n", 4) + "\r\n", ErrHeaderTooLarge},
+		{"unterminated", "X: " + strings.Repeat("a", 1<<20), ErrHeaderTooLarge},
+	}
+	for _, c := range cases {
+		if _, _, err := readCGIHeader(strings.NewReader(c.input), limits); !errors.Is(err, c.want) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.want)
+		}
+	}
+
+	// 错误信息包含出错的行
+	_, _, err = readCGIHeader(strings.NewReader("bogus line\r\n\r\n"), limits)
+	if err == nil || !strings.Contains(err.Error(), `"bogus line"`) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestHandlerHeaderLimits(t *testing.T) {
+	cookie := strings.Repeat("c", 12*1024)
+	stub := &stubClient{recorded: map[string][]byte{
+		"": []byte("Content-Type: text/plain\r\nSet-Cookie: " + cookie + "\r\n\r\nok"),
+	}}
+	h := NewHandler(BasicHandler, func() (Client, error) { return stub, nil })
+
+	// 超过默认的单行长度
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", rec.Code)
+	}
+
+	h.SetHeaderLimits(HeaderLimits{MaxLineBytes: 16 * 1024})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 200 || len(rec.Header().Get("Set-Cookie")) != len(cookie) {
+		t.Fatalf("status = %d, Set-Cookie %d bytes", rec.Code, len(rec.Header().Get("Set-Cookie")))
+	}
+}
+
+// stalledBodyPipe 返回输出header和1MB响应体的ResponsePipe，写入在无人读取时阻塞
+func stalledBodyPipe(header string) *ResponsePipe {
+	resp := NewResponsePipe()
+	go func() {
+		resp.stdOutWriter.Write([]byte(header))
+		resp.stdOutWriter.Write(make([]byte, 1<<20))
+		resp.Close()
+	}()
+	return resp
+}
+
+func TestWriteResponseDrainsAfterHeaderError(t *testing.T) {
+	cases := map[string]string{
+		"too large":            "X-Big: " + strings.Repeat("a", 64*1024) + "\r\n\r\n",
+		"missing content type": "X-Powered-By: PHP\r\n\r\n",
+		"bogus status":         "Status: x\r\n\r\n",
+	}
+	for name, header := range cases {
+		rec := httptest.NewRecorder()
+		done := make(chan error, 1)
+		go func() { done <- stalledBodyPipe(header).WriteTo(rec, io.Discard) }()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: WriteTo did not return", name)
+		}
+		if rec.Code != http.StatusBadGateway {
+			t.Errorf("%s: status = %d, want 502", name, rec.Code)
+		}
+	}
+}
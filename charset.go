@@ -0,0 +1,146 @@
+package ffcgiclient
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// 响应体字符集转码
+
+// CharsetDecoder 将指定字符集的数据流转换为UTF-8数据流
+// 例如GBK可使用golang.org/x/text: simplifiedchinese.GBK.NewDecoder().Reader
+type CharsetDecoder func(r io.Reader) io.Reader
+
+// Transcoder 根据Content-Type中声明的charset，将响应体转码为UTF-8并更新响应头
+// 没有对应解码器的字符集保持原样
+type Transcoder struct {
+
+	// Decoders 字符集名称（小写）到解码器的映射，优先于内置解码器
+	// 内置: iso-8859-1/latin1, windows-1252
+	Decoders map[string]CharsetDecoder
+
+	// Types 需要转码的媒体类型，默认所有text/*类型及常见的文本类型
+	Types []string
+}
+
+// Middleware 返回响应体转码的中间件
+func (t *Transcoder) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			resp, err := inner(client, req)
+			if err != nil {
+				return resp, err
+			}
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+				// 已编码（压缩）的响应不处理
+				if header.Get("Content-Encoding") != "" {
+					return body, nil
+				}
+				mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+				if err != nil || !t.acceptType(mediaType) {
+					return body, nil
+				}
+				decoder := t.decoder(params["charset"])
+				if decoder == nil {
+					return body, nil
+				}
+				// 更新charset，长度已改变
+				params["charset"] = "utf-8"
+				header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+				header.Del("Content-Length")
+				return decoder(body), nil
+			}), nil
+		}
+	}
+}
+
+// acceptType 检查媒体类型是否需要转码
+func (t *Transcoder) acceptType(mediaType string) bool {
+	if len(t.Types) == 0 {
+		return strings.HasPrefix(mediaType, "text/") ||
+			mediaType == "application/json" ||
+			mediaType == "application/javascript" ||
+			mediaType == "application/xml"
+	}
+	for _, typ := range t.Types {
+		if strings.EqualFold(typ, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// decoder 查找字符集对应的解码器，UTF-8及未知字符集返回nil
+func (t *Transcoder) decoder(charset string) CharsetDecoder {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if d, ok := t.Decoders[charset]; ok {
+		return d
+	}
+	switch charset {
+	case "iso-8859-1", "iso8859-1", "latin1", "l1":
+		return func(r io.Reader) io.Reader {
+			return &singleByteDecoder{r: bufio.NewReader(r)}
+		}
+	case "windows-1252", "cp1252":
+		return func(r io.Reader) io.Reader {
+			return &singleByteDecoder{r: bufio.NewReader(r), table: &windows1252}
+		}
+	}
+	return nil
+}
+
+// windows1252 Windows-1252中0x80-0x9F对应的Unicode字符，其余与ISO-8859-1相同
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
+
+// singleByteDecoder 单字节字符集到UTF-8的流式解码器
+type singleByteDecoder struct {
+	r       *bufio.Reader
+	table   *[32]rune // 0x80-0x9F的映射表，nil表示ISO-8859-1
+	pending []byte    // 上次未能写入p的UTF-8字节
+}
+
+// Read 实现io.Reader
+func (d *singleByteDecoder) Read(p []byte) (n int, err error) {
+	var buf [utf8.UTFMax]byte
+	for n < len(p) {
+		// 先输出上次剩余的字节
+		if len(d.pending) > 0 {
+			c := copy(p[n:], d.pending)
+			n += c
+			d.pending = d.pending[c:]
+			continue
+		}
+		// 已有输出且没有缓冲的数据时返回，避免流式响应等待填满p
+		if n > 0 && d.r.Buffered() == 0 {
+			break
+		}
+		var b byte
+		if b, err = d.r.ReadByte(); err != nil {
+			break
+		}
+		if b < utf8.RuneSelf {
+			p[n] = b
+			n++
+			continue
+		}
+		r := rune(b)
+		if d.table != nil && b >= 0x80 && b <= 0x9F {
+			r = d.table[b-0x80]
+		}
+		size := utf8.EncodeRune(buf[:], r)
+		d.pending = append(d.pending[:0], buf[:size]...)
+	}
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return
+}
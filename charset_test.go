@@ -0,0 +1,87 @@
+package ffcgiclient
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestSingleByteDecoder(t *testing.T) {
+	tr := &Transcoder{}
+	cases := []struct {
+		charset, in, want string
+	}{
+		{"ISO-8859-1", "caf\xe9 \xa9", "café ©"},
+		{"latin1", "\x80", "\u0080"},
+		{"windows-1252", "\x80 \x93q\x94 \x9f", "€ “q” Ÿ"},
+		{"cp1252", "plain", "plain"},
+	}
+	for _, c := range cases {
+		// 每次只读取一个字节，验证多字节字符的拆分输出
+		b, err := io.ReadAll(iotest.OneByteReader(tr.decoder(c.charset)(strings.NewReader(c.in))))
+		if err != nil || string(b) != c.want {
+			t.Errorf("%s: %q, %v, want %q", c.charset, b, err, c.want)
+		}
+	}
+	if tr.decoder("utf-8") != nil || tr.decoder("koi8-r") != nil {
+		t.Error("decoder for utf-8 or unknown charset")
+	}
+}
+
+func TestSingleByteDecoderStreaming(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	r := (&Transcoder{}).decoder("latin1")(pr)
+	go pw.Write([]byte("data: caf\xe9\n\n"))
+
+	// 后端只写了一个事件，Read不能等待填满缓冲区
+	done := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		n, _ := r.Read(buf)
+		done <- string(buf[:n])
+	}()
+	select {
+	case got := <-done:
+		if got != "data: café\n\n" {
+			t.Fatalf("Read() = %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read blocked waiting for more data")
+	}
+}
+
+func TestTranscoder(t *testing.T) {
+	stub := &stubClient{recorded: map[string][]byte{
+		"latin1": []byte("Content-Type: text/html; charset=ISO-8859-1\r\nContent-Length: 4\r\n\r\ncaf\xe9"),
+		"utf8":   []byte("Content-Type: text/html; charset=utf-8\r\n\r\ncafé"),
+		"binary": []byte("Content-Type: image/png\r\n\r\n\xe9"),
+		"gzip":   []byte("Content-Type: text/plain; charset=latin1\r\nContent-Encoding: gzip\r\n\r\n\xe9"),
+	}}
+	handler := (&Transcoder{}).Middleware()(BasicHandler)
+	cases := []struct {
+		size, contentType, body string
+	}{
+		{"latin1", "text/html; charset=utf-8", "café"},
+		{"utf8", "text/html; charset=utf-8", "café"},
+		{"binary", "image/png", "\xe9"},
+		{"gzip", "text/plain; charset=latin1", "\xe9"},
+	}
+	for _, c := range cases {
+		resp, err := handler(stub, NewRequest(httptest.NewRequest("GET", "/?size="+c.size, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		resp.WriteTo(rec, io.Discard)
+		if rec.Header().Get("Content-Type") != c.contentType || rec.Body.String() != c.body {
+			t.Errorf("%s: %q %q", c.size, rec.Header().Get("Content-Type"), rec.Body.String())
+		}
+		if c.size == "latin1" && rec.Header().Get("Content-Length") != "" {
+			t.Errorf("Content-Length kept after transcoding")
+		}
+	}
+}
@@ -1,15 +1,18 @@
 package ffcgiclient
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"suilz/ffcgi-client/fcgiproto"
 )
 
 // client部分
@@ -17,10 +20,10 @@ import (
 // NewRequest 返回一个标准FastCgi请求
 func NewRequest(r *http.Request) (req *Request) {
 	req = &Request{
-		Raw:          r,                       // 保留原始请求
-		Role:         roleResponder,           // 目前Role只支持roleResponder
-		Params:       make(map[string]string), // 键值对参数
-		FlagKeepConn: 1,                       // keepAlive
+		Raw:          r,             // 保留原始请求
+		Role:         roleResponder, // 目前Role只支持roleResponder
+		Params:       NewParams(),   // 键值对参数
+		FlagKeepConn: 1,             // keepAlive
 	}
 
 	// 在客户端，如果Body是nil表示该请求没有主体写入GET请求
@@ -35,65 +38,156 @@ func NewRequest(r *http.Request) (req *Request) {
 
 // Request 包含FastCGI信息的标准请求
 type Request struct {
-	Raw          *http.Request     // http请求元数据
-	Role         role              // 指定FastCGI服务器担当的角色定义
-	Params       map[string]string // 键值对参数
-	Stdin        io.ReadCloser     // 标准输入数据
-	Data         io.ReadCloser     // 额外数据
-	FlagKeepConn uint8             // 完成后是否保持连接
+	Raw          *http.Request // http请求元数据
+	Role         role          // 指定FastCGI服务器担当的角色定义
+	Params       *Params       // 键值对参数
+	Stdin        io.ReadCloser // 标准输入数据
+	Data         io.ReadCloser // 额外数据
+	FlagKeepConn uint8         // 完成后是否保持连接
+
+	// onOutput 按接收顺序在写入ResponsePipe之前调用，stream为"stdout"或"stderr"
+	onOutput func(stream string, p []byte)
+
+	// headerLimits 解析CGI响应头的限制，由Handler设置，传递给Do返回的ResponsePipe
+	headerLimits HeaderLimits
+
+	// asteriskPassed 为true时"OPTIONS *"已由RequestTarget放行，路由中间件原样转发
+	asteriskPassed bool
+
+	// ctx 由WithContext设置的上下文
+	ctx context.Context
+}
+
+// Context 返回请求的上下文：WithContext设置的上下文，否则为原始请求的上下文，都没有时为context.Background()
+// 上下文结束时client发送FCGI_ABORT_REQUEST，Do返回的ResponsePipe.Err返回上下文的错误
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	if r.Raw != nil {
+		return r.Raw.Context()
+	}
+	return context.Background()
+}
+
+// WithContext 返回使用ctx作为上下文的浅拷贝，原始请求同样使用ctx，用于没有原始请求时限制请求时间
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//	defer cancel()
+//	resp, err := client.Do(req.WithContext(ctx))
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	if r.Raw != nil {
+		r2.Raw = r.Raw.WithContext(ctx)
+	}
+	return r2
 }
 
 // idPool 请求id生成池
+// 已释放的ID保存在空闲列表中，分配和释放都是O(1)且不需要额外的协程
 type idPool struct {
-	IDs chan uint16
+	slots   chan struct{} // 分配名额，容量即ID的最大数量
+	mutex   sync.Mutex
+	free    []uint16 // 已释放的ID，后进先出
+	next    uint16   // 下一个从未分配过的ID
+	size    uint32   // 可同时分配的ID数量，由limit缩小
+	pending uint32   // 缩小数量时尚未收回的名额，在Release时收回
 }
 
-// Alloc 从ID池中分配一个ID
-func (p *idPool) Alloc() uint16 {
-	return <-p.IDs
+// Alloc 从ID池中分配一个ID，ID已全部分配时等待释放，直到ctx结束
+func (p *idPool) Alloc(ctx context.Context) (uint16, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return 0, fmt.Errorf("request id pool exhausted: %w", ctx.Err())
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if n := len(p.free); n > 0 {
+		id := p.free[n-1]
+		p.free = p.free[:n-1]
+		atomic.AddInt64(&debugCounters.requestIDs, 1)
+		return id, nil
+	}
+	p.next++
+	atomic.AddInt64(&debugCounters.requestIDs, 1)
+	return p.next, nil
 }
 
-// ReleaseID 释放使用的ID
+// Release 释放使用的ID
 func (p *idPool) Release(id uint16) {
-	go func() {
-		// 释放ID回ID池，重用ID
-		// 使用goroutine，避免阻塞
-		// TODO 改为缓冲池？
-		p.IDs <- id
-		// 测试流程
-		// fmt.Println("【Release】释放ID回ID池:" + string(id))
-	}()
+	atomic.AddInt64(&debugCounters.requestIDs, -1)
+	p.mutex.Lock()
+	p.free = append(p.free, id)
+	if p.pending > 0 {
+		// 保留名额以缩小ID的数量
+		p.pending--
+		p.mutex.Unlock()
+		return
+	}
+	p.mutex.Unlock()
+	<-p.slots
 }
 
-// newIDPool 创建一个请求ID生成池
-func newIDPool(limit uint32) (p idPool) {
+// limit 将可同时分配的ID数量缩小到n，只缩小不扩大
+// 已分配的ID释放时才收回其名额，因此已分配的数量可能暂时超过n
+func (p *idPool) limit(n uint32) {
+	if n == 0 {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for ; p.size > n; p.size-- {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			p.pending++
+		}
+	}
+}
+
+// newIDPool 创建一个请求ID生成池，ID从1开始
+func newIDPool(limit uint32) *idPool {
 
 	// 限制ID数量
 	if limit == 0 || limit > 65535 {
 		limit = 65535
 	}
-
-	// 创建一个chan，用于存放请求ID
-	idsChan := make(chan uint16)
-	go func(maxID uint16) {
-		for i := uint16(1); i <= maxID; i++ {
-			idsChan <- i
-		}
-	}(uint16(limit))
-
-	p.IDs = idsChan
-	return
+	return &idPool{slots: make(chan struct{}, limit), size: limit}
 }
 
 // client 是Client接口的实现
 type client struct {
 	conn        *conn       // 请求连接
 	connFactory ConnFactory // 创建新连接工厂方法
-	idPool      idPool      // 请求ID池
+	idPool      *idPool     // 请求ID池
+	chunkSize   int         // 每次从请求体读取的字节数
+	coalesce    bool        // 开始消息和参数是否与第一个stdin消息一起写出
+
+	autoTune bool          // 建立第一个连接后是否按后端公布的处理能力限制请求ID
+	tuned    int32         // 为1时已询问到后端的处理能力
+	limits   backendLimits // 询问到的后端处理能力，tuned之后不再修改
+
+	hooks *RecordHooks // 发送和接收消息时调用的钩子
+
+	// 正在进行的请求，包括被终止后仍在读取剩余消息的请求
+	// 此时连接不能交给其他借出者，否则两边同时读取连接会互相抢走消息
+	reqMutex sync.Mutex
+	inFlight int           // 正在进行的请求数
+	drained  chan struct{} // inFlight减为0时关闭
 }
 
 // writeRequest client发起一个包含params和stdin的fastcgi请求
 func (c *client) writeRequest(reqID uint16, req *Request) (err error) {
+	// 请求结束后关闭stdin，发送开始消息失败时同样关闭
+	if req.Stdin != nil {
+		defer req.Stdin.Close()
+	}
 
 	// 发生错误时发起一个异常结束消息
 	defer func() {
@@ -103,119 +197,215 @@ func (c *client) writeRequest(reqID uint16, req *Request) (err error) {
 		}
 	}()
 
+	// 开始消息和键值对参数合并为尽量少的写入
+	c.conn.cork()
 	// 发起一个开始消息
 	err = c.conn.writeBeginRequest(reqID, req.Role, req.FlagKeepConn)
+	if err == nil {
+		// 发送键值对参数
+		err = c.conn.writePairs(typeParams, reqID, req.Params)
+	}
 	if err != nil {
+		c.conn.flush()
 		return
 	}
-	// 发送键值对参数
-	err = c.conn.writePairs(typeParams, reqID, req.Params)
-	if err != nil {
+	if c.coalesce {
+		// 与第一个stdin消息（至少有结束消息）一起写出
+		c.conn.uncork()
+	} else if err = c.conn.flush(); err != nil {
 		return
 	}
 
-	// 发送标准输入
+	// 发送标准输入，没有请求体时只发送表示结束的空消息
+	stdinWriter := newWriter(c.conn, typeStdin, reqID)
 	if req.Stdin != nil {
-		// 创建一个标准输入bufWriter
-		stdinWriter := newWriter(c.conn, typeStdin, reqID)
-		// 延后关闭stdin
-		defer req.Stdin.Close()
-
-		// 每次获取最多1024字节数据
-		p := make([]byte, 1024)
-		var count int
-		for {
-			// 从标准输入中获取数据
-			count, err = req.Stdin.Read(p)
-			if err == io.EOF {
-				err = nil
-			} else if err != nil {
-				stdinWriter.Close()
-				return
-			}
-			if count == 0 {
-				break
-			}
-			// 将获取到的部分写入buf
-			_, err = stdinWriter.Write(p[:count])
-			if err != nil {
-				stdinWriter.Close()
-				return
-			}
+		if wt, ok := req.Stdin.(io.WriterTo); ok {
+			// 请求体可以直接写出时不经过中间缓冲
+			_, err = wt.WriteTo(stdinWriter)
+		} else {
+			// 每次读取最多chunkSize字节，直接读入池化的消息缓冲发送
+			_, err = stdinWriter.readFrom(req.Stdin, c.chunkSize)
 		}
-		// 发送并关闭bufwriter
-		if err = stdinWriter.Close(); err != nil {
+		if err != nil {
+			stdinWriter.Close()
 			return
 		}
 	}
-
+	// 发送并关闭bufwriter
+	err = stdinWriter.Close()
 	return
 }
 
+// DefaultStdinChunkSize 每次从请求体读取的默认字节数
+const DefaultStdinChunkSize = 32 * 1024
+
+// copyBufferPools 按大小区分的复制缓冲池
+var copyBufferPools sync.Map // map[int]*sync.Pool
+
+// getCopyBuffer 从池中取出size大小的缓冲
+func getCopyBuffer(size int) *[]byte {
+	pool, _ := copyBufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, size)
+			return &b
+		},
+	})
+	return pool.(*sync.Pool).Get().(*[]byte)
+}
+
+// putCopyBuffer 将缓冲放回池中
+func putCopyBuffer(buf *[]byte) {
+	if pool, ok := copyBufferPools.Load(len(*buf)); ok {
+		pool.(*sync.Pool).Put(buf)
+	}
+}
+
 // readResponse 读取fastcgi的stdout和stderr信息，写入ResponsePipe
-func (c *client) readResponse(ctx context.Context, resp *ResponsePipe, req *Request) (err error) {
+// ctx结束时发送FCGI_ABORT_REQUEST，并继续读取丢弃此请求的消息直到EndRequest，使连接可以继续使用；
+// 从ctx结束起超过abortDrainTimeout仍未结束（包括FCGI_ABORT_REQUEST无法写出）时关闭连接。wrote在请求写出结束时收到写出的结果，
+// ctx结束时请求仍在写出（例如服务器不再读取请求体）则中断写入，写出失败时关闭连接
+func (c *client) readResponse(ctx context.Context, resp *ResponsePipe, req *Request, reqID uint16, wrote <-chan error) (err error) {
 	// 构造一个空消息
 	var rec record
 	done := make(chan int)
+	var aborted int32 // 已发送终止请求，之后的输出被丢弃
 
 	// 开启新的协程循环读取处理
 	go func() {
+		// 处理完成发起关闭信号
+		defer close(done)
+		// onOutput等回调中的panic不影响整个进程，此后连接的状态不确定，关闭连接
+		defer func() {
+			if p := recover(); p != nil {
+				resp.setErr(newPanicError(p))
+				c.conn.Close()
+			}
+		}()
 	readLoop:
 		for {
 			// 测试
 			// fmt.Println("【readResponse】读取fastcgi的stdout和stderr信息，写入ResponsePipe，读取消息")
 			// 读取消息
-			if err := rec.read(c.conn.rwc); err != nil {
+			if err := c.conn.readRecord(&rec); err != nil {
 				// 测试
 				// fmt.Println("read 错误：" + err.Error())
 				// if err == io.EOF {
 				// 	continue
 				// }
+				// 消息不合法时无法再与服务器同步，连接断开时也不能继续使用，关闭连接
+				c.conn.Close()
+				// 没有收到EndRequest，报告传输错误
+				resp.setErr(fmt.Errorf("reading response: %w", err))
 				break
 			}
+			// 忽略管理消息（请求ID为0），例如ping之后迟到的FCGI_GET_VALUES_RESULT，
+			// 以及应用程序对无法识别的管理消息回复的FCGI_UNKNOWN_TYPE
+			if rec.h.RequestID == 0 {
+				continue
+			}
+			// 丢弃其他请求的消息，例如之前被终止的请求迟到的输出，避免写入当前请求的管道或提前结束当前请求
+			if rec.h.RequestID != reqID {
+				continue
+			}
+			// 已终止的请求只等待EndRequest
+			if atomic.LoadInt32(&aborted) == 1 && rec.h.Type != typeEndRequest {
+				continue
+			}
 			// 不同输出类型获取不同的流
 			switch rec.h.Type {
 			case typeStdout:
+				resp.markTiming(func(t *Timing) *time.Duration { return &t.FirstByte })
+				if req.onOutput != nil {
+					req.onOutput("stdout", rec.content())
+				}
 				// 写入stdOutWriter
 				resp.stdOutWriter.Write(rec.content())
 			case typeStderr:
+				if req.onOutput != nil {
+					req.onOutput("stderr", rec.content())
+				}
 				// 写入stdErrWriter
 				resp.stdErrWriter.Write(rec.content())
 			case typeEndRequest:
+				// 应用程序拒绝了请求
+				resp.setErr(endRequestError(rec.content()))
 				// 结束中断循环
 				break readLoop
 			default:
-				// 异常，返回自定义错误
-				err := fmt.Sprintf("unexpected type %#v in readLoop", rec.h.Type)
-				resp.stdErrWriter.Write([]byte(err))
+				// 异常，报告协议错误
+				resp.setErr(fmt.Errorf("unexpected type %#v in readLoop", rec.h.Type))
 			}
 		}
 		// 测试
 		// fmt.Println("【readResponse】读取fastcgi的stdout和stderr信息，写入ResponsePipe，处理完成")
-		// 处理完成发起关闭信号
-		close(done)
 	}()
 
 	select {
 	case <-ctx.Done():
 		// 上下文取消
-		err = fmt.Errorf("timeout or canceled")
+		err = fmt.Errorf("timeout or canceled: %w", ctx.Err())
+		resp.setErr(err)
+		// 通知服务器终止请求，等待剩余的消息读取完毕
+		atomic.StoreInt32(&aborted, 1)
+		// 关闭输出管道，避免读取协程阻塞在无人读取的管道上
+		if w, ok := resp.stdOutWriter.(*io.PipeWriter); ok {
+			w.CloseWithError(err)
+		}
+		if w, ok := resp.stdErrWriter.(*io.PipeWriter); ok {
+			w.CloseWithError(err)
+		}
+		// 中断写入、发送FCGI_ABORT_REQUEST和等待EndRequest都可能阻塞在不再读取的服务器上，共用一个计时
+		deadline := time.Now().Add(abortDrainTimeout)
+		drain := time.NewTimer(abortDrainTimeout)
+		defer drain.Stop()
+		var werr error
+		select {
+		case werr = <-wrote:
+		default:
+			// 写协程可能阻塞在不再读取的服务器上并持有写锁，使其写入立即失败
+			c.conn.interruptWrite()
+			select {
+			case werr = <-wrote:
+			case <-drain.C:
+				werr = errWriteStalled
+			}
+			if werr == nil {
+				// 中断之前请求已完整写出
+				c.conn.resumeWrite()
+			}
+		}
+		// 请求写出失败时消息可能只写出了一部分，无法再发送FCGI_ABORT_REQUEST
+		if werr == nil && c.conn.writeAbortRequestBefore(reqID, deadline) == nil {
+			select {
+			case <-done:
+				return
+			case <-drain.C:
+			}
+		}
+		// 无法确认请求已结束，关闭连接，读取协程随即因读取失败退出
+		c.conn.Close()
+		<-done
 	case <-done:
 		// 处理完毕
 	}
 	return
 }
 
+// abortDrainTimeout 终止请求后等待服务器结束请求的最长时间
+var abortDrainTimeout = 5 * time.Second
+
+// errWriteStalled 中断写入后写协程仍未结束，例如阻塞在读取请求体上
+var errWriteStalled = errors.New("request write did not stop after interrupt")
+
 // Do 实现Client.Do方法，是业务主逻辑
 func (c *client) Do(req *Request) (resp *ResponsePipe, err error) {
 
-	// 分配请求ID
-	reqID := c.idPool.Alloc()
-
 	// 测试
 	// fmt.Println("【Client.Do】创建responsePipe")
 	// 创建responsePipe
 	resp = NewResponsePipe()
+	resp.headerLimits = req.headerLimits
+	resp.started = time.Now()
 	// 创建Err通道和完成信号通道
 	rwError, allDone := make(chan error), make(chan int)
 
@@ -225,13 +415,20 @@ func (c *client) Do(req *Request) (resp *ResponsePipe, err error) {
 		return
 	}
 
-	// 如果是原始请求，则使用其附带的上下文
-	var ctx context.Context
-	if req.Raw != nil {
-		ctx = req.Raw.Context()
-	} else {
-		ctx = context.TODO()
+	// 请求的上下文，结束时发送FCGI_ABORT_REQUEST
+	ctx := req.Context()
+
+	atomic.AddInt64(&debugCounters.requests, 1)
+	atomic.AddInt64(&debugCounters.inFlight, 1)
+
+	// 分配请求ID
+	reqID, err := c.idPool.Alloc(ctx)
+	if err != nil {
+		atomic.AddInt64(&debugCounters.inFlight, -1)
+		recordDebugError(err)
+		return
 	}
+	c.beginRequest()
 
 	// 定义WaitGroup，等待所有读写完成
 	var wg sync.WaitGroup
@@ -244,11 +441,15 @@ func (c *client) Do(req *Request) (resp *ResponsePipe, err error) {
 	}()
 
 	// 并行执行读写
-	// 写入请求
+	// 写入请求，写出结束时将结果发送到wrote
+	wrote := make(chan error, 1)
 	go func() {
 		// 测试
 		// fmt.Println("【Client.Do】写入请求开始")
-		if err := c.writeRequest(reqID, req); err != nil {
+		err := catchPanic(func() error { return c.writeRequest(reqID, req) })
+		wrote <- err
+		resp.markTiming(func(t *Timing) *time.Duration { return &t.Write })
+		if err != nil {
 			rwError <- err
 		}
 		// 测试
@@ -261,7 +462,7 @@ func (c *client) Do(req *Request) (resp *ResponsePipe, err error) {
 
 		// 测试
 		// fmt.Println("【Client.Do】读取请求开始")
-		if err := c.readResponse(ctx, resp, req); err != nil {
+		if err := catchPanic(func() error { return c.readResponse(ctx, resp, req, reqID, wrote) }); err != nil {
 			rwError <- err
 		}
 		// 测试
@@ -276,8 +477,8 @@ func (c *client) Do(req *Request) (resp *ResponsePipe, err error) {
 		for {
 			select {
 			case err := <-rwError:
-				// 将获取到的Err写入buf
-				resp.stdErrWriter.Write([]byte(err.Error()))
+				// 记录传输错误，与应用程序的stderr区分
+				resp.setErr(err)
 				continue
 			case <-allDone:
 				// 处理完成，跳出循环
@@ -289,12 +490,49 @@ func (c *client) Do(req *Request) (resp *ResponsePipe, err error) {
 		// fmt.Println("【Client.Do】处理完成，释放资源")
 		// 关闭/释放资源
 		c.idPool.Release(reqID)
+		resp.markTiming(func(t *Timing) *time.Duration { return &t.Total })
+		atomic.AddInt64(&debugCounters.inFlight, -1)
+		if err := resp.Err(); err != nil {
+			recordDebugError(err)
+		}
+		// 在stdout结束之前，读取stdout后归还的Client不会被视为仍有请求在进行
+		c.endRequest()
 		resp.Close()
 		close(rwError)
 	}()
 	return
 }
 
+// beginRequest 记录开始一个请求
+func (c *client) beginRequest() {
+	c.reqMutex.Lock()
+	if c.inFlight == 0 {
+		c.drained = make(chan struct{})
+	}
+	c.inFlight++
+	c.reqMutex.Unlock()
+}
+
+// endRequest 记录一个请求的读写全部结束
+func (c *client) endRequest() {
+	c.reqMutex.Lock()
+	c.inFlight--
+	if c.inFlight == 0 {
+		close(c.drained)
+	}
+	c.reqMutex.Unlock()
+}
+
+// busy 返回正在进行的请求全部结束时关闭的通道，没有正在进行的请求时返回nil
+func (c *client) busy() <-chan struct{} {
+	c.reqMutex.Lock()
+	defer c.reqMutex.Unlock()
+	if c.inFlight == 0 {
+		return nil
+	}
+	return c.drained
+}
+
 // Close Client.Close的实现
 func (c *client) Close() (err error) {
 	return c.CloseConn()
@@ -309,12 +547,20 @@ func (c *client) CloseConn() (err error) {
 	}
 	// 关闭连接
 	err = c.conn.Close()
-	c.conn = nil
+	// 仍有请求在读写连接时保留已关闭的连接，请求随即因读写失败结束
+	if c.busy() == nil {
+		c.conn = nil
+	}
 	// 测试
 	// fmt.Println("【Client.Close】conn置空")
 	return
 }
 
+// connUsable 检查连接是否仍可使用：已建立且没有因传输错误被关闭
+func (c *client) connUsable() bool {
+	return c.conn != nil && !c.conn.isClosed()
+}
+
 // NewConn 使用conn工厂为client创建一个连接
 func (c *client) NewConn() (err error) {
 	// 测试
@@ -323,8 +569,178 @@ func (c *client) NewConn() (err error) {
 	if err != nil {
 		return
 	}
-	c.conn = newConn(conn)
-	return
+	// 关闭之前的连接，避免泄漏
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = c.openConn(conn)
+	return c.tune()
+}
+
+// openConn 在rwc上创建client一端的连接
+func (c *client) openConn(rwc io.ReadWriteCloser) *conn {
+	cn := newConn(rwc)
+	cn.hooks = c.hooks
+	cn.counted = true
+	atomic.AddInt64(&debugCounters.connections, 1)
+	return cn
+}
+
+// ping 发送FCGI_GET_VALUES管理消息并等待FCGI_GET_VALUES_RESULT，检查连接是否可用
+// timeout大于0且底层为net.Conn时设置读写超时
+// 应用程序不支持FCGI_GET_VALUES时回复FCGI_UNKNOWN_TYPE，同样说明连接可用
+func (c *client) ping(timeout time.Duration) error {
+	_, err := c.getValues(timeout, "FCGI_MPXS_CONNS")
+	var unknown *UnknownTypeError
+	if errors.As(err, &unknown) {
+		return nil
+	}
+	return err
+}
+
+// GetValues 发送FCGI_GET_VALUES管理消息询问names（例如FCGI_MAX_CONNS、FCGI_MAX_REQS、FCGI_MPXS_CONNS），
+// 返回应用程序回复的变量；应用程序不支持FCGI_GET_VALUES时返回空的结果和*UnknownTypeError
+// c为NewClientFactory创建的Client或ClientPool借出的Client，不能与同一Client上进行中的请求同时调用
+func GetValues(c Client, timeout time.Duration, names ...string) (map[string]string, error) {
+	if pc, ok := c.(*PoolClient); ok {
+		c = pc.Client
+	}
+	cl, ok := c.(*client)
+	if !ok {
+		return nil, fmt.Errorf("fcgi: %T does not support FCGI_GET_VALUES", c)
+	}
+	return cl.getValues(timeout, names...)
+}
+
+// Ping 检查c与应用程序的连接是否可用：没有连接时先建立连接，再发送FCGI_GET_VALUES管理消息并等待回复
+// ctx结束时停止等待并返回ctx的错误，此时连接被关闭；c的要求同GetValues
+func Ping(ctx context.Context, c Client) error {
+	if pc, ok := c.(*PoolClient); ok {
+		c = pc.Client
+	}
+	cl, ok := c.(*client)
+	if !ok {
+		return fmt.Errorf("fcgi: %T does not support ping", c)
+	}
+	if !cl.connUsable() {
+		if err := cl.NewConn(); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// 不单独设置超时，ctx结束时使读写立即超时
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			if nc, ok := cl.conn.rwc.(net.Conn); ok {
+				nc.SetDeadline(time.Unix(1, 0))
+			}
+		case <-stop:
+		}
+	}()
+	err := cl.ping(0)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		// 消息可能只读取了一部分，连接不能继续使用
+		cl.conn.Close()
+		return ctx.Err()
+	}
+	return err
+}
+
+// getValues 发送FCGI_GET_VALUES管理消息询问names，返回应用程序回复的变量
+// 应用程序不支持FCGI_GET_VALUES时回复FCGI_UNKNOWN_TYPE，此时返回空的结果和*UnknownTypeError
+// timeout大于0且底层为net.Conn时设置读写超时
+func (c *client) getValues(timeout time.Duration, names ...string) (values map[string]string, err error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("client connection has been closed")
+	}
+	if nc, ok := c.conn.rwc.(net.Conn); ok && timeout > 0 {
+		nc.SetDeadline(time.Now().Add(timeout))
+		defer nc.SetDeadline(time.Time{})
+	}
+
+	// 只有变量名没有值的键值对，管理消息的请求ID为0
+	if err = c.conn.writeRecord(typeGetValues, 0, fcgiproto.GetValues(names...).Content); err != nil {
+		return
+	}
+	var rec record
+	for {
+		if err = c.conn.readRecord(&rec); err != nil {
+			return
+		}
+		if rec.h.RequestID != 0 {
+			continue
+		}
+		if rec.h.Type == typeGetValuesResult {
+			return DecodePairs(rec.content())
+		}
+		if rec.h.Type == typeUnknownType && rec.unknownType() == typeGetValues {
+			return map[string]string{}, &UnknownTypeError{Type: uint8(typeGetValues)}
+		}
+	}
+}
+
+// autoTuneTimeout 建立连接后询问后端处理能力的超时时间
+const autoTuneTimeout = 5 * time.Second
+
+// backendLimits 后端在FCGI_GET_VALUES_RESULT中公布的处理能力，0表示未公布
+type backendLimits struct {
+	MaxConns  uint32 // FCGI_MAX_CONNS 最多接受的连接数
+	MaxReqs   uint32 // FCGI_MAX_REQS 最多同时处理的请求数
+	Multiplex bool   // FCGI_MPXS_CONNS 是否在一个连接上同时处理多个请求
+}
+
+// parseBackendLimits 由FCGI_GET_VALUES_RESULT的变量得到后端的处理能力，未回复FCGI_MPXS_CONNS时视为支持多路复用
+func parseBackendLimits(values map[string]string) backendLimits {
+	limits := backendLimits{Multiplex: values["FCGI_MPXS_CONNS"] != "0"}
+	if n, err := strconv.ParseUint(values["FCGI_MAX_CONNS"], 10, 32); err == nil {
+		limits.MaxConns = uint32(n)
+	}
+	if n, err := strconv.ParseUint(values["FCGI_MAX_REQS"], 10, 32); err == nil {
+		limits.MaxReqs = uint32(n)
+	}
+	return limits
+}
+
+// tune 在第一个连接上询问后端的处理能力，并按其限制请求ID的数量
+// 询问失败时关闭连接并返回错误，下次建立连接时重新询问
+func (c *client) tune() error {
+	if !c.autoTune || atomic.LoadInt32(&c.tuned) == 1 {
+		return nil
+	}
+	values, err := c.getValues(autoTuneTimeout, "FCGI_MAX_CONNS", "FCGI_MAX_REQS", "FCGI_MPXS_CONNS")
+	// 不支持FCGI_GET_VALUES的应用程序按没有公布任何值处理
+	var unknown *UnknownTypeError
+	if err != nil && !errors.As(err, &unknown) {
+		c.conn.Close()
+		c.conn = nil
+		return fmt.Errorf("query backend limits: %w", err)
+	}
+	limits := parseBackendLimits(values)
+	switch {
+	case !limits.Multiplex:
+		c.idPool.limit(1)
+	case limits.MaxReqs > 0:
+		c.idPool.limit(limits.MaxReqs)
+	}
+	c.limits = limits
+	atomic.StoreInt32(&c.tuned, 1)
+	return nil
+}
+
+// backendLimits 返回询问到的后端处理能力，没有询问过时ok为false
+func (c *client) backendLimits() (limits backendLimits, ok bool) {
+	if atomic.LoadInt32(&c.tuned) == 0 {
+		return backendLimits{}, false
+	}
+	return c.limits, true
 }
 
 // Client 是FastCGI的客户端接口定义
@@ -333,7 +749,7 @@ type Client interface {
 
 	// 执行FastCGI请求
 	// 返回响应流（stdout和stderr）和错误
-	// 注意：协议错误将写入ResponsePipe中的stderr流
+	// 注意：协议错误和传输错误通过ResponsePipe.Err返回，不会写入stderr流
 	Do(req *Request) (resp *ResponsePipe, err error)
 
 	NewConn() error
@@ -360,35 +776,68 @@ type ClientFactory func() (Client, error)
 // SimpleClientFactory 返回根据传入的ConnFactory而实现的client工厂方法
 // limit 是fastcgi server所支持的最大请求数，0即代表最大值65535，默认:0
 func SimpleClientFactory(connFactory ConnFactory, limit uint32) ClientFactory {
-	return func() (c Client, err error) {
-		// 连接指定的地址
-		conn, err := connFactory()
-		if err != nil {
-			return
-		}
-
-		// 创建client
-		c = &client{
-			conn:        newConn(conn),    // 连接
-			connFactory: connFactory,      // 工厂方法
-			idPool:      newIDPool(limit), // 请求ID池
-		}
-		return
-	}
+	return NewClientFactory(connFactory, ClientConfig{Limit: limit})
 }
 
 // SimpleClientFactoryNoConn 返回根据传入的ConnFactory而实现的client工厂方法
 // limit 是fastcgi server所支持的最大请求数，0即代表最大值65535，默认:0
 // 此方法不预先创建连接
 func SimpleClientFactoryNoConn(connFactory ConnFactory, limit uint32) ClientFactory {
+	return NewClientFactory(connFactory, ClientConfig{Limit: limit, Lazy: true})
+}
+
+// ClientConfig client的配置
+type ClientConfig struct {
+
+	// Limit fastcgi server所支持的最大请求数，0即代表最大值65535
+	Limit uint32
+
+	// Lazy 为true时不预先创建连接
+	Lazy bool
+
+	// StdinChunkSize 每次从请求体读取并作为一个消息发送的最大字节数，0表示DefaultStdinChunkSize，
+	// 最大为65535；请求体实现了io.WriterTo时不使用
+	StdinChunkSize int
+
+	// CoalesceStdin 为true时，开始消息和参数等到第一块请求体读取后一起写出，减少一次写入；
+	// 请求体读取较慢（例如流式上传）时会推迟后端开始处理请求
+	CoalesceStdin bool
+
+	// AutoTune 为true时，第一个连接建立后发送FCGI_GET_VALUES询问FCGI_MAX_CONNS、FCGI_MAX_REQS和FCGI_MPXS_CONNS，
+	// 请求ID的数量缩小到后端公布的FCGI_MAX_REQS（不支持多路复用时为1），ClientPool的MaxActive缩小到FCGI_MAX_CONNS，
+	// 都不会超过配置的值；后端必须回复FCGI_GET_VALUES，公布的值不准确时设置PoolConfig.IgnoreBackendLimits或不开启
+	AutoTune bool
+
+	// Hooks 不为nil时，连接上发送和接收的每个消息都经过钩子，用于统计和测试中的故障注入
+	Hooks *RecordHooks
+}
+
+// NewClientFactory 按配置返回根据传入的ConnFactory而实现的client工厂方法
+func NewClientFactory(connFactory ConnFactory, config ClientConfig) ClientFactory {
 	return func() (c Client, err error) {
-		// 创建client
-		c = &client{
-			conn:        nil,              // 连接
-			connFactory: connFactory,      // 工厂方法
-			idPool:      newIDPool(limit), // 请求ID池
+		cl := &client{
+			connFactory: connFactory,             // 工厂方法
+			idPool:      newIDPool(config.Limit), // 请求ID池
+			chunkSize:   config.StdinChunkSize,   // 请求体分块大小
+			coalesce:    config.CoalesceStdin,    // 合并第一个stdin消息
+			autoTune:    config.AutoTune,         // 按后端的处理能力限制请求ID
+			hooks:       config.Hooks,            // 消息钩子
 		}
-		return
+		if cl.chunkSize <= 0 {
+			cl.chunkSize = DefaultStdinChunkSize
+		}
+		if !config.Lazy {
+			// 连接指定的地址
+			conn, err := connFactory()
+			if err != nil {
+				return nil, err
+			}
+			cl.conn = cl.openConn(conn)
+			if err = cl.tune(); err != nil {
+				return nil, err
+			}
+		}
+		return cl, nil
 	}
 }
 
@@ -408,6 +857,94 @@ type ResponsePipe struct {
 	stdOutWriter io.WriteCloser
 	stdErrReader io.Reader
 	stdErrWriter io.WriteCloser
+
+	// headerLimits 解析CGI响应头的限制
+	headerLimits HeaderLimits
+
+	// discardBody 为true时WriteTo读取并丢弃响应体，用于HEAD请求，由Handler设置
+	discardBody bool
+
+	// headerError 读取响应头失败时写入错误响应，由Handler设置，为nil时只写入ErrorStatus映射的状态码
+	headerError func(w http.ResponseWriter, err error)
+
+	// err 传输或协议错误，只保留第一个
+	mutex sync.Mutex
+	err   error
+
+	// timing 各阶段的耗时，started为Client.Do开始的时间，由mutex保护
+	started time.Time
+	timing  Timing
+
+	// upstream 改写前的响应，不为nil时Timing返回其耗时；返回后可能替换的用setUpstream设置，由mutex保护
+	upstream *ResponsePipe
+}
+
+// Timing 返回请求各阶段的耗时，在stdout读取结束后调用才能得到完整的结果
+// 不是由Client.Do创建的响应（例如中间件直接生成的响应）返回零值
+func (pipes *ResponsePipe) Timing() Timing {
+	pipes.mutex.Lock()
+	upstream, timing := pipes.upstream, pipes.timing
+	pipes.mutex.Unlock()
+	if upstream != nil {
+		return upstream.Timing()
+	}
+	return timing
+}
+
+// setUpstream 设置改写前的响应，用于返回后才确定上游的响应（例如重试）
+func (pipes *ResponsePipe) setUpstream(upstream *ResponsePipe) {
+	pipes.mutex.Lock()
+	defer pipes.mutex.Unlock()
+	pipes.upstream = upstream
+}
+
+// markTiming 把从Client.Do开始到现在的耗时记录到field，field已有值时忽略
+func (pipes *ResponsePipe) markTiming(field func(t *Timing) *time.Duration) {
+	pipes.mutex.Lock()
+	defer pipes.mutex.Unlock()
+	if d := field(&pipes.timing); *d == 0 && !pipes.started.IsZero() {
+		*d = time.Since(pipes.started)
+	}
+}
+
+// Err 返回请求过程中发生的传输或协议错误（连接断开、消息不合法、超时等），没有时返回nil
+// 应用程序的stderr输出不属于错误；在stdout读取结束后调用才能得到确定的结果
+func (pipes *ResponsePipe) Err() error {
+	pipes.mutex.Lock()
+	defer pipes.mutex.Unlock()
+	return pipes.err
+}
+
+// setErr 记录错误，已有错误时忽略
+func (pipes *ResponsePipe) setErr(err error) {
+	if err == nil {
+		return
+	}
+	pipes.mutex.Lock()
+	defer pipes.mutex.Unlock()
+	if pipes.err == nil {
+		pipes.err = err
+	}
+}
+
+// CloseWithError 记录传输错误并关闭所有的writer，供自定义的Client实现使用
+func (pipes *ResponsePipe) CloseWithError(err error) {
+	pipes.setErr(err)
+	pipes.Close()
+}
+
+// writeHeaderError WriteTo读取响应头失败时写入错误响应，默认只写入状态码，无法识别的错误为502
+func (pipes *ResponsePipe) writeHeaderError(w http.ResponseWriter, err error) {
+	if pipes.headerError != nil {
+		pipes.headerError(w, err)
+		return
+	}
+	w.WriteHeader(ErrorStatus(err, http.StatusBadGateway))
+}
+
+// SetHeaderLimits 设置WriteTo解析CGI响应头的限制
+func (pipes *ResponsePipe) SetHeaderLimits(limits HeaderLimits) {
+	pipes.headerLimits = limits
 }
 
 // Close 关闭所有的writer
@@ -428,7 +965,7 @@ func (pipes *ResponsePipe) WriteTo(rw http.ResponseWriter, ew io.Writer) (err er
 	go func() {
 		// 测试
 		// fmt.Println("【WriteTo】将给定的输出写入http.ResponseWriter/io.Writer，写入开始")
-		chErr <- pipes.writeResponse(rw)
+		chErr <- catchPanic(func() error { return pipes.writeResponse(rw) })
 		// 测试
 		// fmt.Println("【WriteTo】将给定的输出写入http.ResponseWriter/io.Writer，写入完成")
 		wg.Done()
@@ -437,7 +974,7 @@ func (pipes *ResponsePipe) WriteTo(rw http.ResponseWriter, ew io.Writer) (err er
 	go func() {
 		// 测试
 		// fmt.Println("【WriteTo】将给定的错误写入http.ResponseWriter/io.Writer，写入开始")
-		chErr <- pipes.writeError(ew)
+		chErr <- catchPanic(func() error { return pipes.writeError(ew) })
 		// 测试
 		// fmt.Println("【WriteTo】将给定的错误写入http.ResponseWriter/io.Writer，写入完成")
 		wg.Done()
@@ -464,92 +1001,40 @@ func (pipes *ResponsePipe) writeError(w io.Writer) (err error) {
 
 // writeResponse 将给定的输出写入http.ResponseWriter
 func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
-	// 测试
-	// fmt.Println("【writeResponse】将给定的输出写入http.ResponseWriter：初始化")
-	// 创建一个具有最少有size尺寸的缓冲、从stdOutReader读取的*Reader
-	linebody := bufio.NewReaderSize(pipes.stdOutReader, 1024)
-	// 初始化http.Header，该值会被WriteHeader方法发送
-	headers := make(http.Header)
+	// 出错时读取并丢弃剩余的输出，避免后端和writeError阻塞在无人读取的管道上
+	defer func() {
+		if err != nil {
+			pipes.discardStdout()
+		}
+	}()
+	// 读取并解析CGI响应头
+	headers, linebody, err := readCGIHeader(pipes.stdOutReader, pipes.headerLimits)
+	if err != nil {
+		// 传输错误或请求被拒绝时报告传输错误
+		if terr := pipes.Err(); terr != nil {
+			err = terr
+		}
+		err = fmt.Errorf("error reading headers: %w", err)
+		pipes.writeHeaderError(w, err)
+		return
+	}
 	// 状态码
 	statusCode := 0
-	// 记录header行数
-	headerLines := 0
-	// 标记是否空行
-	sawBlankLine := false
-
-	// 循环处理Header
-	for {
-		var line []byte
-		var isPrefix bool
-		// 读取一行
-		line, isPrefix, err = linebody.ReadLine()
-		// 如果行太长超过了缓冲，返回值isPrefix会被设为true
-		if isPrefix {
-			// header值过长，发送500
-			w.WriteHeader(http.StatusInternalServerError)
-			err = fmt.Errorf("long header line from subprocess")
+	if status := headers.Get("Status"); status != "" {
+		// 处理状态码
+		// 状态码格式是3位，少于3则返回错误
+		headers.Del("Status")
+		if len(status) < 3 {
+			err = fmt.Errorf("%w: bogus status (short): %q", ErrMalformedResponse, status)
+			pipes.writeHeaderError(w, err)
 			return
 		}
-		// 遇到结束符，跳出循环
-		if err == io.EOF {
-			break
-		}
-		// 错误
+		statusCode, err = parseStatusCode(status[0:3])
 		if err != nil {
-			// 发送500
-			w.WriteHeader(http.StatusInternalServerError)
-			err = fmt.Errorf("error reading headers: %v", err)
+			err = fmt.Errorf("%w: bogus status: %q", ErrMalformedResponse, status)
+			pipes.writeHeaderError(w, err)
 			return
 		}
-		// 空行结束，跳出循环
-		if len(line) == 0 {
-			sawBlankLine = true
-			break
-		}
-		// header行数+1
-		headerLines++
-		// 以:切割字符串，获取此行的header参数
-		parts := strings.SplitN(string(line), ":", 2)
-		// 少于2个元素，返回错误
-		if len(parts) < 2 {
-			err = fmt.Errorf("bogus header line: %s", string(line))
-			return
-		}
-		// 赋值
-		headerName, headerVal := parts[0], parts[1]
-		// 将前后端所有空白（unicode.IsSpace指定）都去掉
-		headerName = strings.TrimSpace(headerName)
-		headerVal = strings.TrimSpace(headerVal)
-
-		switch {
-		case headerName == "Status":
-			// 处理状态码
-			// 状态码格式是3位，少于3则返回错误
-			if len(headerVal) < 3 {
-				err = fmt.Errorf("bogus status (short): %q", headerVal)
-				return
-			}
-			var code int
-			code, err = strconv.Atoi(headerVal[0:3])
-			if err != nil {
-				err = fmt.Errorf("bogus status: %q\nline was %q",
-					headerVal, line)
-				return
-			}
-			statusCode = code
-		default:
-			// 除status外，其他header参数添加到headers
-			headers.Add(headerName, headerVal)
-		}
-	}
-	// 如果header行数为0或没有空行结束
-	if headerLines == 0 || !sawBlankLine {
-		// 测试
-		// fmt.Println("【writeResponse】将给定的输出写入http.ResponseWriter：no headers写入错误")
-		// 500
-		w.WriteHeader(http.StatusInternalServerError)
-		err = fmt.Errorf("no headers")
-		return
 	}
 
 	// 获取Location值
@@ -566,10 +1051,10 @@ func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
 		}
 	}
 
-	// 没有指定状态码，且Content-Type没有内容，返回500
+	// 没有指定状态码，且Content-Type没有内容
 	if statusCode == 0 && headers.Get("Content-Type") == "" {
-		w.WriteHeader(http.StatusInternalServerError)
-		err = fmt.Errorf("missing required Content-Type in headers")
+		err = fmt.Errorf("%w: missing required Content-Type in headers", ErrMalformedResponse)
+		pipes.writeHeaderError(w, err)
 		return
 	}
 
@@ -586,15 +1071,45 @@ func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
 	}
 	// 写入并发送Header
 	w.WriteHeader(statusCode)
-	// 将剩下的数据拷贝并发送
-	_, err = io.Copy(w, linebody)
+	if pipes.discardBody {
+		// 不发送响应体，仍读取完毕，避免后端阻塞在无人读取的输出上
+		_, err = io.Copy(io.Discard, linebody)
+	} else {
+		// 将剩下的数据拷贝并发送
+		_, err = io.Copy(w, linebody)
+	}
 	// fmt.Println(string(linebody.buf))
 	if err != nil {
-		err = fmt.Errorf("copy error: %v", err)
+		err = fmt.Errorf("copy error: %w", err)
 	}
 	return
 }
 
+// discardStdout 读取并丢弃stdout中剩余的数据
+// 必须读取管道本身：readCGIHeader返回的reader在读取超过头部限制后停止
+func (pipes *ResponsePipe) discardStdout() {
+	io.Copy(io.Discard, pipes.stdOutReader)
+}
+
+// parseStatusCode 解析Status响应头中的三位数字状态码，只接受200到999
+// strconv.Atoi会接受"+99"、"-12"等，这样的状态码传给http.ResponseWriter.WriteHeader会引发panic
+func parseStatusCode(s string) (int, error) {
+	if len(s) != 3 {
+		return 0, errors.New("status code must be 3 digits")
+	}
+	code := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, errors.New("status code must be 3 digits")
+		}
+		code = code*10 + int(s[i]-'0')
+	}
+	if code < 200 {
+		return 0, fmt.Errorf("status code %d out of range", code)
+	}
+	return code, nil
+}
+
 // ClientFunc 是Client接口的快捷函数实现，主要用于测试和开发
 type ClientFunc func(req *Request) (resp *ResponsePipe, err error)
 
@@ -1,11 +1,20 @@
 package ffcgiclient
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
 	"testing"
 	"time"
+
+	"suilz/ffcgi-client/fcgiproto"
 )
 
 func TestClient(t *testing.T) {
@@ -34,7 +43,7 @@ func TestClient(t *testing.T) {
 	// Pool
 	pool := NewClientPool(
 		SimpleClientFactoryNoConn(connFactory, 0),
-		10,             // 通道缓冲数量，即预创建client的数量
+		10,             // client的最大数量，按需创建
 		30*time.Second, // client存活时间
 	)
 	// 连接池模式
@@ -61,3 +70,566 @@ func TestHttpHandle(t *testing.T) {
 	// 	gofast.SimpleClientFactory(connFactory, 0),
 	// ))
 }
+
+func TestIDPool(t *testing.T) {
+	p := newIDPool(2)
+	ctx := context.Background()
+	a, _ := p.Alloc(ctx)
+	b, _ := p.Alloc(ctx)
+	if a != 1 || b != 2 {
+		t.Fatalf("got ids %d, %d", a, b)
+	}
+
+	// ID已全部分配时等待到ctx结束
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Alloc(timeout); err == nil {
+		t.Fatal("expected error when pool is exhausted")
+	}
+
+	// 释放后可以重新分配
+	p.Release(a)
+	if id, err := p.Alloc(ctx); err != nil || id != a {
+		t.Fatalf("got id %d, err %v", id, err)
+	}
+}
+
+func TestIDPoolLimit(t *testing.T) {
+	p := newIDPool(3)
+	ctx := context.Background()
+	a, _ := p.Alloc(ctx)
+
+	// 空闲的名额立即收回
+	p.limit(2)
+	b, _ := p.Alloc(ctx)
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Alloc(timeout); err == nil {
+		t.Fatal("expected error when limited pool is exhausted")
+	}
+
+	// 已分配的ID释放时才收回名额
+	p.limit(1)
+	p.Release(a)
+	timeout, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Alloc(timeout); err == nil {
+		t.Fatal("expected released slot to be reserved")
+	}
+	p.Release(b)
+	if _, err := p.Alloc(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordBackend 返回连接到内存中的FastCGI后端的ConnFactory
+// 每个连接上读取完整的请求后以请求ID和请求体调用serve，serve直接写出响应消息
+func recordBackend(serve func(sc *conn, reqID uint16, stdin []byte)) ConnFactory {
+	return valuesBackend(nil, serve)
+}
+
+// valuesBackend 同recordBackend，以values回复FCGI_GET_VALUES
+func valuesBackend(values map[string]string, serve func(sc *conn, reqID uint16, stdin []byte)) ConnFactory {
+	var result []byte
+	for k, v := range values {
+		result = fcgiproto.AppendPair(result, k, v)
+	}
+	return func() (net.Conn, error) {
+		cli, srv := net.Pipe()
+		go func() {
+			defer srv.Close()
+			sc := newConn(srv)
+			var rec record
+			var reqID uint16
+			var stdin []byte
+			for {
+				if err := sc.readRecord(&rec); err != nil {
+					return
+				}
+				switch {
+				case rec.h.Type == typeGetValues:
+					sc.writeRecord(typeGetValuesResult, 0, result)
+				case rec.h.Type == typeBeginRequest:
+					reqID, stdin = rec.h.RequestID, nil
+				case rec.h.Type == typeStdin && rec.h.ContentLength > 0:
+					stdin = append(stdin, rec.content()...)
+				case rec.h.Type == typeStdin:
+					serve(sc, reqID, stdin)
+				}
+			}
+		}()
+		return cli, nil
+	}
+}
+
+// TestReadResponseForeignRecords 测试丢弃其他请求的消息并忽略FCGI_UNKNOWN_TYPE
+func TestReadResponseForeignRecords(t *testing.T) {
+	factory := recordBackend(func(sc *conn, reqID uint16, _ []byte) {
+		other := reqID + 1
+		sc.writeRecord(typeStdout, other, []byte("Status: 500\r\n\r\nstray"))
+		sc.writeRecord(typeUnknownType, 0, []byte{200, 0, 0, 0, 0, 0, 0, 0})
+		sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\nok"))
+		sc.writeEndRequest(other, 0, statusRequestComplete)
+		sc.writeRecord(typeStdout, reqID, []byte("!"))
+		sc.writeEndRequest(reqID, 0, statusRequestComplete)
+	})
+
+	c, err := SimpleClientFactory(factory, 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	resp, err := c.Do(NewRequest(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(resp.stdOutReader)
+	if string(out) != "Content-Type: text/plain\r\n\r\nok!" {
+		t.Fatalf("stdout = %q", out)
+	}
+	if err := resp.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+}
+
+// TestReadResponseManagementRecords 测试响应中穿插的管理消息（例如ping之后迟到的FCGI_GET_VALUES_RESULT）被忽略
+func TestReadResponseManagementRecords(t *testing.T) {
+	factory := recordBackend(func(sc *conn, reqID uint16, _ []byte) {
+		sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\na"))
+		sc.writeRecord(typeGetValuesResult, 0, []byte{15, 1, 'F', 'C', 'G', 'I', '_', 'M', 'P', 'X', 'S', '_', 'C', 'O', 'N', 'N', 'S', '0'})
+		sc.writeRecord(typeStdout, reqID, []byte("b"))
+		sc.writeEndRequest(reqID, 0, statusRequestComplete)
+	})
+	c, err := SimpleClientFactory(factory, 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// 同一连接上连续的请求都不受影响
+	for i := 0; i < 2; i++ {
+		resp, err := c.Do(NewRequest(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := io.ReadAll(resp.stdOutReader)
+		if string(out) != "Content-Type: text/plain\r\n\r\nab" || resp.Err() != nil {
+			t.Fatalf("request %d: stdout = %q, Err() = %v", i, out, resp.Err())
+		}
+	}
+}
+
+// TestReadResponseAbort 测试请求取消后发送FCGI_ABORT_REQUEST，等待EndRequest后连接可以继续使用
+func TestReadResponseAbort(t *testing.T) {
+	started, release, aborted := make(chan struct{}, 2), make(chan struct{}), make(chan struct{}, 1)
+	c, err := SimpleClientFactory(stallBackend(started, release, aborted), 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := c.Do(NewRequest(httptest.NewRequest("GET", "/", nil).WithContext(ctx)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	cancel()
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("FCGI_ABORT_REQUEST not sent")
+	}
+	io.Copy(io.Discard, resp.stdOutReader)
+	if err := resp.Err(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Err() = %v, want context.Canceled", err)
+	}
+
+	// 服务器确认结束请求后连接保持可用
+	if !c.(*client).connUsable() {
+		t.Fatal("connection closed after confirmed abort")
+	}
+	close(release)
+	resp, err = c.Do(NewRequest(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(resp.stdOutReader)
+	if string(out) != "Content-Type: text/plain\r\n\r\ndone" || resp.Err() != nil {
+		t.Fatalf("stdout = %q, Err() = %v", out, resp.Err())
+	}
+}
+
+// TestRequestWithContext 测试没有原始请求时由WithContext限制请求时间
+func TestRequestWithContext(t *testing.T) {
+	started, release, aborted := make(chan struct{}, 1), make(chan struct{}), make(chan struct{}, 1)
+	defer close(release)
+	c, err := SimpleClientFactory(stallBackend(started, release, aborted), 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := NewRequest(nil)
+	if req.Context() != context.Background() {
+		t.Fatal("request without context should use context.Background()")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("FCGI_ABORT_REQUEST not sent")
+	}
+	io.Copy(io.Discard, resp.stdOutReader)
+	if err := resp.Err(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Err() = %v, want context.DeadlineExceeded", err)
+	}
+
+	// 原始请求使用相同的上下文
+	raw := NewRequest(httptest.NewRequest("GET", "/", nil)).WithContext(ctx)
+	if raw.Context() != ctx || raw.Raw.Context() != ctx {
+		t.Fatal("WithContext did not propagate to the raw request")
+	}
+}
+
+// deafBackend 返回读取到until类型的结束消息（空消息）后不再读取连接的ConnFactory，
+// 例如typeParams模拟不读取请求体的服务器；stalled在停止读取时收到通知，release关闭后关闭服务器一端的连接
+func deafBackend(until recType, stalled chan<- struct{}, release <-chan struct{}) ConnFactory {
+	return func() (net.Conn, error) {
+		cli, srv := net.Pipe()
+		go func() {
+			defer srv.Close()
+			sc := newConn(srv)
+			var rec record
+			for sc.readRecord(&rec) == nil {
+				if rec.h.Type == until && rec.h.ContentLength == 0 {
+					stalled <- struct{}{}
+					<-release
+					return
+				}
+			}
+		}()
+		return cli, nil
+	}
+}
+
+// TestRequestContextStalledStdin 测试服务器不再读取请求体时，上下文结束后中断写入，请求ID和连接随即释放
+func TestRequestContextStalledStdin(t *testing.T) {
+	stalled, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	c, err := SimpleClientFactory(deafBackend(typeParams, stalled, release), 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := NewRequest(nil).WithContext(ctx)
+	req.Stdin = io.NopCloser(bytes.NewReader(make([]byte, 1<<20)))
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-stalled
+	io.Copy(io.Discard, resp.stdOutReader)
+	if err := resp.Err(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Err() = %v, want context.DeadlineExceeded", err)
+	}
+
+	select {
+	case <-waitIdle(c.(*client)):
+	case <-time.After(time.Second):
+		t.Fatal("request still in flight after the context ended")
+	}
+	if c.(*client).connUsable() {
+		t.Fatal("connection with a partially written request still usable")
+	}
+}
+
+// TestReadResponseAbortStalled 测试服务器不再读取连接、FCGI_ABORT_REQUEST无法写出时，
+// 从请求取消起超过abortDrainTimeout后关闭连接
+func TestReadResponseAbortStalled(t *testing.T) {
+	defer func(d time.Duration) { abortDrainTimeout = d }(abortDrainTimeout)
+	abortDrainTimeout = 50 * time.Millisecond
+
+	stalled, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	c, err := SimpleClientFactory(deafBackend(typeStdin, stalled, release), 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := c.Do(NewRequest(nil).WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-stalled
+	cancel()
+	io.Copy(io.Discard, resp.stdOutReader)
+	if err := resp.Err(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Err() = %v, want context.Canceled", err)
+	}
+
+	select {
+	case <-waitIdle(c.(*client)):
+	case <-time.After(time.Second):
+		t.Fatal("request still in flight after abortDrainTimeout")
+	}
+	if c.(*client).connUsable() {
+		t.Fatal("connection kept after an unconfirmed abort")
+	}
+}
+
+// waitIdle 返回c上没有进行中的请求时关闭的通道
+func waitIdle(c *client) <-chan struct{} {
+	if ch := c.busy(); ch != nil {
+		return ch
+	}
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// TestClientStdinChunkSize 测试按StdinChunkSize拆分请求体，请求体实现io.WriterTo时直接写出
+func TestClientStdinChunkSize(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 10000)
+	tests := []struct {
+		name      string
+		chunkSize int
+		stdin     io.ReadCloser
+		max       int
+	}{
+		{"default", 0, io.NopCloser(struct{ io.Reader }{bytes.NewReader(body)}), DefaultStdinChunkSize},
+		{"small chunks", 1000, io.NopCloser(struct{ io.Reader }{bytes.NewReader(body)}), 1000},
+		{"writer to", 1000, nopCloser{bytes.NewBuffer(body)}, maxWrite},
+	}
+	for _, tt := range tests {
+		var sizes []int
+		var got []byte
+		factory := func() (net.Conn, error) {
+			cli, srv := net.Pipe()
+			go func() {
+				defer srv.Close()
+				sc := newConn(srv)
+				var rec record
+				for sc.readRecord(&rec) == nil {
+					if rec.h.Type != typeStdin {
+						continue
+					}
+					if rec.h.ContentLength == 0 {
+						sc.writeRecord(typeStdout, rec.h.RequestID, []byte("Content-Type: text/plain\r\n\r\n"))
+						sc.writeEndRequest(rec.h.RequestID, 0, statusRequestComplete)
+						continue
+					}
+					sizes = append(sizes, int(rec.h.ContentLength))
+					got = append(got, rec.content()...)
+				}
+			}()
+			return cli, nil
+		}
+		c, err := NewClientFactory(factory, ClientConfig{StdinChunkSize: tt.chunkSize})()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := NewRequest(nil)
+		req.Stdin = tt.stdin
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.stdOutReader)
+		c.Close()
+		if !bytes.Equal(got, body) {
+			t.Errorf("%s: received %d bytes, want %d", tt.name, len(got), len(body))
+		}
+		for _, n := range sizes {
+			if n > tt.max {
+				t.Errorf("%s: record of %d bytes, want at most %d", tt.name, n, tt.max)
+				break
+			}
+		}
+		if tt.max < len(body) && len(sizes) < len(body)/tt.max {
+			t.Errorf("%s: %d records", tt.name, len(sizes))
+		}
+	}
+}
+
+func TestClientAutoTune(t *testing.T) {
+	serve := func(sc *conn, reqID uint16, _ []byte) {
+		sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\nok"))
+		sc.writeEndRequest(reqID, 0, statusRequestComplete)
+	}
+	tests := []struct {
+		name     string
+		values   map[string]string
+		config   ClientConfig
+		ids      uint32
+		maxConns uint32
+		tuned    bool
+	}{
+		{"disabled", map[string]string{"FCGI_MAX_REQS": "5"}, ClientConfig{}, 65535, 0, false},
+		{"multiplexed", map[string]string{"FCGI_MAX_CONNS": "2", "FCGI_MAX_REQS": "5", "FCGI_MPXS_CONNS": "1"}, ClientConfig{AutoTune: true}, 5, 2, true},
+		{"not multiplexed", map[string]string{"FCGI_MAX_CONNS": "8", "FCGI_MAX_REQS": "8", "FCGI_MPXS_CONNS": "0"}, ClientConfig{AutoTune: true}, 1, 8, true},
+		{"within limit", map[string]string{"FCGI_MAX_REQS": "500"}, ClientConfig{AutoTune: true, Limit: 10}, 10, 0, true},
+		{"nothing advertised", nil, ClientConfig{AutoTune: true, Lazy: true}, 65535, 0, true},
+	}
+	for _, tt := range tests {
+		c, err := NewClientFactory(valuesBackend(tt.values, serve), tt.config)()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.config.Lazy {
+			if err := c.NewConn(); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		cl := c.(*client)
+		if cl.idPool.size != tt.ids {
+			t.Errorf("%s: id limit = %d, want %d", tt.name, cl.idPool.size, tt.ids)
+		}
+		limits, ok := cl.backendLimits()
+		if ok != tt.tuned || limits.MaxConns != tt.maxConns {
+			t.Errorf("%s: backendLimits() = %+v, %v", tt.name, limits, ok)
+		}
+		// 询问之后的请求不受影响
+		resp, err := c.Do(NewRequest(nil))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if out, _ := io.ReadAll(resp.stdOutReader); string(out) != "Content-Type: text/plain\r\n\r\nok" {
+			t.Errorf("%s: stdout = %q", tt.name, out)
+		}
+		c.Close()
+	}
+}
+
+// TestParseStatusCode 测试Status响应头中的状态码只接受三位数字
+func TestParseStatusCode(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int
+	}{
+		{"200", 200},
+		{"404", 404},
+		{"999", 999},
+		{"-12", 0},
+		{"+99", 0},
+		{"099", 0},
+		{"1 0", 0},
+		{"20", 0},
+	}
+	for _, c := range cases {
+		got, err := parseStatusCode(c.in)
+		if got != c.want || (err == nil) != (c.want != 0) {
+			t.Errorf("parseStatusCode(%q) = %d, %v, want %d", c.in, got, err, c.want)
+		}
+	}
+}
+
+// unknownTypeBackend 对所有管理消息回复FCGI_UNKNOWN_TYPE的后端
+func unknownTypeBackend() (net.Conn, error) {
+	cli, srv := net.Pipe()
+	go func() {
+		defer srv.Close()
+		sc := newConn(srv)
+		var rec record
+		for sc.readRecord(&rec) == nil {
+			if rec.h.RequestID == 0 {
+				sc.writeUnknownType(rec.h.Type)
+			}
+		}
+	}()
+	return cli, nil
+}
+
+// TestGetValues 测试询问应用程序的变量，应用程序不支持时返回*UnknownTypeError
+func TestGetValues(t *testing.T) {
+	values := map[string]string{"FCGI_MAX_CONNS": "4", "FCGI_MPXS_CONNS": "1"}
+	tests := []struct {
+		name        string
+		factory     ConnFactory
+		want        map[string]string
+		wantUnknown bool
+	}{
+		{"supported", valuesBackend(values, nil), values, false},
+		{"unknown type", unknownTypeBackend, map[string]string{}, true},
+	}
+	for _, tt := range tests {
+		c, err := SimpleClientFactory(tt.factory, 0)()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := GetValues(c, time.Second, "FCGI_MAX_CONNS", "FCGI_MPXS_CONNS")
+		var unknown *UnknownTypeError
+		if errors.As(err, &unknown) != tt.wantUnknown || (err != nil && !tt.wantUnknown) {
+			t.Errorf("%s: GetValues() error = %v", tt.name, err)
+		}
+		if tt.wantUnknown && unknown.Type != uint8(typeGetValues) {
+			t.Errorf("%s: rejected type = %d, want %d", tt.name, unknown.Type, typeGetValues)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: GetValues() = %v, want %v", tt.name, got, tt.want)
+		}
+		// 不支持FCGI_GET_VALUES的应用程序仍然可以通过ping检查
+		if err := PingValidator(time.Second)(c); err != nil {
+			t.Errorf("%s: ping = %v", tt.name, err)
+		}
+		c.Close()
+	}
+
+	// 自动询问处理能力时按没有公布任何值处理
+	c, err := NewClientFactory(unknownTypeBackend, ClientConfig{AutoTune: true})()
+	if err != nil {
+		t.Fatalf("AutoTune with FCGI_UNKNOWN_TYPE: %v", err)
+	}
+	c.Close()
+	if _, err := GetValues(struct{ Client }{}, time.Second); err == nil {
+		t.Error("GetValues with a custom Client should fail")
+	}
+}
+
+// TestPing 测试检查连接：没有连接时先建立连接，ctx结束时返回ctx的错误并关闭连接
+func TestPing(t *testing.T) {
+	tests := []struct {
+		name    string
+		factory ConnFactory
+		timeout time.Duration
+		wantErr error
+	}{
+		{"supported", valuesBackend(nil, nil), time.Second, nil},
+		{"unknown type", unknownTypeBackend, 0, nil},
+		{"no reply", pipeConnFactory, 20 * time.Millisecond, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := SimpleClientFactoryNoConn(tt.factory, 0)()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			if err := Ping(ctx, c); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Ping() = %v, want %v", err, tt.wantErr)
+			}
+			if connUsable(c) != (tt.wantErr == nil) {
+				t.Fatalf("connection usable = %v after Ping", connUsable(c))
+			}
+		})
+	}
+	if err := Ping(context.Background(), struct{ Client }{}); err == nil {
+		t.Error("Ping with a custom Client should fail")
+	}
+}
@@ -0,0 +1,96 @@
+package ffcgiclient
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 可替换的时间和随机数来源，使过期、淘汰、抽样等逻辑可以在测试中确定地验证
+// 注意：只影响读取当前时间和生成随机数，后台协程的定时器仍使用实际时间
+
+// Clock 时间来源
+type Clock interface {
+	Now() time.Time
+}
+
+// Rand 随机数来源，*rand.Rand满足此接口
+type Rand interface {
+	Float64() float64
+	Int63n(n int64) int64
+}
+
+// systemClock 使用time.Now的Clock
+type systemClock struct{}
+
+// Now 实现Clock
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// globalRand 使用math/rand全局函数的Rand
+type globalRand struct{}
+
+// Float64 实现Rand
+func (globalRand) Float64() float64 {
+	return rand.Float64()
+}
+
+// Int63n 实现Rand
+func (globalRand) Int63n(n int64) int64 {
+	return rand.Int63n(n)
+}
+
+// 默认的时间和随机数来源
+var (
+	SystemClock Clock = systemClock{}
+	GlobalRand  Rand  = globalRand{}
+)
+
+// clockOr 返回c，为nil时返回SystemClock
+func clockOr(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+	return c
+}
+
+// randOr 返回r，为nil时返回GlobalRand
+func randOr(r Rand) Rand {
+	if r == nil {
+		return GlobalRand
+	}
+	return r
+}
+
+// ManualClock 手动控制的Clock，用于测试
+type ManualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewManualClock 创建从now开始的ManualClock
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now 实现Clock
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance 将时间向后推移d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set 将时间设置为t
+func (c *ManualClock) Set(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = t
+}
@@ -0,0 +1,404 @@
+// fcgibench 直接以FastCGI协议对应用程序（php-fpm等）做压力测试，类似ab、wrk，不经过Web服务器
+//
+//	fcgibench -connect 127.0.0.1:9000 -c 50 -d 30s /srv/www/index.php
+//	fcgibench -connect /run/php-fpm.sock -n 10000 -method POST -data 'a=1' /srv/www/form.php
+//
+// 结束后输出吞吐量、延迟的百分位数，以及按状态码、协议状态和错误类型的统计
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ffcgiclient "suilz/ffcgi-client"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// paramFlags 可重复的-param NAME=VALUE参数
+type paramFlags [][2]string
+
+// String 实现flag.Value
+func (p *paramFlags) String() string {
+	var s []string
+	for _, kv := range *p {
+		s = append(s, kv[0]+"="+kv[1])
+	}
+	return strings.Join(s, ",")
+}
+
+// Set 实现flag.Value
+func (p *paramFlags) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("param %q is not NAME=VALUE", v)
+	}
+	*p = append(*p, [2]string{name, value})
+	return nil
+}
+
+// config 一次压力测试的配置
+type config struct {
+	connFactory ffcgiclient.ConnFactory
+	params      *ffcgiclient.Params
+	body        []byte
+	concurrency int
+	duration    time.Duration
+	requests    int64
+	timeout     time.Duration
+}
+
+// run 解析参数、执行压力测试并输出报告，返回退出码
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("fcgibench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	connect := fs.String("connect", "", "FastCGI `address`: host:port, or a unix socket path")
+	concurrency := fs.Int("c", 10, "number of concurrent workers, each with its own connection")
+	duration := fs.Duration("d", 10*time.Second, "test duration, ignored when -n is set")
+	requests := fs.Int64("n", 0, "total number of requests, 0 to run for -d")
+	timeout := fs.Duration("timeout", 10*time.Second, "per-request timeout, 0 for no limit")
+	method := fs.String("method", "GET", "REQUEST_METHOD")
+	query := fs.String("query", "", "QUERY_STRING")
+	data := fs.String("data", "", "request body")
+	var params paramFlags
+	fs.Var(&params, "param", "extra FastCGI param `NAME=VALUE`, overrides the defaults; may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: fcgibench -connect address [flags] script-filename")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *connect == "" || fs.NArg() != 1 || *concurrency <= 0 {
+		fs.Usage()
+		return 2
+	}
+	network := "tcp"
+	if strings.Contains(*connect, "/") {
+		network = "unix"
+	}
+	cfg := config{
+		connFactory: ffcgiclient.SimpleConnFactory(network, *connect),
+		params:      requestParams(fs.Arg(0), *method, *query, len(*data), params),
+		body:        []byte(*data),
+		concurrency: *concurrency,
+		duration:    *duration,
+		requests:    *requests,
+		timeout:     *timeout,
+	}
+	fmt.Fprintf(stdout, "Benchmarking %s %s with %d workers\n", *connect, fs.Arg(0), cfg.concurrency)
+	benchmark(cfg).report(stdout)
+	return 0
+}
+
+// requestParams 返回每个请求的参数
+func requestParams(script, method, query string, contentLength int, extra paramFlags) *ffcgiclient.Params {
+	name := "/" + path.Base(script)
+	uri := name
+	if query != "" {
+		uri += "?" + query
+	}
+	p := ffcgiclient.NewParams()
+	p.Set("GATEWAY_INTERFACE", "CGI/1.1")
+	p.Set("SERVER_SOFTWARE", "fcgibench")
+	p.Set("SERVER_PROTOCOL", "HTTP/1.1")
+	p.Set("SERVER_NAME", "localhost")
+	p.Set("SERVER_PORT", "80")
+	p.Set("REMOTE_ADDR", "127.0.0.1")
+	p.Set("REQUEST_METHOD", strings.ToUpper(method))
+	p.Set("REQUEST_URI", uri)
+	p.Set("QUERY_STRING", query)
+	p.Set("DOCUMENT_ROOT", path.Dir(script))
+	p.Set("SCRIPT_FILENAME", script)
+	p.Set("SCRIPT_NAME", name)
+	p.Set("HTTP_HOST", "localhost")
+	if contentLength > 0 {
+		p.Set("CONTENT_LENGTH", strconv.Itoa(contentLength))
+		p.Set("CONTENT_TYPE", "application/x-www-form-urlencoded")
+	}
+	for _, kv := range extra {
+		p.Set(kv[0], kv[1])
+	}
+	return p
+}
+
+// result 压力测试的结果
+type result struct {
+	elapsed   time.Duration
+	latencies []time.Duration  // 所有请求的延迟，包括失败的请求
+	bytes     int64            // 响应体的总字节数
+	status    map[int]int      // 成功请求的HTTP状态码
+	protocol  map[string]int   // 被应用程序拒绝的请求，按协议状态
+	errors    map[string]int   // 其他错误，按类型
+	workers   []*workerResult  // 每个worker的结果
+	started   int64            // 已开始的请求数，-n时使用
+	sample    map[string]error // 每类错误的一个例子
+}
+
+// workerResult 一个worker的结果，结束后合并
+type workerResult struct {
+	latencies []time.Duration
+	bytes     int64
+	status    map[int]int
+	errors    map[string]error
+	counts    map[string]int
+}
+
+// benchmark 按cfg执行压力测试
+func benchmark(cfg config) *result {
+	ctx := context.Background()
+	var cancel context.CancelFunc = func() {}
+	if cfg.requests <= 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.duration)
+	}
+	defer cancel()
+	res := &result{}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < cfg.concurrency; i++ {
+		w := &workerResult{status: make(map[int]int), errors: make(map[string]error), counts: make(map[string]int)}
+		res.workers = append(res.workers, w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res.work(ctx, cfg, w)
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	res.merge()
+	return res
+}
+
+// work 一个worker按顺序发送请求，出错后重新建立连接
+func (res *result) work(ctx context.Context, cfg config, w *workerResult) {
+	var c ffcgiclient.Client
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+	for ctx.Err() == nil {
+		if cfg.requests > 0 && atomic.AddInt64(&res.started, 1) > cfg.requests {
+			return
+		}
+		start := time.Now()
+		// 测试时间结束时不中断正在进行的请求
+		status, n, err := do(cfg, &c)
+		w.latencies = append(w.latencies, time.Since(start))
+		w.bytes += n
+		if err != nil {
+			kind := errorKind(err)
+			w.counts[kind]++
+			if w.errors[kind] == nil {
+				w.errors[kind] = err
+			}
+			if c != nil {
+				c.Close()
+				c = nil
+			}
+			continue
+		}
+		w.status[status]++
+	}
+}
+
+// do 发送一个请求，返回状态码和响应体的字节数
+func do(cfg config, c *ffcgiclient.Client) (int, int64, error) {
+	if *c == nil {
+		cl, err := ffcgiclient.SimpleClientFactory(cfg.connFactory, 0)()
+		if err != nil {
+			return 0, 0, err
+		}
+		*c = cl
+	}
+	ctx := context.Background()
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+	req := ffcgiclient.NewRequest(nil).WithContext(ctx)
+	req.Params = cfg.params.Clone()
+	req.Stdin = io.NopCloser(bytes.NewReader(cfg.body))
+	resp, err := (*c).Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	w := &countingWriter{header: make(http.Header)}
+	err = resp.WriteTo(w, io.Discard)
+	if rerr := resp.Err(); rerr != nil {
+		err = rerr
+	}
+	return w.status, w.n, err
+}
+
+// protocolPrefix 应用程序以协议状态拒绝请求时错误类型的前缀
+const protocolPrefix = "protocol: "
+
+// errorKind 返回错误的类型，协议状态以protocolPrefix开头
+func errorKind(err error) string {
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, ffcgiclient.ErrOverloaded):
+		return protocolPrefix + "FCGI_OVERLOADED"
+	case errors.Is(err, ffcgiclient.ErrCantMultiplex):
+		return protocolPrefix + "FCGI_CANT_MPX_CONN"
+	case errors.Is(err, ffcgiclient.ErrUnknownRole):
+		return protocolPrefix + "FCGI_UNKNOWN_ROLE"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "dial"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return "connection closed"
+	}
+	return "other"
+}
+
+// merge 合并所有worker的结果，在worker都结束后调用
+func (res *result) merge() {
+	res.status = make(map[int]int)
+	res.protocol = make(map[string]int)
+	res.errors = make(map[string]int)
+	res.sample = make(map[string]error)
+	for _, w := range res.workers {
+		res.latencies = append(res.latencies, w.latencies...)
+		res.bytes += w.bytes
+		for code, n := range w.status {
+			res.status[code] += n
+		}
+		for kind, n := range w.counts {
+			if strings.HasPrefix(kind, protocolPrefix) {
+				res.protocol[strings.TrimPrefix(kind, protocolPrefix)] += n
+				continue
+			}
+			res.errors[kind] += n
+			if res.sample[kind] == nil {
+				res.sample[kind] = w.errors[kind]
+			}
+		}
+	}
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+}
+
+// percentile 返回已排序的延迟中的第p百分位数
+func (res *result) percentile(p float64) time.Duration {
+	if len(res.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(res.latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(res.latencies) {
+		i = len(res.latencies) - 1
+	}
+	return res.latencies[i]
+}
+
+// report 输出结果
+func (res *result) report(w io.Writer) {
+	total := len(res.latencies)
+	failed := 0
+	for _, n := range res.protocol {
+		failed += n
+	}
+	for _, n := range res.errors {
+		failed += n
+	}
+	seconds := res.elapsed.Seconds()
+	fmt.Fprintf(w, "\nRequests:      %d (%d failed)\n", total, failed)
+	fmt.Fprintf(w, "Duration:      %s\n", res.elapsed.Round(time.Millisecond))
+	if seconds > 0 {
+		fmt.Fprintf(w, "Throughput:    %.1f req/s, %.1f KB/s\n", float64(total)/seconds, float64(res.bytes)/1024/seconds)
+	}
+	if total > 0 {
+		var sum time.Duration
+		for _, d := range res.latencies {
+			sum += d
+		}
+		fmt.Fprintf(w, "\nLatency:\n")
+		fmt.Fprintf(w, "  min   %s\n", res.latencies[0])
+		fmt.Fprintf(w, "  mean  %s\n", sum/time.Duration(total))
+		for _, p := range []float64{50, 90, 95, 99} {
+			fmt.Fprintf(w, "  p%-4g %s\n", p, res.percentile(p))
+		}
+		fmt.Fprintf(w, "  max   %s\n", res.latencies[total-1])
+	}
+	if len(res.status) > 0 {
+		fmt.Fprintf(w, "\nStatus codes:\n")
+		codes := make([]int, 0, len(res.status))
+		for code := range res.status {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "  %d: %d\n", code, res.status[code])
+		}
+	}
+	if len(res.protocol) > 0 {
+		fmt.Fprintf(w, "\nProtocol status:\n")
+		for _, status := range sortedKeys(res.protocol) {
+			fmt.Fprintf(w, "  %s: %d\n", status, res.protocol[status])
+		}
+	}
+	if len(res.errors) > 0 {
+		fmt.Fprintf(w, "\nErrors:\n")
+		for _, kind := range sortedKeys(res.errors) {
+			fmt.Fprintf(w, "  %s: %d (e.g. %v)\n", kind, res.errors[kind], res.sample[kind])
+		}
+	}
+}
+
+// sortedKeys 返回排序后的键
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// countingWriter 丢弃响应，只记录状态码和响应体的字节数
+type countingWriter struct {
+	header http.Header
+	status int
+	n      int64
+}
+
+// Header 实现http.ResponseWriter
+func (w *countingWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader 实现http.ResponseWriter
+func (w *countingWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+// Write 实现http.ResponseWriter
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.n += int64(len(p))
+	return len(p), nil
+}
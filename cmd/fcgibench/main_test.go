@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"suilz/ffcgi-client/fcgiproto"
+	"suilz/ffcgi-client/fcgitest"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  func(req *fcgitest.Request) fcgitest.Response
+		args     []string
+		wantCode int
+		want     []string
+	}{
+		{
+			name: "fixed number of requests",
+			handler: func(req *fcgitest.Request) fcgitest.Response {
+				return fcgitest.Response{Body: []string{req.Params["REQUEST_METHOD"]}}
+			},
+			args: []string{"-n", "20", "-c", "4", "-method", "post", "-data", "a=1"},
+			want: []string{"Requests:      20 (0 failed)", "Status codes:\n  200: 20\n", "p99"},
+		},
+		{
+			name: "status codes and protocol status",
+			handler: fcgitest.Script(
+				fcgitest.Response{Status: http.StatusNotFound},
+				fcgitest.Response{ProtocolStatus: fcgiproto.StatusOverloaded},
+			),
+			args: []string{"-n", "5", "-c", "1"},
+			want: []string{"(4 failed)", "  404: 1\n", "Protocol status:\n  FCGI_OVERLOADED: 4\n"},
+		},
+		{
+			name: "duration",
+			args: []string{"-d", "50ms", "-c", "2"},
+			want: []string{"Status codes:\n  200: "},
+		},
+		{
+			name:     "missing script",
+			args:     []string{"-n", "1"},
+			wantCode: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := fcgitest.NewServer(tt.handler)
+			defer backend.Close()
+			addr, err := backend.Listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := append([]string{"-connect", addr}, tt.args...)
+			if tt.wantCode == 0 {
+				args = append(args, "/srv/www/index.php")
+			}
+			var stdout, stderr bytes.Buffer
+			if code := run(args, &stdout, &stderr); code != tt.wantCode {
+				t.Fatalf("exit code = %d, want %d; stderr: %s", code, tt.wantCode, stderr.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(stdout.String(), want) {
+					t.Errorf("report does not contain %q:\n%s", want, stdout.String())
+				}
+			}
+		})
+	}
+}
+
+// TestRunDialError 测试连接失败按错误类型统计
+func TestRunDialError(t *testing.T) {
+	var stdout bytes.Buffer
+	run([]string{"-connect", "127.0.0.1:1", "-n", "2", "-c", "1", "/x.php"}, &stdout, &bytes.Buffer{})
+	if !strings.Contains(stdout.String(), "Errors:\n  dial: 2") {
+		t.Fatalf("report:\n%s", stdout.String())
+	}
+}
@@ -0,0 +1,222 @@
+// ffcgi-gateway 可直接运行的PHP网关：HTTP服务器通过FastCGI把请求转发给php-fpm，不需要编写Go代码
+//
+//	ffcgi-gateway -listen :8080 -root /srv/www -backend 127.0.0.1:9000
+//	ffcgi-gateway -listen :8080 -root /srv/app/public -index index.php -backend /run/php-fpm.sock -pool 32 -timeout 30s
+//	ffcgi-gateway -listen :8080 -config gateway.json
+//
+// 配置文件的格式见ffcgiclient.Config，使用配置文件时不能再指定路由相关的参数；
+// 启动前检查后端和文档根目录（-check只检查不启动），收到SIGINT或SIGTERM时等待正在处理的请求结束后退出
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	ffcgiclient "suilz/ffcgi-client"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stderr))
+}
+
+// listFlags 可重复的参数
+type listFlags []string
+
+// String 实现flag.Value
+func (l *listFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set 实现flag.Value
+func (l *listFlags) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// options 命令行参数
+type options struct {
+	listen            string
+	config            *ffcgiclient.Config
+	readHeaderTimeout time.Duration
+	shutdownTimeout   time.Duration
+	check             bool
+	strict            bool
+}
+
+// parseFlags 解析命令行参数，由-config或路由参数得到网关配置
+func parseFlags(args []string, stderr io.Writer) (*options, error) {
+	fs := flag.NewFlagSet("ffcgi-gateway", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	opts := &options{}
+	fs.StringVar(&opts.listen, "listen", ":8080", "HTTP listen `address`")
+	configFile := fs.String("config", "", "load routes from a JSON config `file` instead of the flags below")
+	fs.DurationVar(&opts.readHeaderTimeout, "read-header-timeout", 10*time.Second, "time allowed to read request headers")
+	fs.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", 30*time.Second, "time to wait for in-flight requests on shutdown")
+	fs.BoolVar(&opts.check, "check", false, "check the backends and document roots, then exit")
+	fs.BoolVar(&opts.strict, "strict", false, "refuse to start when the startup check fails")
+
+	root := fs.String("root", "", "document root")
+	index := fs.String("index", "", "front controller (e.g. index.php) that handles every request, relative to -root")
+	var backends, params listFlags
+	fs.Var(&backends, "backend", "FastCGI backend `address`: host:port, or a unix socket path; may be repeated")
+	fs.Var(&params, "param", "extra FastCGI param `NAME=VALUE`; may be repeated")
+	pool := fs.Int("pool", 16, "maximum connections per backend")
+	idle := fs.Duration("idle-timeout", time.Minute, "close backend connections idle for this long, 0 to keep them")
+	borrow := fs.Duration("borrow-timeout", 0, "maximum wait for a free backend connection, 0 for no limit")
+	timeout := fs.Duration("timeout", 0, "abort requests running longer than this, 0 for no limit")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: ffcgi-gateway [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if *configFile != "" {
+		conflict := false
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "root", "index", "backend", "param", "pool", "idle-timeout", "borrow-timeout", "timeout":
+				conflict = true
+			}
+		})
+		if conflict {
+			return nil, errors.New("-config cannot be combined with -root, -index, -backend, -param, -pool or the pool timeouts")
+		}
+		cfg, err := ffcgiclient.LoadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.config = cfg
+		return opts, nil
+	}
+
+	route := ffcgiclient.RouteConfig{
+		Name:            "default",
+		DocRoot:         *root,
+		FrontController: *index,
+		Timeout:         ffcgiclient.Duration(*timeout),
+		Pool: ffcgiclient.PoolSettings{
+			MaxActive:     *pool,
+			IdleTimeout:   ffcgiclient.Duration(*idle),
+			BorrowTimeout: ffcgiclient.Duration(*borrow),
+		},
+	}
+	for _, addr := range backends {
+		b := ffcgiclient.BackendConfig{Network: "tcp", Address: addr}
+		if strings.Contains(addr, "/") {
+			b.Network = "unix"
+		}
+		route.Backends = append(route.Backends, b)
+	}
+	for _, kv := range params {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("param %q is not NAME=VALUE", kv)
+		}
+		if route.Params == nil {
+			route.Params = make(map[string]string)
+		}
+		route.Params[name] = value
+	}
+	opts.config = &ffcgiclient.Config{Routes: []ffcgiclient.RouteConfig{route}}
+	if err := opts.config.Validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// run 启动网关直到ctx结束，返回退出码
+func run(ctx context.Context, args []string, stderr io.Writer) int {
+	opts, err := parseFlags(args, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "ffcgi-gateway: %v\n", err)
+		return 2
+	}
+	logger := log.New(stderr, "ffcgi-gateway: ", log.LstdFlags)
+	built, err := ffcgiclient.Build(opts.config)
+	if err != nil {
+		logger.Print(err)
+		return 1
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	report := built.Gateway.Check(checkCtx)
+	cancel()
+	if opts.check {
+		fmt.Fprint(stderr, report)
+		built.Close(ctx)
+		if !report.OK() {
+			return 1
+		}
+		return 0
+	}
+	if err := report.Err(); err != nil {
+		if opts.strict {
+			logger.Print(err)
+			built.Close(ctx)
+			return 1
+		}
+		logger.Printf("warning: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", opts.listen)
+	if err != nil {
+		logger.Print(err)
+		built.Close(ctx)
+		return 1
+	}
+	if err := serve(ctx, ln, built, opts, logger); err != nil {
+		logger.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// serve 在ln上提供服务直到ctx结束，然后等待正在处理的请求结束并关闭Client池
+func serve(ctx context.Context, ln net.Listener, built *ffcgiclient.Built, opts *options, logger *log.Logger) error {
+	srv := &http.Server{
+		Handler:           built.Handler,
+		ReadHeaderTimeout: opts.readHeaderTimeout,
+		ErrorLog:          logger,
+	}
+	logger.Printf("listening on %s", ln.Addr())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+	select {
+	case err := <-errc:
+		built.Close(context.Background())
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Print("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if cerr := built.Close(shutdownCtx); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ffcgiclient "suilz/ffcgi-client"
+	"suilz/ffcgi-client/fcgitest"
+)
+
+func TestParseFlags(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "gateway.json")
+	config := `{"routes": [{"name": "site", "backends": [{"address": "127.0.0.1:9000"}], "doc_root": "/var/www"}]}`
+	if err := os.WriteFile(configFile, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+		check   func(t *testing.T, rt ffcgiclient.RouteConfig)
+	}{
+		{
+			name: "flags",
+			args: []string{"-root", "/srv/www", "-backend", "127.0.0.1:9000", "-backend", "/run/php-fpm.sock",
+				"-pool", "4", "-timeout", "30s", "-param", "APP_ENV=prod"},
+			check: func(t *testing.T, rt ffcgiclient.RouteConfig) {
+				if rt.DocRoot != "/srv/www" || rt.Pool.MaxActive != 4 || time.Duration(rt.Timeout) != 30*time.Second {
+					t.Errorf("route = %+v", rt)
+				}
+				if len(rt.Backends) != 2 || rt.Backends[0].Network != "tcp" || rt.Backends[1].Network != "unix" {
+					t.Errorf("backends = %+v", rt.Backends)
+				}
+				if rt.Params["APP_ENV"] != "prod" {
+					t.Errorf("params = %v", rt.Params)
+				}
+			},
+		},
+		{
+			name: "config file",
+			args: []string{"-config", configFile, "-listen", ":9090"},
+			check: func(t *testing.T, rt ffcgiclient.RouteConfig) {
+				if rt.Name != "site" || rt.DocRoot != "/var/www" {
+					t.Errorf("route = %+v", rt)
+				}
+			},
+		},
+		{name: "config with route flags", args: []string{"-config", configFile, "-root", "/srv"}, wantErr: true},
+		{name: "missing backend", args: []string{"-root", "/srv/www"}, wantErr: true},
+		{name: "missing root", args: []string{"-backend", "127.0.0.1:9000"}, wantErr: true},
+		{name: "bad param", args: []string{"-root", "/srv", "-backend", "a:1", "-param", "X"}, wantErr: true},
+		{name: "missing config file", args: []string{"-config", filepath.Join(dir, "none.json")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseFlags(tt.args, io.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFlags() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				tt.check(t, opts.config.Routes[0])
+			}
+		})
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	backend := fcgitest.NewServer(nil)
+	defer backend.Close()
+	addr, err := backend.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"ok", []string{"-check", "-root", root, "-backend", addr}, 0},
+		{"missing root", []string{"-check", "-root", filepath.Join(root, "none"), "-backend", addr}, 1},
+		{"strict", []string{"-strict", "-root", filepath.Join(root, "none"), "-backend", addr}, 1},
+		{"usage", []string{"-backend", addr}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := run(context.Background(), tt.args, io.Discard); code != tt.want {
+				t.Fatalf("exit code = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	backend := fcgitest.NewServer(func(req *fcgitest.Request) fcgitest.Response {
+		return fcgitest.Response{Body: []string{req.Params["SCRIPT_FILENAME"]}}
+	})
+	defer backend.Close()
+	addr, err := backend.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := parseFlags([]string{"-root", "/srv/www", "-backend", addr}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, err := ffcgiclient.Build(opts.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, ln, built, opts, log.New(io.Discard, "", 0))
+	}()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/index.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "/srv/www/index.php" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("serve() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after shutdown")
+	}
+}
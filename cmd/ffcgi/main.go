@@ -0,0 +1,208 @@
+// ffcgi 向FastCGI应用程序（php-fpm等）发送一个请求，输出响应头、响应体和stderr，用于排查部署问题，可代替cgi-fcgi
+//
+//	ffcgi -connect 127.0.0.1:9000 /srv/www/index.php
+//	ffcgi -connect /run/php-fpm.sock -method POST -data-file body.json -param CONTENT_TYPE=application/json /srv/www/api.php
+//	echo 'a=1' | ffcgi -connect 127.0.0.1:9000 -method POST -data-file - -query debug=1 /srv/www/form.php
+//
+// 响应头和响应体写入标准输出，应用程序的stderr写入标准错误；传输或协议错误时退出码为1，参数错误时为2
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	ffcgiclient "suilz/ffcgi-client"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// paramFlags 可重复的-param NAME=VALUE参数
+type paramFlags [][2]string
+
+// String 实现flag.Value
+func (p *paramFlags) String() string {
+	var s []string
+	for _, kv := range *p {
+		s = append(s, kv[0]+"="+kv[1])
+	}
+	return strings.Join(s, ",")
+}
+
+// Set 实现flag.Value
+func (p *paramFlags) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("param %q is not NAME=VALUE", v)
+	}
+	*p = append(*p, [2]string{name, value})
+	return nil
+}
+
+// run 解析参数并发送请求，返回退出码
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("ffcgi", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	connect := fs.String("connect", "", "FastCGI `address`: host:port, or a unix socket path")
+	method := fs.String("method", "GET", "REQUEST_METHOD")
+	query := fs.String("query", "", "QUERY_STRING")
+	uri := fs.String("uri", "", "REQUEST_URI, defaults to the script name plus the query string")
+	docRoot := fs.String("root", "", "DOCUMENT_ROOT, defaults to the directory of the script")
+	data := fs.String("data", "", "request body")
+	dataFile := fs.String("data-file", "", "read the request body from `file`, - for standard input")
+	timeout := fs.Duration("timeout", 30*time.Second, "abort the request after this long, 0 for no limit")
+	bodyOnly := fs.Bool("body-only", false, "do not print the response headers")
+	var params paramFlags
+	fs.Var(&params, "param", "extra FastCGI param `NAME=VALUE`, overrides the defaults; may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: ffcgi -connect address [flags] script-filename")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *connect == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	script := fs.Arg(0)
+
+	var body []byte
+	var err error
+	switch {
+	case *dataFile == "-":
+		body, err = io.ReadAll(stdin)
+	case *dataFile != "":
+		body, err = os.ReadFile(*dataFile)
+	default:
+		body = []byte(*data)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "ffcgi: %v\n", err)
+		return 1
+	}
+
+	req := ffcgiclient.NewRequest(nil)
+	for _, kv := range defaultParams(script, *method, *query, *uri, *docRoot, len(body)) {
+		req.Params.Set(kv[0], kv[1])
+	}
+	for _, kv := range params {
+		req.Params.Set(kv[0], kv[1])
+	}
+	req.Stdin = io.NopCloser(bytes.NewReader(body))
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	req = req.WithContext(ctx)
+
+	network := "tcp"
+	if strings.Contains(*connect, "/") {
+		network = "unix"
+	}
+	c, err := ffcgiclient.SimpleClientFactory(ffcgiclient.SimpleConnFactory(network, *connect), 0)()
+	if err != nil {
+		fmt.Fprintf(stderr, "ffcgi: %v\n", err)
+		return 1
+	}
+	defer c.Close()
+	resp, err := c.Do(req)
+	if err != nil {
+		fmt.Fprintf(stderr, "ffcgi: %v\n", err)
+		return 1
+	}
+	w := &responseWriter{w: stdout, header: make(http.Header), bodyOnly: *bodyOnly}
+	err = resp.WriteTo(w, stderr)
+	if rerr := resp.Err(); rerr != nil {
+		err = rerr
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "ffcgi: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// defaultParams 返回一个CGI请求的基本参数
+func defaultParams(script, method, query, uri, docRoot string, contentLength int) [][2]string {
+	name := "/" + path.Base(script)
+	if docRoot == "" {
+		docRoot = path.Dir(script)
+	} else if rel := strings.TrimPrefix(script, strings.TrimSuffix(docRoot, "/")); rel != script {
+		name = rel
+	}
+	if uri == "" {
+		uri = name
+		if query != "" {
+			uri += "?" + query
+		}
+	}
+	params := [][2]string{
+		{"GATEWAY_INTERFACE", "CGI/1.1"},
+		{"SERVER_SOFTWARE", "ffcgi"},
+		{"SERVER_PROTOCOL", "HTTP/1.1"},
+		{"SERVER_NAME", "localhost"},
+		{"SERVER_ADDR", "127.0.0.1"},
+		{"SERVER_PORT", "80"},
+		{"REMOTE_ADDR", "127.0.0.1"},
+		{"REMOTE_PORT", "0"},
+		{"REQUEST_METHOD", strings.ToUpper(method)},
+		{"REQUEST_URI", uri},
+		{"QUERY_STRING", query},
+		{"DOCUMENT_ROOT", docRoot},
+		{"SCRIPT_FILENAME", script},
+		{"SCRIPT_NAME", name},
+		{"HTTP_HOST", "localhost"},
+	}
+	if contentLength > 0 {
+		params = append(params,
+			[2]string{"CONTENT_LENGTH", strconv.Itoa(contentLength)},
+			[2]string{"CONTENT_TYPE", "application/x-www-form-urlencoded"})
+	}
+	return params
+}
+
+// responseWriter 以CGI格式（Status行、响应头、空行）把响应写到终端
+type responseWriter struct {
+	w           io.Writer
+	header      http.Header
+	bodyOnly    bool
+	wroteHeader bool
+}
+
+// Header 实现http.ResponseWriter
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader 实现http.ResponseWriter
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.bodyOnly {
+		return
+	}
+	fmt.Fprintf(w.w, "Status: %d %s\r\n", code, http.StatusText(code))
+	w.header.Write(w.w)
+	io.WriteString(w.w, "\r\n")
+}
+
+// Write 实现http.ResponseWriter
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.w.Write(p)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"suilz/ffcgi-client/fcgitest"
+)
+
+func TestRun(t *testing.T) {
+	backend := fcgitest.NewServer(func(req *fcgitest.Request) fcgitest.Response {
+		return fcgitest.Response{
+			Status: http.StatusCreated,
+			Header: http.Header{"X-Script": {req.Params["SCRIPT_NAME"]}},
+			Body:   []string{req.Params["REQUEST_METHOD"], " ", req.Params["REQUEST_URI"], " ", string(req.Stdin)},
+			Stderr: "notice",
+		}
+	})
+	defer backend.Close()
+	addr, err := backend.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		stdin      string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{
+		{
+			name:       "get",
+			args:       []string{"-connect", addr, "-query", "a=1", "/srv/www/index.php"},
+			wantStdout: "Status: 201 Created\r\nContent-Type: text/html\r\nX-Script: /index.php\r\n\r\nGET /index.php?a=1 ",
+			wantStderr: "notice",
+		},
+		{
+			name:       "post from stdin",
+			args:       []string{"-connect", addr, "-method", "post", "-data-file", "-", "-root", "/srv", "-body-only", "/srv/www/form.php"},
+			stdin:      "a=1",
+			wantStdout: "POST /www/form.php a=1",
+			wantStderr: "notice",
+		},
+		{
+			name:       "param overrides default",
+			args:       []string{"-connect", addr, "-param", "REQUEST_URI=/custom", "-body-only", "-data", "x", "/srv/index.php"},
+			wantStdout: "GET /custom x",
+			wantStderr: "notice",
+		},
+		{
+			name:     "missing script",
+			args:     []string{"-connect", addr},
+			wantCode: 2,
+		},
+		{
+			name:     "bad param",
+			args:     []string{"-connect", addr, "-param", "NOVALUE", "/srv/index.php"},
+			wantCode: 2,
+		},
+		{
+			name:     "connection refused",
+			args:     []string{"-connect", "127.0.0.1:1", "/srv/index.php"},
+			wantCode: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Fatalf("exit code = %d, want %d; stderr: %s", code, tt.wantCode, stderr.String())
+			}
+			if code != 0 {
+				return
+			}
+			if stdout.String() != tt.wantStdout {
+				t.Errorf("stdout = %q, want %q", stdout.String(), tt.wantStdout)
+			}
+			if stderr.String() != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+}
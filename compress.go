@@ -0,0 +1,233 @@
+package ffcgiclient
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 按客户端的Accept-Encoding压缩应用程序的响应体
+// 只使用标准库，内置gzip和deflate，br等其他编码通过RegisterEncoder注册
+
+// DefaultCompressTypes 默认压缩的MIME类型
+var DefaultCompressTypes = []string{
+	"text/html",
+	"text/plain",
+	"text/css",
+	"text/xml",
+	"text/javascript",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// Encoder 创建压缩写入w的io.WriteCloser，level为Compress.Level，为0时使用编码的默认级别
+// Close需要写入剩余的压缩数据，但不关闭w
+type Encoder func(w io.Writer, level int) (io.WriteCloser, error)
+
+// builtinEncoders 内置的编码，按优先级排列
+var builtinEncoders = []string{"gzip", "deflate"}
+
+// DefaultCompressMinSize 默认压缩的最小响应体字节数
+const DefaultCompressMinSize = 1024
+
+// Compress 压缩响应体的配置
+// 应用程序已设置Content-Encoding、状态码为204/304或响应体小于MinSize时不压缩
+type Compress struct {
+
+	// Types 压缩的MIME类型，为空时使用DefaultCompressTypes
+	Types []string
+
+	// MinSize 压缩的最小响应体字节数，为0时使用DefaultCompressMinSize
+	// 没有Content-Length时读取最多MinSize字节判断
+	MinSize int
+
+	// Level 压缩级别，为0时使用默认级别
+	Level int
+
+	// encoders RegisterEncoder注册的编码，names按注册顺序排列
+	encoders map[string]Encoder
+	names    []string
+}
+
+// RegisterEncoder 注册名为name的Content-Encoding，例如使用第三方库实现的br
+// 注册的编码按注册顺序优先于内置的gzip和deflate，同名时替换原来的Encoder
+// 需要在Middleware处理请求之前注册
+func (c *Compress) RegisterEncoder(name string, enc Encoder) {
+	name = strings.ToLower(name)
+	if c.encoders == nil {
+		c.encoders = make(map[string]Encoder)
+	}
+	if _, ok := c.encoders[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.encoders[name] = enc
+}
+
+// encodings 返回按优先级排列的编码名称
+func (c *Compress) encodings() []string {
+	names := append([]string(nil), c.names...)
+	for _, name := range builtinEncoders {
+		if _, ok := c.encoders[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// encoder 返回编码对应的Encoder
+func (c *Compress) encoder(encoding string) Encoder {
+	if enc, ok := c.encoders[encoding]; ok {
+		return enc
+	}
+	if encoding == "gzip" {
+		return func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		}
+	}
+	return func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		return flate.NewWriter(w, level)
+	}
+}
+
+// Middleware 返回压缩响应体的中间件
+func (c *Compress) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			resp, err := inner(client, req)
+			if err != nil || req.Raw == nil {
+				return resp, err
+			}
+			encoding := acceptEncoding(req.Raw.Header.Get("Accept-Encoding"), c.encodings())
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+				if !c.compressible(header) {
+					return body, nil
+				}
+				header.Add("Vary", "Accept-Encoding")
+				if encoding == "" {
+					return body, nil
+				}
+				// 响应体过小时不压缩
+				min := c.MinSize
+				if min <= 0 {
+					min = DefaultCompressMinSize
+				}
+				if n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && n < int64(min) {
+					return body, nil
+				}
+				br := bufio.NewReaderSize(body, min)
+				if b, _ := br.Peek(min); len(b) < min {
+					return br, nil
+				}
+				header.Set("Content-Encoding", encoding)
+				header.Del("Content-Length")
+				// 压缩后的表示不同，强ETag改为弱ETag
+				if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+					header.Set("ETag", "W/"+etag)
+				}
+				return c.compress(br, encoding), nil
+			}), nil
+		}
+	}
+}
+
+// compressible 检查响应是否可以压缩
+func (c *Compress) compressible(header http.Header) bool {
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if status := header.Get("Status"); strings.HasPrefix(status, "204") || strings.HasPrefix(status, "304") {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	types := c.Types
+	if len(types) == 0 {
+		types = DefaultCompressTypes
+	}
+	for _, t := range types {
+		if strings.EqualFold(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// compress 返回读取r压缩后内容的io.Reader，关闭时停止压缩
+func (c *Compress) compress(r io.Reader, encoding string) io.Reader {
+	enc := c.encoder(encoding)
+	pr, pw := io.Pipe()
+	cr := &compressReader{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(cr.done)
+		zw, err := enc(pw, c.Level)
+		if err == nil {
+			if _, err = io.Copy(zw, r); err == nil {
+				err = zw.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return cr
+}
+
+// compressReader 压缩后的响应体，Close等待压缩的协程结束，之后才能继续读取原响应体
+type compressReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close 实现io.Closer
+func (cr *compressReader) Close() error {
+	cr.PipeReader.Close()
+	<-cr.done
+	return nil
+}
+
+// acceptEncoding 按Accept-Encoding从codings中选择第一个接受的编码，都不接受时返回空字符串
+func acceptEncoding(accept string, codings []string) string {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					weight = v
+				}
+			}
+		}
+		q[coding] = weight
+	}
+	for _, coding := range codings {
+		if w, ok := q[coding]; ok {
+			if w > 0 {
+				return coding
+			}
+			continue
+		}
+		if w, ok := q["*"]; ok && w > 0 {
+			return coding
+		}
+	}
+	return ""
+}
@@ -0,0 +1,126 @@
+package ffcgiclient
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                      "",
+		"gzip, deflate, br":     "gzip",
+		"deflate":               "deflate",
+		"gzip;q=0, deflate":     "deflate",
+		"*":                     "gzip",
+		"gzip;q=0, *;q=0.5":     "deflate",
+		"identity":              "",
+		"GZIP;q=0.8, br;q=1.0 ": "gzip",
+	}
+	for accept, want := range cases {
+		if got := acceptEncoding(accept, builtinEncoders); got != want {
+			t.Errorf("acceptEncoding(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	page := strings.Repeat("<p>hello</p>", 200)
+	stub := &stubClient{recorded: map[string][]byte{
+		"":    []byte("Content-Type: text/html; charset=utf-8\r\nETag: \"v1\"\r\n\r\n" + page),
+		"1":   []byte("Content-Type: text/html\r\n\r\nsmall"),
+		"png": []byte("Content-Type: image/png\r\n\r\n" + page),
+	}}
+	h := NewHandler((&Compress{}).Middleware()(BasicHandler), func() (Client, error) { return stub, nil })
+
+	cases := []struct {
+		target, accept, encoding string
+	}{
+		{"/", "gzip", "gzip"},
+		{"/", "deflate", "deflate"},
+		{"/", "", ""},
+		{"/?size=1", "gzip", ""},
+		{"/?size=png", "gzip", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.target, nil)
+		r.Header.Set("Accept-Encoding", c.accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if got := rec.Header().Get("Content-Encoding"); got != c.encoding {
+			t.Errorf("%s %q: Content-Encoding = %q, want %q", c.target, c.accept, got, c.encoding)
+			continue
+		}
+		var body io.Reader = rec.Body
+		switch c.encoding {
+		case "gzip":
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+			if rec.Header().Get("ETag") != `W/"v1"` {
+				t.Errorf("ETag = %q", rec.Header().Get("ETag"))
+			}
+		case "deflate":
+			body = flate.NewReader(rec.Body)
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.target == "/" && string(b) != page {
+			t.Errorf("%s %q: body mismatch (%d bytes)", c.target, c.accept, len(b))
+		}
+	}
+}
+
+func TestCompressRegisterEncoder(t *testing.T) {
+	page := strings.Repeat("<p>hello</p>", 200)
+	stub := &stubClient{recorded: map[string][]byte{
+		"": []byte("Content-Type: text/html\r\n\r\n" + page),
+	}}
+	c := &Compress{Level: 3}
+	var level int
+	// 用deflate代替第三方的br实现
+	c.RegisterEncoder("BR", func(w io.Writer, l int) (io.WriteCloser, error) {
+		level = l
+		return flate.NewWriter(w, l)
+	})
+	h := NewHandler(c.Middleware()(BasicHandler), func() (Client, error) { return stub, nil })
+
+	cases := []struct {
+		accept, encoding string
+	}{
+		{"gzip, deflate, br", "br"},
+		{"br;q=0, gzip", "gzip"},
+		{"*", "br"},
+		{"deflate", "deflate"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tc.accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if got := rec.Header().Get("Content-Encoding"); got != tc.encoding {
+			t.Errorf("%q: Content-Encoding = %q, want %q", tc.accept, got, tc.encoding)
+			continue
+		}
+		if tc.encoding != "br" {
+			continue
+		}
+		b, err := io.ReadAll(flate.NewReader(rec.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != page {
+			t.Errorf("%q: body mismatch (%d bytes)", tc.accept, len(b))
+		}
+		if level != 3 {
+			t.Errorf("encoder level = %d, want 3", level)
+		}
+	}
+}
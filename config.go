@@ -0,0 +1,270 @@
+package ffcgiclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// 由配置文件组装网关，修改后端、池、文档根目录、路由、超时和额外的FastCGI参数不需要重新编译
+// 配置文件使用JSON格式（只依赖标准库），YAML/TOML可以先转换为JSON再加载
+
+// Config 网关配置
+type Config struct {
+	Routes []RouteConfig `json:"routes"`
+}
+
+// RouteConfig 一条路由的配置
+type RouteConfig struct {
+
+	// Name 路由名称，用于自检报告和日志
+	Name string `json:"name"`
+
+	// Pattern 路由匹配的主机名和路径前缀，格式同Router.Handle，默认"/"
+	Pattern string `json:"pattern"`
+
+	// Backends 处理请求的后端，多个后端之间轮询
+	Backends []BackendConfig `json:"backends"`
+
+	// DocRoot 文档根目录
+	DocRoot string `json:"doc_root"`
+
+	// FrontController 入口文件（例如index.php），相对路径基于DocRoot，为空表示按文件系统路由
+	FrontController string `json:"front_controller"`
+
+	// DirListing 目录中没有index.php时生成目录列表，只在按文件系统路由时有效
+	DirListing bool `json:"dir_listing"`
+
+	// Params 额外的FastCGI参数，覆盖映射得到的同名参数
+	Params map[string]string `json:"params"`
+
+	// Rewrite 在参数映射之前按顺序执行的重写规则
+	Rewrite []RewriteRule `json:"rewrite"`
+
+	// Timeout 请求的超时时间，超时后终止FastCGI请求，0表示不限制
+	Timeout Duration `json:"timeout"`
+
+	// Pool 每个后端的Client池的配置
+	Pool PoolSettings `json:"pool"`
+}
+
+// BackendConfig 后端的配置
+type BackendConfig struct {
+	Network string `json:"network"` // tcp或unix，默认tcp
+	Address string `json:"address"`
+}
+
+// PoolSettings Client池的配置，对应PoolConfig
+type PoolSettings struct {
+	MaxActive     int      `json:"max_active"`
+	MinIdle       int      `json:"min_idle"`
+	MaxIdle       int      `json:"max_idle"`
+	IdleTimeout   Duration `json:"idle_timeout"`
+	Expires       Duration `json:"expires"`
+	BorrowTimeout Duration `json:"borrow_timeout"`
+}
+
+// Duration 以"5s"、"1m30s"等字符串表示的时间，也接受以纳秒为单位的数字
+type Duration time.Duration
+
+// UnmarshalJSON 实现json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v)
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+// MarshalJSON 实现json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig 读取JSON格式的配置文件
+func LoadConfig(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := ParseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig 解析JSON格式的配置，不允许未知的字段
+func ParseConfig(r io.Reader) (*Config, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	cfg := new(Config)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate 检查配置是否完整
+func (cfg *Config) Validate() error {
+	if len(cfg.Routes) == 0 {
+		return errors.New("config: no routes")
+	}
+	patterns := make(map[string]bool)
+	for i, rt := range cfg.Routes {
+		name := rt.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		pattern := rt.pattern()
+		if patterns[pattern] {
+			return fmt.Errorf("config: route %s: duplicate pattern %q", name, pattern)
+		}
+		patterns[pattern] = true
+		if len(rt.Backends) == 0 {
+			return fmt.Errorf("config: route %s: no backends", name)
+		}
+		for _, b := range rt.Backends {
+			if b.Address == "" {
+				return fmt.Errorf("config: route %s: backend without address", name)
+			}
+			if network := b.network(); network != "tcp" && network != "unix" {
+				return fmt.Errorf("config: route %s: unsupported network %q", name, network)
+			}
+		}
+		if rt.FrontController == "" && rt.DocRoot == "" {
+			return fmt.Errorf("config: route %s: doc_root or front_controller is required", name)
+		}
+		if _, err := NewRewriter(rt.Rewrite); err != nil {
+			return fmt.Errorf("config: route %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// pattern 返回路由的匹配模式
+func (rt *RouteConfig) pattern() string {
+	if rt.Pattern == "" {
+		return "/"
+	}
+	return rt.Pattern
+}
+
+// network 返回后端的网络类型
+func (b *BackendConfig) network() string {
+	if b.Network == "" {
+		return "tcp"
+	}
+	return b.Network
+}
+
+// Built Build组装的网关
+type Built struct {
+
+	// Handler 分发请求的http.Handler
+	Handler http.Handler
+
+	// Router 与Handler相同，可以继续添加路由
+	Router *Router
+
+	// Gateway 用于启动前自检
+	Gateway *Gateway
+
+	pools []*PoolSet
+}
+
+// Close 关闭所有的Client池，返回第一个错误
+func (b *Built) Close(ctx context.Context) (err error) {
+	for _, pools := range b.pools {
+		if cerr := pools.Close(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return
+}
+
+// Build 按配置组装网关，每条路由使用独立的Client池
+func Build(cfg *Config) (*Built, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	built := &Built{Router: &Router{}, Gateway: &Gateway{}}
+	built.Handler = built.Router
+	for _, rc := range cfg.Routes {
+		rc := rc
+		route := &Route{Name: rc.Name, DocRoot: rc.DocRoot, FrontController: rc.FrontController}
+		for _, bc := range rc.Backends {
+			route.Backends = append(route.Backends, &Backend{Network: bc.network(), Address: bc.Address})
+		}
+		built.Gateway.Routes = append(built.Gateway.Routes, route)
+
+		pools := NewPoolSet(PoolConfig{
+			MaxActive:   rc.Pool.MaxActive,
+			MinIdle:     rc.Pool.MinIdle,
+			MaxIdle:     rc.Pool.MaxIdle,
+			IdleTimeout: time.Duration(rc.Pool.IdleTimeout),
+			Expires:     time.Duration(rc.Pool.Expires),
+		}, 0)
+		pools.SetBorrowTimeout(time.Duration(rc.Pool.BorrowTimeout))
+		built.pools = append(built.pools, pools)
+		route.Pools = pools
+
+		var middlewares []Middleware
+		if len(rc.Rewrite) > 0 {
+			rw, err := NewRewriter(rc.Rewrite)
+			if err != nil {
+				return nil, err
+			}
+			middlewares = append(middlewares, rw.Middleware())
+		}
+		if fc := route.frontController(); fc != "" {
+			middlewares = append(middlewares, NewFileEndpoint(fc))
+		} else if rc.DirListing {
+			fs := &FileSystemRouter{DocRoot: rc.DocRoot, Exts: []string{"php"}, DirIndex: []string{"index.php"}, Listing: &DirListing{}}
+			middlewares = append(middlewares, BasicParamsMapMiddleware, MapHeaderMiddleware, fs.Router())
+		} else {
+			middlewares = append(middlewares, NewPHPFS(rc.DocRoot))
+		}
+		if len(rc.Params) > 0 {
+			middlewares = append(middlewares, (&ParamsFilter{Set: rc.Params}).Middleware())
+		}
+		if rc.Timeout > 0 {
+			middlewares = append(middlewares, requestTimeout(time.Duration(rc.Timeout)))
+		}
+		built.Router.Handle(rc.pattern(), Chain(middlewares...)(BasicHandler), pools.ClientFactory(route.Backends...))
+	}
+	return built, nil
+}
+
+// requestTimeout 返回限制请求时间的中间件，超时后client发送FCGI_ABORT_REQUEST
+func requestTimeout(timeout time.Duration) Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			ctx, cancel := context.WithTimeout(req.Context(), timeout)
+			// 超时或请求的上下文结束时释放
+			go func() {
+				<-ctx.Done()
+				cancel()
+			}()
+			return inner(client, req.WithContext(ctx))
+		}
+	}
+}
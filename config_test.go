@@ -0,0 +1,97 @@
+package ffcgiclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig(strings.NewReader(`{"routes": [{
+		"name": "site",
+		"backends": [{"address": "127.0.0.1:9000"}],
+		"doc_root": "/var/www",
+		"dir_listing": true,
+		"timeout": "30s",
+		"pool": {"max_active": 4, "idle_timeout": 1000000000}
+	}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := cfg.Routes[0]
+	if time.Duration(rt.Timeout) != 30*time.Second || time.Duration(rt.Pool.IdleTimeout) != time.Second || rt.Pool.MaxActive != 4 || !rt.DirListing {
+		t.Fatalf("parsed %+v", rt)
+	}
+
+	invalid := []string{
+		`{"routes": []}`,
+		`{"routes": [{"doc_root": "/var/www"}]}`,
+		`{"routes": [{"backends": [{"address": "a"}]}]}`,
+		`{"routes": [{"backends": [{"network": "udp", "address": "a"}], "doc_root": "/"}]}`,
+		`{"routes": [{"backends": [{"address": "a"}], "doc_root": "/", "timeout": "soon"}]}`,
+		`{"routes": [{"backends": [{"address": "a"}], "doc_root": "/", "unknown": 1}]}`,
+		`{"routes": [{"backends": [{"address": "a"}], "doc_root": "/", "rewrite": [{"match": "("}]}]}`,
+		`{"routes": [{"backends": [{"address": "a"}], "doc_root": "/"}, {"backends": [{"address": "b"}], "doc_root": "/"}]}`,
+	}
+	for _, s := range invalid {
+		if _, err := ParseConfig(strings.NewReader(s)); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	a, b := docRootBackend(t, "a"), docRootBackend(t, "b")
+	cfg, err := ParseConfig(strings.NewReader(fmt.Sprintf(`{"routes": [
+		{"name": "main", "backends": [{"address": %q}], "doc_root": "/srv/main",
+		 "rewrite": [{"match": "^/old$", "replace": "/index.php", "redirect": 301}]},
+		{"name": "api", "pattern": "/api/", "backends": [{"address": %q}], "doc_root": "/srv/api",
+		 "params": {"DOCUMENT_ROOT": "/override"}, "timeout": "5s", "pool": {"borrow_timeout": "1s"}}
+	]}`, a.Address, b.Address)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, err := Build(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer built.Close(context.Background())
+	if len(built.Gateway.Routes) != 2 || built.Gateway.Routes[1].Backends[0].Address != b.Address {
+		t.Fatalf("gateway routes = %+v", built.Gateway.Routes)
+	}
+
+	cases := map[string]string{
+		"/index.php":     "a /srv/main",
+		"/api/index.php": "b /override",
+		"/old":           "Moved Permanently\n",
+	}
+	for target, want := range cases {
+		rec := httptest.NewRecorder()
+		built.Handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Body.String() != want {
+			t.Errorf("%s: got %q (status %d), want %q", target, rec.Body.String(), rec.Code, want)
+		}
+	}
+}
+
+// TestRequestTimeout 测试路由的超时作用于Request.Context()，没有原始请求时同样生效
+func TestRequestTimeout(t *testing.T) {
+	for _, req := range []*Request{
+		NewRequest(httptest.NewRequest("GET", "/", nil)).WithContext(context.Background()),
+		NewRequest(nil),
+	} {
+		client := &contextClient{}
+		resp, err := requestTimeout(time.Minute)(BasicHandler)(client, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.WriteTo(httptest.NewRecorder(), io.Discard)
+		if _, ok := client.ctx.Deadline(); !ok {
+			t.Fatal("timeout not applied to the request context")
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package ffcgiclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 进程内所有client的实时计数和最近的错误，用于生产环境中的快速排查，不需要部署完整的监控系统
+//
+//	mux.Handle("/debug/ffcgi", ffcgiclient.DebugHandler(pools))
+//
+// 也可以发布到expvar：
+//
+//	expvar.Publish("ffcgi", expvar.Func(func() any { return ffcgiclient.ReadDebugStats() }))
+
+// maxRecentErrors 保留的最近错误数
+const maxRecentErrors = 20
+
+// debugCounters 进程内的全局计数，原子操作
+var debugCounters struct {
+	connections int64 // 打开的连接数
+	inFlight    int64 // 正在处理的请求数
+	requestIDs  int64 // 已分配的请求ID数
+	requests    int64 // 请求总数
+	errors      int64 // 出错的请求总数
+}
+
+// recentErrors 最近的错误，环形缓冲
+var recentErrors struct {
+	mutex sync.Mutex
+	buf   [maxRecentErrors]DebugError
+	next  int
+	count int
+}
+
+// DebugError 一次请求的传输或协议错误
+type DebugError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// DebugStats 进程内所有client的计数
+type DebugStats struct {
+	Connections  int64        `json:"connections"`   // 打开的连接数
+	InFlight     int64        `json:"in_flight"`     // 正在处理的请求数（含等待请求ID的请求）
+	RequestIDs   int64        `json:"request_ids"`   // 已分配的请求ID数
+	Requests     int64        `json:"requests"`      // 请求总数
+	Errors       int64        `json:"errors"`        // 出错的请求总数
+	RecentErrors []DebugError `json:"recent_errors"` // 最近的错误，从新到旧
+
+	// Pools 每个PoolSet中各后端的池的统计信息，仅由DebugHandler提供
+	Pools []map[string]PoolStats `json:"pools,omitempty"`
+}
+
+// recordDebugError 记录一次请求的错误
+func recordDebugError(err error) {
+	atomic.AddInt64(&debugCounters.errors, 1)
+	recentErrors.mutex.Lock()
+	defer recentErrors.mutex.Unlock()
+	recentErrors.buf[recentErrors.next] = DebugError{Time: time.Now(), Error: err.Error()}
+	recentErrors.next = (recentErrors.next + 1) % maxRecentErrors
+	if recentErrors.count < maxRecentErrors {
+		recentErrors.count++
+	}
+}
+
+// ReadDebugStats 返回进程内所有client的计数
+func ReadDebugStats() DebugStats {
+	stats := DebugStats{
+		Connections: atomic.LoadInt64(&debugCounters.connections),
+		InFlight:    atomic.LoadInt64(&debugCounters.inFlight),
+		RequestIDs:  atomic.LoadInt64(&debugCounters.requestIDs),
+		Requests:    atomic.LoadInt64(&debugCounters.requests),
+		Errors:      atomic.LoadInt64(&debugCounters.errors),
+	}
+	recentErrors.mutex.Lock()
+	defer recentErrors.mutex.Unlock()
+	stats.RecentErrors = make([]DebugError, recentErrors.count)
+	for i := range stats.RecentErrors {
+		stats.RecentErrors[i] = recentErrors.buf[(recentErrors.next-1-i+maxRecentErrors)%maxRecentErrors]
+	}
+	return stats
+}
+
+// DebugHandler 返回以JSON格式输出DebugStats的http.Handler，sets中各池的统计信息按顺序输出到Pools
+// 输出包含错误信息，不要暴露到公网
+func DebugHandler(sets ...*PoolSet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := ReadDebugStats()
+		for _, s := range sets {
+			stats.Pools = append(stats.Pools, s.Stats())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(stats)
+	})
+}
+
+// DebugHandler 返回输出所有路由的Client池的DebugHandler
+func (b *Built) DebugHandler() http.Handler {
+	return DebugHandler(b.pools...)
+}
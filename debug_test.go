@@ -0,0 +1,89 @@
+package ffcgiclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugStats(t *testing.T) {
+	before := ReadDebugStats()
+
+	// 请求处理中时计入连接、请求和请求ID
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	c, err := SimpleClientFactory(stallBackend(started, release, nil), 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	resp, err := c.Do(NewRequest(httptest.NewRequest("GET", "/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	stats := ReadDebugStats()
+	if stats.Connections < 1 || stats.InFlight < 1 || stats.RequestIDs < 1 || stats.Requests <= before.Requests {
+		t.Fatalf("during request: stats = %+v", stats)
+	}
+	close(release)
+	resp.WriteTo(httptest.NewRecorder(), io.Discard)
+
+	// 应用程序拒绝的请求记录到最近的错误
+	factory := recordBackend(func(sc *conn, reqID uint16, _ []byte) {
+		sc.writeEndRequest(reqID, 0, statusOverloaded)
+	})
+	c2, err := SimpleClientFactory(factory, 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	resp, err = c2.Do(NewRequest(httptest.NewRequest("GET", "/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.WriteTo(httptest.NewRecorder(), io.Discard)
+	stats = ReadDebugStats()
+	if stats.Errors <= before.Errors || len(stats.RecentErrors) == 0 {
+		t.Fatalf("after error: stats = %+v", stats)
+	}
+	if got, want := stats.RecentErrors[0].Error, resp.Err().Error(); got != want {
+		t.Fatalf("recent error = %q, want %q", got, want)
+	}
+}
+
+func TestRecentErrorsRing(t *testing.T) {
+	for i := 0; i < maxRecentErrors+5; i++ {
+		recordDebugError(io.ErrUnexpectedEOF)
+	}
+	recordDebugError(io.EOF)
+	stats := ReadDebugStats()
+	if len(stats.RecentErrors) != maxRecentErrors {
+		t.Fatalf("%d recent errors, want %d", len(stats.RecentErrors), maxRecentErrors)
+	}
+	if stats.RecentErrors[0].Error != io.EOF.Error() || stats.RecentErrors[1].Error != io.ErrUnexpectedEOF.Error() {
+		t.Fatalf("recent errors not newest first: %v", stats.RecentErrors[:2])
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	set := NewPoolSet(PoolConfig{MaxActive: 3}, 0)
+	defer set.Close(context.Background())
+	if _, err := set.Pool(&Backend{Network: "tcp", Address: "127.0.0.1:9000"}); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	DebugHandler(set).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/ffcgi", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var stats DebugStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Pools) != 1 || stats.Pools[0]["tcp://127.0.0.1:9000"].Max != 3 {
+		t.Fatalf("pools = %+v", stats.Pools)
+	}
+}
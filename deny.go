@@ -0,0 +1,79 @@
+package ffcgiclient
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// 禁止访问隐藏文件及敏感文件的中间件
+// 相当于nginx中常见的 location ~ /\. { deny all; } 配置
+
+// DefaultDenyPatterns 默认禁止访问的路径模式
+var DefaultDenyPatterns = []string{
+	".*",            // 隐藏文件及目录，包括.git、.env、.htaccess等
+	"composer.json", // composer依赖信息
+	"composer.lock",
+	"*.sql", // 数据库导出文件
+}
+
+// DenyRules 禁止访问的路径规则
+// 模式使用path.Match语法，与URL路径中的每一段（不区分大小写）进行匹配，任意一段匹配即返回403
+type DenyRules struct {
+
+	// Patterns 禁止访问的模式
+	Patterns []string
+
+	// Allow 例外的路径段，优先于Patterns，例如".well-known"
+	Allow []string
+}
+
+// DefaultDenyRules 返回使用DefaultDenyPatterns的规则，并允许.well-known（RFC 8615）
+// Patterns是DefaultDenyPatterns的副本，修改它不会影响其他规则
+func DefaultDenyRules() *DenyRules {
+	return &DenyRules{
+		Patterns: append([]string(nil), DefaultDenyPatterns...),
+		Allow:    []string{".well-known"},
+	}
+}
+
+// Middleware 返回一个中间件，匹配规则的请求直接返回403，不转发到后端
+func (d *DenyRules) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if d.Denied(req.Raw.URL.Path) {
+				return newStatusResponse(http.StatusForbidden), nil
+			}
+			return inner(client, req)
+		}
+	}
+}
+
+// Denied 检查URL路径是否被禁止访问
+func (d *DenyRules) Denied(urlPath string) bool {
+	for _, seg := range strings.Split(urlPath, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			continue
+		}
+		seg = strings.ToLower(seg)
+		if d.allowed(seg) {
+			continue
+		}
+		for _, pattern := range d.Patterns {
+			if ok, _ := path.Match(strings.ToLower(pattern), seg); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowed 检查路径段是否属于例外
+func (d *DenyRules) allowed(seg string) bool {
+	for _, a := range d.Allow {
+		if strings.EqualFold(a, seg) {
+			return true
+		}
+	}
+	return false
+}
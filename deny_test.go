@@ -0,0 +1,53 @@
+package ffcgiclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDenyRules(t *testing.T) {
+	d := DefaultDenyRules()
+	tests := []struct {
+		path   string
+		denied bool
+	}{
+		{"/index.php", false},
+		{"/.env", true},
+		{"/.git/config", true},
+		{"/sub/.htaccess", true},
+		{"/vendor/Composer.JSON", true},
+		{"/backup/dump.sql", true},
+		{"/dump.sql.txt", false},
+		{"/.well-known/acme-challenge/token", false},
+		{"/.well-known/.secret", true},
+		{"/a/./b/../c.php", false},
+	}
+	for _, tt := range tests {
+		if got := d.Denied(tt.path); got != tt.denied {
+			t.Errorf("Denied(%q) = %v, want %v", tt.path, got, tt.denied)
+		}
+
+		var params map[string]string
+		r := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+		code := readStatus(t, mustDo(t, d.Middleware()(recordHandler(&params)), NewRequest(r)))
+		if tt.denied && (code != http.StatusForbidden || params != nil) {
+			t.Errorf("%s: status %d, reached backend %v", tt.path, code, params != nil)
+		}
+		if !tt.denied && code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", tt.path, code)
+		}
+	}
+}
+
+func TestDefaultDenyRulesCopy(t *testing.T) {
+	d := DefaultDenyRules()
+	d.Patterns[0] = "*.php"
+	d.Patterns = append(d.Patterns, "*.bak")
+	if DefaultDenyPatterns[0] != ".*" || len(DefaultDenyPatterns) != 4 {
+		t.Fatalf("DefaultDenyPatterns modified: %v", DefaultDenyPatterns)
+	}
+	if !DefaultDenyRules().Denied("/.env") {
+		t.Error("new DefaultDenyRules affected by earlier modification")
+	}
+}
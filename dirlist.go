@@ -0,0 +1,155 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 目录列表：目录中没有索引文件时由网关生成文件列表，而不是把注定失败的请求转发给PHP
+// 网关需要能够以相同的路径访问DocRoot（与后端在同一台机器上或共享文件系统）
+//
+//	fs := &ffcgiclient.FileSystemRouter{DocRoot: "/srv", DirIndex: []string{"index.php", "index.html"}, Listing: &ffcgiclient.DirListing{}}
+//	handler := ffcgiclient.Chain(ffcgiclient.BasicParamsMapMiddleware, ffcgiclient.MapHeaderMiddleware, fs.Router())(ffcgiclient.BasicHandler)
+
+// DirListing 目录列表的配置
+type DirListing struct {
+
+	// ShowHidden 是否列出以"."开头的文件
+	ShowHidden bool
+
+	// MaxEntries 最多列出的文件数，0表示默认的1000
+	MaxEntries int
+}
+
+// DirEntry 目录列表中的一项，以JSON格式输出时使用
+type DirEntry struct {
+	Name    string    `json:"name"`  // 文件名，目录以"/"结尾
+	Dir     bool      `json:"dir"`   // 是否为目录
+	Size    int64     `json:"size"`  // 文件大小，目录为0
+	ModTime time.Time `json:"mtime"` // 修改时间
+}
+
+// hasIndex 检查目录中是否有索引文件，DirIndex为空时检查index.php
+func (fs *FileSystemRouter) hasIndex(dir string) bool {
+	index := fs.DirIndex
+	if len(index) == 0 {
+		index = []string{"index.php"}
+	}
+	for _, name := range index {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err == nil && !fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// entries 读取目录中的文件，目录在前，按名称排序
+func (l *DirListing) entries(dir string) ([]DirEntry, bool, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	max := l.MaxEntries
+	if max <= 0 {
+		max = 1000
+	}
+	entries := make([]DirEntry, 0, len(files))
+	truncated := false
+	for _, f := range files {
+		if !l.ShowHidden && strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if len(entries) == max {
+			truncated = true
+			break
+		}
+		info, err := f.Info()
+		if err != nil {
+			// 读取期间被删除
+			continue
+		}
+		entry := DirEntry{Name: f.Name(), Dir: f.IsDir(), ModTime: info.ModTime().UTC()}
+		if entry.Dir {
+			entry.Name += "/"
+		} else {
+			entry.Size = info.Size()
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Dir != entries[j].Dir {
+			return entries[i].Dir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, truncated, nil
+}
+
+// dirListingTemplate HTML格式的目录列表
+var dirListingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Last modified</th><th>Size</th></tr>
+{{- if ne .Path "/"}}
+<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.ModTime.Format "2006-01-02 15:04:05"}}</td><td>{{if .Dir}}-{{else}}{{.Size}}{{end}}</td></tr>
+{{- end}}
+</table>
+{{- if .Truncated}}
+<p>Listing truncated.</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// dirListingEntry 模板中的一项
+type dirListingEntry struct {
+	DirEntry
+	Href string
+}
+
+// response 返回目录dir的列表，urlPath为请求的以"/"结尾的路径；
+// 请求的Accept包含application/json时以JSON格式输出，否则输出HTML
+func (l *DirListing) response(dir, urlPath string, r *http.Request) *ResponsePipe {
+	entries, truncated, err := l.entries(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newStatusResponse(http.StatusNotFound)
+		}
+		return newStatusResponse(http.StatusForbidden)
+	}
+	header := make(http.Header)
+	header.Set("Cache-Control", "no-cache")
+	var body bytes.Buffer
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		header.Set("Content-Type", "application/json")
+		json.NewEncoder(&body).Encode(entries)
+		return newStaticResponse(header, &body)
+	}
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	items := make([]dirListingEntry, len(entries))
+	for i, e := range entries {
+		// 文件名作为相对路径，避免包含":"的名称被解析为URL的scheme
+		href := (&url.URL{Path: "./" + e.Name}).EscapedPath()
+		items[i] = dirListingEntry{DirEntry: e, Href: href}
+	}
+	dirListingTemplate.Execute(&body, struct {
+		Path      string
+		Entries   []dirListingEntry
+		Truncated bool
+	}{urlPath, items, truncated})
+	return newStaticResponse(header, &body)
+}
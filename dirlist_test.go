@@ -0,0 +1,105 @@
+package ffcgiclient
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirListing(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"docs/sub", "app", "empty"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"docs/a b.txt":  "hello",
+		"docs/<x>.html": "<p>",
+		"docs/.env":     "SECRET=1",
+		"app/index.php": "<?php",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var forwarded string
+	backend := func(client Client, req *Request) (*ResponsePipe, error) {
+		forwarded = req.Params.Get("SCRIPT_NAME")
+		return newStatusResponse(http.StatusOK), nil
+	}
+	fs := &FileSystemRouter{DocRoot: root, DirIndex: []string{"index.php"}, Listing: &DirListing{}}
+	handler := Chain(BasicParamsMapMiddleware, MapHeaderMiddleware, fs.Router())(backend)
+	serve := func(target, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		forwarded = ""
+		resp, err := handler(nil, NewRequest(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		resp.WriteTo(rec, io.Discard)
+		return rec
+	}
+
+	// HTML：目录在前，文件名转义，不列出隐藏文件
+	rec := serve("/docs/", "text/html")
+	body := rec.Body.String()
+	if forwarded != "" || rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("listing: forwarded %q, status %d, header %v", forwarded, rec.Code, rec.Header())
+	}
+	for _, want := range []string{`href="../"`, `href="./sub/"`, `href="./a%20b.txt"`, `&lt;x&gt;.html`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing missing %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, ".env") || strings.Contains(body, "<x>") {
+		t.Errorf("listing exposes hidden or unescaped names:\n%s", body)
+	}
+	if strings.Index(body, "sub/") > strings.Index(body, "a b.txt") {
+		t.Errorf("directories not listed first:\n%s", body)
+	}
+
+	// JSON
+	rec = serve("/docs/", "application/json")
+	var entries []DirEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Name != "sub/" || !entries[0].Dir || entries[2].Name != "a b.txt" || entries[2].Size != 5 {
+		t.Fatalf("entries = %+v", entries)
+	}
+
+	tests := []struct {
+		target        string
+		wantForwarded string
+		wantCode      int
+	}{
+		{"/app/", "/app/index.php", http.StatusOK}, // 有索引文件时转发到后端
+		{"/empty/", "", http.StatusOK},
+		{"/missing/", "", http.StatusNotFound},
+		{"/docs/a%20b.txt", "/docs/a b.txt", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := serve(tt.target, "")
+		if forwarded != tt.wantForwarded || rec.Code != tt.wantCode {
+			t.Errorf("%s: forwarded %q status %d, want %q %d", tt.target, forwarded, rec.Code, tt.wantForwarded, tt.wantCode)
+		}
+	}
+
+	// 未开启时总是转发
+	fs.Listing = nil
+	if serve("/docs/", ""); forwarded != "/docs/index.php" {
+		t.Fatalf("listing disabled: forwarded %q", forwarded)
+	}
+}
@@ -0,0 +1,311 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ESI(Edge Side Includes) 1.0 响应体处理
+// 支持以下标签:
+//  <esi:include src="..." alt="..." onerror="continue"/>
+//  <esi:remove>...</esi:remove>
+//  <esi:comment text="..."/>
+//  <!--esi ... -->
+
+var (
+	// esiTagRe 匹配支持的ESI标签
+	esiTagRe = regexp.MustCompile(`(?s)<esi:include\s+([^>]*?)/?>(?:\s*</esi:include>)?|<esi:remove>.*?</esi:remove>|<esi:comment\s[^>]*?/>|<!--esi(.*?)-->`)
+	// esiAttrRe 匹配标签属性
+	esiAttrRe = regexp.MustCompile(`([a-zA-Z]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// esiDepthKey 子请求嵌套深度在context中的key
+type esiDepthKey struct{}
+
+// ESI 处理响应体中的ESI标签，esi:include通过子请求Handler解析
+type ESI struct {
+
+	// Handler 处理esi:include子请求的http.Handler，通常为网关自身的Handler
+	Handler http.Handler
+
+	// TTL 片段缓存有效期，0表示不缓存
+	TTL time.Duration
+
+	// MaxCacheEntries 最大缓存片段数量，默认1024
+	MaxCacheEntries int
+
+	// MaxDepth 片段嵌套处理的最大深度，默认3
+	MaxDepth int
+
+	// Types 需要处理的Content-Type，默认只处理text/html
+	Types []string
+
+	// Events 发布缓存清除（EventCachePurge）事件，可以为nil
+	Events *EventBus
+
+	// Clock 判断缓存过期使用的时间来源，为nil时使用SystemClock
+	Clock Clock
+
+	// Budget 缓冲响应体和缓存片段占用的内存预算，可以为nil
+	// 预算不足时响应体不做处理原样返回，片段不缓存
+	Budget *ByteBudget
+
+	mutex sync.Mutex
+	cache map[string]esiCacheEntry
+}
+
+// esiCacheEntry 片段缓存项
+type esiCacheEntry struct {
+	uri     string // 片段的URI，不包含主机名
+	body    []byte
+	expires time.Time
+}
+
+// Middleware 返回处理ESI标签的中间件
+func (e *ESI) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			resp, err := inner(client, req)
+			if err != nil || req.Raw == nil {
+				return resp, err
+			}
+			r := req.Raw
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+				// 已编码或类型不匹配的响应不处理
+				if header.Get("Content-Encoding") != "" || !e.acceptType(header.Get("Content-Type")) {
+					return body, nil
+				}
+				b, ok, err := readAllBudget(e.Budget, body)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					// 预算不足，放弃处理
+					return io.MultiReader(bytes.NewReader(b), body), nil
+				}
+				n := int64(len(b))
+				if b, err = e.process(r, b); err != nil {
+					e.Budget.Release(n)
+					return nil, err
+				}
+				header.Del("Content-Length")
+				header.Del("Surrogate-Control")
+				return &budgetReader{Reader: bytes.NewReader(b), budget: e.Budget, n: n}, nil
+			}), nil
+		}
+	}
+}
+
+// acceptType 检查Content-Type是否需要处理
+func (e *ESI) acceptType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	types := e.Types
+	if len(types) == 0 {
+		types = []string{"text/html"}
+	}
+	for _, t := range types {
+		if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// process 替换b中的ESI标签
+func (e *ESI) process(r *http.Request, b []byte) ([]byte, error) {
+	if !bytes.Contains(b, []byte("<esi:")) && !bytes.Contains(b, []byte("<!--esi")) {
+		return b, nil
+	}
+	var err error
+	out := esiTagRe.ReplaceAllFunc(b, func(tag []byte) []byte {
+		if err != nil {
+			return nil
+		}
+		switch {
+		case bytes.HasPrefix(tag, []byte("<!--esi")):
+			// 去掉注释包装，继续处理其中的内容
+			var inner []byte
+			inner, err = e.process(r, tag[len("<!--esi"):len(tag)-len("-->")])
+			return inner
+		case bytes.HasPrefix(tag, []byte("<esi:include")):
+			var fragment []byte
+			fragment, err = e.include(r, tag)
+			return fragment
+		default:
+			// esi:remove和esi:comment直接去掉
+			return nil
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// include 解析esi:include标签并获取片段内容
+func (e *ESI) include(r *http.Request, tag []byte) ([]byte, error) {
+	attrs := make(map[string]string)
+	for _, m := range esiAttrRe.FindAllSubmatch(tag, -1) {
+		attrs[strings.ToLower(string(m[1]))] = string(m[2]) + string(m[3])
+	}
+	src, ok := attrs["src"]
+	if !ok {
+		return nil, errors.New("esi: include without src")
+	}
+	b, err := e.fetch(r, src)
+	if err != nil && attrs["alt"] != "" {
+		b, err = e.fetch(r, attrs["alt"])
+	}
+	if err != nil && attrs["onerror"] == "continue" {
+		return nil, nil
+	}
+	return b, err
+}
+
+// fetch 通过子请求获取片段，并按TTL缓存
+func (e *ESI) fetch(r *http.Request, src string) ([]byte, error) {
+	u, err := r.URL.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("esi: invalid src %q: %v", src, err)
+	}
+	// 只允许同站点的片段
+	if u.Host != "" && u.Host != r.Host {
+		return nil, fmt.Errorf("esi: cross-host include %q not supported", src)
+	}
+	uri := u.RequestURI()
+	// 不同的虚拟主机的片段分别缓存
+	key := strings.ToLower(r.Host) + uri
+
+	// 查找缓存
+	if b, ok := e.cached(key); ok {
+		return b, nil
+	}
+
+	// 检查嵌套深度
+	depth, _ := r.Context().Value(esiDepthKey{}).(int)
+	maxDepth := e.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = 3
+	}
+	if depth >= maxDepth {
+		return nil, fmt.Errorf("esi: include %q exceeds max depth %d", src, maxDepth)
+	}
+	if e.Handler == nil {
+		return nil, errors.New("esi: no Handler for include")
+	}
+
+	// 构造子请求，沿用原始请求的头部信息
+	ctx := context.WithValue(r.Context(), esiDepthKey{}, depth+1)
+	sub, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	sub.Header = r.Header.Clone()
+	for _, h := range []string{"Content-Length", "Content-Type", "Accept-Encoding", "Range", "If-None-Match", "If-Modified-Since"} {
+		sub.Header.Del(h)
+	}
+	sub.Host = r.Host
+	sub.RemoteAddr = r.RemoteAddr
+	sub.RequestURI = uri
+	sub.TLS = r.TLS
+
+	rec := newResponseRecorder()
+	e.Handler.ServeHTTP(rec, sub)
+	if rec.Code() != http.StatusOK {
+		return nil, fmt.Errorf("esi: include %q returned status %d", src, rec.Code())
+	}
+	b := rec.body.Bytes()
+
+	// 可能因用户而不同的片段不缓存：请求带有Cookie或Authorization，
+	// 或响应设置了Cookie、Vary、private、no-store
+	cc := rec.header.Get("Cache-Control")
+	personal := sub.Header.Get("Cookie") != "" || sub.Header.Get("Authorization") != "" ||
+		rec.header.Get("Set-Cookie") != "" || rec.header.Get("Vary") != ""
+	if !personal && !strings.Contains(cc, "private") && !strings.Contains(cc, "no-store") {
+		e.store(key, uri, b)
+	}
+	return b, nil
+}
+
+// cached 获取未过期的缓存片段
+func (e *ESI) cached(key string) ([]byte, bool) {
+	if e.TTL <= 0 {
+		return nil, false
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	entry, ok := e.cache[key]
+	if !ok || clockOr(e.Clock).Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.body, true
+}
+
+// store 缓存片段，缓存已满时先清理过期项，仍满则放弃缓存
+func (e *ESI) store(key, uri string, b []byte) {
+	if e.TTL <= 0 {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.cache == nil {
+		e.cache = make(map[string]esiCacheEntry)
+	}
+	max := e.MaxCacheEntries
+	if max <= 0 {
+		max = 1024
+	}
+	if len(e.cache) >= max {
+		now := clockOr(e.Clock).Now()
+		for k, entry := range e.cache {
+			if now.After(entry.expires) {
+				e.evict(k, entry)
+			}
+		}
+		if len(e.cache) >= max {
+			return
+		}
+	}
+	if old, ok := e.cache[key]; ok {
+		e.evict(key, old)
+	}
+	// 预算不足时不缓存
+	if !e.Budget.Acquire(int64(len(b))) {
+		return
+	}
+	e.cache[key] = esiCacheEntry{uri: uri, body: b, expires: clockOr(e.Clock).Now().Add(e.TTL)}
+}
+
+// evict 删除缓存项并释放占用的预算，调用时需持有e.mutex
+func (e *ESI) evict(key string, entry esiCacheEntry) {
+	delete(e.cache, key)
+	e.Budget.Release(int64(len(entry.body)))
+}
+
+// Purge 清除所有主机的URI以prefix开头的片段缓存，prefix为空时清除全部，返回清除的数量
+func (e *ESI) Purge(prefix string) int {
+	e.mutex.Lock()
+	n := 0
+	for k, entry := range e.cache {
+		if strings.HasPrefix(entry.uri, prefix) {
+			e.evict(k, entry)
+			n++
+		}
+	}
+	e.mutex.Unlock()
+	e.Events.Publish(Event{
+		Type:    EventCachePurge,
+		Source:  "esi",
+		Message: fmt.Sprintf("purged %d fragments with prefix %q", n, prefix),
+	})
+	return n
+}
@@ -0,0 +1,78 @@
+package ffcgiclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestESI(t *testing.T) {
+	calls := 0
+	fragments := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/user":
+			w.Header().Set("Vary", "Cookie")
+			io.WriteString(w, "user")
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			io.WriteString(w, r.Host+r.URL.Path)
+		}
+	})
+	stub := &stubClient{recorded: map[string][]byte{
+		"page":   []byte(`Content-Type: text/html` + "\r\n\r\n" + `[<esi:include src="/nav"/>]<esi:remove>x</esi:remove><!--esi <esi:comment text="c"/>!-->`),
+		"alt":    []byte(`Content-Type: text/html` + "\r\n\r\n" + `[<esi:include src="/missing" alt="/alt"/>|<esi:include src="/missing" onerror="continue"/>]`),
+		"user":   []byte(`Content-Type: text/html` + "\r\n\r\n" + `[<esi:include src="/user"/>]`),
+		"plain":  []byte("Content-Type: text/plain\r\n\r\n<esi:include src=\"/nav\"/>"),
+		"failed": []byte(`Content-Type: text/html` + "\r\n\r\n" + `<esi:include src="/missing"/>`),
+	}}
+	e := &ESI{Handler: fragments, TTL: time.Minute}
+	handler := e.Middleware()(BasicHandler)
+	get := func(host, size string, header http.Header) (int, string) {
+		r := httptest.NewRequest("GET", "/?size="+size, nil)
+		r.Host = host
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		resp, err := handler(stub, NewRequest(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		resp.WriteTo(rec, io.Discard)
+		return rec.Code, rec.Body.String()
+	}
+
+	cases := []struct {
+		name, host, size string
+		header           http.Header
+		code             int
+		body             string
+		calls            int
+	}{
+		{"include", "a.test", "page", nil, 200, "[a.test/nav] !", 1},
+		{"cache hit", "a.test", "page", nil, 200, "[a.test/nav] !", 1},
+		{"other host", "b.test", "page", nil, 200, "[b.test/nav] !", 2},
+		{"alt and continue", "a.test", "alt", nil, 200, "[a.test/alt|]", 5},
+		{"cookie not cached", "a.test", "page", http.Header{"Cookie": {"sid=1"}}, 200, "[a.test/nav] !", 5},
+		{"credentials", "c.test", "page", http.Header{"Authorization": {"Basic eDp5"}}, 200, "[c.test/nav] !", 6},
+		{"credentials not cached", "c.test", "page", http.Header{"Authorization": {"Basic eDp5"}}, 200, "[c.test/nav] !", 7},
+		{"vary", "a.test", "user", nil, 200, "[user]", 8},
+		{"vary not cached", "a.test", "user", nil, 200, "[user]", 9},
+		{"other types untouched", "a.test", "plain", nil, 200, `<esi:include src="/nav"/>`, 9},
+		{"failed include", "a.test", "failed", nil, 502, "", 10},
+	}
+	for _, c := range cases {
+		code, body := get(c.host, c.size, c.header)
+		if code != c.code || (c.body != "" && body != c.body) || calls != c.calls {
+			t.Fatalf("%s: %d %q after %d subrequests, want %d %q after %d", c.name, code, body, calls, c.code, c.body, c.calls)
+		}
+	}
+
+	if n := e.Purge("/nav"); n != 2 {
+		t.Fatalf("Purge() = %d, want 2", n)
+	}
+}
@@ -0,0 +1,109 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 为应用程序的响应生成ETag，并按If-None-Match、If-Modified-Since返回304，减少可缓存响应的传输
+
+// DefaultETagMaxBytes 为计算ETag缓冲的响应体的默认最大字节数
+const DefaultETagMaxBytes = 1024 * 1024
+
+// ETag 为GET、HEAD请求的200响应计算ETag并处理条件请求
+// 应用程序已设置ETag时直接使用；否则为GET缓冲响应体计算sha256，超过MaxBytes的响应不生成ETag
+// HEAD的响应通常没有响应体，不生成ETag，只按应用程序设置的ETag、Last-Modified判断
+// 应用程序设置了Last-Modified且请求没有If-None-Match时按If-Modified-Since判断，包括超过MaxBytes的响应
+type ETag struct {
+
+	// MaxBytes 缓冲的响应体的最大字节数，默认DefaultETagMaxBytes
+	MaxBytes int64
+
+	// Weak 为true时生成弱ETag（W/"..."）
+	Weak bool
+}
+
+// Middleware 返回处理ETag和条件请求的中间件
+func (e *ETag) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			resp, err := inner(client, req)
+			r := req.Raw
+			if err != nil || r == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				return resp, err
+			}
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+				if status := header.Get("Status"); status != "" && !strings.HasPrefix(status, "200") {
+					return body, nil
+				}
+				if header.Get("ETag") == "" && r.Method != http.MethodHead {
+					max := e.MaxBytes
+					if max <= 0 {
+						max = DefaultETagMaxBytes
+					}
+					data, err := io.ReadAll(io.LimitReader(body, max+1))
+					if err != nil {
+						return nil, err
+					}
+					if int64(len(data)) > max {
+						// 不生成ETag，仍按Last-Modified判断
+						body = io.MultiReader(bytes.NewReader(data), body)
+					} else {
+						header.Set("ETag", e.tag(data))
+						body = bytes.NewReader(data)
+					}
+				}
+				if notModified(r, header) {
+					header.Set("Status", "304 Not Modified")
+					header.Del("Content-Type")
+					header.Del("Content-Length")
+					return strings.NewReader(""), nil
+				}
+				return body, nil
+			}), nil
+		}
+	}
+}
+
+// tag 返回data的ETag
+func (e *ETag) tag(data []byte) string {
+	sum := sha256.Sum256(data)
+	tag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	if e.Weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// notModified 按条件请求头判断响应是否未修改，If-None-Match优先于If-Modified-Since
+// 响应没有ETag时If-None-Match不匹配
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			// GET、HEAD使用弱比较
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(ims)
+}
@@ -0,0 +1,68 @@
+package ffcgiclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestETag(t *testing.T) {
+	stub := &stubClient{recorded: map[string][]byte{
+		"":      []byte("Content-Type: text/html\r\n\r\n<p>hello</p>"),
+		"own":   []byte("Content-Type: text/html\r\nETag: \"v1\"\r\n\r\nown"),
+		"dated": []byte("Content-Type: text/html\r\nLast-Modified: Mon, 02 Jan 2006 15:04:05 GMT\r\n\r\ndated"),
+		"large": []byte("Content-Type: text/html\r\n\r\n" + strings.Repeat("x", 100)),
+		"large-dated": []byte("Content-Type: text/html\r\nLast-Modified: Mon, 02 Jan 2006 15:04:05 GMT\r\n\r\n" +
+			strings.Repeat("x", 100)),
+	}}
+	h := NewHandler((&ETag{MaxBytes: 64}).Middleware()(BasicHandler), func() (Client, error) { return stub, nil })
+	serve := func(method, target string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := serve("GET", "/", nil)
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) || rec.Body.String() != "<p>hello</p>" {
+		t.Fatalf("status = %d, ETag = %q, body = %q", rec.Code, etag, rec.Body.String())
+	}
+
+	// HEAD不按空的响应体生成ETag
+	if rec := serve("HEAD", "/", nil); rec.Code != http.StatusOK || rec.Header().Get("ETag") != "" {
+		t.Fatalf("HEAD: status = %d, ETag = %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	cases := []struct {
+		method string
+		target string
+		header map[string]string
+		want   int
+	}{
+		{"GET", "/", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"GET", "/", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+		{"GET", "/", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"GET", "/?size=own", map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified},
+		{"GET", "/?size=dated", map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusNotModified},
+		{"GET", "/?size=dated", map[string]string{"If-Modified-Since": "Sun, 01 Jan 2006 15:04:05 GMT"}, http.StatusOK},
+		{"GET", "/?size=large", map[string]string{"If-None-Match": "*"}, http.StatusOK},
+		{"GET", "/?size=large-dated", map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusNotModified},
+		{"HEAD", "/?size=own", map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified},
+		{"HEAD", "/?size=dated", map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusNotModified},
+		{"HEAD", "/", map[string]string{"If-None-Match": etag}, http.StatusOK},
+	}
+	for _, c := range cases {
+		rec := serve(c.method, c.target, c.header)
+		if rec.Code != c.want {
+			t.Errorf("%s %s %v: status = %d, want %d", c.method, c.target, c.header, rec.Code, c.want)
+		}
+		if c.want == http.StatusNotModified && rec.Body.Len() != 0 {
+			t.Errorf("%s: 304 with body %q", c.target, rec.Body.String())
+		}
+	}
+}
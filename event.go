@@ -0,0 +1,93 @@
+package ffcgiclient
+
+import (
+	"sync"
+	"time"
+)
+
+// 生命周期事件，供嵌入的应用程序订阅，而不必解析日志
+
+// EventType 事件类型
+type EventType string
+
+// 事件类型定义
+const (
+	EventBackendUp      EventType = "backend_up"      // 后端恢复可用
+	EventBackendDown    EventType = "backend_down"    // 后端不可用
+	EventPoolExhausted  EventType = "pool_exhausted"  // Client池已全部借出，请求需要等待
+	EventCachePurge     EventType = "cache_purge"     // 缓存被清除
+	EventConfigReload   EventType = "config_reload"   // 配置重新加载，Err不为nil时表示加载失败
+	EventBudgetExceeded EventType = "budget_exceeded" // 内存预算耗尽，请求被拒绝
+)
+
+// Event 事件
+type Event struct {
+	Type    EventType // 事件类型
+	Time    time.Time // 发生时间
+	Source  string    // 事件来源，例如后端地址
+	Message string    // 附加说明
+	Err     error     // 相关的错误
+}
+
+// EventBus 事件的订阅/发布中心，零值可以直接使用，对nil的*EventBus调用Publish不做任何事
+type EventBus struct {
+	mutex       sync.RWMutex
+	subscribers map[int]func(Event)
+	nextID      int
+}
+
+// NewEventBus 创建一个EventBus
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[int]func(Event))}
+}
+
+// Subscribe 订阅事件，fn在发布事件的协程中同步调用，应尽快返回
+// 返回取消订阅的函数
+func (bus *EventBus) Subscribe(fn func(Event)) (unsubscribe func()) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if bus.subscribers == nil {
+		bus.subscribers = make(map[int]func(Event))
+	}
+	id := bus.nextID
+	bus.nextID++
+	bus.subscribers[id] = fn
+	return func() {
+		bus.mutex.Lock()
+		defer bus.mutex.Unlock()
+		delete(bus.subscribers, id)
+	}
+}
+
+// SubscribeChan 以通道的方式订阅事件，通道已满时丢弃事件
+// 取消订阅后通道不会被关闭
+func (bus *EventBus) SubscribeChan(buffer int) (events <-chan Event, unsubscribe func()) {
+	ch := make(chan Event, buffer)
+	unsubscribe = bus.Subscribe(func(e Event) {
+		select {
+		case ch <- e:
+		default:
+		}
+	})
+	return ch, unsubscribe
+}
+
+// Publish 发布事件，Time为空时使用当前时间
+// 不持有锁调用订阅者，订阅者可以在回调中订阅或取消订阅
+func (bus *EventBus) Publish(e Event) {
+	if bus == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	bus.mutex.RLock()
+	subscribers := make([]func(Event), 0, len(bus.subscribers))
+	for _, fn := range bus.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	bus.mutex.RUnlock()
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
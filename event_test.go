@@ -0,0 +1,53 @@
+package ffcgiclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	// 零值可以直接使用
+	var bus EventBus
+	var got []EventType
+	unsubscribe := bus.Subscribe(func(e Event) { got = append(got, e.Type) })
+	events, unsubscribeChan := bus.SubscribeChan(1)
+	defer unsubscribeChan()
+
+	bus.Publish(Event{Type: EventBackendDown})
+	if len(got) != 1 || got[0] != EventBackendDown {
+		t.Fatalf("got %v", got)
+	}
+	e := <-events
+	if e.Type != EventBackendDown || e.Time.IsZero() {
+		t.Fatalf("event = %+v", e)
+	}
+	// 通道已满时丢弃
+	bus.Publish(Event{Type: EventBackendUp, Time: time.Unix(1, 0)})
+	bus.Publish(Event{Type: EventPoolExhausted})
+	if e := <-events; e.Type != EventBackendUp || !e.Time.Equal(time.Unix(1, 0)) {
+		t.Fatalf("event = %+v", e)
+	}
+
+	unsubscribe()
+	bus.Publish(Event{Type: EventCachePurge})
+	if len(got) != 3 {
+		t.Fatalf("got %v after unsubscribe", got)
+	}
+
+	// 订阅者可以在回调中取消订阅
+	var once func()
+	calls := 0
+	once = bus.Subscribe(func(Event) {
+		calls++
+		once()
+	})
+	bus.Publish(Event{Type: EventConfigReload})
+	bus.Publish(Event{Type: EventConfigReload})
+	if calls != 1 {
+		t.Fatalf("calls = %d", calls)
+	}
+
+	// nil的EventBus不做任何事
+	var nilBus *EventBus
+	nilBus.Publish(Event{Type: EventBackendUp})
+}
@@ -3,11 +3,15 @@ package ffcgiclient
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"suilz/ffcgi-client/fcgiproto"
 )
 
 // 此文件是fastcgi协议的基本实现
@@ -15,8 +19,8 @@ import (
 
 // 最大值定义
 const (
-	maxWrite = 65535 // maximum record body 单个消息的最大长度限制
-	maxPad   = 255   // 最大填充长度
+	maxWrite = fcgiproto.MaxContent // maximum record body 单个消息的最大长度限制
+	maxPad   = fcgiproto.MaxPad     // 最大填充长度
 )
 
 // 填充用数据
@@ -26,47 +30,32 @@ var pad [maxPad]byte
 
 // -------------------2.Header-------------------
 
-// recType 消息类型定义
+// recType 消息类型定义，消息头的编码和解码由fcgiproto实现
 // recType is a record type, as defined by
 // https://web.archive.org/web/20150420080736/http://www.fastcgi.com/drupal/node/6?q=node/22#S8
-type recType uint8
+type recType = fcgiproto.RecType
 
 // 消息类型定义
 const (
-	typeBeginRequest    recType = iota + 1        // (Client) 表示一次请求的开始
-	typeAbortRequest                              // (Client) 表示终止一次请求
-	typeEndRequest                                // (Server) 表示一次请求结束
-	typeParams                                    // (Client) 表示一个向FastCGI服务器传递的环境变量
-	typeStdin                                     // (Client) 表示向FastCGI服务器传递的标准输入(请求数据)
-	typeStdout                                    // (Server) 表示FastCGI服务器的标准输出(应答数据)
-	typeStderr                                    // (Server) 表示FastCGI服务器的标准错误输出(错误数据)
-	typeData                                      // (Client) 向FastCGI服务器传递的额外数据
-	typeGetValues                                 // (Client) 向FastCGI服务器询问一些环境变量
-	typeGetValuesResult                           // (Server) 询问环境变量的结果
-	typeUnknownType                               // 未知类型，可能用作拓展
-	typeMaxType         recType = typeUnknownType // 类型的最大值
+	typeBeginRequest    = fcgiproto.TypeBeginRequest    // (Client) 表示一次请求的开始
+	typeAbortRequest    = fcgiproto.TypeAbortRequest    // (Client) 表示终止一次请求
+	typeEndRequest      = fcgiproto.TypeEndRequest      // (Server) 表示一次请求结束
+	typeParams          = fcgiproto.TypeParams          // (Client) 表示一个向FastCGI服务器传递的环境变量
+	typeStdin           = fcgiproto.TypeStdin           // (Client) 表示向FastCGI服务器传递的标准输入(请求数据)
+	typeStdout          = fcgiproto.TypeStdout          // (Server) 表示FastCGI服务器的标准输出(应答数据)
+	typeStderr          = fcgiproto.TypeStderr          // (Server) 表示FastCGI服务器的标准错误输出(错误数据)
+	typeData            = fcgiproto.TypeData            // (Client) 向FastCGI服务器传递的额外数据
+	typeGetValues       = fcgiproto.TypeGetValues       // (Client) 向FastCGI服务器询问一些环境变量
+	typeGetValuesResult = fcgiproto.TypeGetValuesResult // (Server) 询问环境变量的结果
+	typeUnknownType     = fcgiproto.TypeUnknownType     // 未知类型，可能用作拓展
+	typeMaxType         = typeUnknownType               // 类型的最大值
 )
 
-// header 消息头结构定义
-type header struct {
-	Version       uint8   // 协议版本
-	Type          recType // 请求类型
-	ID            uint16  // 请求id
-	ContentLength uint16  // 内容长度
-	PaddingLength uint8   // 填充字符长度
-	Reserved      uint8   // 保留字段
-}
+// header 消息头结构定义：版本、类型、请求id、内容长度、填充长度
+type header = fcgiproto.Header
 
-// init 初始化header
-func (h *header) init(recType recType, reqID uint16, contentLength int) {
-	h.Version = 1    // 目前版本都是1
-	h.Type = recType // 指定类型
-	h.ID = reqID     // 指定这次请求ID
-	// 消息体长度
-	h.ContentLength = uint16(contentLength)
-	// 取反（补码+1）后 位与& 111 保留后三位，以使相加得1000结尾（也就是ContentLength+PaddingLength相加肯定为8的倍数）
-	h.PaddingLength = uint8(-contentLength & 7)
-}
+// headerLen 消息头的长度
+const headerLen = fcgiproto.HeaderLen
 
 // -------------------3.Body-------------------
 
@@ -87,6 +76,41 @@ const (
 	statusUnknownRole            // FastCGI不支持指定的role，请求已被拒绝
 )
 
+// 应用程序在FCGI_END_REQUEST中拒绝请求时ResponsePipe.Err返回的错误
+var (
+	// ErrCantMultiplex 应用程序不支持在一个连接上并发处理请求（FCGI_CANT_MPX_CONN）
+	ErrCantMultiplex = errors.New("fcgi: application cannot multiplex connection")
+	// ErrOverloaded 应用程序耗尽了资源或达到限制（FCGI_OVERLOADED）
+	ErrOverloaded = errors.New("fcgi: application overloaded")
+	// ErrUnknownRole 应用程序不支持请求的角色（FCGI_UNKNOWN_ROLE）
+	ErrUnknownRole = errors.New("fcgi: application does not support role")
+)
+
+// endRequestError 返回FCGI_END_REQUEST消息内容中protocolStatus对应的错误，请求正常完成时返回nil
+func endRequestError(content []byte) error {
+	switch content[4] {
+	case statusRequestComplete:
+		return nil
+	case statusCantMultiplex:
+		return ErrCantMultiplex
+	case statusOverloaded:
+		return ErrOverloaded
+	case statusUnknownRole:
+		return ErrUnknownRole
+	}
+	return fmt.Errorf("fcgi: unknown protocol status %d", content[4])
+}
+
+// UnknownTypeError 应用程序以FCGI_UNKNOWN_TYPE回复了无法识别的管理消息
+type UnknownTypeError struct {
+	Type uint8 // 应用程序无法识别的消息类型
+}
+
+// Error 实现error接口
+func (e *UnknownTypeError) Error() string {
+	return fmt.Sprintf("fcgi: application does not recognize record type %s (%d)", fcgiproto.RecType(e.Type), e.Type)
+}
+
 // 消息体定义-展示用，暂时不需要定义结构体
 
 // 消息体定义 - 发起请求
@@ -112,25 +136,63 @@ type record struct {
 }
 
 // read 从io.Reader中获取消息到record.buf
-func (rec *record) read(r io.Reader) (err error) {
-	// 从io.Reader中获取header，binary.BigEndian只会读取指定参数的固定长度值，此处为8字节（header）
-	if err = binary.Read(r, binary.BigEndian, &rec.h); err != nil {
-		fmt.Println(err.Error())
+// 连接在消息之间正常关闭时返回io.EOF，消息不合法或不完整时返回*RecordError
+func (rec *record) read(r io.Reader) error {
+	prec, err := fcgiproto.ReadRecordBuf(r, rec.buf[:])
+	rec.h = prec.Header
+	if err == io.EOF {
 		return err
 	}
-	// 检验版本
-	if rec.h.Version != 1 {
-		return errors.New("fcgi: invalid header version")
-	}
-	// 计算body的长度
-	n := int(rec.h.ContentLength) + int(rec.h.PaddingLength)
-	// 读取body内容并填充
-	if _, err = io.ReadFull(r, rec.buf[:n]); err != nil {
-		return err
+	if err != nil {
+		return newRecordError(rec.h, err)
 	}
 	return nil
 }
 
+// 消息错误定义
+var (
+	errInvalidVersion = fcgiproto.ErrInvalidVersion
+	errInvalidLength  = fcgiproto.ErrInvalidLength
+)
+
+// RecordError 从服务器读取到不合法或不完整的消息
+// 此后连接上的数据无法再按消息边界解析，连接会被关闭
+// 读取消息头失败时消息头相关的字段为零值
+type RecordError struct {
+	Type          uint8  // 消息类型
+	RequestID     uint16 // 请求id
+	ContentLength uint16 // 内容长度
+	PaddingLength uint8  // 填充字符长度
+	Err           error  // 具体错误
+}
+
+// newRecordError 根据消息头创建*RecordError
+func newRecordError(h header, err error) *RecordError {
+	return &RecordError{
+		Type:          uint8(h.Type),
+		RequestID:     h.RequestID,
+		ContentLength: h.ContentLength,
+		PaddingLength: h.PaddingLength,
+		Err:           err,
+	}
+}
+
+// Error 实现error接口
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("fcgi: malformed record (type %d, request %d, content %d, padding %d): %v",
+		e.Type, e.RequestID, e.ContentLength, e.PaddingLength, e.Err)
+}
+
+// Unwrap 返回具体错误
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// unknownType 返回FCGI_UNKNOWN_TYPE消息中应用程序无法识别的管理消息类型
+func (rec *record) unknownType() recType {
+	return recType(rec.buf[0])
+}
+
 // content 从buf中读取消息内容
 func (rec *record) content() []byte {
 	// 根据header定义的内容长度获取
@@ -152,22 +214,147 @@ type conn struct {
 	// ReadWriteCloser
 	rwc io.ReadWriteCloser
 
-	// 消息体，设定Buffer，以避免混乱分配
+	// 待发送的小消息，合并后一次写出
 	// to avoid allocations
 	buf bytes.Buffer
-	// 消息头
-	h header
+	// 是否已关闭
+	closed bool
+	// 为true时小消息只放入buf，直到调用flush
+	corked bool
+
+	// 读取消息使用的缓冲，第一次读取时从readerPool获取，关闭时放回
+	rmutex sync.Mutex
+	br     *bufio.Reader
+
+	// 发送和接收消息时调用的钩子，创建后不再修改
+	hooks *RecordHooks
+
+	// client一端的连接，计入DebugStats.Connections，创建后不再修改
+	counted bool
+}
+
+// readBufferSize 读取缓冲的大小，通常可以一次读入消息头和消息体
+const readBufferSize = 16 * 1024
+
+// readerPool 连接的读取缓冲池
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, readBufferSize)
+	},
+}
+
+// readRecord 经读取缓冲从连接读取一个消息
+func (c *conn) readRecord(rec *record) error {
+	c.rmutex.Lock()
+	defer c.rmutex.Unlock()
+	if c.br == nil {
+		c.br = readerPool.Get().(*bufio.Reader)
+		c.br.Reset(c.rwc)
+	}
+	for {
+		if err := rec.read(c.br); err != nil {
+			return err
+		}
+		drop, err := c.hooks.receive(rec)
+		if !drop {
+			return err
+		}
+	}
+}
+
+// releaseReader 将读取缓冲放回池中，正在进行的读取在连接关闭后返回
+func (c *conn) releaseReader() {
+	c.rmutex.Lock()
+	defer c.rmutex.Unlock()
+	if c.br != nil {
+		c.br.Reset(nil)
+		readerPool.Put(c.br)
+		c.br = nil
+	}
+}
+
+// coalesceLimit 消息体不超过此长度的消息复制到buf中合并写出，更长的消息体不复制，
+// 与消息头、填充一起以net.Buffers写出（*net.TCPConn、*net.UnixConn上为一次writev）
+const coalesceLimit = 1024
+
+// cork 开始合并消息，之后的小消息暂存在buf中，直到调用flush
+func (c *conn) cork() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.corked = true
+}
+
+// flush 写出暂存的消息并停止合并
+func (c *conn) flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.corked = false
+	return c.flushLocked()
+}
+
+// uncork 停止合并，但不立即写出暂存的消息，暂存的消息与下一个消息一起写出
+// 调用方需保证之后一定会发送消息（例如stdin的结束消息）
+func (c *conn) uncork() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.corked = false
+}
+
+// flushLocked 写出暂存的消息，调用时需持有c.mutex
+func (c *conn) flushLocked() error {
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	_, err := c.rwc.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+// isClosed 检查连接是否已关闭
+func (c *conn) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
 }
 
-// Close 关闭连接
+// Close 关闭连接，重复关闭时不做任何事
 func (c *conn) Close() error {
 	// 加锁
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	// 重复关闭时不做任何事
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	if c.counted {
+		atomic.AddInt64(&debugCounters.connections, -1)
+	}
 	// 调用底层关闭函数
 	// 测试
 	// fmt.Println("【conn.Close】释放rwc")
-	return c.rwc.Close()
+	err := c.rwc.Close()
+	c.mutex.Unlock()
+	// 底层关闭后读取会返回，再回收读取缓冲
+	c.releaseReader()
+	return err
+}
+
+// interruptWrite 使阻塞在rwc上的写入立即失败，不需要持有c.mutex
+// 底层支持写超时（例如net.Conn）时设置已过期的写超时，否则直接关闭底层连接；写入失败后需调用Close
+func (c *conn) interruptWrite() {
+	if wd, ok := c.rwc.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		wd.SetWriteDeadline(time.Unix(1, 0))
+		return
+	}
+	c.rwc.Close()
+}
+
+// resumeWrite 清除interruptWrite设置的写超时
+func (c *conn) resumeWrite() {
+	if wd, ok := c.rwc.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		wd.SetWriteDeadline(time.Time{})
+	}
 }
 
 // writeRecord 发送一个包含 header 和 body 的消息
@@ -176,45 +363,79 @@ func (c *conn) writeRecord(recType recType, reqID uint16, b []byte) error {
 	// 加锁
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	// 重置buffer
-	c.buf.Reset()
-	// 初始化生成header
-	c.h.init(recType, reqID, len(b))
-	// 将header写入buf
-	if err := binary.Write(&c.buf, binary.BigEndian, c.h); err != nil {
+	// 钩子可以修改或丢弃消息
+	recType, reqID, b, drop, err := c.hooks.send(recType, reqID, b)
+	if drop || err != nil {
 		return err
 	}
-	// 将body写入buf
-	if _, err := c.buf.Write(b); err != nil {
-		return err
+	// 生成header
+	h := fcgiproto.NewHeader(recType, reqID, len(b))
+	var hb [headerLen]byte
+	h.Encode(hb[:])
+	if len(b) <= coalesceLimit {
+		// 小消息复制到buf中，未合并时立即写出
+		c.buf.Write(hb[:])
+		c.buf.Write(b)
+		c.buf.Write(pad[:h.PaddingLength])
+		if c.corked {
+			return nil
+		}
+		return c.flushLocked()
+	}
+	// 消息体不复制，与暂存的消息、消息头、填充一起写出
+	bufs := make(net.Buffers, 0, 4)
+	if c.buf.Len() > 0 {
+		bufs = append(bufs, c.buf.Bytes())
+	}
+	bufs = append(bufs, hb[:], b, pad[:h.PaddingLength])
+	_, err = bufs.WriteTo(c.rwc)
+	c.buf.Reset()
+	return err
+}
+
+// writeRecordBuf 发送内容已位于buf[headerLen:headerLen+n]的消息，
+// 消息头和填充直接写入buf，buf至少需要headerLen+n+maxPad字节
+func (c *conn) writeRecordBuf(recType recType, reqID uint16, buf []byte, n int) error {
+	if c.hooks != nil && c.hooks.OnSendRecord != nil {
+		// 钩子可能修改消息内容，经writeRecord发送
+		return c.writeRecord(recType, reqID, buf[headerLen:headerLen+n])
 	}
-	// 将填充数据写入buf
-	if _, err := c.buf.Write(pad[:c.h.PaddingLength]); err != nil {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	h := fcgiproto.NewHeader(recType, reqID, n)
+	h.Encode(buf)
+	end := headerLen + n
+	copy(buf[end:end+int(h.PaddingLength)], pad[:h.PaddingLength])
+	record := buf[:end+int(h.PaddingLength)]
+	if c.buf.Len() == 0 {
+		_, err := c.rwc.Write(record)
 		return err
 	}
-	// 写入rwc（io.ReadWriteCloser）
-	_, err := c.rwc.Write(c.buf.Bytes())
+	// 与暂存的消息一起写出
+	bufs := net.Buffers{c.buf.Bytes(), record}
+	_, err := bufs.WriteTo(c.rwc)
+	c.buf.Reset()
 	return err
 }
 
 // writeBeginRequest 发送一个开始请求(自描述型记录)
 func (c *conn) writeBeginRequest(reqID uint16, role role, flags uint8) error {
-	// 构造header：截取前8位作为首byte,紧跟着是第2 byte，flags
-	b := [8]byte{byte(role >> 8), byte(role), flags}
+	rec := fcgiproto.BeginRequest(reqID, fcgiproto.Role(role), flags)
 	// 发送开始请求
-	return c.writeRecord(typeBeginRequest, reqID, b[:])
+	return c.writeRecord(typeBeginRequest, reqID, rec.Content)
 }
 
 // writeEndRequest 发送一个结束请求(自描述型记录)
 func (c *conn) writeEndRequest(reqID uint16, appStatus int, protocolStatus uint8) error {
-	// 构造一个8字节的消息体：appStatus uint32 protocolStatus uint8 reserved [3]uint8
-	b := make([]byte, 8)
-	// 先放入appStatus
-	binary.BigEndian.PutUint32(b, uint32(appStatus))
-	// 再放入protocolStatus
-	b[4] = protocolStatus
+	// 8字节的消息体：appStatus uint32 protocolStatus uint8 reserved [3]uint8
+	rec := fcgiproto.EndRequest(reqID, uint32(appStatus), fcgiproto.ProtocolStatus(protocolStatus))
 	// 发送结束请求
-	return c.writeRecord(typeEndRequest, reqID, b)
+	return c.writeRecord(typeEndRequest, reqID, rec.Content)
+}
+
+// writeUnknownType 回复无法识别的管理消息类型t（FCGI_UNKNOWN_TYPE，管理消息）
+func (c *conn) writeUnknownType(t recType) error {
+	return c.writeRecord(typeUnknownType, 0, fcgiproto.UnknownType(t).Content)
 }
 
 // writeAbortRequest 发送一个异常结束请求(自描述型记录)
@@ -223,23 +444,36 @@ func (c *conn) writeAbortRequest(reqID uint16) error {
 	return c.writeRecord(typeAbortRequest, reqID, nil)
 }
 
-// writePairs 发送键值对数据（typeParams，流数据型记录）
-func (c *conn) writePairs(recType recType, reqID uint16, pairs map[string]string) error {
+// writeAbortRequestBefore 在until之前发送FCGI_ABORT_REQUEST，到时仍未写出则中断写入并返回错误，此后连接不能继续使用
+func (c *conn) writeAbortRequestBefore(reqID uint16, until time.Time) error {
+	t := time.AfterFunc(time.Until(until), c.interruptWrite)
+	err := c.writeAbortRequest(reqID)
+	if !t.Stop() && err == nil {
+		// 已设置写超时
+		err = errWriteInterrupted
+	}
+	return err
+}
+
+// errWriteInterrupted 写入被interruptWrite中断
+var errWriteInterrupted = errors.New("write interrupted")
+
+// writePairs 按顺序发送键值对数据（typeParams，流数据型记录）
+func (c *conn) writePairs(recType recType, reqID uint16, pairs *Params) error {
 	// 创建一个bufwriter
 	w := newWriter(c, recType, reqID)
-	// 先构造一个最大8字节的空间
-	b := make([]byte, 8)
-	for k, v := range pairs {
-
-		// nameLength uint32/uint8
-		// 计算nameLength的长度并把长度值填充进slice中，返回此值所占字节大小
-		n := encodeSize(b, uint32(len(k)))
-
-		// valueLength uint32/uint8
-		// 计算valueLength的长度并把长度值填充进slice中，返回此值所占字节大小
-		n += encodeSize(b[n:], uint32(len(v)))
-		// 截取有效的字节大小部分，将nameLength valueLength的信息写入buf
-		if _, err := w.Write(b[:n]); err != nil {
+	// 名和值的长度，最多8字节
+	b := make([]byte, 0, 8)
+	if pairs == nil {
+		pairs = &Params{}
+	}
+	for _, pair := range pairs.pairs {
+		k, v := pair.key, pair.value
+
+		// nameLength uint32/uint8, valueLength uint32/uint8
+		b = fcgiproto.AppendSize(fcgiproto.AppendSize(b[:0], len(k)), len(v))
+		// 将nameLength valueLength的信息写入buf
+		if _, err := w.Write(b); err != nil {
 			return err
 		}
 		// nameData 参数名
@@ -278,6 +512,14 @@ type bufWriter struct {
 	*bufio.Writer
 }
 
+// readFrom 发送缓冲中的数据后，从r读取数据直接组成消息发送，每个消息最多chunk字节
+func (w *bufWriter) readFrom(r io.Reader, chunk int) (int64, error) {
+	if err := w.Writer.Flush(); err != nil {
+		return 0, err
+	}
+	return w.closer.(*streamWriter).readFrom(r, chunk)
+}
+
 // Close 关闭bufWriter，并关闭底层流
 func (w *bufWriter) Close() error {
 	// 关闭上层bufWriter前先尝试调用bufio.Writer的Flush方法
@@ -325,6 +567,38 @@ func (w *streamWriter) Write(p []byte) (int, error) {
 	return nn, nil
 }
 
+// ReadFrom 从r读取数据直接组成消息发送，不经过bufio缓冲
+// 实现 io.ReaderFrom 接口，io.Copy及bufio.Writer（缓冲为空时）会自动使用
+func (w *streamWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.readFrom(r, maxWrite)
+}
+
+// readFrom 每次从r读取最多chunk字节，读入消息缓冲后作为一个消息发送
+func (w *streamWriter) readFrom(r io.Reader, chunk int) (nn int64, err error) {
+	if chunk <= 0 || chunk > maxWrite {
+		chunk = maxWrite
+	}
+	// 消息缓冲：header + body + padding
+	buf := getCopyBuffer(headerLen + chunk + maxPad)
+	defer putCopyBuffer(buf)
+	b := *buf
+	for {
+		n, rerr := r.Read(b[headerLen : headerLen+chunk])
+		if n > 0 {
+			if err = w.c.writeRecordBuf(w.recType, w.reqID, b, n); err != nil {
+				return
+			}
+			nn += int64(n)
+		}
+		if rerr == io.EOF {
+			return nn, nil
+		}
+		if rerr != nil {
+			return nn, rerr
+		}
+	}
+}
+
 // Close 发送一个空消息，以告知server端此类型消息已经发送结束
 // 实现 io.Closer 接口
 func (w *streamWriter) Close() error {
@@ -334,58 +608,72 @@ func (w *streamWriter) Close() error {
 
 // -------------------8.其他函数-------------------
 
-// readSize 返回参数名/值的长度值和自身所占的字节数
-func readSize(s []byte) (uint32, int) {
-	// 二进制内容为空，返回0, 0
-	if len(s) == 0 {
-		return 0, 0
-	}
-	// 获取第一个字节，以此判断是4字节还是1字节
-	size, n := uint32(s[0]), 1
-	// size（第一个字节）的最高位（标志位）为1时，表示4字节
-	if size&(1<<7) != 0 {
-		// 不足四字节，返回0, 0
-		if len(s) < 4 {
-			return 0, 0
+// ErrTruncatedPairs 名值对的内容不完整：长度不足以包含声明的名或值
+var ErrTruncatedPairs = errors.New("fcgi: truncated name-value pair")
+
+// DecodePairs 解码名值对（FCGI_PARAMS、FCGI_GET_VALUES、FCGI_GET_VALUES_RESULT的内容），同名时保留最后一个
+// 内容不完整时返回已解码的名值对和ErrTruncatedPairs；参数分为多个消息时使用PairDecoder
+func DecodePairs(b []byte) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for len(b) > 0 {
+		name, value, n := fcgiproto.DecodePair(b)
+		if n == 0 {
+			return pairs, ErrTruncatedPairs
 		}
-		n = 4
-		// 转换为对应的长度值
-		size = binary.BigEndian.Uint32(s)
-
-		// &^= 双目运算符，将运算符左边数据相异的位保留，相同位清零
-		// 1、如果右侧是0，则左侧数保持不变
-		// 2、如果右侧是1，则左侧数一定清零
-		// 此处作用是将size的最高位置为0
-		size &^= 1 << 31
+		pairs[name] = value
+		b = b[n:]
 	}
-	return size, n
+	return pairs, nil
+}
+
+// PairDecoder 逐个消息解码名值对流，一个名值对可以跨越多个消息
+//
+//	d := ffcgiclient.NewPairDecoder()
+//	for each FCGI_PARAMS record with content {
+//		d.Write(content)
+//	}
+//	err := d.Close() // 收到空的FCGI_PARAMS后
+//	params := d.Pairs()
+type PairDecoder struct {
+	pairs map[string]string
+	buf   []byte // 尚不完整的名值对
+}
+
+// NewPairDecoder 创建PairDecoder
+func NewPairDecoder() *PairDecoder {
+	return &PairDecoder{pairs: make(map[string]string)}
 }
 
-// readString 从二进制内容中获取指定长度的字符串
-func readString(s []byte, size uint32) string {
-	// 如果二进制内容的长度不足，则返回空字串
-	if size > uint32(len(s)) {
-		return ""
+// Write 解码p中完整的名值对，不完整的部分暂存到下一次Write，总是返回len(p), nil
+func (d *PairDecoder) Write(p []byte) (int, error) {
+	b := p
+	if len(d.buf) > 0 {
+		d.buf = append(d.buf, p...)
+		b = d.buf
 	}
-	// 从内容中截取指定长度，并转换为字符串返回
-	return string(s[:size])
-}
-
-// encodeSize 计算键值对参数长度所占字节数并将长度值写入b
-// 长度成员的第一个字节的最高位为标志位，为 0 则表示本长度编码为 1 字节，为 1 则表示编码为 4 字节
-func encodeSize(b []byte, size uint32) int {
-	// 如果长度大于127字节，则需要4字节来表示长度
-	if size > 127 {
-		// 长度的最高位置为1，其他不变
-		size |= 1 << 31
-		// 转换为uint32并写入b
-		binary.BigEndian.PutUint32(b, size)
-		// 返回所占字节数
-		return 4
+	for len(b) > 0 {
+		name, value, n := fcgiproto.DecodePair(b)
+		if n == 0 {
+			break
+		}
+		d.pairs[name] = value
+		b = b[n:]
 	}
-	// 长度小于127字节，用1字节表示长度
-	b[0] = byte(size)
-	return 1
+	d.buf = append(d.buf[:0], b...)
+	return len(p), nil
+}
+
+// Pairs 返回已解码的名值对
+func (d *PairDecoder) Pairs() map[string]string {
+	return d.pairs
+}
+
+// Close 结束解码，还有不完整的名值对时返回ErrTruncatedPairs
+func (d *PairDecoder) Close() error {
+	if len(d.buf) > 0 {
+		return ErrTruncatedPairs
+	}
+	return nil
 }
 
 // -------------------9.调用方法-------------------
@@ -0,0 +1,247 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"suilz/ffcgi-client/fcgiproto"
+)
+
+// TestRecordReadMalformed 测试读取不合法的消息时返回*RecordError
+func TestRecordReadMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"clean eof", nil, io.EOF},
+		{"short header", []byte{1, 6, 0}, io.ErrUnexpectedEOF},
+		{"bad version", []byte{2, 6, 0, 1, 0, 0, 0, 0}, errInvalidVersion},
+		{"bad end request", []byte{1, 3, 0, 1, 0, 4, 0, 0, 0, 0, 0, 0}, errInvalidLength},
+		{"bad unknown type", []byte{1, 11, 0, 0, 0, 1, 0, 0, 9}, errInvalidLength},
+		{"short body", []byte{1, 6, 0, 1, 0, 10, 0, 0, 'a'}, io.ErrUnexpectedEOF},
+		{"short padding", []byte{1, 6, 0, 1, 0, 1, 7, 0, 'a', 0}, io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		var rec record
+		err := rec.read(bytes.NewReader(c.data))
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+			continue
+		}
+		var recErr *RecordError
+		if isRecErr := errors.As(err, &recErr); isRecErr == (c.want == io.EOF) {
+			t.Errorf("%s: unexpected error type %T", c.name, err)
+		}
+	}
+
+	// 合法的消息
+	var rec record
+	if err := rec.read(bytes.NewReader([]byte{1, 6, 0, 1, 0, 1, 7, 0, 'a', 0, 0, 0, 0, 0, 0, 0})); err != nil {
+		t.Fatal(err)
+	}
+	if string(rec.content()) != "a" {
+		t.Errorf("content = %q", rec.content())
+	}
+}
+
+// nopCloser 为bytes.Buffer添加Close
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+// TestStreamWriterReadFrom 测试ReadFrom按chunk大小直接组成消息
+func TestStreamWriterReadFrom(t *testing.T) {
+	var out bytes.Buffer
+	w := &streamWriter{c: newConn(nopCloser{&out}), recType: typeStdin, reqID: 1}
+	body := bytes.Repeat([]byte("abcdefg"), 3)
+	n, err := w.readFrom(bytes.NewReader(body), 8)
+	if err != nil || n != int64(len(body)) {
+		t.Fatalf("readFrom = %d, %v", n, err)
+	}
+
+	var got []byte
+	var sizes []int
+	for {
+		var rec record
+		if err := rec.read(&out); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if rec.h.Type != typeStdin || rec.h.RequestID != 1 {
+			t.Fatalf("unexpected header %+v", rec.h)
+		}
+		sizes = append(sizes, int(rec.h.ContentLength))
+		got = append(got, rec.content()...)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("body = %q, want %q", got, body)
+	}
+	if len(sizes) != 3 || sizes[0] != 8 || sizes[2] != 5 {
+		t.Fatalf("record sizes = %v, want [8 8 5]", sizes)
+	}
+}
+
+// countingWriter 记录每次Write的数据
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func (w *countingWriter) Close() error { return nil }
+
+// TestConnCork 测试合并的小消息一次写出，且大消息不改变消息顺序
+func TestConnCork(t *testing.T) {
+	var out countingWriter
+	c := newConn(&out)
+	c.cork()
+	c.writeBeginRequest(1, roleResponder, 0)
+	c.writePairs(typeParams, 1, ParamsFromMap(map[string]string{"A": "1"}))
+	if out.writes != 0 {
+		t.Fatalf("%d writes while corked", out.writes)
+	}
+	if err := c.flush(); err != nil || out.writes != 1 {
+		t.Fatalf("flush: %v, %d writes", err, out.writes)
+	}
+
+	big := bytes.Repeat([]byte("x"), coalesceLimit+1)
+	c.cork()
+	c.writeRecord(typeStdin, 1, []byte("a"))
+	c.writeRecord(typeStdin, 1, big)
+	c.flush()
+
+	// uncork后暂存的消息在下一个消息之前写出
+	c.cork()
+	c.writeRecord(typeParams, 1, nil)
+	c.uncork()
+	writes := out.writes
+	if c.writeRecord(typeParams, 1, nil); out.writes != writes+1 {
+		t.Fatalf("%d writes after uncork, want 1", out.writes-writes)
+	}
+	c.cork()
+	c.writeRecord(typeParams, 1, nil)
+	c.uncork()
+	w := &streamWriter{c: c, recType: typeStdin, reqID: 1}
+	w.readFrom(bytes.NewReader([]byte("b")), 0)
+
+	var types []recType
+	var lens []int
+	for {
+		var rec record
+		if err := rec.read(&out.Buffer); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, rec.h.Type)
+		lens = append(lens, int(rec.h.ContentLength))
+	}
+	want := []recType{typeBeginRequest, typeParams, typeParams, typeStdin, typeStdin, typeParams, typeParams, typeParams, typeStdin}
+	if len(types) != len(want) || lens[3] != 1 || lens[4] != len(big) || lens[8] != 1 {
+		t.Fatalf("records = %v %v", types, lens)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("records = %v, want %v", types, want)
+		}
+	}
+}
+
+// nopWriteCloser 只用于写入的连接
+type nopWriteCloser struct{ io.ReadWriter }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// TestFcgiprotoInterop 测试fcgiproto与内部实现的编码一致
+func TestFcgiprotoInterop(t *testing.T) {
+	var buf bytes.Buffer
+	c := newConn(nopWriteCloser{&buf})
+	c.writeBeginRequest(3, roleResponder, 1)
+	c.writeEndRequest(3, 7, statusOverloaded)
+	c.writePairs(typeParams, 3, ParamsFromMap(map[string]string{"SCRIPT_NAME": "/index.php"}))
+
+	rec, err := fcgiproto.ReadRecord(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role, flags, err := rec.ParseBeginRequest(); err != nil || role != fcgiproto.RoleResponder || flags != fcgiproto.FlagKeepConn {
+		t.Fatalf("begin request = %d, %d, %v", role, flags, err)
+	}
+	rec, err = fcgiproto.ReadRecord(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app, status, err := rec.ParseEndRequest(); err != nil || app != 7 || status != fcgiproto.StatusOverloaded {
+		t.Fatalf("end request = %d, %d, %v", app, status, err)
+	}
+	rec, err = fcgiproto.ReadRecord(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fcgiproto.AppendPair(nil, "SCRIPT_NAME", "/index.php"); !bytes.Equal(rec.Content, want) {
+		t.Fatalf("params = %q, want %q", rec.Content, want)
+	}
+
+	// 反方向：内部实现读取fcgiproto写出的消息
+	buf.Reset()
+	fcgiproto.WriteRecord(&buf, fcgiproto.NewRecord(fcgiproto.TypeStdout, 9, []byte("hello")))
+	var r record
+	if err := r.read(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if r.h.Type != typeStdout || r.h.RequestID != 9 || string(r.content()) != "hello" {
+		t.Fatalf("record = %+v %q", r.h, r.content())
+	}
+}
+
+// TestDecodePairs 测试名值对的解码，包括跨越多个消息的名值对和不完整的内容
+func TestDecodePairs(t *testing.T) {
+	long := string(bytes.Repeat([]byte("v"), 300))
+	encoded := fcgiproto.AppendPair(fcgiproto.AppendPair(nil, "SCRIPT_NAME", "/index.php"), "LONG", long)
+	cases := []struct {
+		name    string
+		records [][]byte
+		want    map[string]string
+		wantErr error
+	}{
+		{"empty", nil, map[string]string{}, nil},
+		{"one record", [][]byte{encoded}, map[string]string{"SCRIPT_NAME": "/index.php", "LONG": long}, nil},
+		{"split inside length", [][]byte{encoded[:14], encoded[14:]}, map[string]string{"SCRIPT_NAME": "/index.php", "LONG": long}, nil},
+		{"split byte by byte", splitBytes(encoded), map[string]string{"SCRIPT_NAME": "/index.php", "LONG": long}, nil},
+		{"duplicate name", [][]byte{fcgiproto.AppendPair(fcgiproto.AppendPair(nil, "A", "1"), "A", "2")}, map[string]string{"A": "2"}, nil},
+		{"truncated value", [][]byte{encoded[:len(encoded)-1]}, map[string]string{"SCRIPT_NAME": "/index.php"}, ErrTruncatedPairs},
+		{"truncated 4-byte length", [][]byte{{0x80, 0}}, map[string]string{}, ErrTruncatedPairs},
+		{"oversized length", [][]byte{{0xff, 0xff, 0xff, 0xff, 1, 'a'}}, map[string]string{}, ErrTruncatedPairs},
+	}
+	for _, c := range cases {
+		d := NewPairDecoder()
+		for _, content := range c.records {
+			d.Write(content)
+		}
+		if err := d.Close(); err != c.wantErr || !reflect.DeepEqual(d.Pairs(), c.want) {
+			t.Errorf("%s: PairDecoder = %v, %v, want %v, %v", c.name, d.Pairs(), err, c.want, c.wantErr)
+		}
+		pairs, err := DecodePairs(bytes.Join(c.records, nil))
+		if err != c.wantErr || !reflect.DeepEqual(pairs, c.want) {
+			t.Errorf("%s: DecodePairs = %v, %v, want %v, %v", c.name, pairs, err, c.want, c.wantErr)
+		}
+	}
+}
+
+// splitBytes 把b拆分为单字节的切片
+func splitBytes(b []byte) [][]byte {
+	out := make([][]byte, len(b))
+	for i := range b {
+		out[i] = b[i : i+1]
+	}
+	return out
+}
@@ -0,0 +1,372 @@
+// Package fcgiproto 提供FastCGI协议的消息（record）层，用于在本库之上编写代理、抓包、模糊测试等自定义工具
+// 只处理消息的编码和解码，不涉及连接管理和请求调度，ffcgiclient的连接使用同一套编码和解码；发送请求和处理响应使用ffcgiclient
+//
+//	fcgiproto.WriteRecord(conn, fcgiproto.BeginRequest(1, fcgiproto.RoleResponder, fcgiproto.FlagKeepConn))
+//	rec, err := fcgiproto.ReadRecord(conn)
+package fcgiproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 协议的固定值
+const (
+	Version1   = 1     // 协议版本，目前只有1
+	HeaderLen  = 8     // 消息头的长度
+	MaxContent = 65535 // 单个消息内容的最大长度
+	MaxPad     = 255   // 填充的最大长度
+
+	// FlagKeepConn FCGI_BEGIN_REQUEST的flags，请求结束后应用程序保持连接
+	FlagKeepConn = 1
+)
+
+// RecType 消息类型
+type RecType uint8
+
+// 消息类型
+const (
+	TypeBeginRequest    RecType = iota + 1 // (Client) 一次请求的开始
+	TypeAbortRequest                       // (Client) 终止一次请求
+	TypeEndRequest                         // (Server) 一次请求结束
+	TypeParams                             // (Client) 环境变量流
+	TypeStdin                              // (Client) 标准输入流
+	TypeStdout                             // (Server) 标准输出流
+	TypeStderr                             // (Server) 标准错误流
+	TypeData                               // (Client) 额外数据流
+	TypeGetValues                          // (Client) 询问应用程序的变量
+	TypeGetValuesResult                    // (Server) 询问变量的结果
+	TypeUnknownType                        // (Server) 无法识别的管理消息类型
+)
+
+// typeNames 消息类型的名称
+var typeNames = []string{
+	TypeBeginRequest:    "FCGI_BEGIN_REQUEST",
+	TypeAbortRequest:    "FCGI_ABORT_REQUEST",
+	TypeEndRequest:      "FCGI_END_REQUEST",
+	TypeParams:          "FCGI_PARAMS",
+	TypeStdin:           "FCGI_STDIN",
+	TypeStdout:          "FCGI_STDOUT",
+	TypeStderr:          "FCGI_STDERR",
+	TypeData:            "FCGI_DATA",
+	TypeGetValues:       "FCGI_GET_VALUES",
+	TypeGetValuesResult: "FCGI_GET_VALUES_RESULT",
+	TypeUnknownType:     "FCGI_UNKNOWN_TYPE",
+}
+
+// String 返回协议中的类型名称，未定义的类型返回数字
+func (t RecType) String() string {
+	if int(t) < len(typeNames) && typeNames[t] != "" {
+		return typeNames[t]
+	}
+	return fmt.Sprintf("FCGI_TYPE_%d", uint8(t))
+}
+
+// Management 是否为管理消息（请求ID为0）的类型
+func (t RecType) Management() bool {
+	return t == TypeGetValues || t == TypeGetValuesResult || t == TypeUnknownType
+}
+
+// Role 应用程序担当的角色
+type Role uint16
+
+// 角色
+const (
+	RoleResponder  Role = iota + 1 // 响应器
+	RoleAuthorizer                 // 认证器
+	RoleFilter                     // 过滤器
+)
+
+// ProtocolStatus FCGI_END_REQUEST中的协议状态
+type ProtocolStatus uint8
+
+// 协议状态
+const (
+	StatusRequestComplete ProtocolStatus = iota // 请求正常完成
+	StatusCantMultiplex                         // 不支持在一个连接上并发处理，请求被拒绝
+	StatusOverloaded                            // 资源耗尽或达到限制，请求被拒绝
+	StatusUnknownRole                           // 不支持指定的角色，请求被拒绝
+)
+
+// 解码消息的错误
+var (
+	ErrInvalidVersion = errors.New("fcgiproto: invalid header version")
+	ErrInvalidLength  = errors.New("fcgiproto: invalid content length")
+	ErrContentTooLong = errors.New("fcgiproto: content exceeds 65535 bytes")
+)
+
+// Header 消息头
+type Header struct {
+	Version       uint8   // 协议版本
+	Type          RecType // 消息类型
+	RequestID     uint16  // 请求ID，管理消息为0
+	ContentLength uint16  // 内容长度
+	PaddingLength uint8   // 填充长度
+	Reserved      uint8   // 保留字段
+}
+
+// NewHeader 创建内容长度为contentLength的消息头，填充使内容加填充为8的倍数
+func NewHeader(t RecType, reqID uint16, contentLength int) Header {
+	return Header{
+		Version:       Version1,
+		Type:          t,
+		RequestID:     reqID,
+		ContentLength: uint16(contentLength),
+		PaddingLength: uint8(-contentLength & 7),
+	}
+}
+
+// Validate 检查协议版本，以及结束请求和未知类型消息的内容是否为固定的8字节
+func (h Header) Validate() error {
+	if h.Version != Version1 {
+		return ErrInvalidVersion
+	}
+	if (h.Type == TypeEndRequest || h.Type == TypeUnknownType) && h.ContentLength != 8 {
+		return ErrInvalidLength
+	}
+	return nil
+}
+
+// Encode 将消息头按网络字节序写入b，b至少需要HeaderLen字节
+func (h Header) Encode(b []byte) {
+	b[0] = h.Version
+	b[1] = byte(h.Type)
+	binary.BigEndian.PutUint16(b[2:], h.RequestID)
+	binary.BigEndian.PutUint16(b[4:], h.ContentLength)
+	b[6] = h.PaddingLength
+	b[7] = h.Reserved
+}
+
+// DecodeHeader 从b的前HeaderLen字节解码消息头，不足时返回io.ErrUnexpectedEOF
+func DecodeHeader(b []byte) (Header, error) {
+	if len(b) < HeaderLen {
+		return Header{}, io.ErrUnexpectedEOF
+	}
+	h := Header{
+		Version:       b[0],
+		Type:          RecType(b[1]),
+		RequestID:     binary.BigEndian.Uint16(b[2:]),
+		ContentLength: binary.BigEndian.Uint16(b[4:]),
+		PaddingLength: b[6],
+		Reserved:      b[7],
+	}
+	if h.Version != Version1 {
+		return h, ErrInvalidVersion
+	}
+	return h, nil
+}
+
+// Record 一个完整的消息，Content不包含填充
+type Record struct {
+	Header  Header
+	Content []byte
+}
+
+// NewRecord 创建内容为content的消息，填充使内容加填充为8的倍数
+// content超过MaxContent时panic，较长的数据使用Stream拆分
+func NewRecord(t RecType, reqID uint16, content []byte) Record {
+	if len(content) > MaxContent {
+		panic(ErrContentTooLong)
+	}
+	return Record{Header: NewHeader(t, reqID, len(content)), Content: content}
+}
+
+// Stream 将流数据拆分为多个消息，最后是表示流结束的空消息
+func Stream(t RecType, reqID uint16, data []byte) []Record {
+	var recs []Record
+	for len(data) > 0 {
+		n := len(data)
+		if n > MaxContent {
+			n = MaxContent
+		}
+		recs = append(recs, NewRecord(t, reqID, data[:n]))
+		data = data[n:]
+	}
+	return append(recs, NewRecord(t, reqID, nil))
+}
+
+// BeginRequest 创建FCGI_BEGIN_REQUEST消息
+func BeginRequest(reqID uint16, role Role, flags uint8) Record {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b, uint16(role))
+	b[2] = flags
+	return NewRecord(TypeBeginRequest, reqID, b)
+}
+
+// AbortRequest 创建FCGI_ABORT_REQUEST消息
+func AbortRequest(reqID uint16) Record {
+	return NewRecord(TypeAbortRequest, reqID, nil)
+}
+
+// EndRequest 创建FCGI_END_REQUEST消息
+func EndRequest(reqID uint16, appStatus uint32, status ProtocolStatus) Record {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, appStatus)
+	b[4] = byte(status)
+	return NewRecord(TypeEndRequest, reqID, b)
+}
+
+// UnknownType 创建回复无法识别的管理消息类型t的FCGI_UNKNOWN_TYPE消息
+func UnknownType(t RecType) Record {
+	b := make([]byte, 8)
+	b[0] = byte(t)
+	return NewRecord(TypeUnknownType, 0, b)
+}
+
+// GetValues 创建询问names的FCGI_GET_VALUES消息
+func GetValues(names ...string) Record {
+	var b []byte
+	for _, name := range names {
+		b = AppendPair(b, name, "")
+	}
+	return NewRecord(TypeGetValues, 0, b)
+}
+
+// ParseBeginRequest 解码FCGI_BEGIN_REQUEST的内容
+func (rec *Record) ParseBeginRequest() (role Role, flags uint8, err error) {
+	if rec.Header.Type != TypeBeginRequest || len(rec.Content) != 8 {
+		return 0, 0, fmt.Errorf("fcgiproto: not a valid %s record", TypeBeginRequest)
+	}
+	return Role(binary.BigEndian.Uint16(rec.Content)), rec.Content[2], nil
+}
+
+// ParseEndRequest 解码FCGI_END_REQUEST的内容
+func (rec *Record) ParseEndRequest() (appStatus uint32, status ProtocolStatus, err error) {
+	if rec.Header.Type != TypeEndRequest || len(rec.Content) != 8 {
+		return 0, 0, fmt.Errorf("fcgiproto: not a valid %s record", TypeEndRequest)
+	}
+	return binary.BigEndian.Uint32(rec.Content), ProtocolStatus(rec.Content[4]), nil
+}
+
+// ParseUnknownType 解码FCGI_UNKNOWN_TYPE的内容，返回对方无法识别的类型
+func (rec *Record) ParseUnknownType() (RecType, error) {
+	if rec.Header.Type != TypeUnknownType || len(rec.Content) != 8 {
+		return 0, fmt.Errorf("fcgiproto: not a valid %s record", TypeUnknownType)
+	}
+	return RecType(rec.Content[0]), nil
+}
+
+// ReadRecord 从r读取一个消息并丢弃填充
+// 在消息之间遇到EOF时返回io.EOF，消息不完整时返回io.ErrUnexpectedEOF
+func ReadRecord(r io.Reader) (*Record, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, int(h.ContentLength)+int(h.PaddingLength))
+	if err := readBody(r, b); err != nil {
+		return nil, err
+	}
+	return &Record{Header: h, Content: b[:h.ContentLength]}, nil
+}
+
+// ReadRecordBuf 同ReadRecord，内容和填充读入buf而不另外分配，返回的Content引用buf
+// buf至少需要MaxContent+MaxPad字节；解码消息头之后出错时返回的消息中包含消息头
+func ReadRecordBuf(r io.Reader, buf []byte) (Record, error) {
+	h, err := readHeader(r)
+	rec := Record{Header: h}
+	if err != nil {
+		return rec, err
+	}
+	if err := readBody(r, buf[:int(h.ContentLength)+int(h.PaddingLength)]); err != nil {
+		return rec, err
+	}
+	rec.Content = buf[:h.ContentLength]
+	return rec, nil
+}
+
+// readHeader 读取并检查消息头
+func readHeader(r io.Reader) (Header, error) {
+	var hb [HeaderLen]byte
+	if _, err := io.ReadFull(r, hb[:]); err != nil {
+		return Header{}, err
+	}
+	h, _ := DecodeHeader(hb[:])
+	return h, h.Validate()
+}
+
+// readBody 读取内容和填充，消息体不完整时返回io.ErrUnexpectedEOF
+func readBody(r io.Reader, b []byte) error {
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// WriteRecord 将消息（消息头、内容和填充）一次写入w
+// 消息头的ContentLength与Content的长度不一致时返回ErrInvalidLength
+func WriteRecord(w io.Writer, rec Record) error {
+	if len(rec.Content) != int(rec.Header.ContentLength) {
+		return ErrInvalidLength
+	}
+	b := make([]byte, HeaderLen+len(rec.Content)+int(rec.Header.PaddingLength))
+	rec.Header.Encode(b)
+	copy(b[HeaderLen:], rec.Content)
+	_, err := w.Write(b)
+	return err
+}
+
+// AppendPair 将一个键值对按名值对编码追加到b
+// 长度不超过127时用1字节表示，否则用最高位为1的4字节表示
+func AppendPair(b []byte, name, value string) []byte {
+	b = AppendSize(b, len(name))
+	b = AppendSize(b, len(value))
+	return append(append(b, name...), value...)
+}
+
+// AppendSize 追加名值对中的一个长度，用于不复制名和值、直接写出的编码
+// 长度成员的第一个字节的最高位为标志位，为 0 则表示本长度编码为 1 字节，为 1 则表示编码为 4 字节
+func AppendSize(b []byte, size int) []byte {
+	if size > 127 {
+		return binary.BigEndian.AppendUint32(b, uint32(size)|1<<31)
+	}
+	return append(b, byte(size))
+}
+
+// DecodePair 从b的开头解码一个名值对，返回名、值和所占的字节数，数据不完整时n为0
+func DecodePair(b []byte) (name, value string, n int) {
+	nameLen, n1 := readSize(b)
+	if n1 == 0 {
+		return "", "", 0
+	}
+	valueLen, n2 := readSize(b[n1:])
+	if n2 == 0 || uint64(nameLen)+uint64(valueLen) > uint64(len(b)-n1-n2) {
+		return "", "", 0
+	}
+	b = b[n1+n2:]
+	return readString(b, nameLen), readString(b[nameLen:], valueLen), n1 + n2 + int(nameLen) + int(valueLen)
+}
+
+// readSize 返回参数名/值的长度值和自身所占的字节数，数据不完整时返回0, 0
+func readSize(s []byte) (uint32, int) {
+	// 二进制内容为空，返回0, 0
+	if len(s) == 0 {
+		return 0, 0
+	}
+	// 获取第一个字节，以此判断是4字节还是1字节
+	size, n := uint32(s[0]), 1
+	// size（第一个字节）的最高位（标志位）为1时，表示4字节
+	if size&(1<<7) != 0 {
+		// 不足四字节，返回0, 0
+		if len(s) < 4 {
+			return 0, 0
+		}
+		n = 4
+		// 转换为对应的长度值，并将最高位置为0
+		size = binary.BigEndian.Uint32(s) &^ (1 << 31)
+	}
+	return size, n
+}
+
+// readString 从二进制内容中获取指定长度的字符串，长度不足时返回空字串
+func readString(s []byte, size uint32) string {
+	if size > uint32(len(s)) {
+		return ""
+	}
+	return string(s[:size])
+}
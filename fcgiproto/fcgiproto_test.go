@@ -0,0 +1,136 @@
+package fcgiproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		rec  Record
+	}{
+		{"begin", BeginRequest(1, RoleResponder, FlagKeepConn)},
+		{"abort", AbortRequest(7)},
+		{"end", EndRequest(2, 255, StatusOverloaded)},
+		{"unknown", UnknownType(42)},
+		{"get values", GetValues("FCGI_MAX_CONNS", "FCGI_MPXS_CONNS")},
+		{"stdout", NewRecord(TypeStdout, 3, []byte("Status: 200\r\n\r\nhello"))},
+		{"empty stdin", NewRecord(TypeStdin, 3, nil)},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := WriteRecord(&buf, tt.rec); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if buf.Len()%8 != 0 {
+			t.Errorf("%s: encoded length %d is not padded", tt.name, buf.Len())
+		}
+		got, err := ReadRecord(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got.Header != tt.rec.Header || !bytes.Equal(got.Content, tt.rec.Content) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.rec)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: %d bytes left after record", tt.name, buf.Len())
+		}
+	}
+}
+
+func TestParseBodies(t *testing.T) {
+	begin := BeginRequest(1, RoleFilter, FlagKeepConn)
+	if role, flags, err := begin.ParseBeginRequest(); err != nil || role != RoleFilter || flags != FlagKeepConn {
+		t.Errorf("ParseBeginRequest() = %d, %d, %v", role, flags, err)
+	}
+	end := EndRequest(1, 3, StatusUnknownRole)
+	if app, status, err := end.ParseEndRequest(); err != nil || app != 3 || status != StatusUnknownRole {
+		t.Errorf("ParseEndRequest() = %d, %d, %v", app, status, err)
+	}
+	unknown := UnknownType(TypeData)
+	if typ, err := unknown.ParseUnknownType(); err != nil || typ != TypeData {
+		t.Errorf("ParseUnknownType() = %v, %v", typ, err)
+	}
+	if _, _, err := unknown.ParseEndRequest(); err == nil {
+		t.Error("ParseEndRequest on FCGI_UNKNOWN_TYPE: expected error")
+	}
+}
+
+func TestStream(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), MaxContent+10)
+	recs := Stream(TypeStdin, 5, data)
+	if len(recs) != 3 {
+		t.Fatalf("got %d records, want 3", len(recs))
+	}
+	if len(recs[0].Content) != MaxContent || len(recs[1].Content) != 10 || len(recs[2].Content) != 0 {
+		t.Errorf("content lengths = %d, %d, %d", len(recs[0].Content), len(recs[1].Content), len(recs[2].Content))
+	}
+	if recs := Stream(TypeParams, 5, nil); len(recs) != 1 || recs[0].Header.ContentLength != 0 {
+		t.Errorf("empty stream = %+v", recs)
+	}
+}
+
+func TestReadRecordErrors(t *testing.T) {
+	valid := new(bytes.Buffer)
+	WriteRecord(valid, NewRecord(TypeStdout, 1, []byte("hello")))
+	tests := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"empty", nil, io.EOF},
+		{"short header", valid.Bytes()[:4], io.ErrUnexpectedEOF},
+		{"short content", valid.Bytes()[:10], io.ErrUnexpectedEOF},
+		{"bad version", []byte{2, 6, 0, 1, 0, 0, 0, 0}, ErrInvalidVersion},
+		{"bad end request", []byte{1, 3, 0, 1, 0, 4, 0, 0, 0, 0, 0, 0}, ErrInvalidLength},
+	}
+	buf := make([]byte, MaxContent+MaxPad)
+	for _, tt := range tests {
+		if _, err := ReadRecord(bytes.NewReader(tt.input)); !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+		if _, err := ReadRecordBuf(bytes.NewReader(tt.input), buf); !errors.Is(err, tt.err) {
+			t.Errorf("%s: ReadRecordBuf err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestAppendPair(t *testing.T) {
+	long := strings.Repeat("v", 200)
+	b := AppendPair(nil, "A", long)
+	want := append([]byte{1, 0x80, 0, 0, 200, 'A'}, long...)
+	if !bytes.Equal(b, want) {
+		t.Errorf("AppendPair = %v", b[:8])
+	}
+}
+
+func TestDecodePair(t *testing.T) {
+	long := strings.Repeat("v", 200)
+	b := AppendPair(AppendPair(nil, "A", long), "B", "")
+	name, value, n := DecodePair(b)
+	if name != "A" || value != long || n != 6+len(long) {
+		t.Fatalf("DecodePair = %q, %d bytes, %d", name, len(value), n)
+	}
+	if name, value, _ := DecodePair(b[n:]); name != "B" || value != "" {
+		t.Errorf("second pair = %q, %q", name, value)
+	}
+	// 不完整的名值对
+	for _, short := range [][]byte{nil, b[:1], b[:3], b[:10]} {
+		if _, _, n := DecodePair(short); n != 0 {
+			t.Errorf("DecodePair(%v) = %d bytes, want 0", short, n)
+		}
+	}
+}
+
+func TestRecTypeString(t *testing.T) {
+	if s := TypeGetValuesResult.String(); s != "FCGI_GET_VALUES_RESULT" {
+		t.Errorf("String() = %q", s)
+	}
+	if s := RecType(99).String(); s != "FCGI_TYPE_99" {
+		t.Errorf("String() = %q", s)
+	}
+}
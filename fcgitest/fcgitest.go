@@ -0,0 +1,369 @@
+// Package fcgitest 提供测试用的FastCGI后端，不需要php-fpm即可测试Handler和中间件
+// 后端记录收到的请求（开始消息、参数和请求体），并按脚本返回响应（响应头、分块的响应体、stderr、协议状态和延迟）
+//
+//	backend := fcgitest.NewServer(func(req *fcgitest.Request) fcgitest.Response {
+//		return fcgitest.Response{Body: []string{"hello"}}
+//	})
+//	defer backend.Close()
+//	h := ffcgiclient.NewHandler(ffcgiclient.NewPHPFS("/srv")(ffcgiclient.BasicHandler),
+//		ffcgiclient.SimpleClientFactory(backend.ConnFactory(), 0))
+package fcgitest
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	ffcgiclient "suilz/ffcgi-client"
+	"suilz/ffcgi-client/fcgiproto"
+)
+
+// Request 后端收到的一个请求
+type Request struct {
+	ID       uint16            // 请求ID
+	Role     fcgiproto.Role    // 角色
+	KeepConn bool              // 是否要求保持连接
+	Params   map[string]string // 参数
+	Stdin    []byte            // 请求体
+	Aborted  bool              // 响应完成前是否收到了FCGI_ABORT_REQUEST
+}
+
+// Response 后端对一个请求的响应
+type Response struct {
+
+	// Status 状态码，0时不发送Status响应头（即200）
+	Status int
+
+	// Header 响应头，没有Content-Type时使用text/html
+	Header http.Header
+
+	// Body 响应体，每一块作为单独的FCGI_STDOUT消息发送
+	Body []string
+
+	// Stderr 发送到FCGI_STDERR的内容
+	Stderr string
+
+	// Delay 开始响应前等待的时间，ChunkDelay 每块响应体之间等待的时间
+	Delay      time.Duration
+	ChunkDelay time.Duration
+
+	// AppStatus FCGI_END_REQUEST中的应用程序状态
+	AppStatus uint32
+
+	// ProtocolStatus 不为FCGI_REQUEST_COMPLETE时不发送输出，直接以此状态拒绝请求
+	ProtocolStatus fcgiproto.ProtocolStatus
+
+	// Hangup 为true时发送输出后不发送FCGI_END_REQUEST，直接关闭连接，模拟后端崩溃
+	Hangup bool
+}
+
+// Script 依次返回responses中的响应，用完后重复最后一个
+func Script(responses ...Response) func(req *Request) Response {
+	var mutex sync.Mutex
+	var i int
+	return func(req *Request) Response {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if len(responses) == 0 {
+			return Response{}
+		}
+		resp := responses[i]
+		if i < len(responses)-1 {
+			i++
+		}
+		return resp
+	}
+}
+
+// Server 测试用的FastCGI后端，一个连接上的请求并发处理
+type Server struct {
+
+	// Handler 返回对请求的响应，为nil时返回200空响应
+	Handler func(req *Request) Response
+
+	// Values 回复FCGI_GET_VALUES的变量，只回复询问到的变量
+	Values map[string]string
+
+	mutex    sync.Mutex
+	requests []*Request
+	conns    map[net.Conn]struct{}
+	listener net.Listener
+	closed   bool
+}
+
+// NewServer 创建以handler响应请求的后端
+func NewServer(handler func(req *Request) Response) *Server {
+	return &Server{Handler: handler}
+}
+
+// ConnFactory 返回连接到后端的ConnFactory，每次调用创建一个内存中的连接（net.Pipe）
+func (s *Server) ConnFactory() ffcgiclient.ConnFactory {
+	return func() (net.Conn, error) {
+		cli, srv := net.Pipe()
+		if !s.track(srv) {
+			srv.Close()
+			cli.Close()
+			return nil, net.ErrClosed
+		}
+		go s.serve(srv)
+		return cli, nil
+	}
+}
+
+// Listen 在回环地址上监听TCP连接，返回监听的地址，用于需要真实网络连接的测试
+func (s *Server) Listen() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	s.listener = ln
+	s.mutex.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if !s.track(conn) {
+				conn.Close()
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return ln.Addr().String(), nil
+}
+
+// Close 停止监听并关闭所有连接
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	conns := s.conns
+	s.conns = nil
+	ln := s.listener
+	s.mutex.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+	if ln != nil {
+		return ln.Close()
+	}
+	return nil
+}
+
+// Requests 返回已收到的完整请求（参数和请求体都已接收）的副本，按收到的顺序
+func (s *Server) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	reqs := make([]Request, len(s.requests))
+	for i, req := range s.requests {
+		reqs[i] = *req
+	}
+	return reqs
+}
+
+// track 记录连接以便Close时关闭，已关闭时返回false
+func (s *Server) track(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack 移除已关闭的连接
+func (s *Server) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	delete(s.conns, conn)
+	s.mutex.Unlock()
+}
+
+// pending 连接上正在接收的请求
+type pending struct {
+	req    *Request
+	params []byte
+	abort  chan struct{} // 收到终止请求时关闭
+	done   bool          // 响应已完成，由Server.mutex保护
+}
+
+// serverConn 一个连接，写入需要加锁
+type serverConn struct {
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+// write 写出一个消息
+func (c *serverConn) write(rec fcgiproto.Record) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return fcgiproto.WriteRecord(c.conn, rec)
+}
+
+// serve 读取连接上的消息直到连接关闭
+func (s *Server) serve(conn net.Conn) {
+	defer s.untrack(conn)
+	defer conn.Close()
+	c := &serverConn{conn: conn}
+	reqs := make(map[uint16]*pending)
+	for {
+		rec, err := fcgiproto.ReadRecord(conn)
+		if err != nil {
+			return
+		}
+		id := rec.Header.RequestID
+		p := reqs[id]
+		switch rec.Header.Type {
+		case fcgiproto.TypeGetValues:
+			c.write(s.getValues(rec.Content))
+		case fcgiproto.TypeBeginRequest:
+			role, flags, err := rec.ParseBeginRequest()
+			if err != nil {
+				return
+			}
+			reqs[id] = &pending{
+				req:   &Request{ID: id, Role: role, KeepConn: flags&fcgiproto.FlagKeepConn != 0},
+				abort: make(chan struct{}),
+			}
+		case fcgiproto.TypeParams:
+			if p != nil {
+				p.params = append(p.params, rec.Content...)
+			}
+		case fcgiproto.TypeStdin:
+			if p == nil {
+				continue
+			}
+			if len(rec.Content) > 0 {
+				p.req.Stdin = append(p.req.Stdin, rec.Content...)
+				continue
+			}
+			p.req.Params, _ = ffcgiclient.DecodePairs(p.params)
+			s.mutex.Lock()
+			s.requests = append(s.requests, p.req)
+			s.mutex.Unlock()
+			go s.respond(c, p)
+		case fcgiproto.TypeAbortRequest:
+			if p == nil {
+				continue
+			}
+			delete(reqs, id)
+			s.mutex.Lock()
+			if !p.done {
+				p.req.Aborted = true
+				close(p.abort)
+			}
+			s.mutex.Unlock()
+		default:
+			if rec.Header.RequestID == 0 {
+				c.write(fcgiproto.UnknownType(rec.Header.Type))
+			}
+		}
+	}
+}
+
+// respond 按Handler返回的响应写出消息
+func (s *Server) respond(c *serverConn, p *pending) {
+	defer func() {
+		s.mutex.Lock()
+		p.done = true
+		s.mutex.Unlock()
+	}()
+	var resp Response
+	if s.Handler != nil {
+		s.mutex.Lock()
+		req := *p.req
+		s.mutex.Unlock()
+		resp = s.Handler(&req)
+	}
+	id := p.req.ID
+	if resp.ProtocolStatus != fcgiproto.StatusRequestComplete {
+		c.write(fcgiproto.EndRequest(id, resp.AppStatus, resp.ProtocolStatus))
+		return
+	}
+	// 等待时收到终止请求则立即结束
+	wait := func(d time.Duration) bool {
+		if d <= 0 {
+			return true
+		}
+		select {
+		case <-time.After(d):
+			return true
+		case <-p.abort:
+			return false
+		}
+	}
+	end := func() {
+		if resp.Hangup {
+			c.conn.Close()
+			return
+		}
+		c.write(fcgiproto.EndRequest(id, resp.AppStatus, fcgiproto.StatusRequestComplete))
+		if !p.req.KeepConn {
+			c.conn.Close()
+		}
+	}
+	if !wait(resp.Delay) {
+		end()
+		return
+	}
+	if resp.Stderr != "" {
+		writeStream(c, fcgiproto.TypeStderr, id, []byte(resp.Stderr))
+	}
+	writeStream(c, fcgiproto.TypeStdout, id, responseHeader(resp))
+	for i, chunk := range resp.Body {
+		if i > 0 && !wait(resp.ChunkDelay) {
+			end()
+			return
+		}
+		writeStream(c, fcgiproto.TypeStdout, id, []byte(chunk))
+	}
+	c.write(fcgiproto.NewRecord(fcgiproto.TypeStdout, id, nil))
+	end()
+}
+
+// writeStream 写出流数据，不发送表示结束的空消息
+func writeStream(c *serverConn, t fcgiproto.RecType, id uint16, data []byte) {
+	recs := fcgiproto.Stream(t, id, data)
+	for _, rec := range recs[:len(recs)-1] {
+		c.write(rec)
+	}
+}
+
+// responseHeader 返回CGI响应头
+func responseHeader(resp Response) []byte {
+	var b bytes.Buffer
+	if resp.Status != 0 {
+		b.WriteString("Status: " + strconv.Itoa(resp.Status) + " " + http.StatusText(resp.Status) + "\r\n")
+	}
+	header := resp.Header
+	if header.Get("Content-Type") == "" {
+		header = header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		header.Set("Content-Type", "text/html")
+	}
+	header.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// getValues 回复FCGI_GET_VALUES，只包含询问到且在Values中的变量
+func (s *Server) getValues(content []byte) fcgiproto.Record {
+	var b []byte
+	names, _ := ffcgiclient.DecodePairs(content)
+	for name := range names {
+		if v, ok := s.Values[name]; ok {
+			b = fcgiproto.AppendPair(b, name, v)
+		}
+	}
+	return fcgiproto.NewRecord(fcgiproto.TypeGetValuesResult, 0, b)
+}
@@ -0,0 +1,142 @@
+package fcgitest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ffcgiclient "suilz/ffcgi-client"
+	"suilz/ffcgi-client/fcgiproto"
+)
+
+func TestServer(t *testing.T) {
+	backend := NewServer(Script(
+		Response{
+			Status: http.StatusCreated,
+			Header: http.Header{"X-App": {"test"}},
+			Body:   []string{"a", "b"},
+			Stderr: "notice",
+		},
+		Response{Body: []string{strings.Repeat("x", 70000)}},
+	))
+	defer backend.Close()
+	h := ffcgiclient.NewHandler(ffcgiclient.NewPHPFS("/srv")(ffcgiclient.BasicHandler),
+		ffcgiclient.SimpleClientFactory(backend.ConnFactory(), 0))
+	h.SetLogger(log.New(io.Discard, "", 0))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/index.php?q=1", strings.NewReader("hi")))
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-App") != "test" || rec.Body.String() != "ab" {
+		t.Fatalf("got %d %v %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/index.php", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 70000 {
+		t.Fatalf("got %d, body %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	reqs := backend.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d requests, want 2", len(reqs))
+	}
+	first := reqs[0]
+	if first.Role != fcgiproto.RoleResponder || !first.KeepConn || string(first.Stdin) != "hi" {
+		t.Errorf("first request = %+v", first)
+	}
+	if first.Params["SCRIPT_FILENAME"] != "/srv/index.php" || first.Params["QUERY_STRING"] != "q=1" {
+		t.Errorf("params = %v", first.Params)
+	}
+}
+
+func TestServerProtocolStatus(t *testing.T) {
+	backend := NewServer(func(req *Request) Response {
+		return Response{ProtocolStatus: fcgiproto.StatusOverloaded}
+	})
+	defer backend.Close()
+	c, err := ffcgiclient.SimpleClientFactory(backend.ConnFactory(), 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	resp, err := c.Do(ffcgiclient.NewRequest(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.WriteTo(httptest.NewRecorder(), io.Discard)
+	if err := resp.Err(); !errors.Is(err, ffcgiclient.ErrOverloaded) {
+		t.Fatalf("Err() = %v, want ErrOverloaded", err)
+	}
+}
+
+func TestServerListen(t *testing.T) {
+	backend := NewServer(func(req *Request) Response {
+		return Response{Body: []string{req.Params["REQUEST_METHOD"]}}
+	})
+	defer backend.Close()
+	addr, err := backend.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ffcgiclient.SimpleClientFactory(ffcgiclient.SimpleConnFactory("tcp", addr), 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := ffcgiclient.NewRequest(nil)
+	req.Params.Set("REQUEST_METHOD", "PUT")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	var stderr bytes.Buffer
+	if err := resp.WriteTo(rec, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.String() != "PUT" {
+		t.Fatalf("body = %q", rec.Body.String())
+	}
+}
+
+func TestServerAbort(t *testing.T) {
+	backend := NewServer(func(req *Request) Response {
+		return Response{Delay: time.Hour}
+	})
+	defer backend.Close()
+	c, err := ffcgiclient.SimpleClientFactory(backend.ConnFactory(), 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := c.Do(ffcgiclient.NewRequest(nil).WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(backend.Requests()) == 1 })
+	cancel()
+	resp.WriteTo(httptest.NewRecorder(), io.Discard)
+	if err := resp.Err(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Err() = %v, want context.Canceled", err)
+	}
+	waitFor(t, func() bool { return backend.Requests()[0].Aborted })
+}
+
+// waitFor 等待cond成立，最多一秒
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,130 @@
+package ffcgiclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 通过继承的文件描述符连接后端，用于由systemd或上级进程创建套接字的部署方式
+// 例如php-fpm.socket（Accept=no）同时传递给php-fpm和网关时，网关连接该套接字的地址：
+//
+//  factory, err := ffcgiclient.SystemdConnFactory("php-fpm")
+//  pool := ffcgiclient.NewClientPool(ffcgiclient.SimpleClientFactoryNoConn(factory, 0), 16, time.Minute)
+
+// systemd socket activation使用的环境变量，见sd_listen_fds(3)
+const (
+	envSystemdPID     = "LISTEN_PID"
+	envSystemdFDs     = "LISTEN_FDS"
+	envSystemdFDNames = "LISTEN_FDNAMES"
+)
+
+// ErrFileConnUsed 已连接的套接字文件只能建立一个连接
+var ErrFileConnUsed = errors.New("connection from file has already been used")
+
+// FileConnFactory 返回使用已连接的套接字f（例如上级进程用socketpair创建）的ConnFactory
+// 一个套接字只能作为一个连接，之后的调用返回ErrFileConnUsed，因此应配合可以多路复用的Client使用
+func FileConnFactory(f *os.File) ConnFactory {
+	var once sync.Once
+	return func() (conn net.Conn, err error) {
+		err = ErrFileConnUsed
+		once.Do(func() {
+			conn, err = net.FileConn(f)
+			f.Close()
+		})
+		return
+	}
+}
+
+// ListenerConnFactory 返回连接监听套接字f的地址的ConnFactory，每次调用都建立新的连接
+// f不会被关闭，监听未指定IP（例如0.0.0.0）时连接本机的回环地址
+func ListenerConnFactory(f *os.File) (ConnFactory, error) {
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	// 关闭复制的文件描述符，不影响f，也不会删除unix套接字文件
+	addr := ln.Addr()
+	ln.Close()
+
+	network, address := addr.Network(), addr.String()
+	if a, ok := addr.(*net.TCPAddr); ok && (a.IP == nil || a.IP.IsUnspecified()) {
+		loopback := net.IPv4(127, 0, 0, 1)
+		if a.IP != nil && a.IP.To4() == nil {
+			loopback = net.IPv6loopback
+		}
+		address = net.JoinHostPort(loopback.String(), strconv.Itoa(a.Port))
+	}
+	return SimpleConnFactory(network, address), nil
+}
+
+// systemdFiles 本进程由systemd传递的套接字
+var systemdFiles struct {
+	once  sync.Once
+	files []*os.File
+	err   error
+}
+
+// SystemdFiles 返回由systemd socket activation传递给本进程的套接字，文件名为LISTEN_FDNAMES中的名称
+// 只有第一次调用读取并清除环境变量，之后的调用返回相同的结果；不是由systemd启动时返回空
+func SystemdFiles() ([]*os.File, error) {
+	systemdFiles.once.Do(func() {
+		names, err := listenFDNames(os.Getenv(envSystemdPID), os.Getenv(envSystemdFDs), os.Getenv(envSystemdFDNames))
+		os.Unsetenv(envSystemdPID)
+		os.Unsetenv(envSystemdFDs)
+		os.Unsetenv(envSystemdFDNames)
+		for i, name := range names {
+			systemdFiles.files = append(systemdFiles.files, os.NewFile(uintptr(3+i), name))
+		}
+		systemdFiles.err = err
+	})
+	return systemdFiles.files, systemdFiles.err
+}
+
+// listenFDNames 按sd_listen_fds的约定由环境变量的值得到从fd 3开始的各个文件描述符的名称
+func listenFDNames(pid, fds, names string) ([]string, error) {
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+		// 传递给其他进程的套接字
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q", envSystemdFDs, fds)
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+	result := make([]string, n)
+	for i := range result {
+		result[i] = "LISTEN_FD_" + strconv.Itoa(3+i)
+		if i < len(fdNames) && fdNames[i] != "" {
+			result[i] = fdNames[i]
+		}
+	}
+	return result, nil
+}
+
+// SystemdConnFactory 返回连接systemd传递的名为name的监听套接字的ConnFactory，name为空时使用第一个
+func SystemdConnFactory(name string) (ConnFactory, error) {
+	files, err := SystemdFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if name == "" || f.Name() == name {
+			return ListenerConnFactory(f)
+		}
+	}
+	if name == "" {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+}
@@ -0,0 +1,125 @@
+package ffcgiclient
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListenerConnFactory(t *testing.T) {
+	tests := []struct {
+		network, address string
+	}{
+		{"tcp", "127.0.0.1:0"},
+		{"tcp", ":0"},
+		{"unix", filepath.Join(t.TempDir(), "fpm.sock")},
+	}
+	for _, tt := range tests {
+		ln, err := net.Listen(tt.network, tt.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := ln.(fileListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		factory, err := ListenerConnFactory(f)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.address, err)
+		}
+		// 每次调用都建立新的连接
+		for i := 0; i < 2; i++ {
+			conn, err := factory()
+			if err != nil {
+				t.Fatalf("%s: %v", tt.address, err)
+			}
+			accepted, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			accepted.Close()
+			conn.Close()
+		}
+		f.Close()
+		ln.Close()
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if _, err := ListenerConnFactory(r); err == nil {
+		t.Fatal("expected error for non-socket file")
+	}
+}
+
+func TestFileConnFactory(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := server.(*net.TCPConn).File()
+	server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	factory := FileConnFactory(f)
+	conn, err := factory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	var b [1]byte
+	if _, err := client.Read(b[:]); err != nil || b[0] != 'x' {
+		t.Fatalf("read %q, %v", b[:], err)
+	}
+	if _, err := factory(); !errors.Is(err, ErrFileConnUsed) {
+		t.Fatalf("second call: err = %v, want ErrFileConnUsed", err)
+	}
+}
+
+func TestListenFDNames(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		pid, fds, names string
+		want            []string
+		err             bool
+	}{
+		{"", "", "", nil, false},
+		{"1", "2", "", nil, false},
+		{pid, "x", "", nil, true},
+		{pid, "2", "", []string{"LISTEN_FD_3", "LISTEN_FD_4"}, false},
+		{pid, "2", "php-fpm", []string{"php-fpm", "LISTEN_FD_4"}, false},
+		{pid, "2", "php-fpm:admin", []string{"php-fpm", "admin"}, false},
+	}
+	for _, tt := range tests {
+		names, err := listenFDNames(tt.pid, tt.fds, tt.names)
+		if (err != nil) != tt.err {
+			t.Errorf("listenFDNames(%q, %q, %q): err = %v", tt.pid, tt.fds, tt.names, err)
+			continue
+		}
+		if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("listenFDNames(%q, %q, %q) = %v, want %v", tt.pid, tt.fds, tt.names, names, tt.want)
+		}
+	}
+}
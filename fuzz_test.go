@@ -0,0 +1,114 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"suilz/ffcgi-client/fcgiproto"
+)
+
+// 解码后端输出的函数的模糊测试，后端输出不合法时不能panic或过量分配内存
+//
+//	go test -run '^$' -fuzz FuzzRecordRead
+//	go test -run '^$' -fuzz FuzzDecodePairs
+//	go test -run '^$' -fuzz FuzzReadCGIHeader
+//	go test -run '^$' -fuzz FuzzWriteResponse
+
+func FuzzRecordRead(f *testing.F) {
+	f.Add([]byte{1, 6, 0, 1, 0, 1, 7, 0, 'a', 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{1, 3, 0, 1, 0, 8, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0})
+	f.Add([]byte{1, 11, 0, 0, 0, 8, 0, 0, 200, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{1, 6, 0, 1, 0xff, 0xff, 0xff, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// 连接使用的读取（读入固定缓冲）与fcgiproto.ReadRecord结果一致
+		var rec record
+		err := rec.read(bytes.NewReader(data))
+		prec, perr := fcgiproto.ReadRecord(bytes.NewReader(data))
+		if (err == nil) != (perr == nil) {
+			t.Fatalf("record.read error = %v, fcgiproto.ReadRecord error = %v", err, perr)
+		}
+		if err != nil {
+			return
+		}
+		if rec.h != prec.Header || !bytes.Equal(rec.content(), prec.Content) {
+			t.Fatalf("record = %+v %q, fcgiproto record = %+v %q", rec.h, rec.content(), prec.Header, prec.Content)
+		}
+		// 重新编码得到相同的消息头和内容
+		var out bytes.Buffer
+		if err := fcgiproto.WriteRecord(&out, *prec); err != nil {
+			t.Fatal(err)
+		}
+		n := headerLen + int(rec.h.ContentLength)
+		if !bytes.Equal(out.Bytes()[:n], data[:n]) {
+			t.Fatalf("re-encoded %x, read %x", out.Bytes()[:n], data[:n])
+		}
+		switch rec.h.Type {
+		case typeEndRequest:
+			endRequestError(rec.content())
+		case typeUnknownType:
+			rec.unknownType()
+		}
+	})
+}
+
+func FuzzDecodePairs(f *testing.F) {
+	f.Add(fcgiproto.AppendPair(fcgiproto.AppendPair(nil, "SCRIPT_NAME", "/index.php"), "Q", string(make([]byte, 200))))
+	f.Add([]byte{0x80, 0, 0, 1, 1, 'a', 'b'})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pairs, err := DecodePairs(data)
+		// 分为两个消息流式解码的结果相同
+		d := NewPairDecoder()
+		d.Write(data[:len(data)/2])
+		d.Write(data[len(data)/2:])
+		if derr := d.Close(); (derr == nil) != (err == nil) || !reflect.DeepEqual(d.Pairs(), pairs) {
+			t.Fatalf("PairDecoder = %v, %v; DecodePairs = %v, %v", d.Pairs(), derr, pairs, err)
+		}
+		// 解码得到的名值对重新编码后解码结果不变
+		var b []byte
+		for k, v := range pairs {
+			b = fcgiproto.AppendPair(b, k, v)
+		}
+		if again, err := DecodePairs(b); err != nil || !reflect.DeepEqual(again, pairs) {
+			t.Fatalf("round trip: got %v, %v, want %v", again, err, pairs)
+		}
+	})
+}
+
+func FuzzReadCGIHeader(f *testing.F) {
+	f.Add([]byte("Status: 404 Not Found\r\nContent-Type: text/plain\r\n\r\nbody"))
+	f.Add([]byte("X-A: 1\r\n folded\r\n\r\n"))
+	f.Add([]byte("no colon\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		limits := HeaderLimits{MaxBytes: 256, MaxCount: 8, MaxLineBytes: 64}
+		header, _, err := readCGIHeader(bytes.NewReader(data), limits)
+		if err != nil {
+			return
+		}
+		n := 0
+		for _, values := range header {
+			n += len(values)
+		}
+		if n > limits.MaxCount {
+			t.Fatalf("%d header lines, limit %d", n, limits.MaxCount)
+		}
+	})
+}
+
+func FuzzWriteResponse(f *testing.F) {
+	f.Add([]byte("Status: 201 Created\r\nContent-Type: text/plain\r\n\r\nok"))
+	f.Add([]byte("Status: -12\r\n\r\n"))
+	f.Add([]byte("Location: /next\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pipes := NewResponsePipe()
+		go func() {
+			pipes.stdOutWriter.Write(data)
+			pipes.Close()
+		}()
+		// httptest.ResponseRecorder与net/http一样，对不合法的状态码panic
+		pipes.WriteTo(httptest.NewRecorder(), io.Discard)
+	})
+}
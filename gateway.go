@@ -0,0 +1,227 @@
+package ffcgiclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 网关的路由/后端描述及启动前自检
+
+// Backend FastCGI后端（例如php-fpm）的地址
+type Backend struct {
+
+	// Network 网络类型，tcp或unix
+	Network string
+
+	// Address 后端地址，例如127.0.0.1:9000或/run/php-fpm.sock
+	Address string
+
+	// Resolver 解析Address中域名使用的解析器，为nil时使用系统默认的解析
+	Resolver Resolver
+}
+
+// String 返回network://address形式的描述
+func (b *Backend) String() string {
+	return b.Network + "://" + b.Address
+}
+
+// DialContext 连接后端
+func (b *Backend) DialContext(ctx context.Context) (net.Conn, error) {
+	return dialResolved(ctx, b.Resolver, b.Network, b.Address)
+}
+
+// ConnFactory 返回连接此后端的ConnFactory
+func (b *Backend) ConnFactory() ConnFactory {
+	return func() (net.Conn, error) {
+		return b.DialContext(context.Background())
+	}
+}
+
+// Route 网关中的一条路由，对应一组后端和文档根目录
+type Route struct {
+
+	// Name 路由名称，用于报告和日志
+	Name string
+
+	// Backends 处理此路由请求的后端
+	Backends []*Backend
+
+	// DocRoot 文档根目录
+	DocRoot string
+
+	// FrontController 入口文件（例如index.php），相对路径基于DocRoot，为空表示按文件系统路由
+	FrontController string
+
+	// Pools 此路由的后端使用的Client池，就绪探针根据池的状态判断后端是否可用，可以为nil
+	Pools *PoolSet
+}
+
+// frontController 返回入口文件的完整路径
+func (rt *Route) frontController() string {
+	if rt.FrontController == "" || filepath.IsAbs(rt.FrontController) {
+		return rt.FrontController
+	}
+	return filepath.Join(rt.DocRoot, rt.FrontController)
+}
+
+// Gateway 网关，由多条路由组成
+type Gateway struct {
+	Routes []*Route
+
+	// Events 发布后端状态变化（EventBackendUp/EventBackendDown）等事件，可以为nil
+	Events *EventBus
+
+	// ProbeDial 就绪探针是否在每次探测时连接后端，默认只根据路由的Client池的状态判断
+	ProbeDial bool
+
+	mutex        sync.Mutex
+	backendState map[string]error // 后端上一次探测的结果
+}
+
+// updateBackendState 记录后端的探测结果，状态变化时发布事件
+// 第一次探测时只在不可用时发布事件
+func (g *Gateway) updateBackendState(b *Backend, err error) {
+	g.mutex.Lock()
+	if g.backendState == nil {
+		g.backendState = make(map[string]error)
+	}
+	prev, known := g.backendState[b.String()]
+	g.backendState[b.String()] = err
+	g.mutex.Unlock()
+
+	switch {
+	case err != nil && (!known || prev == nil):
+		g.Events.Publish(Event{Type: EventBackendDown, Source: b.String(), Err: err})
+	case err == nil && known && prev != nil:
+		g.Events.Publish(Event{Type: EventBackendUp, Source: b.String()})
+	}
+}
+
+// 自检项的类型
+const (
+	CheckBackend         = "backend"          // 后端是否可以连接
+	CheckDocRoot         = "docroot"          // 文档根目录是否存在
+	CheckFrontController = "front_controller" // 入口文件是否存在
+)
+
+// CheckResult 单个自检项的结果
+type CheckResult struct {
+	Route    string        // 路由名称
+	Kind     string        // 自检项类型
+	Target   string        // 检查的对象（后端地址、目录或文件）
+	Err      error         // 错误，nil表示通过
+	Duration time.Duration // 耗时
+}
+
+// CheckReport 自检报告
+type CheckReport struct {
+	Results []CheckResult
+}
+
+// OK 是否全部通过
+func (report *CheckReport) OK() bool {
+	return report.Err() == nil
+}
+
+// Failed 返回未通过的自检项
+func (report *CheckReport) Failed() (failed []CheckResult) {
+	for _, result := range report.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return
+}
+
+// Err 返回汇总了所有未通过项的错误，全部通过时返回nil
+func (report *CheckReport) Err() error {
+	failed := report.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(failed))
+	for i, result := range failed {
+		msgs[i] = fmt.Sprintf("route %q: %s %s: %v", result.Route, result.Kind, result.Target, result.Err)
+	}
+	return fmt.Errorf("gateway check failed: %s", strings.Join(msgs, "; "))
+}
+
+// String 以每项一行的形式输出报告
+func (report *CheckReport) String() string {
+	var b strings.Builder
+	for _, result := range report.Results {
+		status := "ok"
+		if result.Err != nil {
+			status = "FAIL: " + result.Err.Error()
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%s\n", result.Route, result.Kind, result.Target, result.Duration, status)
+	}
+	return b.String()
+}
+
+// Check 检查所有后端可以连接、DocRoot存在、入口文件存在，返回自检报告
+// 建议在生产环境监听端口之前执行，ctx用于限制检查的总耗时
+// 注意：DocRoot和入口文件在本机文件系统上检查，后端位于其他主机时应将其留空
+func (g *Gateway) Check(ctx context.Context) *CheckReport {
+	var checks []func() CheckResult
+	for _, rt := range g.Routes {
+		rt := rt
+		for _, b := range rt.Backends {
+			b := b
+			checks = append(checks, func() CheckResult {
+				result := CheckResult{Route: rt.Name, Kind: CheckBackend, Target: b.String()}
+				conn, err := b.DialContext(ctx)
+				if err == nil {
+					conn.Close()
+				}
+				g.updateBackendState(b, err)
+				result.Err = err
+				return result
+			})
+		}
+		if rt.DocRoot != "" {
+			checks = append(checks, func() CheckResult {
+				result := CheckResult{Route: rt.Name, Kind: CheckDocRoot, Target: rt.DocRoot}
+				if info, err := os.Stat(rt.DocRoot); err != nil {
+					result.Err = err
+				} else if !info.IsDir() {
+					result.Err = fmt.Errorf("not a directory")
+				}
+				return result
+			})
+		}
+		if fc := rt.frontController(); fc != "" {
+			checks = append(checks, func() CheckResult {
+				result := CheckResult{Route: rt.Name, Kind: CheckFrontController, Target: fc}
+				if info, err := os.Stat(fc); err != nil {
+					result.Err = err
+				} else if !info.Mode().IsRegular() {
+					result.Err = fmt.Errorf("not a regular file")
+				}
+				return result
+			})
+		}
+	}
+
+	// 并发执行，结果按添加顺序排列
+	report := &CheckReport{Results: make([]CheckResult, len(checks))}
+	var wg sync.WaitGroup
+	wg.Add(len(checks))
+	for i, check := range checks {
+		go func(i int, check func() CheckResult) {
+			defer wg.Done()
+			start := time.Now()
+			result := check()
+			result.Duration = time.Since(start)
+			report.Results[i] = result
+		}(i, check)
+	}
+	wg.Wait()
+	return report
+}
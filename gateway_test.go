@@ -0,0 +1,51 @@
+package ffcgiclient
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGatewayCheck(t *testing.T) {
+	// 可以连接的后端
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// 存在入口文件的DocRoot
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "index.php"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &Gateway{Routes: []*Route{
+		{
+			Name:            "ok",
+			Backends:        []*Backend{{Network: "tcp", Address: ln.Addr().String()}},
+			DocRoot:         dir,
+			FrontController: "index.php",
+		},
+		{
+			Name:            "bad",
+			Backends:        []*Backend{{Network: "unix", Address: filepath.Join(dir, "missing.sock")}},
+			DocRoot:         filepath.Join(dir, "missing"),
+			FrontController: "index.php",
+		},
+	}}
+	report := g.Check(context.Background())
+	if report.OK() {
+		t.Fatalf("expected failures, got:\n%s", report)
+	}
+	failed := report.Failed()
+	if len(failed) != 3 {
+		t.Fatalf("expected 3 failures, got:\n%s", report)
+	}
+	for _, result := range failed {
+		if result.Route != "bad" {
+			t.Errorf("unexpected failure: %+v", result)
+		}
+	}
+}
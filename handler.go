@@ -1,9 +1,11 @@
 package ffcgiclient
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"sync"
 )
 
 // Handler 实现http.Handler并提供记录logger方法
@@ -13,36 +15,137 @@ type Handler interface {
 }
 
 // NewHandler 返回默认的Http.Handler实现
-func NewHandler(requestHandler RequestHandler, clientFactory ClientFactory) Handler {
-	return &defaultHandler{
+// 返回具体类型以便设置响应头限制、错误响应等，可以赋值给Handler
+func NewHandler(requestHandler RequestHandler, clientFactory ClientFactory) *DefaultHandler {
+	return &DefaultHandler{
 		requestHandler: requestHandler, // 请求处理Handler
-		newClient:      clientFactory,  // client
+		newClient: func(*http.Request) (Client, error) {
+			return clientFactory() // client
+		},
 	}
 }
 
-// defaultHandler Http.Handler的实现
-type defaultHandler struct {
-	requestHandler RequestHandler // 请求Handler
-	newClient      ClientFactory  // client工厂方法
-	logger         *log.Logger    // 日志
+// RequestClientFactory 按请求创建Client，用于按请求选择后端
+type RequestClientFactory func(r *http.Request) (Client, error)
+
+// DefaultHandler Http.Handler的实现，实现了Handler
+type DefaultHandler struct {
+	requestHandler RequestHandler       // 请求Handler
+	newClient      RequestClientFactory // client工厂方法
+	logger         *log.Logger          // 日志
+	headerLimits   HeaderLimits         // 响应头的限制
+	stderrPolicy   StderrPolicy         // stderr的处理策略
+	errorStatus    ErrorStatusFunc      // 自定义请求失败时的响应状态码
+	errorHandler   ErrorHandlerFunc     // 自定义请求失败时的响应
+
+	mutex      sync.Mutex
+	closing    bool                                 // 已开始Shutdown，不再接受新请求
+	inflight   sync.WaitGroup                       // 正在处理的请求
+	aborts     map[*http.Request]context.CancelFunc // 终止正在处理的请求
+	onShutdown []func(ctx context.Context) error    // Shutdown时调用，例如关闭Client池
 }
 
 // SetLogger 设置日志
-func (h *defaultHandler) SetLogger(logger *log.Logger) {
+func (h *DefaultHandler) SetLogger(logger *log.Logger) {
 	h.logger = logger
 }
 
+// SetRequestClientFactory 设置按请求创建Client的工厂方法，替换NewHandler传入的clientFactory
+// 例如PoolSet.RequestClientFactory按BackendSelector为每个请求选择后端
+func (h *DefaultHandler) SetRequestClientFactory(factory RequestClientFactory) {
+	h.newClient = factory
+}
+
+// SetHeaderLimits 设置解析CGI响应头的限制
+func (h *DefaultHandler) SetHeaderLimits(limits HeaderLimits) {
+	h.headerLimits = limits
+}
+
+// SetStderrPolicy 设置应用程序stderr输出的处理策略
+func (h *DefaultHandler) SetStderrPolicy(policy StderrPolicy) {
+	h.stderrPolicy = policy
+}
+
+// SetErrorStatus 设置自定义请求失败时响应状态码的函数，为nil时使用ErrorStatus的映射
+func (h *DefaultHandler) SetErrorStatus(fn ErrorStatusFunc) {
+	h.errorStatus = fn
+}
+
+// SetErrorHandler 设置生成错误响应的函数，为nil时使用http.Error返回纯文本
+// 传入的err为*StatusError，包含按SetErrorStatus确定的状态码
+func (h *DefaultHandler) SetErrorHandler(fn ErrorHandlerFunc) {
+	h.errorHandler = fn
+}
+
+// fail 返回错误响应，fallback为ErrorStatus无法识别err时的状态码，msg为默认的响应内容
+func (h *DefaultHandler) fail(w http.ResponseWriter, r *http.Request, err error, fallback int, msg string) {
+	status := errorStatus(h.errorStatus, r, err, fallback)
+	if h.errorHandler != nil {
+		h.errorHandler(w, r, &StatusError{Status: status, Err: err})
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// logf 记录日志，没有设置logger时使用log包的默认logger
+func (h *DefaultHandler) logf(format string, v ...interface{}) {
+	if h.logger != nil {
+		h.logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// logPanic err为*PanicError时记录panic的调用栈
+func (h *DefaultHandler) logPanic(r *http.Request, err error) {
+	var pe *PanicError
+	if errors.As(err, &pe) {
+		h.logf("panic serving %s: %v\n%s", r.URL.Path, pe.Value, pe.Stack)
+	}
+}
+
 // ServeHTTP 主处理逻辑，实现http.Handler接口
-func (h *defaultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (h *DefaultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sw := &statusWriter{ResponseWriter: w}
+
+	// 登记请求以便Shutdown等待或终止，已开始Shutdown时返回503
+	tracked, done, ok := h.track(r)
+	if !ok {
+		h.fail(sw, r, ErrHandlerShutdown, http.StatusServiceUnavailable, "server is shutting down")
+		return
+	}
+	defer done()
+	r = tracked
+
+	// 中间件中的panic只影响当前请求，记录调用栈并返回500
+	defer func() {
+		if p := recover(); p != nil {
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			err := newPanicError(p)
+			h.logPanic(r, err)
+			if sw.code == 0 {
+				h.fail(sw, r, err, http.StatusInternalServerError, "internal server error")
+			}
+		}
+	}()
 
 	// 创建fcgi client
 	// 测试
 	// fmt.Println("【ServeHTTP】初始化")
-	c, err := h.newClient()
+	c, err := h.newClient(r)
+	if errors.Is(err, ErrPoolTimeout) || errors.Is(err, ErrPoolClosed) {
+		// 池已全部借出或已关闭，默认返回503
+		h.fail(sw, r, err, http.StatusServiceUnavailable, "FastCGI application is busy")
+		h.logf("unable to get client from pool. %s",
+			err.Error())
+		return
+	}
 	if err != nil {
-		// 返回502
-		http.Error(w, "failed to connect to FastCGI application", http.StatusBadGateway)
-		log.Printf("unable to connect to FastCGI application. %s",
+		// 连接失败，默认返回502
+		h.fail(sw, r, err, http.StatusBadGateway, "failed to connect to FastCGI application")
+		h.logf("unable to connect to FastCGI application. %s",
 			err.Error())
 		return
 	}
@@ -55,7 +158,7 @@ func (h *defaultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		// 关闭client
 		if err = c.Close(); err != nil {
-			log.Printf("error closing client: %s",
+			h.logf("error closing client: %s",
 				err.Error())
 		}
 	}()
@@ -63,33 +166,51 @@ func (h *defaultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// 处理请求
 	// 测试
 	// fmt.Println("【ServeHTTP】开始处理请求")
-	resp, err := h.requestHandler(c, NewRequest(r))
+	req := NewRequest(r)
+	req.headerLimits = h.headerLimits
+	resp, err := h.requestHandler(c, req)
 	// 测试
 	// fmt.Println("【ServeHTTP】处理请求完成")
 	if err != nil {
-		// 返回500
-		http.Error(w, "failed to process request", http.StatusInternalServerError)
-		log.Printf("unable to process request %s",
+		// 默认返回500
+		h.fail(sw, r, err, http.StatusInternalServerError, "failed to process request")
+		h.logf("unable to process request %s",
 			err.Error())
 		return
 	}
-	// Buffer
-	errBuffer := new(bytes.Buffer)
+	// 按策略处理stderr
+	stderr := &stderrCollector{policy: h.stderrPolicy, logf: h.logf}
+	defer stderr.finish(r)
+	resp.SetHeaderLimits(h.headerLimits)
+	// HEAD请求仍转发给应用程序，保留应用程序输出的Content-Length等响应头，丢弃响应体
+	resp.discardBody = r.Method == http.MethodHead
+	// 读取响应头失败（传输错误、请求被拒绝或响应不合法）时默认返回502
+	resp.headerError = func(w http.ResponseWriter, err error) {
+		h.fail(w, r, err, http.StatusBadGateway, "failed to read response from FastCGI application")
+	}
 	// 测试
 	// fmt.Println("【ServeHTTP】准备开始WriteTo")
-	err = resp.WriteTo(w, errBuffer)
+	err = resp.WriteTo(sw, stderr)
 	// 测试
 	// fmt.Println("【ServeHTTP】完成WriteTo")
-	if err != nil {
-		// 返回500
-		http.Error(w, "failed to write stream", http.StatusInternalServerError)
-		log.Printf("Unable WriteTo: %s",
+	if terr := resp.Err(); terr != nil {
+		// 与后端通信失败或请求被拒绝
+		h.logf("error communicating with FastCGI application: %s",
+			terr.Error())
+		h.logPanic(r, terr)
+	} else if err != nil {
+		// 响应头已写出，只能记录错误
+		if sw.code == 0 {
+			h.fail(sw, r, err, http.StatusInternalServerError, "failed to write stream")
+		}
+		h.logf("Unable WriteTo: %s",
 			err.Error())
-		return
+		h.logPanic(r, err)
 	}
 
-	if errBuffer.Len() > 0 {
-		log.Printf("error stream from application process %s",
-			errBuffer.String())
+	// 调试模式下将stderr附加到5xx响应
+	if h.stderrPolicy.Debug && sw.code >= 500 && stderr.buf.Len() > 0 && w.Header().Get("Content-Length") == "" {
+		sw.Write([]byte("\n--- stderr ---\n"))
+		sw.Write(stderr.buf.Bytes())
 	}
 }
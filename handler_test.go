@@ -0,0 +1,34 @@
+package ffcgiclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerHead(t *testing.T) {
+	stub := &stubClient{recorded: map[string][]byte{
+		"": []byte("Content-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello"),
+	}}
+	var method string
+	handler := func(client Client, req *Request) (*ResponsePipe, error) {
+		method = req.Params.Get("REQUEST_METHOD")
+		return client.Do(req)
+	}
+	h := NewHandler(BasicParamsMapMiddleware(handler), func() (Client, error) { return stub, nil })
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("HEAD", "/", nil))
+	if method != "HEAD" {
+		t.Fatalf("REQUEST_METHOD = %q", method)
+	}
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "5" || rec.Body.Len() != 0 {
+		t.Fatalf("status = %d, Content-Length = %q, body = %q", rec.Code, rec.Header().Get("Content-Length"), rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != "hello" {
+		t.Fatalf("GET body = %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,214 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// 监听器交接，用于不中断连接的二进制升级
+// 旧进程通过Upgrade启动新进程并以文件描述符继承的方式传递监听器，
+// 新进程通过Listen取得继承的监听器，开始服务后调用NotifyReady，
+// 旧进程收到就绪通知后再调用http.Server.Shutdown排空现有连接并退出。
+//
+// 旧进程:
+//  proc, err := ffcgiclient.Upgrade(ctx, ln)  // 例如收到SIGUSR2时
+//  if err == nil { server.Shutdown(ctx) }
+// 新进程:
+//  ln, err := ffcgiclient.Listen("tcp", ":8080")
+//  go server.Serve(ln)
+//  ffcgiclient.NotifyReady()
+
+// 传递给新进程的环境变量
+const (
+	envListenFDs = "FFCGI_LISTEN_FDS" // 继承的监听器数量，从fd 3开始
+	envReadyFD   = "FFCGI_READY_FD"   // 通知就绪的管道fd
+)
+
+// fileListener 可以取得底层文件的监听器，*net.TCPListener和*net.UnixListener已实现
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+}
+
+// inheritedListeners 从父进程继承、尚未被Listen取走的监听器
+type inheritedListeners struct {
+	once      sync.Once
+	mutex     sync.Mutex
+	listeners []net.Listener
+	err       error
+}
+
+// inherited 本进程继承的监听器
+var inherited inheritedListeners
+
+// InheritListeners 取得由Upgrade传递给本进程的监听器，供之后的Listen使用，返回取得的数量
+// 只有第一次调用有效，之后的调用返回相同的结果；不是由Upgrade启动时不做任何事
+// Listen会自动调用，只有需要在Listen之前确认交接结果时才需要直接调用
+func InheritListeners() (int, error) {
+	inherited.once.Do(func() {
+		n, _ := strconv.Atoi(os.Getenv(envListenFDs))
+		os.Unsetenv(envListenFDs)
+		files := make([]*os.File, n)
+		for i := range files {
+			files[i] = os.NewFile(uintptr(3+i), "listener")
+		}
+		inherited.err = inherited.add(files)
+	})
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+	return len(inherited.listeners), inherited.err
+}
+
+// add 由文件创建监听器并关闭文件，返回第一个错误
+func (l *inheritedListeners) add(files []*os.File) (err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, f := range files {
+		fd := f.Fd()
+		ln, ferr := net.FileListener(f)
+		f.Close()
+		if ferr != nil {
+			if err == nil {
+				err = fmt.Errorf("inherit listener fd %d: %w", fd, ferr)
+			}
+			continue
+		}
+		l.listeners = append(l.listeners, ln)
+	}
+	return
+}
+
+// take 取走地址匹配的监听器，没有时返回nil
+func (l *inheritedListeners) take(network, address string) net.Listener {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i, ln := range l.listeners {
+		if sameAddr(ln.Addr(), network, address) {
+			l.listeners = append(l.listeners[:i], l.listeners[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+// Listen 优先返回从父进程继承的、地址匹配的监听器，没有时新建监听
+func Listen(network, address string) (net.Listener, error) {
+	InheritListeners()
+	if ln := inherited.take(network, address); ln != nil {
+		return ln, nil
+	}
+	return net.Listen(network, address)
+}
+
+// sameAddr 检查监听地址是否与network/address相同，未指定IP的地址视为相同
+func sameAddr(addr net.Addr, network, address string) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		want, err := net.ResolveTCPAddr(network, address)
+		if err != nil || a.Port != want.Port {
+			return false
+		}
+		if want.IP == nil || want.IP.IsUnspecified() {
+			return a.IP == nil || a.IP.IsUnspecified()
+		}
+		return a.IP.Equal(want.IP)
+	case *net.UnixAddr:
+		return a.Name == address
+	}
+	return false
+}
+
+// Upgrade 以当前的可执行文件和参数启动新进程，并传递listeners
+// 阻塞直至新进程调用NotifyReady；ctx结束或新进程提前退出时终止新进程并返回错误，旧进程应继续服务
+func Upgrade(ctx context.Context, listeners ...net.Listener) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	// 取得监听器的文件描述符
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range listeners {
+		fl, ok := ln.(fileListener)
+		if !ok {
+			return nil, fmt.Errorf("listener %s does not support handoff", ln.Addr())
+		}
+		// 旧进程关闭unix监听器时不删除套接字文件
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	// 就绪通知管道
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", envListenFDs, len(files)),
+		fmt.Sprintf("%s=%d", envReadyFD, 3+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// 等待就绪，新进程退出时管道读取返回EOF
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		if _, err := readyR.Read(b[:]); err != nil {
+			ready <- errors.New("new process exited before ready")
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	// 回收子进程，避免产生僵尸进程
+	go cmd.Wait()
+	return cmd.Process, nil
+}
+
+// NotifyReady 通知启动本进程的旧进程已经就绪，不是由Upgrade启动时不做任何事
+func NotifyReady() error {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	if err != nil {
+		return nil
+	}
+	os.Unsetenv(envReadyFD)
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
@@ -0,0 +1,58 @@
+package ffcgiclient
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestInheritedListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不是套接字的文件描述符被跳过并报告错误
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var l inheritedListeners
+	if err := l.add([]*os.File{r, f}); err == nil {
+		t.Fatal("expected error for non-socket fd")
+	}
+	if len(l.listeners) != 1 {
+		t.Fatalf("%d listeners inherited", len(l.listeners))
+	}
+
+	addr := ln.Addr().String()
+	if l.take("tcp", "127.0.0.2:1") != nil {
+		t.Fatal("listener returned for another address")
+	}
+	got := l.take("tcp", addr)
+	if got == nil || got.Addr().String() != addr {
+		t.Fatalf("take(%s) = %v", addr, got)
+	}
+	defer got.Close()
+	if l.take("tcp", addr) != nil {
+		t.Fatal("listener returned twice")
+	}
+}
+
+func TestInheritListenersWithoutParent(t *testing.T) {
+	os.Unsetenv(envListenFDs)
+	if n, err := InheritListeners(); n != 0 || err != nil {
+		t.Fatalf("InheritListeners() = %d, %v", n, err)
+	}
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
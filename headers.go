@@ -0,0 +1,147 @@
+package ffcgiclient
+
+import (
+	"io"
+	"net/http"
+)
+
+// 响应头相关的中间件
+
+// SecurityHeaders 安全响应头配置，值为空的项不添加
+// 应用程序已设置的响应头不会被覆盖
+type SecurityHeaders struct {
+
+	// HSTS Strict-Transport-Security，仅对HTTPS请求添加
+	HSTS string
+
+	// ContentTypeOptions X-Content-Type-Options
+	ContentTypeOptions string
+
+	// FrameOptions X-Frame-Options
+	FrameOptions string
+
+	// ReferrerPolicy Referrer-Policy
+	ReferrerPolicy string
+
+	// ContentSecurityPolicy Content-Security-Policy
+	ContentSecurityPolicy string
+
+	// Extra 其他需要添加的响应头
+	Extra map[string]string
+}
+
+// DefaultSecurityHeaders 返回常用的安全响应头预设，不包含CSP
+func DefaultSecurityHeaders() *SecurityHeaders {
+	return &SecurityHeaders{
+		HSTS:               "max-age=31536000",
+		ContentTypeOptions: "nosniff",
+		FrameOptions:       "SAMEORIGIN",
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+	}
+}
+
+// StrictSecurityHeaders 返回严格的安全响应头预设，只允许加载同源资源
+func StrictSecurityHeaders() *SecurityHeaders {
+	return &SecurityHeaders{
+		HSTS:                  "max-age=63072000; includeSubDomains",
+		ContentTypeOptions:    "nosniff",
+		FrameOptions:          "DENY",
+		ReferrerPolicy:        "no-referrer",
+		ContentSecurityPolicy: "default-src 'self'; frame-ancestors 'none'",
+	}
+}
+
+// Middleware 返回添加安全响应头的中间件
+func (sh *SecurityHeaders) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			resp, err := inner(client, req)
+			if err != nil {
+				return resp, err
+			}
+			isHTTPS := req.Raw != nil && req.Raw.TLS != nil
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+				if isHTTPS {
+					setDefaultHeader(header, "Strict-Transport-Security", sh.HSTS)
+				}
+				setDefaultHeader(header, "X-Content-Type-Options", sh.ContentTypeOptions)
+				setDefaultHeader(header, "X-Frame-Options", sh.FrameOptions)
+				setDefaultHeader(header, "Referrer-Policy", sh.ReferrerPolicy)
+				setDefaultHeader(header, "Content-Security-Policy", sh.ContentSecurityPolicy)
+				for k, v := range sh.Extra {
+					setDefaultHeader(header, k, v)
+				}
+				return body, nil
+			}), nil
+		}
+	}
+}
+
+// setDefaultHeader 仅在header中不存在key且value非空时设置
+func setDefaultHeader(header http.Header, key, value string) {
+	if value == "" || header.Get(key) != "" {
+		return
+	}
+	header.Set(key, value)
+}
+
+// HeaderOps 对一组header的声明式操作，按Remove、Set、Add的顺序执行
+type HeaderOps struct {
+
+	// Add 追加的header，保留已有的值
+	Add map[string]string `json:"add"`
+
+	// Set 设置的header，覆盖已有的值
+	Set map[string]string `json:"set"`
+
+	// Remove 移除的header
+	Remove []string `json:"remove"`
+}
+
+// apply 将操作作用于header
+func (ops *HeaderOps) apply(header http.Header) {
+	for _, k := range ops.Remove {
+		header.Del(k)
+	}
+	for k, v := range ops.Set {
+		header.Set(k, v)
+	}
+	for k, v := range ops.Add {
+		header.Add(k, v)
+	}
+}
+
+// empty 是否没有任何操作
+func (ops *HeaderOps) empty() bool {
+	return len(ops.Add) == 0 && len(ops.Set) == 0 && len(ops.Remove) == 0
+}
+
+// HeaderRules 请求头和响应头的修改规则，用于按路由进行小的调整而不必编写中间件
+// 请求头在参数映射前作用于原始请求，因此应放在Chain的最前面，HTTP_*参数才能反映修改后的结果
+type HeaderRules struct {
+
+	// Request 作用于原始请求头
+	Request HeaderOps
+
+	// Response 作用于应用程序返回的响应头
+	Response HeaderOps
+}
+
+// Middleware 返回按规则修改请求头/响应头的中间件
+func (hr *HeaderRules) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if req.Raw != nil {
+				hr.Request.apply(req.Raw.Header)
+			}
+			resp, err := inner(client, req)
+			if err != nil || hr.Response.empty() {
+				return resp, err
+			}
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+				hr.Response.apply(header)
+				return body, nil
+			}), nil
+		}
+	}
+}
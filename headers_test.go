@@ -0,0 +1,128 @@
+package ffcgiclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// headerHandler 返回带有指定响应头的200响应
+func headerHandler(header http.Header) RequestHandler {
+	return func(client Client, req *Request) (*ResponsePipe, error) {
+		h := make(http.Header)
+		for k, v := range header {
+			h[k] = append([]string(nil), v...)
+		}
+		h.Set("Status", "200 OK")
+		return newStaticResponse(h, strings.NewReader("ok")), nil
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers *SecurityHeaders
+		target  string
+		backend http.Header
+		want    map[string]string
+	}{
+		{
+			name:    "default over http",
+			headers: DefaultSecurityHeaders(),
+			target:  "http://example.com/",
+			want: map[string]string{
+				"Strict-Transport-Security": "",
+				"X-Content-Type-Options":    "nosniff",
+				"X-Frame-Options":           "SAMEORIGIN",
+				"Referrer-Policy":           "strict-origin-when-cross-origin",
+				"Content-Security-Policy":   "",
+			},
+		},
+		{
+			name:    "strict over https",
+			headers: StrictSecurityHeaders(),
+			target:  "https://example.com/",
+			want: map[string]string{
+				"Strict-Transport-Security": "max-age=63072000; includeSubDomains",
+				"X-Frame-Options":           "DENY",
+				"Content-Security-Policy":   "default-src 'self'; frame-ancestors 'none'",
+			},
+		},
+		{
+			name:    "application headers win",
+			headers: &SecurityHeaders{FrameOptions: "DENY", Extra: map[string]string{"X-Robots-Tag": "noindex"}},
+			target:  "http://example.com/",
+			backend: http.Header{"X-Frame-Options": {"ALLOW-FROM https://a.example"}},
+			want: map[string]string{
+				"X-Frame-Options": "ALLOW-FROM https://a.example",
+				"X-Robots-Tag":    "noindex",
+			},
+		},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		resp := mustDo(t, tt.headers.Middleware()(headerHandler(tt.backend)), NewRequest(r))
+		rec := httptest.NewRecorder()
+		if err := resp.WriteTo(rec, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.want {
+			if got := rec.Header().Get(k); got != v {
+				t.Errorf("%s: %s = %q, want %q", tt.name, k, got, v)
+			}
+		}
+		if rec.Body.String() != "ok" {
+			t.Errorf("%s: body = %q", tt.name, rec.Body.String())
+		}
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	rules := &HeaderRules{
+		Request: HeaderOps{
+			Set:    map[string]string{"X-Forwarded-Proto": "https"},
+			Remove: []string{"Proxy"},
+		},
+		Response: HeaderOps{
+			Add:    map[string]string{"Vary": "Cookie"},
+			Set:    map[string]string{"Cache-Control": "no-cache"},
+			Remove: []string{"X-Powered-By"},
+		},
+	}
+	var params map[string]string
+	backend := func(client Client, req *Request) (*ResponsePipe, error) {
+		params = req.Params.Map()
+		return headerHandler(http.Header{
+			"Vary":          {"Accept-Encoding"},
+			"Cache-Control": {"max-age=60"},
+			"X-Powered-By":  {"PHP/8.2"},
+		})(client, req)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Proxy", "http://evil.example")
+	r.Header.Set("X-Forwarded-Proto", "http")
+	handler := Chain(rules.Middleware(), MapHeaderMiddleware)(backend)
+	resp := mustDo(t, handler, NewRequest(r))
+	rec := httptest.NewRecorder()
+	if err := resp.WriteTo(rec, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := params["HTTP_PROXY"]; ok {
+		t.Errorf("HTTP_PROXY = %q, want removed", params["HTTP_PROXY"])
+	}
+	if got := params["HTTP_X_FORWARDED_PROTO"]; got != "https" {
+		t.Errorf("HTTP_X_FORWARDED_PROTO = %q, want https", got)
+	}
+	if got := rec.Header().Values("Vary"); len(got) != 2 || got[0] != "Accept-Encoding" || got[1] != "Cookie" {
+		t.Errorf("Vary = %v", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", got)
+	}
+	if got := rec.Header().Get("X-Powered-By"); got != "" {
+		t.Errorf("X-Powered-By = %q, want removed", got)
+	}
+}
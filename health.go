@@ -0,0 +1,112 @@
+package ffcgiclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 用于Kubernetes等部署环境的存活/就绪探针
+
+// RouteHealth 单条路由的健康状态
+type RouteHealth struct {
+	Healthy  int               `json:"healthy"`  // 可用的后端数量，包括池已全部借出的后端
+	Backends map[string]string `json:"backends"` // 后端地址到状态（ok、exhausted或错误信息）的映射
+}
+
+// Readiness 就绪状态
+type Readiness struct {
+	Ready  bool                    `json:"ready"`
+	Routes map[string]*RouteHealth `json:"routes"`
+}
+
+// Readiness 检查每条路由是否至少有一个后端可用
+// 后端的状态根据路由的Client池判断：最近一次连接失败或被标记为不可用时连接后端确认是否恢复，
+// 池已全部借出时报告为exhausted，仍视为可用：高峰时所有副本同时借满，
+// 若因此全部退出就绪会进一步加重过载；开启ProbeDial或路由没有池时每次都连接后端
+// 没有配置后端的路由视为就绪
+func (g *Gateway) Readiness(ctx context.Context) *Readiness {
+	readiness := &Readiness{Ready: true, Routes: make(map[string]*RouteHealth)}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, rt := range g.Routes {
+		health := &RouteHealth{Backends: make(map[string]string)}
+		readiness.Routes[rt.Name] = health
+		for _, b := range rt.Backends {
+			wg.Add(1)
+			go func(rt *Route, health *RouteHealth, b *Backend) {
+				defer wg.Done()
+				status, ok := g.backendStatus(ctx, rt, b)
+				mutex.Lock()
+				defer mutex.Unlock()
+				health.Backends[b.String()] = status
+				if ok {
+					health.Healthy++
+				}
+			}(rt, health, b)
+		}
+	}
+	wg.Wait()
+	for _, rt := range g.Routes {
+		if len(rt.Backends) > 0 && readiness.Routes[rt.Name].Healthy == 0 {
+			readiness.Ready = false
+		}
+	}
+	return readiness
+}
+
+// backendStatus 返回后端的状态（ok、exhausted或不可用的原因）和是否可用
+func (g *Gateway) backendStatus(ctx context.Context, rt *Route, b *Backend) (string, bool) {
+	if !g.ProbeDial && rt.Pools != nil {
+		pool, created := rt.Pools.lookup(b)
+		if !created {
+			// 还没有请求使用此后端
+			if rt.Pools.healthy(b) {
+				return "ok", true
+			}
+		} else if stats := pool.Stats(); stats.DialErr == nil && rt.Pools.healthy(b) {
+			g.updateBackendState(b, nil)
+			if stats.Outstanding >= stats.Max {
+				return "exhausted", true
+			}
+			return "ok", true
+		}
+	}
+	conn, err := b.DialContext(ctx)
+	g.updateBackendState(b, err)
+	if err != nil {
+		return err.Error(), false
+	}
+	conn.Close()
+	return "ok", true
+}
+
+// LivenessHandler 返回存活探针（/healthz）的http.Handler，进程能处理请求即返回200
+func (g *Gateway) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// ReadinessHandler 返回就绪探针（/readyz）的http.Handler
+// 每条路由至少有一个后端可用时返回200，否则返回503，响应体为JSON格式的Readiness
+// timeout 限制每次探测连接后端的耗时，0表示默认的2秒
+func (g *Gateway) ReadinessHandler(timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		readiness := g.Readiness(ctx)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !readiness.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(readiness)
+	})
+}
@@ -0,0 +1,148 @@
+package ffcgiclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGatewayProbes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	up := &Backend{Network: "tcp", Address: ln.Addr().String()}
+	down := &Backend{Network: "unix", Address: filepath.Join(t.TempDir(), "missing.sock")}
+
+	tests := []struct {
+		name   string
+		routes []*Route
+		code   int
+		ready  bool
+	}{
+		{"all up", []*Route{{Name: "app", Backends: []*Backend{up}}, {Name: "static"}}, http.StatusOK, true},
+		{"one backend up", []*Route{{Name: "app", Backends: []*Backend{down, up}}}, http.StatusOK, true},
+		{"route down", []*Route{{Name: "app", Backends: []*Backend{up}}, {Name: "admin", Backends: []*Backend{down}}}, http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		g := &Gateway{Routes: tt.routes}
+
+		rec := httptest.NewRecorder()
+		g.LivenessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+			t.Errorf("%s: liveness = %d %q", tt.name, rec.Code, rec.Body.String())
+		}
+
+		rec = httptest.NewRecorder()
+		g.ReadinessHandler(time.Second).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		if rec.Code != tt.code {
+			t.Errorf("%s: readiness status = %d, want %d", tt.name, rec.Code, tt.code)
+		}
+		var readiness Readiness
+		if err := json.Unmarshal(rec.Body.Bytes(), &readiness); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if readiness.Ready != tt.ready || len(readiness.Routes) != len(tt.routes) {
+			t.Errorf("%s: readiness = %+v", tt.name, readiness)
+		}
+		for _, rt := range tt.routes {
+			health := readiness.Routes[rt.Name]
+			if health == nil || len(health.Backends) != len(rt.Backends) {
+				t.Errorf("%s: route %s = %+v", tt.name, rt.Name, health)
+				continue
+			}
+			for _, b := range rt.Backends {
+				if got := health.Backends[b.String()]; (got == "ok") != (b == up) {
+					t.Errorf("%s: backend %s = %q", tt.name, b, got)
+				}
+			}
+		}
+	}
+}
+
+func TestGatewayReadinessPools(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	up := &Backend{Network: "tcp", Address: ln.Addr().String()}
+	down := &Backend{Network: "unix", Address: filepath.Join(t.TempDir(), "missing.sock")}
+
+	tests := []struct {
+		name    string
+		backend *Backend
+		borrow  bool // 探测前借出Client
+		keep    bool // 探测时不归还
+		dial    bool
+		status  string // 为空表示连接错误
+		dials   int32  // 连接后端的总次数，包括借出Client时的连接
+	}{
+		{name: "unused", backend: up, status: "ok"},
+		{name: "idle", backend: up, borrow: true, status: "ok", dials: 1},
+		{name: "exhausted", backend: up, borrow: true, keep: true, status: "exhausted", dials: 1},
+		{name: "probe dial", backend: up, dial: true, status: "ok", dials: 1},
+		{name: "dial failed", backend: down, borrow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pools := NewPoolSet(PoolConfig{MaxActive: 1, Expires: time.Minute}, 0)
+			defer pools.Close(context.Background())
+			before := atomic.LoadInt32(&accepted)
+			if tt.borrow {
+				pool, err := pools.Pool(tt.backend)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c, err := pool.CreateClient()
+				if (err != nil) != (tt.backend == down) {
+					t.Fatalf("borrow: %v", err)
+				}
+				if err == nil {
+					if tt.keep {
+						defer c.Close()
+					} else {
+						c.Close()
+					}
+				}
+			}
+			g := &Gateway{Routes: []*Route{{Name: "app", Backends: []*Backend{tt.backend}, Pools: pools}}, ProbeDial: tt.dial}
+			readiness := g.Readiness(context.Background())
+			status := readiness.Routes["app"].Backends[tt.backend.String()]
+			if tt.status != "" && status != tt.status || tt.status == "" && status == "ok" {
+				t.Fatalf("status = %q, want %q", status, tt.status)
+			}
+			// 池已全部借出不影响就绪
+			if readiness.Ready != (status == "ok" || status == "exhausted") {
+				t.Fatalf("ready = %v with status %q", readiness.Ready, status)
+			}
+			deadline := time.Now().Add(time.Second)
+			for atomic.LoadInt32(&accepted)-before < tt.dials && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(10 * time.Millisecond)
+			if dials := atomic.LoadInt32(&accepted) - before; dials != tt.dials {
+				t.Fatalf("dialed %d times, want %d", dials, tt.dials)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 对冲请求：幂等的请求在一定时间内没有收到响应时，向另一个后端发送相同的请求，使用先响应的一个，
+// 减少个别慢后端造成的长尾延迟；另一个请求以FCGI_ABORT_REQUEST终止
+//
+//	pools := ffcgiclient.NewPoolSet(ffcgiclient.PoolConfig{MaxActive: 16}, 0)
+//	hedge := &ffcgiclient.Hedge{Delay: 200 * time.Millisecond, NewClient: pools.ClientFactory(backends...)}
+//	handler := ffcgiclient.Chain(ffcgiclient.NewPHPFS("/srv"), hedge.Middleware())(ffcgiclient.BasicHandler)
+
+// Hedge 对冲请求的策略，只对没有请求体的GET和HEAD请求生效
+// 需放在中间件链的最后，使对冲只重新执行发送请求的部分
+type Hedge struct {
+
+	// Delay 等待应用程序输出（通常是响应头）的时间，超过时发送对冲请求，0表示不对冲
+	Delay time.Duration
+
+	// NewClient 创建发送对冲请求的Client，通常是选择另一个后端的ClientFactory（如PoolSet.ClientFactory），
+	// 请求结束后关闭；为nil时不对冲
+	NewClient ClientFactory
+
+	hedged int64 // 发送的对冲请求数，原子操作
+	won    int64 // 对冲请求先响应的次数，原子操作
+}
+
+// HedgeStats 对冲请求的统计信息
+type HedgeStats struct {
+	Hedged int64 // 发送的对冲请求数
+	Won    int64 // 对冲请求先响应的次数
+}
+
+// Stats 返回对冲请求的统计信息
+func (h *Hedge) Stats() HedgeStats {
+	return HedgeStats{
+		Hedged: atomic.LoadInt64(&h.hedged),
+		Won:    atomic.LoadInt64(&h.won),
+	}
+}
+
+// hedgeable 检查请求是否可以对冲：没有请求体的GET或HEAD请求
+func hedgeable(req *Request) bool {
+	if req.Raw == nil || req.Raw.ContentLength != 0 {
+		return false
+	}
+	if req.Stdin != nil && req.Stdin != http.NoBody {
+		return false
+	}
+	return req.Raw.Method == http.MethodGet || req.Raw.Method == http.MethodHead
+}
+
+// Middleware 返回发送对冲请求的中间件
+func (h *Hedge) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if h.Delay <= 0 || h.NewClient == nil || !hedgeable(req) {
+				return inner(client, req)
+			}
+			primary, err := h.start(inner, client, nil, req)
+			if err != nil {
+				return nil, err
+			}
+
+			timer := time.NewTimer(h.Delay)
+			defer timer.Stop()
+			select {
+			case <-primary.ready:
+				return primary.win(), nil
+			case <-timer.C:
+			}
+
+			// 对冲请求无法发送时继续等待原始请求
+			c, err := h.NewClient()
+			if err != nil {
+				return primary.win(), nil
+			}
+			hedge := req.WithContext(req.Context())
+			hedge.Stdin = nil
+			secondary, err := h.start(inner, c, c, hedge)
+			if err != nil {
+				c.Close()
+				return primary.win(), nil
+			}
+			atomic.AddInt64(&h.hedged, 1)
+
+			select {
+			case <-primary.ready:
+				secondary.lose()
+				return primary.win(), nil
+			case <-secondary.ready:
+				atomic.AddInt64(&h.won, 1)
+				primary.lose()
+				return secondary.win(), nil
+			}
+		}
+	}
+}
+
+// start 以可以单独取消的上下文发送请求，并开始等待应用程序的第一次输出
+// client 为对冲请求的Client，请求结束后关闭；原始请求为nil
+func (h *Hedge) start(inner RequestHandler, c, client Client, req *Request) (*hedgeAttempt, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := inner(c, req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	a := &hedgeAttempt{resp: resp, client: client, cancel: cancel, ready: make(chan struct{})}
+	go a.peek()
+	return a, nil
+}
+
+// hedgeAttempt 原始请求或对冲请求
+type hedgeAttempt struct {
+	resp   *ResponsePipe
+	client Client // 对冲请求的Client，原始请求为nil
+	cancel context.CancelFunc
+
+	// peek读取的第一次输出，ready关闭后有效
+	buf   []byte
+	err   error
+	ready chan struct{}
+}
+
+// peek 读取应用程序的第一次输出
+func (a *hedgeAttempt) peek() {
+	buf := make([]byte, 4096)
+	n, err := io.ReadAtLeast(a.resp.stdOutReader, buf, 1)
+	a.buf, a.err = buf[:n], err
+	close(a.ready)
+}
+
+// win 等待第一次输出，返回包含第一次输出的响应，stdout读取结束时释放请求的资源
+func (a *hedgeAttempt) win() *ResponsePipe {
+	<-a.ready
+	var once sync.Once
+	finish := func() {
+		once.Do(a.release)
+	}
+	// 读取失败时原来的stdout会再次返回同样的错误
+	r := io.MultiReader(bytes.NewReader(a.buf), a.resp.stdOutReader)
+	a.resp.stdOutReader = &countingReader{r: r, n: new(int64), done: finish}
+	return a.resp
+}
+
+// lose 终止请求，在后台丢弃剩余的输出并释放请求的资源
+func (a *hedgeAttempt) lose() {
+	a.cancel()
+	go io.Copy(io.Discard, a.resp.stdErrReader)
+	go func() {
+		<-a.ready
+		a.resp.discardStdout()
+		a.release()
+	}()
+}
+
+// release 取消请求的上下文并关闭对冲请求的Client，stdout读取结束后调用
+// 被终止的请求此时可能仍在等待EndRequest，池中的Client在读取结束后才会被再次借出
+func (a *hedgeAttempt) release() {
+	a.cancel()
+	if a.client != nil {
+		a.client.Close()
+	}
+}
@@ -0,0 +1,182 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closeTracker 关闭时通知closed
+type closeTracker struct {
+	Client
+	closed chan struct{}
+}
+
+// Close 关闭Client并通知closed
+func (c *closeTracker) Close() error {
+	err := c.Client.Close()
+	close(c.closed)
+	return err
+}
+
+func TestHedge(t *testing.T) {
+	reply := func(body string) ConnFactory {
+		return recordBackend(func(sc *conn, reqID uint16, _ []byte) {
+			sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\n"+body))
+			sc.writeEndRequest(reqID, 0, statusRequestComplete)
+		})
+	}
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		slow       bool // 原始请求在被终止前不响应
+		hedgeErr   bool // 无法创建对冲请求的Client
+		want       string
+		wantStats  HedgeStats
+		wantClosed bool
+	}{
+		{name: "primary before delay", method: "GET", want: "primary"},
+		{name: "hedge wins", method: "GET", slow: true, want: "hedge", wantStats: HedgeStats{Hedged: 1, Won: 1}, wantClosed: true},
+		{name: "head", method: "HEAD", slow: true, want: "hedge", wantStats: HedgeStats{Hedged: 1, Won: 1}, wantClosed: true},
+		{name: "post not hedged", method: "POST", body: "x", want: "primary"},
+		{name: "hedge client error", method: "GET", slow: true, hedgeErr: true, want: "done"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started, release, aborted := make(chan struct{}, 1), make(chan struct{}), make(chan struct{}, 1)
+			primaryFactory := reply("primary")
+			if tt.slow {
+				primaryFactory = stallBackend(started, release, aborted)
+			}
+			primary, err := SimpleClientFactory(primaryFactory, 0)()
+			if err != nil {
+				t.Fatal(err)
+			}
+			closed := make(chan struct{})
+			h := &Hedge{Delay: 20 * time.Millisecond, NewClient: func() (Client, error) {
+				if tt.hedgeErr {
+					// 对冲失败时继续等待原始请求
+					close(release)
+					return nil, errors.New("no backend")
+				}
+				c, err := SimpleClientFactory(reply("hedge"), 0)()
+				if err != nil {
+					return nil, err
+				}
+				return &closeTracker{Client: c, closed: closed}, nil
+			}}
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req := NewRequest(httptest.NewRequest(tt.method, "/", body))
+			resp, err := h.Middleware()(BasicHandler)(primary, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			if err := resp.WriteTo(rec, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			if got := rec.Body.String(); got != tt.want {
+				t.Fatalf("body = %q, want %q", got, tt.want)
+			}
+			if stats := h.Stats(); stats != tt.wantStats {
+				t.Fatalf("stats = %+v, want %+v", stats, tt.wantStats)
+			}
+			if tt.wantClosed {
+				// 原始请求被终止，对冲请求的Client在响应结束后关闭
+				select {
+				case <-aborted:
+				case <-time.After(5 * time.Second):
+					t.Fatal("primary request not aborted")
+				}
+				select {
+				case <-closed:
+				case <-time.After(5 * time.Second):
+					t.Fatal("hedge client not closed")
+				}
+				// 被终止的原始请求可能仍在读取剩余的消息，不关闭其Client
+				return
+			}
+			primary.Close()
+		})
+	}
+}
+
+// TestHedgeReuseLoserPool 被终止的请求读取完剩余的消息后，其所在的池可以继续使用
+func TestHedgeReuseLoserPool(t *testing.T) {
+	reply := func(body string, delay time.Duration) ConnFactory {
+		return recordBackend(func(sc *conn, reqID uint16, _ []byte) {
+			time.Sleep(delay)
+			sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\n"+body))
+			sc.writeEndRequest(reqID, 0, statusRequestComplete)
+		})
+	}
+	tests := []struct {
+		name      string
+		hedgeWins bool
+		want      string
+	}{
+		{name: "hedge wins", hedgeWins: true, want: "hedge"},
+		{name: "primary wins", want: "primary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 失败的一方所在的池使用每个连接的第一个请求不响应的后端
+			started := make(chan struct{}, 1)
+			loser := NewClientPoolConfig(SimpleClientFactory(slowAbortBackend(started, 50*time.Millisecond), 0), PoolConfig{MaxActive: 1, Expires: time.Minute})
+			defer loser.Close(context.Background())
+			winnerFactory := SimpleClientFactory(reply(tt.want, 0), 0)
+			if !tt.hedgeWins {
+				winnerFactory = SimpleClientFactory(reply(tt.want, 100*time.Millisecond), 0)
+			}
+
+			primaryFactory, hedgeFactory := ClientFactory(loser.CreateClient), winnerFactory
+			if !tt.hedgeWins {
+				primaryFactory, hedgeFactory = winnerFactory, loser.CreateClient
+			}
+			primary, err := primaryFactory()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := &Hedge{Delay: 20 * time.Millisecond, NewClient: hedgeFactory}
+			resp, err := h.Middleware()(BasicHandler)(primary, NewRequest(httptest.NewRequest("GET", "/", nil)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			if err := resp.WriteTo(rec, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			if got := rec.Body.String(); got != tt.want {
+				t.Fatalf("body = %q, want %q", got, tt.want)
+			}
+			// 与DefaultHandler相同，响应结束后关闭原始请求的Client
+			primary.Close()
+
+			// 后端对新连接的第一个请求不响应，只有复用原来的连接才能得到响应
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c, err := loser.CreateClientContext(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			next, err := c.Do(NewRequest(httptest.NewRequest("GET", "/", nil).WithContext(ctx)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, _ := io.ReadAll(next.stdOutReader)
+			if string(out) != "Content-Type: text/plain\r\n\r\nnext" || next.Err() != nil {
+				t.Fatalf("stdout = %q, Err() = %v", out, next.Err())
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package ffcgiclient
+
+import (
+	"errors"
+
+	"suilz/ffcgi-client/fcgiproto"
+)
+
+// 在client发送和接收每个FastCGI消息时调用的钩子，用于协议层的统计、测试中的故障注入（丢弃、延迟、篡改消息）
+//
+//	hooks := &ffcgiclient.RecordHooks{
+//		OnReceiveRecord: func(rec *fcgiproto.Record) error {
+//			if rec.Header.Type == fcgiproto.TypeStdout && rand.Intn(100) == 0 {
+//				return ffcgiclient.ErrDropRecord
+//			}
+//			return nil
+//		},
+//	}
+//	factory := ffcgiclient.NewClientFactory(connFactory, ffcgiclient.ClientConfig{Hooks: hooks})
+
+// ErrDropRecord 由钩子返回，表示丢弃当前消息
+var ErrDropRecord = errors.New("fcgi: record dropped by hook")
+
+// RecordHooks 消息钩子，按消息在连接上的顺序调用，调用时持有连接的锁，不能在钩子中使用同一个client
+// 钩子可以修改rec的Type、RequestID和Content（长度不超过fcgiproto.MaxContent），
+// ContentLength和PaddingLength按修改后的内容重新计算；需要延迟时直接在钩子中等待
+type RecordHooks struct {
+
+	// OnSendRecord 消息写出前调用，返回ErrDropRecord时不发送该消息，返回其他错误时不发送并作为写入错误返回
+	OnSendRecord func(rec *fcgiproto.Record) error
+
+	// OnReceiveRecord 读取到消息后调用，rec.Content在下一次读取前有效；
+	// 返回ErrDropRecord时丢弃该消息并继续读取，返回其他错误时作为读取错误返回（连接随后被关闭）
+	OnReceiveRecord func(rec *fcgiproto.Record) error
+}
+
+// send 对要发送的消息调用OnSendRecord，返回修改后的消息，丢弃时drop为true
+func (hk *RecordHooks) send(t recType, reqID uint16, b []byte) (recType, uint16, []byte, bool, error) {
+	if hk == nil || hk.OnSendRecord == nil {
+		return t, reqID, b, false, nil
+	}
+	rec := fcgiproto.Record{
+		Header:  fcgiproto.Header{Version: fcgiproto.Version1, Type: t, RequestID: reqID},
+		Content: b,
+	}
+	if err := hk.OnSendRecord(&rec); err != nil {
+		if errors.Is(err, ErrDropRecord) {
+			return t, reqID, b, true, nil
+		}
+		return t, reqID, b, false, err
+	}
+	if len(rec.Content) > maxWrite {
+		return t, reqID, b, false, fcgiproto.ErrContentTooLong
+	}
+	return rec.Header.Type, rec.Header.RequestID, rec.Content, false, nil
+}
+
+// receive 对读取到的消息调用OnReceiveRecord，并把修改写回rec，丢弃时drop为true
+func (hk *RecordHooks) receive(rec *record) (drop bool, err error) {
+	if hk == nil || hk.OnReceiveRecord == nil {
+		return false, nil
+	}
+	r := fcgiproto.Record{Header: rec.h, Content: rec.content()}
+	if err := hk.OnReceiveRecord(&r); err != nil {
+		if errors.Is(err, ErrDropRecord) {
+			return true, nil
+		}
+		return false, err
+	}
+	if len(r.Content) > maxWrite {
+		return false, newRecordError(rec.h, fcgiproto.ErrContentTooLong)
+	}
+	rec.h = fcgiproto.NewHeader(r.Header.Type, r.Header.RequestID, copy(rec.buf[:], r.Content))
+	if err := rec.h.Validate(); err != nil {
+		return false, newRecordError(rec.h, err)
+	}
+	return false, nil
+}
@@ -0,0 +1,206 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"suilz/ffcgi-client/fcgiproto"
+)
+
+func TestRecordHooks(t *testing.T) {
+	// 后端把请求体原样写入stdout，并写一条stderr
+	backend := recordBackend(func(sc *conn, reqID uint16, stdin []byte) {
+		sc.writeRecord(typeStderr, reqID, []byte("notice"))
+		sc.writeRecord(typeStdout, reqID, append([]byte("Content-Type: text/plain\r\n\r\n"), stdin...))
+		sc.writeRecord(typeStdout, reqID, nil)
+		sc.writeEndRequest(reqID, 0, statusRequestComplete)
+	})
+	errInjected := errors.New("injected")
+	tests := []struct {
+		name         string
+		hooks        RecordHooks
+		stdin        string
+		wantStdout   string
+		wantStderr   string
+		wantReadErrs bool
+	}{
+		{
+			name:       "nil hooks",
+			stdin:      "hi",
+			wantStdout: "hi",
+			wantStderr: "notice",
+		},
+		{
+			name: "drop received stderr",
+			hooks: RecordHooks{OnReceiveRecord: func(rec *fcgiproto.Record) error {
+				if rec.Header.Type == fcgiproto.TypeStderr {
+					return ErrDropRecord
+				}
+				return nil
+			}},
+			stdin:      "hi",
+			wantStdout: "hi",
+		},
+		{
+			name: "corrupt received stdout",
+			hooks: RecordHooks{OnReceiveRecord: func(rec *fcgiproto.Record) error {
+				if rec.Header.Type == fcgiproto.TypeStdout {
+					rec.Content = bytes.Replace(rec.Content, []byte("hi"), []byte("HELLO"), 1)
+				}
+				return nil
+			}},
+			stdin:      "hi",
+			wantStdout: "HELLO",
+			wantStderr: "notice",
+		},
+		{
+			name: "rewrite sent stdin",
+			hooks: RecordHooks{OnSendRecord: func(rec *fcgiproto.Record) error {
+				if rec.Header.Type == fcgiproto.TypeStdin && len(rec.Content) > 0 {
+					rec.Content = []byte("changed")
+				}
+				return nil
+			}},
+			stdin:      "hi",
+			wantStdout: "changed",
+			wantStderr: "notice",
+		},
+		{
+			name: "drop sent stdin",
+			hooks: RecordHooks{OnSendRecord: func(rec *fcgiproto.Record) error {
+				if rec.Header.Type == fcgiproto.TypeStdin && len(rec.Content) > 0 {
+					return ErrDropRecord
+				}
+				return nil
+			}},
+			stdin:      "hi",
+			wantStdout: "",
+			wantStderr: "notice",
+		},
+		{
+			name: "receive error",
+			hooks: RecordHooks{OnReceiveRecord: func(rec *fcgiproto.Record) error {
+				if rec.Header.Type == fcgiproto.TypeEndRequest {
+					return errInjected
+				}
+				return nil
+			}},
+			stdin:        "hi",
+			wantStdout:   "hi",
+			wantStderr:   "notice",
+			wantReadErrs: true,
+		},
+		{
+			name: "truncated end request",
+			hooks: RecordHooks{OnReceiveRecord: func(rec *fcgiproto.Record) error {
+				if rec.Header.Type == fcgiproto.TypeEndRequest {
+					rec.Content = rec.Content[:2]
+				}
+				return nil
+			}},
+			stdin:        "hi",
+			wantStdout:   "hi",
+			wantStderr:   "notice",
+			wantReadErrs: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hooks := tt.hooks
+			c, err := NewClientFactory(backend, ClientConfig{Hooks: &hooks})()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			req := NewRequest(nil)
+			req.Stdin = io.NopCloser(strings.NewReader(tt.stdin))
+			resp, err := c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stderr []byte
+			done := make(chan struct{})
+			go func() {
+				stderr, _ = io.ReadAll(resp.stdErrReader)
+				close(done)
+			}()
+			stdout, _ := io.ReadAll(resp.stdOutReader)
+			<-done
+			if got := strings.TrimPrefix(string(stdout), "Content-Type: text/plain\r\n\r\n"); got != tt.wantStdout {
+				t.Errorf("stdout = %q, want %q", got, tt.wantStdout)
+			}
+			if string(stderr) != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", stderr, tt.wantStderr)
+			}
+			if err := resp.Err(); (err != nil) != tt.wantReadErrs {
+				t.Errorf("Err() = %v, want error %v", err, tt.wantReadErrs)
+			}
+		})
+	}
+}
+
+// TestRecordHooksCount 测试钩子按类型统计双方的消息
+func TestRecordHooksCount(t *testing.T) {
+	backend := recordBackend(func(sc *conn, reqID uint16, _ []byte) {
+		sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\nok"))
+		sc.writeRecord(typeStdout, reqID, nil)
+		sc.writeEndRequest(reqID, 0, statusRequestComplete)
+	})
+	sent := make(map[fcgiproto.RecType]int)
+	received := make(map[fcgiproto.RecType]int)
+	hooks := &RecordHooks{
+		OnSendRecord:    func(rec *fcgiproto.Record) error { sent[rec.Header.Type]++; return nil },
+		OnReceiveRecord: func(rec *fcgiproto.Record) error { received[rec.Header.Type]++; return nil },
+	}
+	c, err := NewClientFactory(backend, ClientConfig{Hooks: hooks})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := NewRequest(nil)
+	req.Stdin = io.NopCloser(strings.NewReader(strings.Repeat("x", 2000)))
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.stdOutReader)
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if sent[fcgiproto.TypeBeginRequest] != 1 || sent[fcgiproto.TypeParams] < 1 || sent[fcgiproto.TypeStdin] != 2 {
+		t.Errorf("sent = %v", sent)
+	}
+	if received[fcgiproto.TypeStdout] != 2 || received[fcgiproto.TypeEndRequest] != 1 {
+		t.Errorf("received = %v", received)
+	}
+}
+
+// TestRecordHooksSendError 测试OnSendRecord返回错误时不写出消息
+func TestRecordHooksSendError(t *testing.T) {
+	errInjected := errors.New("injected")
+	var buf bytes.Buffer
+	c := newConn(nopWriteCloser{&buf})
+	c.hooks = &RecordHooks{OnSendRecord: func(rec *fcgiproto.Record) error {
+		if rec.Header.Type == fcgiproto.TypeAbortRequest {
+			return errInjected
+		}
+		return nil
+	}}
+	if err := c.writeAbortRequest(1); !errors.Is(err, errInjected) {
+		t.Fatalf("writeAbortRequest() = %v, want %v", err, errInjected)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("wrote %d bytes", buf.Len())
+	}
+	// 修改后的内容超过单个消息的最大长度
+	c.hooks.OnSendRecord = func(rec *fcgiproto.Record) error {
+		rec.Content = make([]byte, fcgiproto.MaxContent+1)
+		return nil
+	}
+	if err := c.writeRecord(typeStdout, 1, nil); !errors.Is(err, fcgiproto.ErrContentTooLong) {
+		t.Fatalf("writeRecord() = %v, want ErrContentTooLong", err)
+	}
+}
@@ -0,0 +1,98 @@
+package ffcgiclient
+
+import (
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// 借出后未归还的Client的检测，用于发现遗漏了Close的代码路径
+
+// LeakReport 未归还Client的报告
+type LeakReport struct {
+	CheckedOut time.Time     // 借出时间
+	Held       time.Duration // 已借出的时长
+	Stack      []byte        // 借出时的调用栈
+	Collected  bool          // 是否因被垃圾回收而发现，此时借出名额已被收回
+}
+
+// lease 一次借出的记录
+// 超时检查不引用PoolClient，以免形成带有finalizer的循环引用而无法被回收
+type lease struct {
+	start time.Time
+	stack []byte
+	timer *time.Timer
+	ended int32 // 是否已归还
+}
+
+// SetLeakDetection 开启泄漏检测：借出时记录调用栈，
+// 借出超过maxLease（大于0时）或未归还就被垃圾回收时调用onLeak，
+// onLeak为nil时输出到标准日志；测试中可以在onLeak中调用t.Error或panic
+// 记录调用栈有额外开销，建议只在调试和测试时开启，应在使用池之前设置
+func (p *ClientPool) SetLeakDetection(maxLease time.Duration, onLeak func(report LeakReport)) {
+	if onLeak == nil {
+		onLeak = func(report LeakReport) {
+			log.Printf("pool client not returned after %s (collected: %t), checked out at:\n%s",
+				report.Held, report.Collected, report.Stack)
+		}
+	}
+	p.leakDetect = true
+	p.maxLease = maxLease
+	p.onLeak = onLeak
+}
+
+// startLease 记录一次借出
+func (p *ClientPool) startLease(pc *PoolClient) {
+	if !p.leakDetect {
+		return
+	}
+	clock := p.config.Clock
+	l := &lease{start: clock.Now(), stack: debug.Stack()}
+	if p.maxLease > 0 {
+		onLeak := p.onLeak
+		l.timer = time.AfterFunc(p.maxLease, func() {
+			if atomic.LoadInt32(&l.ended) == 0 {
+				onLeak(LeakReport{CheckedOut: l.start, Held: clock.Now().Sub(l.start), Stack: l.stack})
+			}
+		})
+	}
+	pc.mutex.Lock()
+	pc.lease = l
+	pc.mutex.Unlock()
+}
+
+// endLease 结束借出记录，调用时需持有pc.mutex
+func (pc *PoolClient) endLease() {
+	if pc.lease != nil {
+		atomic.StoreInt32(&pc.lease.ended, 1)
+		if pc.lease.timer != nil {
+			pc.lease.timer.Stop()
+		}
+	}
+	pc.lease = nil
+}
+
+// trackCollect 为开启了泄漏检测的池中的Client设置垃圾回收时的检查
+func (p *ClientPool) trackCollect(pc *PoolClient) {
+	if p.leakDetect {
+		runtime.SetFinalizer(pc, p.collected)
+	}
+}
+
+// collected Client被垃圾回收时调用，借出未归还时报告并收回借出名额
+func (p *ClientPool) collected(pc *PoolClient) {
+	pc.mutex.Lock()
+	l := pc.lease
+	leaked := !pc.returned && l != nil
+	pc.returned = true
+	pc.mutex.Unlock()
+	if !leaked {
+		return
+	}
+	p.onLeak(LeakReport{CheckedOut: l.start, Held: p.config.Clock.Now().Sub(l.start), Stack: l.stack, Collected: true})
+	p.discard(pc)
+	// 与归还相同，经过release收回名额，保持缩小MaxActive时未收回名额的计数
+	p.release()
+}
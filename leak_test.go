@@ -0,0 +1,116 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolLeakDetection(t *testing.T) {
+	reports := make(chan LeakReport, 4)
+	pool := NewClientPool(SimpleClientFactoryNoConn(pipeConnFactory, 0), 1, time.Minute)
+	pool.SetLeakDetection(20*time.Millisecond, func(report LeakReport) { reports <- report })
+
+	// 借出超过maxLease
+	c, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case report := <-reports:
+		if report.Collected || report.Held < 20*time.Millisecond || !strings.Contains(string(report.Stack), "TestPoolLeakDetection") {
+			t.Fatalf("report = %+v", report)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("leak not reported")
+	}
+	c.Close()
+
+	// 及时归还的Client不报告
+	c, err = pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	select {
+	case report := <-reports:
+		t.Fatalf("unexpected report %+v", report)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 未归还就被垃圾回收时报告并收回名额
+	pool = NewClientPool(SimpleClientFactoryNoConn(pipeConnFactory, 0), 1, time.Minute)
+	pool.SetLeakDetection(0, func(report LeakReport) { reports <- report })
+	if _, err := pool.CreateClient(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(5 * time.Second)
+	for collected := false; !collected; {
+		runtime.GC()
+		select {
+		case report := <-reports:
+			if !report.Collected {
+				t.Fatalf("report = %+v", report)
+			}
+			collected = true
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("collected client not reported")
+		}
+	}
+	if stats := pool.Stats(); stats.Outstanding != 0 || stats.Created != 0 {
+		t.Fatalf("stats = %+v, want slot reclaimed", stats)
+	}
+	c, err = pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestPoolLeakCollectedAfterTune(t *testing.T) {
+	reports := make(chan LeakReport, 1)
+	pool := NewClientPool(SimpleClientFactoryNoConn(pipeConnFactory, 0), 2, time.Minute)
+	pool.SetLeakDetection(0, func(report LeakReport) { reports <- report })
+	held, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	if _, err := pool.CreateClient(); err != nil {
+		t.Fatal(err)
+	}
+	// 与tune相同：两个名额都已借出时缩小到1，借出的名额在归还时收回
+	pool.mutex.Lock()
+	pool.tuned = true
+	pool.pending = 1
+	pool.config.MaxActive = 1
+	pool.mutex.Unlock()
+
+	deadline := time.After(5 * time.Second)
+	for collected := false; !collected; {
+		runtime.GC()
+		select {
+		case <-reports:
+			collected = true
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("collected client not reported")
+		}
+	}
+	if stats := pool.Stats(); stats.Outstanding != 1 {
+		t.Fatalf("stats = %+v, want 1 outstanding", stats)
+	}
+	// 被回收的名额应被保留，held未归还时不能超过缩小后的MaxActive
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if c, err := pool.CreateClientContext(ctx); !errors.Is(err, ErrPoolTimeout) {
+		if c != nil {
+			c.Close()
+		}
+		t.Fatalf("err = %v, want ErrPoolTimeout", err)
+	}
+}
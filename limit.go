@@ -0,0 +1,155 @@
+package ffcgiclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// 限制请求体和响应体的大小，避免失控的脚本或上传占用网关资源
+
+// ErrBodyTooLarge 请求体或响应体超过限制
+var ErrBodyTooLarge = errors.New("body too large")
+
+// BodyLimit 限制发送到stdin的请求体和从stdout复制的响应体的字节数
+type BodyLimit struct {
+
+	// MaxRequest 请求体的最大字节数，0表示不限制
+	// Content-Length超过限制时不发送请求，直接返回413；
+	// 发送过程中超过限制时终止FastCGI请求，应用程序尚未输出响应头时返回413
+	MaxRequest int64
+
+	// MaxResponse 响应体的最大字节数，0表示不限制
+	// Content-Length超过限制时终止FastCGI请求并返回502；
+	// 复制过程中超过限制时终止FastCGI请求，已发送的响应被截断
+	MaxResponse int64
+}
+
+// Middleware 返回限制请求体和响应体大小的中间件
+func (l *BodyLimit) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if l.MaxRequest > 0 && req.Raw != nil && req.Raw.ContentLength > l.MaxRequest {
+				return newStatusResponse(http.StatusRequestEntityTooLarge), nil
+			}
+			var over int32
+			if l.MaxRequest > 0 && req.Stdin != nil {
+				req.Stdin = &limitedBody{ReadCloser: req.Stdin, n: l.MaxRequest, over: &over}
+			}
+			// 取消上下文时client发送FCGI_ABORT_REQUEST
+			ctx, cancel := context.WithCancel(req.Context())
+			resp, err := inner(client, req.WithContext(ctx))
+			if err != nil {
+				cancel()
+				return resp, err
+			}
+			return l.limitResponse(resp, &over, cancel), nil
+		}
+	}
+}
+
+// limitResponse 按限制转发resp，结束后调用cancel
+func (l *BodyLimit) limitResponse(resp *ResponsePipe, over *int32, cancel context.CancelFunc) *ResponsePipe {
+	p := NewResponsePipe()
+	p.headerLimits = resp.headerLimits
+	p.upstream = resp
+
+	// 转发stderr
+	go func() {
+		io.Copy(p.stdErrWriter, resp.stdErrReader)
+		p.stdErrWriter.Close()
+	}()
+
+	go func() {
+		defer cancel()
+		header, br, err := readCGIHeader(resp.stdOutReader, resp.headerLimits)
+		if atomic.LoadInt32(over) == 1 {
+			// 请求体超过限制，请求已被终止
+			resp.discardStdout()
+			l.writeStatus(p, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			resp.discardStdout()
+			p.setErr(resp.Err())
+			p.stdOutWriter.(*io.PipeWriter).CloseWithError(err)
+			return
+		}
+		if l.MaxResponse > 0 {
+			if n, perr := strconv.ParseInt(header.Get("Content-Length"), 10, 64); perr == nil && n > l.MaxResponse {
+				cancel()
+				resp.discardStdout()
+				l.writeStatus(p, http.StatusBadGateway)
+				return
+			}
+		}
+		if err = writeCGIHeader(p.stdOutWriter, header); err == nil {
+			err = l.copyBody(p.stdOutWriter, br, cancel)
+		}
+		resp.discardStdout()
+		// 传递上游的传输错误
+		p.setErr(resp.Err())
+		if err != nil {
+			p.stdOutWriter.(*io.PipeWriter).CloseWithError(err)
+			return
+		}
+		p.stdOutWriter.Close()
+	}()
+	return p
+}
+
+// copyBody 复制响应体，超过MaxResponse时终止请求并返回ErrBodyTooLarge
+func (l *BodyLimit) copyBody(w io.Writer, br *bufio.Reader, cancel context.CancelFunc) error {
+	if l.MaxResponse <= 0 {
+		_, err := io.Copy(w, br)
+		return err
+	}
+	n, err := io.Copy(w, io.LimitReader(br, l.MaxResponse))
+	if err != nil {
+		return err
+	}
+	if n == l.MaxResponse {
+		if _, err = br.Peek(1); err == nil {
+			cancel()
+			return ErrBodyTooLarge
+		}
+	}
+	return nil
+}
+
+// writeStatus 向p写入只包含状态码的响应
+func (l *BodyLimit) writeStatus(p *ResponsePipe, code int) {
+	header, body := statusResponse(code)
+	if err := writeCGIHeader(p.stdOutWriter, header); err == nil {
+		io.Copy(p.stdOutWriter, body)
+	}
+	p.stdOutWriter.Close()
+}
+
+// limitedBody 读取超过n字节时标记over并返回ErrBodyTooLarge
+type limitedBody struct {
+	io.ReadCloser
+	n    int64 // 剩余可读取的字节数
+	over *int32
+}
+
+// Read 实现io.Reader
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// 多读取一个字节以判断是否超过限制
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.n {
+		n = int(b.n)
+		b.n = 0
+		atomic.StoreInt32(b.over, 1)
+		return n, ErrBodyTooLarge
+	}
+	b.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,138 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBodyLimit(t *testing.T) {
+	l := &BodyLimit{MaxRequest: 4, MaxResponse: 8}
+	stub := &stubClient{recorded: map[string][]byte{
+		"small":  []byte("Content-Type: text/plain\r\n\r\nok"),
+		"length": []byte("Content-Type: text/plain\r\nContent-Length: 20\r\n\r\n01234567890123456789"),
+		"stream": []byte("Content-Type: text/plain\r\n\r\n01234567890123456789"),
+	}}
+	handler := l.Middleware()(BasicHandler)
+	do := func(r *http.Request) (*httptest.ResponseRecorder, error) {
+		resp, err := handler(stub, NewRequest(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		return rec, resp.WriteTo(rec, io.Discard)
+	}
+
+	// 请求体的Content-Length超过限制
+	rec, _ := do(httptest.NewRequest("POST", "/?size=small", strings.NewReader("12345")))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", rec.Code)
+	}
+
+	// 响应体的Content-Length超过限制
+	rec, _ = do(httptest.NewRequest("GET", "/?size=length", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", rec.Code)
+	}
+
+	// 复制过程中超过限制时截断
+	rec, err := do(httptest.NewRequest("GET", "/?size=stream", nil))
+	if !errors.Is(err, ErrBodyTooLarge) || rec.Body.String() != "01234567" {
+		t.Fatalf("err = %v, body = %q", err, rec.Body.String())
+	}
+
+	rec, err = do(httptest.NewRequest("GET", "/?size=small", nil))
+	if err != nil || rec.Body.String() != "ok" {
+		t.Fatalf("err = %v, body = %q", err, rec.Body.String())
+	}
+
+	// 流式请求体超过限制
+	var over int32
+	body := &limitedBody{ReadCloser: io.NopCloser(strings.NewReader("123456")), n: 4, over: &over}
+	if b, err := io.ReadAll(body); !errors.Is(err, ErrBodyTooLarge) || string(b) != "1234" || over != 1 {
+		t.Fatalf("read %q, %v, over = %d", b, err, over)
+	}
+}
+
+// TestBodyLimitContext 测试终止请求的上下文派生自Request.Context()，没有原始请求时不panic
+func TestBodyLimitContext(t *testing.T) {
+	type key struct{}
+	l := &BodyLimit{MaxRequest: 4, MaxResponse: 8}
+	parent := context.WithValue(context.Background(), key{}, "v")
+	for _, req := range []*Request{
+		NewRequest(httptest.NewRequest("GET", "/", nil)).WithContext(parent),
+		NewRequest(nil).WithContext(parent),
+	} {
+		client := &contextClient{}
+		resp, err := l.Middleware()(BasicHandler)(client, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.WriteTo(httptest.NewRecorder(), io.Discard)
+		if client.ctx.Value(key{}) != "v" {
+			t.Fatal("request context does not derive from the WithContext context")
+		}
+		// 响应结束后BodyLimit取消的上下文到达client
+		select {
+		case <-client.ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("BodyLimit cancel did not reach the client")
+		}
+	}
+}
+
+// contextClient 记录请求的上下文并返回固定的响应
+type contextClient struct {
+	stubClient
+	ctx context.Context
+}
+
+// Do 实现Client
+func (c *contextClient) Do(req *Request) (*ResponsePipe, error) {
+	c.ctx = req.Context()
+	p := NewResponsePipe()
+	go func() {
+		p.stdOutWriter.Write([]byte("Content-Type: text/plain\r\n\r\nok"))
+		p.Close()
+	}()
+	return p, nil
+}
+
+func TestBodyLimitTiming(t *testing.T) {
+	factory := serveBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	pool := NewClientPoolConfig(SimpleClientFactoryNoConn(factory, 0), PoolConfig{MaxActive: 1})
+	defer pool.Close(context.Background())
+	c, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// ServerTimingMiddleware从BodyLimit返回的响应取得后端的耗时
+	l := &BodyLimit{MaxRequest: 1 << 20, MaxResponse: 1 << 20}
+	h := ServerTimingMiddleware(l.Middleware()(NewPHPFS("/srv")(BasicHandler)))
+	resp, err := h(c, NewRequest(httptest.NewRequest("GET", "/index.php", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err := resp.WriteTo(rec, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.String() != "ok" {
+		t.Fatalf("body = %q", rec.Body.String())
+	}
+	if timing := resp.Timing(); timing.Write <= 0 || timing.Total <= 0 {
+		t.Errorf("Timing = %+v, want backend timing", timing)
+	}
+	if header := rec.Header().Get("Server-Timing"); !strings.Contains(header, "write;") {
+		t.Errorf("Server-Timing = %q, missing write", header)
+	}
+}
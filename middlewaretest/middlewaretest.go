@@ -0,0 +1,126 @@
+// Package middlewaretest 提供测试中间件参数映射的辅助方法
+// 以表格的形式构造请求，检查中间件（或中间件链）生成的fastcgi参数，不需要连接后端
+package middlewaretest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	ffcgiclient "suilz/ffcgi-client"
+)
+
+// Result 中间件处理一个请求的结果
+type Result struct {
+
+	// Called 中间件是否调用了下一个处理器（即请求会被发送到后端）
+	Called bool
+
+	// Params 发送到后端的参数，Called为false时为nil
+	Params map[string]string
+
+	// Status 中间件直接应答时的状态码，Called为true时为0
+	Status int
+
+	// Header 中间件直接应答时的响应头
+	Header http.Header
+}
+
+// Do 使用mw处理请求r，返回处理结果
+func Do(mw ffcgiclient.Middleware, r *http.Request) (Result, error) {
+	var result Result
+	inner := func(client ffcgiclient.Client, req *ffcgiclient.Request) (*ffcgiclient.ResponsePipe, error) {
+		result.Called = true
+		result.Params = req.Params.Map()
+		resp := ffcgiclient.NewResponsePipe()
+		resp.Close()
+		return resp, nil
+	}
+	resp, err := mw(inner)(nil, ffcgiclient.NewRequest(r))
+	if err != nil || result.Called {
+		return result, err
+	}
+	// 读取中间件的直接应答
+	rec := httptest.NewRecorder()
+	if err = resp.WriteTo(rec, io.Discard); err != nil {
+		return result, err
+	}
+	result.Status = rec.Code
+	result.Header = rec.Header()
+	return result, nil
+}
+
+// Case 一个测试用例
+type Case struct {
+
+	// Name 用例名称，为空时使用请求方法和目标
+	Name string
+
+	// Request 测试的请求，可以用httptest.NewRequest构造
+	Request *http.Request
+
+	// Params 期望的参数值，只检查列出的参数
+	Params map[string]string
+
+	// Absent 期望不存在的参数
+	Absent []string
+
+	// Status 期望中间件直接应答的状态码，0表示期望请求被发送到后端
+	Status int
+}
+
+// Run 对每个用例执行mw并检查结果，每个用例作为一个子测试
+func Run(t *testing.T, mw ffcgiclient.Middleware, cases []Case) {
+	t.Helper()
+	for _, c := range cases {
+		c := c
+		name := c.Name
+		if name == "" {
+			name = c.Request.Method + " " + c.Request.URL.String()
+		}
+		t.Run(name, func(t *testing.T) {
+			result, err := Do(mw, c.Request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.Status != 0 {
+				if result.Called {
+					t.Fatalf("request was passed to backend, want status %d", c.Status)
+				}
+				if result.Status != c.Status {
+					t.Fatalf("status = %d, want %d", result.Status, c.Status)
+				}
+				return
+			}
+			if !result.Called {
+				t.Fatalf("middleware answered with status %d, want request passed to backend", result.Status)
+			}
+			Check(t, result.Params, c.Params, c.Absent)
+		})
+	}
+}
+
+// Check 检查参数是否符合期望，want中列出的参数必须存在且相等，absent中的参数必须不存在
+func Check(t testing.TB, params, want map[string]string, absent []string) {
+	t.Helper()
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		got, ok := params[k]
+		if !ok {
+			t.Errorf("%s missing, want %q", k, want[k])
+		} else if got != want[k] {
+			t.Errorf("%s = %q, want %q", k, got, want[k])
+		}
+	}
+	for _, k := range absent {
+		if v, ok := params[k]; ok {
+			t.Errorf("%s = %q, want absent", k, v)
+		}
+	}
+}
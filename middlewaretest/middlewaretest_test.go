@@ -0,0 +1,52 @@
+package middlewaretest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ffcgiclient "suilz/ffcgi-client"
+)
+
+// TestPHPFS 锁定NewPHPFS生成的参数
+func TestPHPFS(t *testing.T) {
+	post := httptest.NewRequest("POST", "http://example.com:8080/app/index.php/users/1?page=2", nil)
+	post.Header.Set("Content-Type", "application/json")
+	post.Header.Set("Proxy", "http://evil.example")
+
+	Run(t, ffcgiclient.Chain(ffcgiclient.NewPHPFS("/var/www"), ffcgiclient.HttpoxyMiddleware), []Case{
+		{
+			Request: httptest.NewRequest("GET", "/", nil),
+			Params: map[string]string{
+				"REQUEST_METHOD":  "GET",
+				"REQUEST_URI":     "/",
+				"SCRIPT_NAME":     "/index.php",
+				"SCRIPT_FILENAME": "/var/www/index.php",
+				"DOCUMENT_ROOT":   "/var/www",
+				"SERVER_NAME":     "example.com",
+				"SERVER_PORT":     "80",
+			},
+		},
+		{
+			Name:    "path info",
+			Request: post,
+			Params: map[string]string{
+				"REQUEST_METHOD":  "POST",
+				"CONTENT_TYPE":    "application/json",
+				"QUERY_STRING":    "page=2",
+				"SCRIPT_NAME":     "/app/index.php",
+				"SCRIPT_FILENAME": "/var/www/app/index.php",
+				"PATH_INFO":       "/users/1",
+				"DOCUMENT_URI":    "/app/index.php/users/1",
+				"SERVER_PORT":     "8080",
+				"HTTP_HOST":       "example.com:8080",
+			},
+			Absent: []string{"HTTP_PROXY", "HTTPS"},
+		},
+		{
+			Name:    "traversal",
+			Request: httptest.NewRequest("GET", "/../etc/passwd", nil),
+			Status:  http.StatusBadRequest,
+		},
+	})
+}
@@ -0,0 +1,372 @@
+package ffcgiclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 读取nginx的fastcgi_param配置片段（例如fastcgi_params、fastcgi.conf），便于从nginx迁移
+// 支持$document_root、$fastcgi_script_name等常用变量，变量的值取自之前的中间件映射的参数
+
+// NginxParams 由nginx配置片段解析得到的fastcgi_param指令
+type NginxParams struct {
+	params []nginxParam
+}
+
+// nginxParam 一条fastcgi_param指令
+type nginxParam struct {
+	name       string
+	value      []nginxSegment
+	ifNotEmpty bool
+}
+
+// nginxSegment 参数值的一段，variable为空时是字面量
+type nginxSegment struct {
+	literal  string
+	variable string
+}
+
+// nginxVariables nginx变量对应的FastCGI参数
+var nginxVariables = map[string]string{
+	"document_root":       "DOCUMENT_ROOT",
+	"fastcgi_script_name": "SCRIPT_NAME",
+	"fastcgi_path_info":   "PATH_INFO",
+	"request_filename":    "SCRIPT_FILENAME",
+	"document_uri":        "DOCUMENT_URI",
+	"uri":                 "DOCUMENT_URI",
+	"request_uri":         "REQUEST_URI",
+	"request_method":      "REQUEST_METHOD",
+	"query_string":        "QUERY_STRING",
+	"args":                "QUERY_STRING",
+	"content_type":        "CONTENT_TYPE",
+	"content_length":      "CONTENT_LENGTH",
+	"server_name":         "SERVER_NAME",
+	"server_port":         "SERVER_PORT",
+	"server_protocol":     "SERVER_PROTOCOL",
+	"remote_addr":         "REMOTE_ADDR",
+	"remote_port":         "REMOTE_PORT",
+	"request_scheme":      "REQUEST_SCHEME",
+	"scheme":              "REQUEST_SCHEME",
+	"https":               "HTTPS",
+	"nginx_version":       "",
+	"host":                "",
+	"is_args":             "",
+	"server_addr":         "",
+	"realpath_root":       "",
+}
+
+// nginxVariablePrefixes 以这些前缀开头的变量取自请求头、查询参数和Cookie
+var nginxVariablePrefixes = []string{"http_", "arg_", "cookie_"}
+
+// LoadNginxParams 读取nginx配置片段文件
+func LoadNginxParams(filename string) (*NginxParams, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := ParseNginxParams(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return p, nil
+}
+
+// ParseNginxParams 解析nginx配置片段中的fastcgi_param指令
+// 其他指令（例如fastcgi_pass、include）被忽略；不支持块和未知的变量
+func ParseNginxParams(r io.Reader) (*NginxParams, error) {
+	p := new(NginxParams)
+	s := &nginxScanner{r: bufio.NewReader(r), line: 1}
+	for {
+		args, err := s.directive()
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", s.line, err)
+		}
+		if args[0] != "fastcgi_param" {
+			continue
+		}
+		if len(args) < 3 || len(args) > 4 || (len(args) == 4 && args[3] != "if_not_empty") {
+			return nil, fmt.Errorf("line %d: invalid fastcgi_param", s.line)
+		}
+		value, err := parseNginxValue(args[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", s.line, err)
+		}
+		p.params = append(p.params, nginxParam{name: args[1], value: value, ifNotEmpty: len(args) == 4})
+	}
+}
+
+// parseNginxValue 将参数值拆分为字面量和变量，变量的格式为$name或${name}
+func parseNginxValue(s string) ([]nginxSegment, error) {
+	var segments []nginxSegment
+	for s != "" {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			segments = append(segments, nginxSegment{literal: s})
+			break
+		}
+		if i > 0 {
+			segments = append(segments, nginxSegment{literal: s[:i]})
+		}
+		s = s[i+1:]
+		var name string
+		if strings.HasPrefix(s, "{") {
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return nil, errors.New("unterminated variable")
+			}
+			name, s = s[1:end], s[end+1:]
+		} else {
+			end := 0
+			for end < len(s) && isNginxVariableChar(s[end]) {
+				end++
+			}
+			name, s = s[:end], s[end:]
+		}
+		if !knownNginxVariable(name) {
+			return nil, fmt.Errorf("unknown variable $%s", name)
+		}
+		segments = append(segments, nginxSegment{variable: strings.ToLower(name)})
+	}
+	return segments, nil
+}
+
+// isNginxVariableChar 检查c是否可以出现在变量名中
+func isNginxVariableChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// knownNginxVariable 检查是否支持变量name
+func knownNginxVariable(name string) bool {
+	name = strings.ToLower(name)
+	if _, ok := nginxVariables[name]; ok {
+		return true
+	}
+	for _, prefix := range nginxVariablePrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Names 返回按出现顺序排列的参数名
+func (p *NginxParams) Names() []string {
+	names := make([]string, len(p.params))
+	for i, param := range p.params {
+		names[i] = param.name
+	}
+	return names
+}
+
+// Middleware 返回按指令设置参数的中间件
+// 变量的值取自已映射的参数，应放在NewPHPFS或NewFileEndpoint之后
+func (p *NginxParams) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			// 先按映射后的参数求出所有的值，避免前面的指令影响后面的变量
+			values := make([]string, len(p.params))
+			for i, param := range p.params {
+				var b strings.Builder
+				for _, seg := range param.value {
+					if seg.variable == "" {
+						b.WriteString(seg.literal)
+						continue
+					}
+					b.WriteString(nginxVariable(req, seg.variable))
+				}
+				values[i] = b.String()
+			}
+			for i, param := range p.params {
+				if param.ifNotEmpty && values[i] == "" {
+					continue
+				}
+				req.Params.Set(param.name, values[i])
+			}
+			return inner(client, req)
+		}
+	}
+}
+
+// nginxVariable 返回变量name的值
+func nginxVariable(req *Request, name string) string {
+	if param := nginxVariables[name]; param != "" {
+		return req.Params.Get(param)
+	}
+	r := req.Raw
+	switch name {
+	case "nginx_version":
+		// 没有对应的nginx版本，返回固定值以兼容"nginx/$nginx_version"
+		return "1.0"
+	case "host":
+		// 与nginx相同：取请求的Host（去掉端口、转为小写），没有时使用SERVER_NAME
+		if r != nil && r.Host != "" {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			} else {
+				host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+			}
+			return strings.ToLower(host)
+		}
+		return req.Params.Get("SERVER_NAME")
+	case "is_args":
+		if req.Params.Get("QUERY_STRING") != "" {
+			return "?"
+		}
+		return ""
+	case "realpath_root":
+		root := req.Params.Get("DOCUMENT_ROOT")
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			return resolved
+		}
+		return root
+	case "server_addr":
+		if r == nil {
+			return ""
+		}
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			host, _, err := net.SplitHostPort(addr.String())
+			if err == nil {
+				return host
+			}
+		}
+		return ""
+	}
+	if r == nil {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(name, "http_"):
+		return r.Header.Get(strings.ReplaceAll(name[len("http_"):], "_", "-"))
+	case strings.HasPrefix(name, "arg_"):
+		return r.URL.Query().Get(name[len("arg_"):])
+	case strings.HasPrefix(name, "cookie_"):
+		if c, err := r.Cookie(name[len("cookie_"):]); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// nginxScanner 按nginx配置的语法读取指令
+type nginxScanner struct {
+	r    *bufio.Reader
+	line int
+}
+
+// directive 读取以分号结尾的一条指令，返回指令名和参数
+func (s *nginxScanner) directive() ([]string, error) {
+	var args []string
+	for {
+		tok, err := s.token()
+		if err == io.EOF && len(args) > 0 {
+			return nil, errors.New("unexpected end of input, missing ';'")
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok {
+		case ";":
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		case "{", "}":
+			return nil, errors.New("blocks are not supported")
+		}
+		args = append(args, strings.TrimPrefix(tok, "\x00"))
+	}
+}
+
+// token 读取一个词，引号内的词以"\x00"开头以区分分号和大括号
+func (s *nginxScanner) token() (string, error) {
+	// 跳过空白和注释
+	var c byte
+	var err error
+	for {
+		if c, err = s.r.ReadByte(); err != nil {
+			return "", err
+		}
+		if c == '\n' {
+			s.line++
+		}
+		if c == '#' {
+			for c != '\n' {
+				if c, err = s.r.ReadByte(); err != nil {
+					return "", err
+				}
+			}
+			s.line++
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			break
+		}
+	}
+	if c == ';' || c == '{' || c == '}' {
+		return string(c), nil
+	}
+
+	var b strings.Builder
+	if c == '"' || c == '\'' {
+		quote := c
+		b.WriteByte(0)
+		for {
+			if c, err = s.r.ReadByte(); err != nil {
+				return "", errors.New("unterminated string")
+			}
+			if c == quote {
+				return b.String(), nil
+			}
+			if c == '\n' {
+				s.line++
+			}
+			if c == '\\' {
+				if c, err = s.r.ReadByte(); err != nil {
+					return "", errors.New("unterminated string")
+				}
+				if c != quote && c != '\\' {
+					b.WriteByte('\\')
+				}
+			}
+			b.WriteByte(c)
+		}
+	}
+	for {
+		b.WriteByte(c)
+		prev := c
+		if c, err = s.r.ReadByte(); err != nil {
+			if err == io.EOF {
+				return b.String(), nil
+			}
+			return "", err
+		}
+		// ${name}中的大括号属于变量
+		if prev == '$' && c == '{' {
+			name, err := s.r.ReadString('}')
+			if err != nil {
+				return "", errors.New("unterminated variable")
+			}
+			b.WriteByte(c)
+			b.WriteString(name[:len(name)-1])
+			c = '}'
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n', ';', '{', '}':
+			s.r.UnreadByte()
+			return b.String(), nil
+		}
+	}
+}
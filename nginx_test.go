@@ -0,0 +1,100 @@
+package ffcgiclient
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNginxParams(t *testing.T) {
+	snippet := `
+# fastcgi.conf
+fastcgi_param  SCRIPT_FILENAME    $document_root$fastcgi_script_name;
+fastcgi_param  QUERY_STRING       $query_string;
+fastcgi_param  SERVER_SOFTWARE    nginx/$nginx_version;
+fastcgi_param  APP_ENV            "production ; quoted";
+fastcgi_param  REQUEST_ID         ${http_x_request_id}-1;
+fastcgi_param  HTTPS              $https if_not_empty;
+fastcgi_param  PAGE               $arg_page;
+fastcgi_pass   127.0.0.1:9000;
+`
+	p, err := ParseNginxParams(strings.NewReader(snippet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := p.Names(); len(names) != 7 || names[0] != "SCRIPT_FILENAME" {
+		t.Fatalf("names = %v", names)
+	}
+
+	var params map[string]string
+	handler := Chain(NewPHPFS("/srv/www"), p.Middleware())(recordHandler(&params))
+	r := httptest.NewRequest("GET", "/app/index.php?page=2", nil)
+	r.Header.Set("X-Request-Id", "abc")
+	if _, err := handler(nil, &Request{Raw: r, Params: NewParams()}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"SCRIPT_FILENAME": "/srv/www/app/index.php",
+		"QUERY_STRING":    "page=2",
+		"SERVER_SOFTWARE": "nginx/1.0",
+		"APP_ENV":         "production ; quoted",
+		"REQUEST_ID":      "abc-1",
+		"PAGE":            "2",
+	}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("%s = %q, want %q", k, params[k], v)
+		}
+	}
+	if _, ok := params["HTTPS"]; ok {
+		t.Error("HTTPS set although empty")
+	}
+}
+
+func TestNginxHost(t *testing.T) {
+	p, err := ParseNginxParams(strings.NewReader("fastcgi_param SERVER_HOST $host;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host       string
+		serverName string
+		want       string
+	}{
+		{"Example.COM:8080", "default.local", "example.com"},
+		{"example.com", "default.local", "example.com"},
+		{"[::1]:8080", "default.local", "::1"},
+		{"[::1]", "default.local", "::1"},
+		{"", "default.local", "default.local"},
+	}
+	for _, tt := range tests {
+		var params map[string]string
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = tt.host
+		req := &Request{Raw: r, Params: NewParams()}
+		req.Params.Set("SERVER_NAME", tt.serverName)
+		if _, err := p.Middleware()(recordHandler(&params))(nil, req); err != nil {
+			t.Fatal(err)
+		}
+		if got := params["SERVER_HOST"]; got != tt.want {
+			t.Errorf("Host %q: $host = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestNginxParamsErrors(t *testing.T) {
+	invalid := []string{
+		`fastcgi_param A;`,
+		`fastcgi_param A $unknown_var;`,
+		`fastcgi_param A ${document_root;`,
+		`fastcgi_param A "unterminated;`,
+		`fastcgi_param A B`,
+		`location / { fastcgi_param A B; }`,
+		`fastcgi_param A B extra;`,
+	}
+	for _, s := range invalid {
+		if _, err := ParseNginxParams(strings.NewReader(s)); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package ffcgiclient
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// 将处理请求的协程中的panic转换为错误，避免一个请求的panic导致整个进程退出
+
+// PanicError 中间件、回调或复制响应的协程中发生的panic
+type PanicError struct {
+	Value interface{} // recover()的返回值
+	Stack []byte      // 发生panic时的调用栈
+}
+
+// Error 实现error接口，不包含调用栈
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// newPanicError 以当前的调用栈创建*PanicError，需在recover所在的defer函数中调用
+func newPanicError(v interface{}) *PanicError {
+	return &PanicError{Value: v, Stack: debug.Stack()}
+}
+
+// catchPanic 执行fn，将其中的panic转换为*PanicError返回
+// http.ErrAbortHandler表示有意中止请求，继续panic
+func catchPanic(fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			err = newPanicError(p)
+		}
+	}()
+	return fn()
+}
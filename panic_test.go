@@ -0,0 +1,47 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerRecoverPanic(t *testing.T) {
+	stub := &stubClient{recorded: map[string][]byte{"": []byte("Content-Type: text/plain\r\n\r\nok")}}
+	factory := func() (Client, error) { return stub, nil }
+	cases := []struct {
+		name    string
+		handler RequestHandler
+	}{
+		{"middleware", func(client Client, req *Request) (*ResponsePipe, error) {
+			panic("boom")
+		}},
+		{"rewriter", func(client Client, req *Request) (*ResponsePipe, error) {
+			// 在改写响应的协程中panic
+			resp, err := client.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+				panic("boom")
+			}), nil
+		}},
+	}
+	for _, c := range cases {
+		var logs bytes.Buffer
+		h := NewHandler(c.handler, factory)
+		h.SetLogger(log.New(&logs, "", 0))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status = %d, want 500", c.name, rec.Code)
+		}
+		if !strings.Contains(logs.String(), "panic serving /: boom") || !strings.Contains(logs.String(), "goroutine") {
+			t.Errorf("%s: stack not logged: %q", c.name, logs.String())
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package ffcgiclient
+
+import "sort"
+
+// Params 发送给FastCGI应用程序的键值对参数
+// 按设置的顺序保存在切片中，发送时的顺序确定；参数较多时建立索引加速查找
+// 零值可以直接使用，对nil的*Params只能读取
+type Params struct {
+	pairs []paramPair
+	index map[string]int // 参数名到pairs下标的索引，参数较少时为nil
+}
+
+// paramPair 一个参数
+type paramPair struct {
+	key, value string
+}
+
+// paramsIndexThreshold 参数数量超过此值时建立索引
+const paramsIndexThreshold = 16
+
+// NewParams 创建空的Params
+func NewParams() *Params {
+	return &Params{pairs: make([]paramPair, 0, 32)}
+}
+
+// ParamsFromMap 由map创建Params，参数按名称排序
+func ParamsFromMap(m map[string]string) *Params {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	p := &Params{pairs: make([]paramPair, 0, len(keys))}
+	for _, k := range keys {
+		p.Set(k, m[k])
+	}
+	return p
+}
+
+// find 返回参数的下标，不存在时返回-1
+func (p *Params) find(key string) int {
+	if p.index != nil {
+		if i, ok := p.index[key]; ok {
+			return i
+		}
+		return -1
+	}
+	for i := range p.pairs {
+		if p.pairs[i].key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Lookup 返回参数的值以及参数是否存在
+func (p *Params) Lookup(key string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	if i := p.find(key); i >= 0 {
+		return p.pairs[i].value, true
+	}
+	return "", false
+}
+
+// Get 返回参数的值，不存在时返回空字符串
+func (p *Params) Get(key string) string {
+	v, _ := p.Lookup(key)
+	return v
+}
+
+// Has 返回参数是否存在
+func (p *Params) Has(key string) bool {
+	_, ok := p.Lookup(key)
+	return ok
+}
+
+// Set 设置参数，已存在时替换值并保持原来的位置
+func (p *Params) Set(key, value string) {
+	if i := p.find(key); i >= 0 {
+		p.pairs[i].value = value
+		return
+	}
+	p.pairs = append(p.pairs, paramPair{key, value})
+	if p.index != nil {
+		p.index[key] = len(p.pairs) - 1
+	} else if len(p.pairs) > paramsIndexThreshold {
+		p.reindex()
+	}
+}
+
+// Del 删除参数
+func (p *Params) Del(key string) {
+	if i := p.find(key); i >= 0 {
+		p.pairs = append(p.pairs[:i], p.pairs[i+1:]...)
+		if p.index != nil {
+			p.reindex()
+		}
+	}
+}
+
+// Filter 只保留keep返回true的参数
+func (p *Params) Filter(keep func(key, value string) bool) {
+	n := 0
+	for _, pair := range p.pairs {
+		if keep(pair.key, pair.value) {
+			p.pairs[n] = pair
+			n++
+		}
+	}
+	if n == len(p.pairs) {
+		return
+	}
+	// 清除被删除的参数，避免保留对字符串的引用
+	for i := n; i < len(p.pairs); i++ {
+		p.pairs[i] = paramPair{}
+	}
+	p.pairs = p.pairs[:n]
+	if p.index != nil {
+		p.reindex()
+	}
+}
+
+// reindex 重新建立索引，参数较少时不使用索引
+func (p *Params) reindex() {
+	if len(p.pairs) <= paramsIndexThreshold {
+		p.index = nil
+		return
+	}
+	p.index = make(map[string]int, len(p.pairs))
+	for i, pair := range p.pairs {
+		p.index[pair.key] = i
+	}
+}
+
+// Len 返回参数的数量
+func (p *Params) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.pairs)
+}
+
+// Range 按顺序遍历参数，fn返回false时停止
+func (p *Params) Range(fn func(key, value string) bool) {
+	if p == nil {
+		return
+	}
+	for _, pair := range p.pairs {
+		if !fn(pair.key, pair.value) {
+			return
+		}
+	}
+}
+
+// Clone 返回参数的副本
+func (p *Params) Clone() *Params {
+	if p == nil {
+		return NewParams()
+	}
+	c := &Params{pairs: append([]paramPair(nil), p.pairs...)}
+	c.reindex()
+	return c
+}
+
+// Map 返回包含所有参数的map，用于兼容使用map[string]string的代码
+func (p *Params) Map() map[string]string {
+	m := make(map[string]string, p.Len())
+	p.Range(func(key, value string) bool {
+		m[key] = value
+		return true
+	})
+	return m
+}
@@ -0,0 +1,47 @@
+package ffcgiclient
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParams(t *testing.T) {
+	p := NewParams()
+	// 超过paramsIndexThreshold，覆盖建立索引前后的查找
+	for i := 0; i < 20; i++ {
+		p.Set(fmt.Sprintf("K%02d", i), fmt.Sprint(i))
+	}
+	p.Set("K05", "five")
+	p.Del("K00")
+	p.Filter(func(k, v string) bool { return k != "K10" })
+
+	if p.Len() != 18 || p.Get("K05") != "five" || p.Has("K00") || p.Has("K10") || p.Get("K19") != "19" {
+		t.Fatalf("unexpected params %v", p.Map())
+	}
+	// 保持设置的顺序
+	var keys []string
+	p.Range(func(k, v string) bool {
+		keys = append(keys, k)
+		return len(keys) < 3
+	})
+	if fmt.Sprint(keys) != "[K01 K02 K03]" {
+		t.Fatalf("order = %v", keys)
+	}
+
+	// 副本互不影响
+	c := p.Clone()
+	c.Set("K01", "changed")
+	c.Del("K02")
+	if p.Get("K01") != "1" || !p.Has("K02") || c.Get("K01") != "changed" {
+		t.Fatal("clone shares state")
+	}
+
+	// nil只能读取
+	var none *Params
+	if none.Len() != 0 || none.Get("K") != "" || len(none.Map()) != 0 {
+		t.Fatal("nil params not empty")
+	}
+	if m := ParamsFromMap(map[string]string{"B": "2", "A": "1"}); fmt.Sprint(m.pairs) != "[{A 1} {B 2}]" {
+		t.Fatalf("ParamsFromMap = %v", m.pairs)
+	}
+}
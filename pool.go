@@ -1,104 +1,663 @@
 package ffcgiclient
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 )
 
 // PoolClient 继承Client并修改Close方法，用于支持Client池的返回/销毁
 type PoolClient struct {
-	Client                     // 继承Client
-	Err     error              // 错误
-	pool    chan<- *PoolClient // 存放PoolClient的通道池，即所属的pool池
-	poolTag chan<- uint        // pool标识
-	expires time.Time          // 过期时间
+	Client               // 继承Client
+	pool     *ClientPool // 所属的pool池
+	expires  time.Time   // 过期时间
+	mutex    sync.Mutex  // 保护returned
+	returned bool        // 是否已归还，避免重复Close
+
+	idleSince time.Time // 归还到空闲列表的时间
+	lease     *lease    // 泄漏检测时本次借出的记录
+
+	waited time.Duration // 本次借出等待名额的耗时
+	dialed time.Duration // 本次借出建立连接（含检查）的耗时
+}
+
+// checkoutTiming 返回本次借出等待名额和建立连接的耗时
+func (pc *PoolClient) checkoutTiming() (waited, dialed time.Duration) {
+	return pc.waited, pc.dialed
+}
+
+// Do 发送请求，并把本次借出等待名额和建立连接的耗时记录到响应的Timing中
+func (pc *PoolClient) Do(req *Request) (*ResponsePipe, error) {
+	resp, err := pc.Client.Do(req)
+	if resp != nil {
+		resp.mutex.Lock()
+		resp.timing.Queue, resp.timing.Dial = pc.waited, pc.dialed
+		resp.mutex.Unlock()
+	}
+	return resp, err
 }
 
 // Expired 检查是否过期
 func (pc *PoolClient) Expired() bool {
 	// 如果t代表的时间点在u之后，返回真；否则返回假
-	// 测试
-	// fmt.Println(time.Now(), "-------", pc.expires)
-	return time.Now().After(pc.expires)
+	return pc.pool.config.Clock.Now().After(pc.expires)
 }
 
-// Close 仅在内部客户端过期时才关闭它，否则它将自己返回到池中
+// Close 将自己归还到池中，过期的Client会被关闭而不是归还
+// 重复调用只有第一次有效
 func (pc *PoolClient) Close() error {
-	// 测试
-	// 过期则回收
-	if pc.Expired() {
-		// fmt.Println("【Close】关闭Client")
-		return pc.Client.Close()
+	pc.mutex.Lock()
+	if pc.returned {
+		pc.mutex.Unlock()
+		return nil
 	}
-	go func() {
-		// fmt.Println("【Close】放回连接池")
-		// 关闭连接
-		pc.CloseConn()
-		// 阻塞直至返回Client
-		pc.poolTag <- 1
-		pc.pool <- pc
-	}()
-	return nil
+	pc.returned = true
+	pc.endLease()
+	pc.mutex.Unlock()
+	return pc.pool.put(pc)
 }
 
 // NewClientPool 创建*ClientPool
-// 借助给定的工厂方法创建Client，并将其带有效期地汇集放进*ClientPool中
+// 借助给定的工厂方法按需创建Client（不预先创建），池中最多同时存在scale个Client，
+// Client在创建expires时间后过期，过期后归还时被关闭
+// 等同于NewClientPoolConfig(clientFactory, PoolConfig{MaxActive: scale, Expires: expires})
 func NewClientPool(
 	clientFactory ClientFactory,
 	scale int,
 	expires time.Duration,
 ) *ClientPool {
-	// 初始化通道池
-	pool := make(chan *PoolClient, scale)
-	poolTag := make(chan uint, scale)
-	// 开启一个并发协程处理Client创建任务
-	go func() {
-		for {
-			// fmt.Println("【NewClientPool】poolTag <- 1,num:", len(poolTag))
-			poolTag <- 1
-			// 测试
-			// fmt.Println("【NewClientPool】创建ClientPool，有效期：", time.Now().Add(expires))
-			// 创建Client
-			c, err := clientFactory()
-			// 初始化PoolClient，将Client包装为PoolClient
-			pc := &PoolClient{
-				Client:  c,
-				Err:     err,
-				pool:    pool,
-				poolTag: poolTag,
-				expires: time.Now().Add(expires),
-			}
-			// 放入通道池
-			pool <- pc
-		}
-	}()
-	// 返回ClientPool
-	return &ClientPool{
-		pool:    pool,
-		poolTag: poolTag,
+	return NewClientPoolConfig(clientFactory, PoolConfig{MaxActive: scale, Expires: expires})
+}
+
+// PoolConfig Client池的配置
+type PoolConfig struct {
+
+	// MaxActive 同时存在（空闲+借出）的Client的最大数量，小于1时为1
+	MaxActive int
+
+	// MinIdle 后台保持的最少空闲Client数量，0表示不预先创建
+	MinIdle int
+
+	// MaxIdle 最多保留的空闲Client数量，超出时归还的Client被关闭，0表示不限制
+	MaxIdle int
+
+	// IdleTimeout 空闲超过此时间的Client被后台关闭（保留MinIdle个），0表示不关闭
+	IdleTimeout time.Duration
+
+	// Expires Client的有效期，过期后归还时被关闭
+	Expires time.Duration
+
+	// ExpiryJitter 为每个Client的有效期增加[0, ExpiryJitter)的随机时间，避免同时过期后集中重连
+	ExpiryJitter time.Duration
+
+	// Clock 判断过期和空闲时间使用的时间来源，为nil时使用SystemClock
+	Clock Clock
+
+	// Rand 生成有效期抖动的随机数来源，为nil时使用GlobalRand
+	Rand Rand
+
+	// IgnoreBackendLimits 为true时不按Client询问到的FCGI_MAX_CONNS缩小MaxActive（见ClientConfig.AutoTune），
+	// 用于公布的值与实际不符的后端
+	IgnoreBackendLimits bool
+}
+
+// NewClientPoolConfig 按配置创建*ClientPool
+// 设置了MinIdle或IdleTimeout时启动后台协程维护空闲Client，在Close时退出
+func NewClientPoolConfig(clientFactory ClientFactory, config PoolConfig) *ClientPool {
+	if config.MaxActive <= 0 {
+		config.MaxActive = 1
+	}
+	if config.MinIdle > config.MaxActive {
+		config.MinIdle = config.MaxActive
+	}
+	if config.MaxIdle > 0 && config.MaxIdle < config.MinIdle {
+		config.MaxIdle = config.MinIdle
 	}
+	config.Clock = clockOr(config.Clock)
+	config.Rand = randOr(config.Rand)
+	p := &ClientPool{
+		clientFactory: clientFactory,
+		config:        config,
+		slots:         make(chan struct{}, config.MaxActive),
+		done:          make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	if config.MinIdle > 0 || config.IdleTimeout > 0 {
+		go p.maintain()
+	}
+	return p
 }
 
+// ErrPoolClosed 池已关闭
+var ErrPoolClosed = errors.New("client pool has been closed")
+
+// ErrPoolTimeout 池已全部借出，等待归还超时
+var ErrPoolTimeout = errors.New("timeout waiting for a pooled client")
+
 // ClientPool Client池定义
 type ClientPool struct {
-	pool    <-chan *PoolClient // 存放PoolClient的通道池
-	poolTag <-chan uint
+	clientFactory ClientFactory        // Client工厂方法
+	config        PoolConfig           // 配置
+	borrowTimeout time.Duration        // 等待借出的超时时间，0表示一直等待
+	validate      func(c Client) error // 借出前检查连接，可以为nil
+
+	// slots 借出名额，每借出一个Client占用一个，容量即池的最大数量
+	slots chan struct{}
+
+	// done 池关闭时关闭，唤醒等待借出的请求
+	done chan struct{}
+
+	// ctx 池的生命周期，池关闭时取消
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex   sync.Mutex
+	idle    []*PoolClient // 空闲的Client，后进先出
+	created int           // 当前存在的Client数量（空闲+借出）
+	closed  bool          // 是否已关闭
+	held    int           // Close等待归还时已收回的名额数
+	tuned   bool          // 是否已按后端的处理能力调整MaxActive
+	dialErr error         // 最近一次新建连接的错误，连接成功时清除
+
+	// reserved 缩小MaxActive后保留不用的名额数，pending 尚未收回（仍被借出）的名额数，在归还时收回
+	reserved int
+	pending  int
+
+	events *EventBus // 事件
+
+	leakDetect bool                    // 是否开启泄漏检测
+	maxLease   time.Duration           // 最长借出时间
+	onLeak     func(report LeakReport) // 发现泄漏时调用
+}
+
+// SetEventBus 设置发布池事件（EventPoolExhausted）的EventBus
+func (p *ClientPool) SetEventBus(bus *EventBus) {
+	p.events = bus
+}
+
+// SetBorrowTimeout 设置CreateClient在池已全部借出时等待归还的最长时间
+// 超时后返回ErrPoolTimeout，0表示一直等待（默认）
+func (p *ClientPool) SetBorrowTimeout(timeout time.Duration) {
+	p.borrowTimeout = timeout
+}
+
+// SetValidator 设置借出空闲Client前检查其保持的连接是否可用的函数，例如PingValidator
+// 检查失败的Client会被关闭，并替换为其他空闲的或新建的Client；新建的连接不检查
+func (p *ClientPool) SetValidator(validate func(c Client) error) {
+	p.validate = validate
+}
+
+// PingValidator 返回发送FCGI_GET_VALUES管理消息检查连接的validator
+// timeout 限制每次检查的耗时，0表示不限制
+func PingValidator(timeout time.Duration) func(c Client) error {
+	return func(c Client) error {
+		if pc, ok := c.(*PoolClient); ok {
+			c = pc.Client
+		}
+		// 不支持的Client不做检查
+		pinger, ok := c.(interface{ ping(time.Duration) error })
+		if !ok {
+			return nil
+		}
+		return pinger.ping(timeout)
+	}
+}
+
+// Context 返回池的生命周期上下文，池关闭时被取消
+// 可用于让Client的连接工厂在池关闭时放弃正在进行的连接
+func (p *ClientPool) Context() context.Context {
+	return p.ctx
+}
+
+// PoolStats 池的统计信息
+type PoolStats struct {
+	Max         int   // 最大数量
+	Created     int   // 当前存在的Client数量
+	Idle        int   // 空闲数量
+	Outstanding int   // 借出未归还的数量
+	DialErr     error // 最近一次新建连接的错误，之后连接成功时为nil
+}
+
+// Stats 返回池的统计信息
+func (p *ClientPool) Stats() PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return PoolStats{
+		Max:         p.config.MaxActive,
+		Created:     p.created,
+		Idle:        len(p.idle),
+		Outstanding: len(p.slots) - p.held - p.reserved,
+		DialErr:     p.dialErr,
+	}
+}
+
+// Warm 预先建立并检查n个连接，用于启动或就绪探测时避免第一批请求等待建立连接
+// 同时借出n个Client（不超过MaxActive和MaxIdle），对每个Client调用Ping后归还，检查失败的连接被关闭；
+// 返回第一个错误，ctx结束时停止等待
+func (p *ClientPool) Warm(ctx context.Context, n int) error {
+	// MaxActive可能被tune同时修改
+	p.mutex.Lock()
+	maxActive, maxIdle := p.config.MaxActive, p.config.MaxIdle
+	p.mutex.Unlock()
+	if n > maxActive {
+		n = maxActive
+	}
+	if maxIdle > 0 && n > maxIdle {
+		n = maxIdle
+	}
+	clients := make([]Client, 0, n)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	var first error
+	for i := 0; i < n; i++ {
+		c, err := p.CreateClientContext(ctx)
+		if err != nil {
+			return err
+		}
+		clients = append(clients, c)
+		if err := Ping(ctx, c); err != nil {
+			c.CloseConn()
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Close 关闭池：停止创建Client，关闭空闲的Client，并等待借出的Client归还（归还时关闭）
+// ctx结束时不再等待并返回ctx.Err()，之后归还的Client仍会被关闭
+// 关闭后CreateClient返回ErrPoolClosed，重复调用Close同样返回ErrPoolClosed
+func (p *ClientPool) Close(ctx context.Context) error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return ErrPoolClosed
+	}
+	p.closed = true
+	close(p.done)
+	p.cancel()
+	// 关闭空闲的Client
+	idle := p.idle
+	p.idle = nil
+	p.created -= len(idle)
+	slots := cap(p.slots) - p.reserved
+	p.mutex.Unlock()
+	for _, pc := range idle {
+		pc.Client.Close()
+	}
+
+	// 收回全部名额即表示所有借出的Client都已归还
+	for i := 0; i < slots; i++ {
+		select {
+		case p.slots <- struct{}{}:
+			p.mutex.Lock()
+			p.held++
+			p.mutex.Unlock()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
 // CreateClient 通道池创建Client的工厂方法，需实现ClientFactory类型
+// 优先复用空闲的Client，没有时按需创建；已借出的数量达到上限时等待归还，
+// 设置了SetBorrowTimeout时等待超时返回ErrPoolTimeout；池关闭后返回ErrPoolClosed
 func (p *ClientPool) CreateClient() (c Client, err error) {
-	// 测试
-	// fmt.Println("【CreateClient】从pool中取出一个PoolClient")
-	// 从pool中取出一个PoolClient
-	pc := <-p.pool
-	// 建立连接
-	pc.NewConn()
-	// 释放
-	// fmt.Println("【NewClientPool】<-poolTag,num:", len(p.poolTag))
-	<-p.poolTag
-	// 检查是否发生错误
-	if c, err = pc, pc.Err; err != nil {
-		return nil, err
-	}
-	// 返回
+	ctx := context.Background()
+	if p.borrowTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.borrowTimeout)
+		defer cancel()
+	}
+	return p.CreateClientContext(ctx)
+}
+
+// CreateClientContext 同CreateClient，已全部借出时最多等待到ctx结束
+// 等待名额时ctx结束返回的错误满足errors.Is(err, ErrPoolTimeout)，建立连接时ctx结束返回ctx.Err()，
+// 池关闭时立即返回ErrPoolClosed，不等待正在进行的连接
+func (p *ClientPool) CreateClientContext(ctx context.Context) (c Client, err error) {
+	start := p.config.Clock.Now()
+	// 占用一个借出名额，已全部借出时发布事件并等待
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.done:
+		return nil, ErrPoolClosed
+	default:
+		p.events.Publish(Event{
+			Type:    EventPoolExhausted,
+			Message: fmt.Sprintf("all %d clients are in use", p.Stats().Max),
+		})
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.done:
+			return nil, ErrPoolClosed
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %v", ErrPoolTimeout, ctx.Err())
+		}
+	}
+
+	waited := p.config.Clock.Now().Sub(start)
+
+	// 在单独的协程中取出并连接Client，池关闭或ctx结束时不再等待，
+	// 连接完成后由该协程关闭Client并释放名额
+	type result struct {
+		pc  *PoolClient
+		err error
+	}
+	ch := make(chan result, 1)
+	dialStart := p.config.Clock.Now()
+	go func() {
+		pc, err := p.checkout()
+		ch <- result{pc, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			p.release()
+			return nil, r.err
+		}
+		r.pc.waited, r.pc.dialed = waited, p.config.Clock.Now().Sub(dialStart)
+		p.startLease(r.pc)
+		return r.pc, nil
+	case <-p.done:
+		err = ErrPoolClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	go func() {
+		if r := <-ch; r.err == nil {
+			p.discard(r.pc)
+		}
+		p.release()
+	}()
+	return nil, err
+}
+
+// checkout 取出一个Client并建立连接
+// 复用的Client失败时关闭并换用下一个，新建的Client失败时返回错误
+func (p *ClientPool) checkout() (*PoolClient, error) {
+	for {
+		pc, reused, err := p.get()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.prepare(pc); err != nil {
+			p.discard(pc)
+			if reused {
+				continue
+			}
+			return nil, err
+		}
+		p.tune(pc.Client)
+		return pc, nil
+	}
+}
+
+// prepare 为Client准备连接
+// 空闲Client保持的连接在设置了validator时先检查，检查失败返回错误；没有可用的连接时新建连接
+func (p *ClientPool) prepare(pc *PoolClient) error {
+	if connUsable(pc.Client) {
+		if p.validate == nil {
+			return nil
+		}
+		err := p.validate(pc.Client)
+		if err != nil {
+			pc.CloseConn()
+		}
+		return err
+	}
+	err := pc.NewConn()
+	p.mutex.Lock()
+	p.dialErr = err
+	p.mutex.Unlock()
+	return err
+}
+
+// connUsable 检查Client是否保持着可以继续使用的连接，无法判断的Client视为没有连接
+func connUsable(c Client) bool {
+	cs, ok := c.(interface{ connUsable() bool })
+	return ok && cs.connUsable()
+}
+
+// clientBusy 返回Client正在进行的请求全部结束时关闭的通道，没有正在进行的请求或无法判断时返回nil
+func clientBusy(c Client) <-chan struct{} {
+	cb, ok := c.(interface{ busy() <-chan struct{} })
+	if !ok {
+		return nil
+	}
+	return cb.busy()
+}
+
+// get 取出一个未过期的空闲Client，没有时新建，reused表示是否为复用的Client
+func (p *ClientPool) get() (pc *PoolClient, reused bool, err error) {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil, false, ErrPoolClosed
+	}
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !pc.Expired() {
+			p.mutex.Unlock()
+			pc.mutex.Lock()
+			pc.returned = false
+			pc.mutex.Unlock()
+			return pc, true, nil
+		}
+		// 关闭过期的Client
+		p.created--
+		pc.Client.Close()
+	}
+	p.created++
+	p.mutex.Unlock()
+
+	// 创建Client
+	c, err := p.clientFactory()
+	if err != nil {
+		p.mutex.Lock()
+		p.created--
+		p.mutex.Unlock()
+		return nil, false, err
+	}
+	return p.newPoolClient(c), false, nil
+}
+
+// newPoolClient 包装新建的Client，有效期增加随机的抖动
+func (p *ClientPool) newPoolClient(c Client) *PoolClient {
+	expires := p.config.Expires
+	if p.config.ExpiryJitter > 0 {
+		expires += time.Duration(p.config.Rand.Int63n(int64(p.config.ExpiryJitter)))
+	}
+	pc := &PoolClient{
+		Client:  c,
+		pool:    p,
+		expires: p.config.Clock.Now().Add(expires),
+	}
+	p.trackCollect(pc)
+	return pc
+}
+
+// put 归还Client并释放借出名额
+// 被终止的请求仍在读取剩余的消息时，等待读取结束后再归还，此前Client不会被再次借出
+func (p *ClientPool) put(pc *PoolClient) (err error) {
+	if drained := clientBusy(pc.Client); drained != nil {
+		go func() {
+			<-drained
+			p.put(pc)
+		}()
+		return nil
+	}
+	defer p.release()
+	// 过期则关闭
+	if pc.Expired() {
+		return p.discard(pc)
+	}
+	// 保持可用的连接供下次借出，已断开或无法判断的连接关闭，下次借出时重新建立
+	if !connUsable(pc.Client) {
+		err = pc.CloseConn()
+	}
+	p.mutex.Lock()
+	if p.closed || p.created > p.config.MaxActive ||
+		(p.config.MaxIdle > 0 && len(p.idle) >= p.config.MaxIdle) {
+		// 池已关闭，或数量超出上限（与后台补充空闲Client并发时可能发生）
+		p.created--
+		p.mutex.Unlock()
+		pc.Client.Close()
+		return
+	}
+	pc.idleSince = p.config.Clock.Now()
+	p.idle = append(p.idle, pc)
+	p.mutex.Unlock()
 	return
 }
+
+// release 释放借出名额，缩小MaxActive后有未收回的名额时保留该名额
+func (p *ClientPool) release() {
+	p.mutex.Lock()
+	if p.pending > 0 && !p.closed {
+		p.pending--
+		p.reserved++
+		p.mutex.Unlock()
+		return
+	}
+	p.mutex.Unlock()
+	<-p.slots
+}
+
+// tune 第一次得到Client询问到的后端处理能力时，将MaxActive缩小到后端公布的FCGI_MAX_CONNS
+func (p *ClientPool) tune(c Client) {
+	if p.config.IgnoreBackendLimits {
+		return
+	}
+	lc, ok := c.(interface {
+		backendLimits() (backendLimits, bool)
+	})
+	if !ok {
+		return
+	}
+	limits, ok := lc.backendLimits()
+	if !ok {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.tuned || p.closed {
+		return
+	}
+	p.tuned = true
+	if limits.MaxConns == 0 || uint64(limits.MaxConns) >= uint64(p.config.MaxActive) {
+		return
+	}
+	// 空闲的名额立即保留，借出中的名额在归还时收回
+	for n := p.config.MaxActive - int(limits.MaxConns); n > 0; n-- {
+		select {
+		case p.slots <- struct{}{}:
+			p.reserved++
+		default:
+			p.pending++
+		}
+	}
+	p.config.MaxActive = int(limits.MaxConns)
+	if p.config.MinIdle > p.config.MaxActive {
+		p.config.MinIdle = p.config.MaxActive
+	}
+}
+
+// discard 关闭Client并将其从池的计数中移除
+func (p *ClientPool) discard(pc *PoolClient) error {
+	p.mutex.Lock()
+	p.created--
+	p.mutex.Unlock()
+	return pc.Client.Close()
+}
+
+// maintain 后台维护空闲Client：关闭空闲超时的Client，并补足MinIdle个空闲Client
+func (p *ClientPool) maintain() {
+	interval := time.Second
+	if p.config.IdleTimeout > 0 && p.config.IdleTimeout/2 < interval {
+		interval = p.config.IdleTimeout / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.reap()
+		p.fill()
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// reap 关闭空闲超时或已过期的Client，保留MinIdle个未过期的Client
+func (p *ClientPool) reap() {
+	now := p.config.Clock.Now()
+	p.mutex.Lock()
+	var closing []*PoolClient
+	keep := p.idle[:0]
+	// idle中越靠前的空闲越久
+	for i, pc := range p.idle {
+		remain := len(p.idle) - i
+		timeout := p.config.IdleTimeout > 0 && now.Sub(pc.idleSince) > p.config.IdleTimeout && remain > p.config.MinIdle
+		if timeout || pc.Expired() {
+			closing = append(closing, pc)
+			continue
+		}
+		keep = append(keep, pc)
+	}
+	for i := len(keep); i < len(p.idle); i++ {
+		p.idle[i] = nil
+	}
+	p.idle = keep
+	p.created -= len(closing)
+	p.mutex.Unlock()
+	for _, pc := range closing {
+		pc.Client.Close()
+	}
+}
+
+// fill 补足MinIdle个空闲Client，不超过MaxActive
+func (p *ClientPool) fill() {
+	for {
+		p.mutex.Lock()
+		if p.closed || len(p.idle) >= p.config.MinIdle || p.created >= p.config.MaxActive {
+			p.mutex.Unlock()
+			return
+		}
+		p.created++
+		p.mutex.Unlock()
+
+		c, err := p.clientFactory()
+		if err != nil {
+			p.mutex.Lock()
+			p.created--
+			p.mutex.Unlock()
+			return
+		}
+		// 预先建立连接，失败时借出时再建立
+		if !connUsable(c) && c.NewConn() != nil {
+			c.CloseConn()
+		}
+		p.tune(c)
+		pc := p.newPoolClient(c)
+		pc.idleSince = p.config.Clock.Now()
+		p.mutex.Lock()
+		if p.closed {
+			p.created--
+			p.mutex.Unlock()
+			c.Close()
+			return
+		}
+		p.idle = append(p.idle, pc)
+		p.mutex.Unlock()
+	}
+}
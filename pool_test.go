@@ -0,0 +1,594 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeConnFactory 返回内存管道连接，不需要后端
+func pipeConnFactory() (net.Conn, error) {
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+// fixedRand 返回固定值的Rand
+type fixedRand int64
+
+func (r fixedRand) Float64() float64     { return 0 }
+func (r fixedRand) Int63n(n int64) int64 { return int64(r) % n }
+
+func TestPoolExpiry(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	pool := NewClientPoolConfig(SimpleClientFactoryNoConn(pipeConnFactory, 0), PoolConfig{
+		MaxActive:    2,
+		Expires:      time.Minute,
+		ExpiryJitter: 10 * time.Second,
+		Clock:        clock,
+		Rand:         fixedRand(5 * time.Second),
+	})
+
+	c, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := c.(*PoolClient)
+	if want := clock.Now().Add(65 * time.Second); !pc.expires.Equal(want) {
+		t.Fatalf("expires = %s, want %s", pc.expires, want)
+	}
+	c.Close()
+
+	// 未过期的Client被复用
+	clock.Advance(time.Minute)
+	c, _ = pool.CreateClient()
+	if c.(*PoolClient) != pc {
+		t.Fatal("expected idle client to be reused")
+	}
+
+	// 过期后归还时被关闭
+	clock.Advance(10 * time.Second)
+	c.Close()
+	if stats := pool.Stats(); stats.Created != 0 || stats.Idle != 0 {
+		t.Fatalf("stats = %+v, want expired client closed", stats)
+	}
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	var dials int
+	var servers []net.Conn
+	backend := recordBackend(func(sc *conn, reqID uint16, _ []byte) {
+		sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\nok"))
+		sc.writeEndRequest(reqID, 0, statusRequestComplete)
+	})
+	factory := func() (net.Conn, error) {
+		dials++
+		c, err := backend()
+		servers = append(servers, c)
+		return c, err
+	}
+	pool := NewClientPool(SimpleClientFactoryNoConn(factory, 0), 1, time.Minute)
+	var validated int
+	ping := PingValidator(time.Second)
+	pool.SetValidator(func(c Client) error {
+		validated++
+		return ping(c)
+	})
+	h := NewHandler(BasicHandler, pool.CreateClient)
+	get := func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Body.String() != "ok" {
+			t.Fatalf("response = %d %q", rec.Code, rec.Body.String())
+		}
+	}
+
+	// 归还时保持连接，再次借出时检查后复用
+	for i := 0; i < 3; i++ {
+		get()
+	}
+	if dials != 1 || validated != 2 {
+		t.Fatalf("dials = %d, validated = %d, want 1 and 2", dials, validated)
+	}
+
+	// 空闲的连接已断开，检查失败后换用新的连接
+	servers[0].Close()
+	get()
+	if dials != 2 || validated != 3 {
+		t.Fatalf("after disconnect: dials = %d, validated = %d, want 2 and 3", dials, validated)
+	}
+}
+
+func TestPoolLazyCheckouts(t *testing.T) {
+	var created int
+	factory := SimpleClientFactoryNoConn(pipeConnFactory, 0)
+	pool := NewClientPool(func() (Client, error) {
+		created++
+		return factory()
+	}, 3, time.Minute)
+	if stats := pool.Stats(); created != 0 || stats != (PoolStats{Max: 3}) {
+		t.Fatalf("created = %d, stats = %+v, want nothing created up front", created, stats)
+	}
+
+	steps := []struct {
+		borrow, release int
+		want            PoolStats
+		created         int
+	}{
+		{borrow: 2, want: PoolStats{Max: 3, Created: 2, Outstanding: 2}, created: 2},
+		{release: 2, want: PoolStats{Max: 3, Created: 2, Idle: 2}, created: 2},
+		{borrow: 3, want: PoolStats{Max: 3, Created: 3, Outstanding: 3}, created: 3},
+		{release: 1, want: PoolStats{Max: 3, Created: 3, Idle: 1, Outstanding: 2}, created: 3},
+	}
+	var out []Client
+	for i, step := range steps {
+		for j := 0; j < step.borrow; j++ {
+			c, err := pool.CreateClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, c)
+		}
+		for j := 0; j < step.release; j++ {
+			c := out[len(out)-1]
+			out = out[:len(out)-1]
+			c.Close()
+			// 重复Close不会重复归还
+			c.Close()
+		}
+		if stats := pool.Stats(); stats != step.want || created != step.created {
+			t.Errorf("step %d: created = %d, stats = %+v, want %d and %+v", i, created, stats, step.created, step.want)
+		}
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	pool := NewClientPool(SimpleClientFactoryNoConn(pipeConnFactory, 0), 2, time.Minute)
+	idle, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle.Close()
+
+	// 借出的Client未归还时等待到ctx结束
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := pool.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close = %v, want deadline exceeded", err)
+	}
+	if stats := pool.Stats(); stats.Idle != 0 || stats.Created != 1 || stats.Outstanding != 1 {
+		t.Fatalf("stats = %+v, want idle client closed and one outstanding", stats)
+	}
+	if _, err := pool.CreateClient(); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("CreateClient = %v, want ErrPoolClosed", err)
+	}
+	if err := pool.Close(context.Background()); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("second Close = %v, want ErrPoolClosed", err)
+	}
+
+	// 之后归还的Client被关闭
+	busy.Close()
+	if stats := pool.Stats(); stats.Created != 0 || stats.Idle != 0 {
+		t.Fatalf("stats = %+v, want returned client closed", stats)
+	}
+
+	// 没有借出的Client时Close立即返回
+	pool = NewClientPool(SimpleClientFactoryNoConn(pipeConnFactory, 0), 2, time.Minute)
+	c, _ := pool.CreateClient()
+	c.Close()
+	done := make(chan error, 1)
+	go func() { done <- pool.Close(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+}
+
+func TestPoolBorrowTimeout(t *testing.T) {
+	pool := NewClientPool(SimpleClientFactoryNoConn(pipeConnFactory, 0), 1, time.Minute)
+	var exhausted int
+	bus := new(EventBus)
+	bus.Subscribe(func(e Event) {
+		if e.Type == EventPoolExhausted {
+			exhausted++
+		}
+	})
+	pool.SetEventBus(bus)
+	held, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	// SetBorrowTimeout
+	pool.SetBorrowTimeout(10 * time.Millisecond)
+	start := time.Now()
+	if _, err := pool.CreateClient(); !errors.Is(err, ErrPoolTimeout) {
+		t.Fatalf("CreateClient = %v, want ErrPoolTimeout", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("waited %s", waited)
+	}
+
+	// CreateClientContext
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pool.CreateClientContext(ctx); !errors.Is(err, ErrPoolTimeout) {
+		t.Fatalf("CreateClientContext = %v, want ErrPoolTimeout", err)
+	}
+
+	// Handler返回503
+	h := NewHandler(BasicHandler, pool.CreateClient)
+	h.SetLogger(log.New(io.Discard, "", 0))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	if exhausted != 3 {
+		t.Fatalf("pool exhausted events = %d, want 3", exhausted)
+	}
+
+	// 归还后可以再次借出
+	held.Close()
+	c, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestPoolIdle(t *testing.T) {
+	borrow := func(pool *ClientPool, n int) {
+		var out []Client
+		for i := 0; i < n; i++ {
+			c, err := pool.CreateClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, c)
+		}
+		for _, c := range out {
+			c.Close()
+		}
+	}
+
+	// MaxIdle 超出的归还的Client被关闭
+	pool := NewClientPoolConfig(SimpleClientFactoryNoConn(pipeConnFactory, 0), PoolConfig{MaxActive: 3, MaxIdle: 1, Expires: time.Hour})
+	borrow(pool, 3)
+	if stats := pool.Stats(); stats.Created != 1 || stats.Idle != 1 {
+		t.Fatalf("MaxIdle: stats = %+v, want one idle client", stats)
+	}
+	pool.Close(context.Background())
+
+	// MinIdle 后台预先创建，IdleTimeout 关闭空闲超时的Client但保留MinIdle个
+	clock := NewManualClock(time.Unix(1000, 0))
+	pool = NewClientPoolConfig(SimpleClientFactoryNoConn(pipeConnFactory, 0), PoolConfig{
+		MaxActive:   3,
+		MinIdle:     1,
+		IdleTimeout: time.Minute,
+		Expires:     time.Hour,
+		Clock:       clock,
+	})
+	defer pool.Close(context.Background())
+	deadline := time.Now().Add(time.Second)
+	for pool.Stats().Idle != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("MinIdle: stats = %+v, want one idle client", pool.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	borrow(pool, 3)
+	if stats := pool.Stats(); stats.Created != 3 || stats.Idle != 3 {
+		t.Fatalf("stats = %+v, want three idle clients", stats)
+	}
+	clock.Advance(2 * time.Minute)
+	pool.reap()
+	if stats := pool.Stats(); stats.Created != 1 || stats.Idle != 1 {
+		t.Fatalf("IdleTimeout: stats = %+v, want MinIdle clients kept", stats)
+	}
+}
+
+func TestPoolDialCanceled(t *testing.T) {
+	dialing, release := make(chan struct{}, 2), make(chan struct{})
+	factory := SimpleClientFactoryNoConn(func() (net.Conn, error) {
+		dialing <- struct{}{}
+		<-release
+		return pipeConnFactory()
+	}, 0)
+	pool := NewClientPool(factory, 2, time.Minute)
+	if pool.Context().Err() != nil {
+		t.Fatal("pool context canceled before Close")
+	}
+
+	// 建立连接时ctx结束
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() {
+		_, err := pool.CreateClientContext(ctx)
+		errs <- err
+	}()
+	<-dialing
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("CreateClientContext = %v, want context.Canceled", err)
+	}
+
+	// 建立连接时池关闭
+	go func() {
+		_, err := pool.CreateClient()
+		errs <- err
+	}()
+	<-dialing
+	go pool.Close(context.Background())
+	if err := <-errs; !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("CreateClient = %v, want ErrPoolClosed", err)
+	}
+	if pool.Context().Err() == nil {
+		t.Fatal("pool context not canceled after Close")
+	}
+
+	// 连接完成后Client被关闭并释放名额
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for stats := pool.Stats(); stats.Created != 0 || stats.Outstanding != 0; stats = pool.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v, want abandoned clients closed", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolBackendLimits(t *testing.T) {
+	backend := valuesBackend(map[string]string{"FCGI_MAX_CONNS": "2"}, func(sc *conn, reqID uint16, _ []byte) {})
+	factory := NewClientFactory(backend, ClientConfig{AutoTune: true, Lazy: true})
+
+	pool := NewClientPoolConfig(factory, PoolConfig{MaxActive: 4, Expires: time.Hour})
+	first, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Max != 2 || stats.Outstanding != 2 {
+		t.Fatalf("stats = %+v, want Max 2, Outstanding 2", stats)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.CreateClientContext(ctx); !errors.Is(err, ErrPoolTimeout) {
+		t.Fatalf("err = %v, want ErrPoolTimeout", err)
+	}
+	first.Close()
+	second.Close()
+	if err := pool.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 后端公布的值不可信时保持配置的数量
+	pool = NewClientPoolConfig(factory, PoolConfig{MaxActive: 4, Expires: time.Hour, IgnoreBackendLimits: true})
+	c, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Max != 4 {
+		t.Fatalf("stats = %+v, want Max 4", stats)
+	}
+	c.Close()
+	pool.Close(context.Background())
+}
+
+// TestPoolBackendLimitsOutstanding 测试缩小数量时借出中的名额在归还时收回
+func TestPoolBackendLimitsOutstanding(t *testing.T) {
+	tuned := NewClientFactory(valuesBackend(map[string]string{"FCGI_MAX_CONNS": "1"}, nil), ClientConfig{AutoTune: true, Lazy: true})
+	var calls int32
+	factory := func() (Client, error) {
+		// 第一个Client不询问后端
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return SimpleClientFactoryNoConn(pipeConnFactory, 0)()
+		}
+		return tuned()
+	}
+	pool := NewClientPool(factory, 2, time.Hour)
+	first, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Max != 1 || stats.Outstanding != 2 {
+		t.Fatalf("stats = %+v, want Max 1, Outstanding 2", stats)
+	}
+	first.Close()
+	if stats := pool.Stats(); stats.Outstanding != 1 {
+		t.Fatalf("stats = %+v, want Outstanding 1", stats)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.CreateClientContext(ctx); !errors.Is(err, ErrPoolTimeout) {
+		t.Fatalf("err = %v, want ErrPoolTimeout", err)
+	}
+	second.Close()
+	if err := pool.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPoolWarm 测试预先建立连接：同时借出的数量不超过MaxActive，检查失败时返回错误且不保留连接
+func TestPoolWarm(t *testing.T) {
+	var dials int32
+	backend := valuesBackend(nil, nil)
+	pool := NewClientPoolConfig(SimpleClientFactoryNoConn(func() (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return backend()
+	}, 0), PoolConfig{MaxActive: 3, Expires: time.Minute})
+	defer pool.Close(context.Background())
+
+	if err := pool.Warm(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Idle != 3 || stats.Outstanding != 0 || atomic.LoadInt32(&dials) != 3 {
+		t.Fatalf("after warm: stats = %+v, %d dials", stats, dials)
+	}
+	// 已有的连接被复用
+	if err := pool.Warm(context.Background(), 2); err != nil || atomic.LoadInt32(&dials) != 3 {
+		t.Fatalf("second warm: err = %v, %d dials", err, dials)
+	}
+
+	// 没有回复的后端
+	silent := NewClientPoolConfig(SimpleClientFactoryNoConn(pipeConnFactory, 0), PoolConfig{MaxActive: 2, Expires: time.Minute})
+	defer silent.Close(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := silent.Warm(ctx, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("silent backend: Warm() = %v", err)
+	}
+	for _, pc := range silent.idle {
+		if connUsable(pc.Client) {
+			t.Fatal("failed connection kept in pool")
+		}
+	}
+}
+
+// TestPoolWarmTune 测试Warm与第一次借出时的tune同时进行，需配合-race运行
+func TestPoolWarmTune(t *testing.T) {
+	factory := NewClientFactory(valuesBackend(map[string]string{"FCGI_MAX_CONNS": "2"}, nil), ClientConfig{AutoTune: true, Lazy: true})
+	pool := NewClientPoolConfig(factory, PoolConfig{MaxActive: 4, Expires: time.Hour})
+	defer pool.Close(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pool.Warm(context.Background(), 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if stats := pool.Stats(); stats.Max != 2 || stats.Outstanding != 0 {
+		t.Fatalf("stats = %+v, want Max 2, Outstanding 0", stats)
+	}
+}
+
+// slowAbortBackend 第一个请求不响应，收到FCGI_ABORT_REQUEST后延迟输出并结束请求，其他请求立即响应
+func slowAbortBackend(started chan<- struct{}, delay time.Duration) ConnFactory {
+	return func() (net.Conn, error) {
+		cli, srv := net.Pipe()
+		go func() {
+			defer srv.Close()
+			sc := newConn(srv)
+			var rec record
+			first := true
+			for {
+				if err := sc.readRecord(&rec); err != nil {
+					return
+				}
+				reqID := rec.h.RequestID
+				switch {
+				case rec.h.Type == typeStdin && rec.h.ContentLength == 0 && first:
+					first = false
+					started <- struct{}{}
+				case rec.h.Type == typeStdin && rec.h.ContentLength == 0:
+					sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\nnext"))
+					sc.writeEndRequest(reqID, 0, statusRequestComplete)
+				case rec.h.Type == typeAbortRequest:
+					go func() {
+						time.Sleep(delay)
+						sc.writeRecord(typeStdout, reqID, []byte("late"))
+						sc.writeEndRequest(reqID, 0, statusRequestComplete)
+					}()
+				}
+			}
+		}()
+		return cli, nil
+	}
+}
+
+// TestPoolReuseAfterAbort 终止的请求读取完剩余的消息之前，连接不能借给下一个请求
+// 后端对每个连接的第一个请求不响应，第二个请求只有复用原来的连接才能得到响应
+func TestPoolReuseAfterAbort(t *testing.T) {
+	started := make(chan struct{}, 1)
+	pool := NewClientPoolConfig(SimpleClientFactory(slowAbortBackend(started, 100*time.Millisecond), 0), PoolConfig{MaxActive: 1, Expires: time.Minute})
+	defer pool.Close(context.Background())
+
+	c, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := c.Do(NewRequest(httptest.NewRequest("GET", "/", nil).WithContext(ctx)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	cancel()
+	io.Copy(io.Discard, resp.stdOutReader)
+	c.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err = pool.CreateClientContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	resp, err = c.Do(NewRequest(httptest.NewRequest("GET", "/", nil).WithContext(ctx)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(resp.stdOutReader)
+	if string(out) != "Content-Type: text/plain\r\n\r\nnext" || resp.Err() != nil {
+		t.Fatalf("stdout = %q, Err() = %v", out, resp.Err())
+	}
+}
+
+// TestPoolClockTimings 排队、建立连接的耗时和借出时长使用池的Clock
+func TestPoolClockTimings(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	dial := func() (net.Conn, error) {
+		clock.Advance(3 * time.Second)
+		return pipeConnFactory()
+	}
+	pool := NewClientPoolConfig(SimpleClientFactoryNoConn(dial, 0), PoolConfig{MaxActive: 1, Expires: time.Hour, Clock: clock})
+	defer pool.Close(context.Background())
+	reports := make(chan LeakReport, 1)
+	pool.SetLeakDetection(20*time.Millisecond, func(report LeakReport) { reports <- report })
+
+	c, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if pc := c.(*PoolClient); pc.waited != 0 || pc.dialed != 3*time.Second {
+		t.Fatalf("waited = %s, dialed = %s", pc.waited, pc.dialed)
+	}
+	clock.Advance(time.Hour)
+	select {
+	case report := <-reports:
+		if report.Held != time.Hour {
+			t.Fatalf("Held = %s, want 1h", report.Held)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("leak not reported")
+	}
+}
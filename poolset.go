@@ -0,0 +1,203 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 多个后端（例如多个php-fpm）各自的Client池
+
+// PoolSet 按后端地址管理一组ClientPool，所有池使用相同的配置
+type PoolSet struct {
+	config PoolConfig
+	limit  uint32
+
+	// borrowTimeout 每个池的SetBorrowTimeout
+	borrowTimeout time.Duration
+
+	mutex  sync.Mutex
+	pools  map[string]*ClientPool // 后端地址到池的映射
+	down   map[string]bool        // 不可用的后端
+	closed bool
+	next   uint32 // 轮询的起始位置
+
+	// ctx 关闭时取消，用于放弃正在进行的连接
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewPoolSet 创建PoolSet
+// config 为每个后端的池的配置，limit 同SimpleClientFactory
+func NewPoolSet(config PoolConfig, limit uint32) *PoolSet {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PoolSet{
+		config: config,
+		limit:  limit,
+		pools:  make(map[string]*ClientPool),
+		down:   make(map[string]bool),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// SetBorrowTimeout 设置每个池已全部借出时等待归还的最长时间，同ClientPool.SetBorrowTimeout
+// ClientFactory在某个后端的池等待超时后尝试下一个后端；0表示一直等待（默认），
+// 这时一个后端的池全部借出会阻塞之后的所有请求。需要在使用ClientFactory之前设置
+func (s *PoolSet) SetBorrowTimeout(timeout time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.borrowTimeout = timeout
+	for _, pool := range s.pools {
+		pool.SetBorrowTimeout(timeout)
+	}
+}
+
+// Pool 返回后端对应的池，不存在时创建
+func (s *PoolSet) Pool(b *Backend) (*ClientPool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, ErrPoolClosed
+	}
+	pool, ok := s.pools[b.String()]
+	if !ok {
+		// 连接使用PoolSet的上下文，关闭时正在进行的连接被取消
+		connFactory := func() (net.Conn, error) {
+			return b.DialContext(s.ctx)
+		}
+		pool = NewClientPoolConfig(SimpleClientFactoryNoConn(connFactory, s.limit), s.config)
+		pool.SetBorrowTimeout(s.borrowTimeout)
+		s.pools[b.String()] = pool
+	}
+	return pool, nil
+}
+
+// lookup 返回后端已经创建的池，不创建新的池
+func (s *PoolSet) lookup(b *Backend) (*ClientPool, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pool, ok := s.pools[b.String()]
+	return pool, ok
+}
+
+// SetHealthy 标记后端是否可用，ClientFactory优先选择可用的后端
+func (s *PoolSet) SetHealthy(b *Backend, healthy bool) {
+	s.setHealthy(b.String(), healthy)
+}
+
+// setHealthy 按后端地址标记是否可用
+func (s *PoolSet) setHealthy(key string, healthy bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if healthy {
+		delete(s.down, key)
+	} else {
+		s.down[key] = true
+	}
+}
+
+// healthy 返回后端是否可用
+func (s *PoolSet) healthy(b *Backend) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.down[b.String()]
+}
+
+// Watch 订阅bus上的EventBackendUp/EventBackendDown事件（例如由Gateway的健康检查发布）以更新后端状态
+// 返回取消订阅的函数
+func (s *PoolSet) Watch(bus *EventBus) (unsubscribe func()) {
+	return bus.Subscribe(func(e Event) {
+		switch e.Type {
+		case EventBackendUp:
+			s.setHealthy(e.Source, true)
+		case EventBackendDown:
+			s.setHealthy(e.Source, false)
+		}
+	})
+}
+
+// ClientFactory 返回在backends之间轮询的ClientFactory
+// 跳过标记为不可用的后端（全部不可用时仍逐个尝试），从某个后端的池获取失败时尝试下一个，
+// 包括池已全部借出、等待SetBorrowTimeout超时（ErrPoolTimeout）的情况
+func (s *PoolSet) ClientFactory(backends ...*Backend) ClientFactory {
+	return func() (Client, error) {
+		if len(backends) == 0 {
+			return nil, errors.New("no backends")
+		}
+		return s.borrow(s.candidates(backends))
+	}
+}
+
+// candidates 返回按轮询顺序排列的可用后端，全部不可用时返回全部后端
+func (s *PoolSet) candidates(backends []*Backend) []*Backend {
+	start := int(atomic.AddUint32(&s.next, 1))
+	var candidates, fallback []*Backend
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		if s.healthy(b) {
+			candidates = append(candidates, b)
+		} else {
+			fallback = append(fallback, b)
+		}
+	}
+	if len(candidates) == 0 {
+		return fallback
+	}
+	return candidates
+}
+
+// borrow 按顺序从candidates的池获取Client，返回第一个成功获取的Client或最后一个错误
+func (s *PoolSet) borrow(candidates []*Backend) (Client, error) {
+	var err error
+	for _, b := range candidates {
+		var pool *ClientPool
+		if pool, err = s.Pool(b); err != nil {
+			return nil, err
+		}
+		var c Client
+		if c, err = pool.CreateClient(); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+// Stats 返回每个后端的池的统计信息
+func (s *PoolSet) Stats() map[string]PoolStats {
+	s.mutex.Lock()
+	pools := make(map[string]*ClientPool, len(s.pools))
+	for k, pool := range s.pools {
+		pools[k] = pool
+	}
+	s.mutex.Unlock()
+	stats := make(map[string]PoolStats, len(pools))
+	for k, pool := range pools {
+		stats[k] = pool.Stats()
+	}
+	return stats
+}
+
+// Close 关闭所有的池，返回第一个错误
+func (s *PoolSet) Close(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return ErrPoolClosed
+	}
+	s.closed = true
+	pools := s.pools
+	s.mutex.Unlock()
+	s.cancel()
+
+	var first error
+	for _, pool := range pools {
+		if err := pool.Close(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,154 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acceptBackend 接受连接但不处理请求的后端
+func acceptBackend(t *testing.T) *Backend {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return &Backend{Network: "tcp", Address: ln.Addr().String()}
+}
+
+func TestPoolSet(t *testing.T) {
+	a, b := acceptBackend(t), acceptBackend(t)
+	set := NewPoolSet(PoolConfig{MaxActive: 2, Expires: time.Hour}, 0)
+	bus := new(EventBus)
+	set.Watch(bus)
+	factory := set.ClientFactory(a, b)
+
+	borrow := func(n int) map[string]int {
+		var out []Client
+		for i := 0; i < n; i++ {
+			c, err := factory()
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, c)
+		}
+		used := make(map[string]int)
+		for k, stats := range set.Stats() {
+			used[k] = stats.Outstanding
+		}
+		for _, c := range out {
+			c.Close()
+		}
+		return used
+	}
+
+	steps := []struct {
+		name  string
+		down  []*Backend
+		up    []*Backend
+		n     int
+		wantA int
+		wantB int
+	}{
+		{name: "round robin", n: 2, wantA: 1, wantB: 1},
+		{name: "skip down backend", down: []*Backend{a}, n: 2, wantA: 0, wantB: 2},
+		{name: "all down", down: []*Backend{b}, n: 2, wantA: 1, wantB: 1},
+		{name: "recovered", up: []*Backend{a, b}, n: 4, wantA: 2, wantB: 2},
+	}
+	for _, step := range steps {
+		for _, be := range step.down {
+			bus.Publish(Event{Type: EventBackendDown, Source: be.String()})
+		}
+		for _, be := range step.up {
+			bus.Publish(Event{Type: EventBackendUp, Source: be.String()})
+		}
+		used := borrow(step.n)
+		if used[a.String()] != step.wantA || used[b.String()] != step.wantB {
+			t.Errorf("%s: outstanding = %v, want %d and %d", step.name, used, step.wantA, step.wantB)
+		}
+	}
+
+	// 某个后端的池已全部借出时尝试下一个
+	set.SetHealthy(a, true)
+	held, _ := set.Pool(a)
+	held.SetBorrowTimeout(time.Millisecond)
+	var out []Client
+	for i := 0; i < 2; i++ {
+		c, err := held.CreateClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, c)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := factory(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := set.Stats()[b.String()]; stats.Outstanding != 2 {
+		t.Errorf("stats = %+v, want requests moved to the other backend", stats)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	set.Close(ctx)
+	if _, err := factory(); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("after Close: err = %v, want ErrPoolClosed", err)
+	}
+	if err := set.Close(context.Background()); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("second Close = %v, want ErrPoolClosed", err)
+	}
+	for _, c := range out {
+		c.Close()
+	}
+}
+
+func TestPoolSetBorrowTimeout(t *testing.T) {
+	a, b := docRootBackend(t, "a"), docRootBackend(t, "b")
+	set := NewPoolSet(PoolConfig{MaxActive: 1, Expires: time.Hour}, 0)
+	defer set.Close(context.Background())
+	set.SetBorrowTimeout(20 * time.Millisecond)
+	h := NewHandler(NewPHPFS("/srv")(BasicHandler), set.ClientFactory(a, b))
+
+	// a的池全部借出
+	pool, err := set.Pool(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	// 轮询的起始位置交替，两次请求都由b处理
+	for i := 0; i < 2; i++ {
+		done := make(chan string, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/index.php", nil))
+			done <- rec.Body.String()
+		}()
+		select {
+		case body := <-done:
+			if !strings.HasPrefix(body, "b ") {
+				t.Errorf("request %d: body = %q, want served by b", i, body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("request blocked on the saturated backend")
+		}
+	}
+}
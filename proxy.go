@@ -0,0 +1,184 @@
+package ffcgiclient
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 位于CDN或负载均衡之后时，根据受信任代理转发的头部还原客户端信息
+
+// TrustedProxies 受信任的代理地址段
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// NewTrustedProxies 根据CIDR（或单个IP）列表创建TrustedProxies
+func NewTrustedProxies(cidrs ...string) (*TrustedProxies, error) {
+	tp := &TrustedProxies{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		tp.nets = append(tp.nets, ipnet)
+	}
+	return tp, nil
+}
+
+// Trusted 检查ip是否属于受信任的代理
+func (tp *TrustedProxies) Trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range tp.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware 返回一个中间件，对来自受信任代理的请求，根据Forwarded（RFC 7239）
+// 或X-Forwarded-For/X-Forwarded-Proto重新计算REMOTE_ADDR、REMOTE_PORT、HTTPS和REQUEST_SCHEME
+// 需要放在BasicParamsMapMiddleware之后
+func (tp *TrustedProxies) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if hop, ok := tp.clientHop(req.Raw); ok {
+				if hop.addr != "" {
+					req.Params.Set("REMOTE_ADDR", hop.addr)
+					req.Params.Set("REMOTE_PORT", hop.port)
+				}
+				switch strings.ToLower(hop.proto) {
+				case "https":
+					req.Params.Set("HTTPS", "on")
+					req.Params.Set("REQUEST_SCHEME", "https")
+				case "http":
+					req.Params.Del("HTTPS")
+					req.Params.Set("REQUEST_SCHEME", "http")
+				}
+			}
+			return inner(client, req)
+		}
+	}
+}
+
+// forwardedHop 转发链中的一跳
+type forwardedHop struct {
+	addr  string // 客户端地址
+	port  string // 客户端端口，可能为空
+	proto string // 协议，可能为空
+}
+
+// clientHop 从转发头中找出客户端，即从右向左第一个不受信任的地址
+// 请求不是来自受信任代理或没有转发头时返回false
+func (tp *TrustedProxies) clientHop(r *http.Request) (hop forwardedHop, ok bool) {
+	peer, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !tp.Trusted(net.ParseIP(peer)) {
+		return
+	}
+
+	// 优先使用标准的Forwarded头，其中每一跳的协议由接收该跳请求的代理写入
+	var hops []forwardedHop
+	forwarded := false
+	// X-Forwarded-Proto只使用最右边的值，即直接连接的受信任代理写入的值，左边的值可能由客户端伪造
+	var proto string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		hops = parseForwarded(values)
+		forwarded = true
+	} else {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, addr := range strings.Split(v, ",") {
+				hops = append(hops, forwardedHop{addr: strings.TrimSpace(addr)})
+			}
+		}
+		protos := r.Header.Values("X-Forwarded-Proto")
+		if len(protos) > 0 {
+			last := protos[len(protos)-1]
+			proto = strings.TrimSpace(last[strings.LastIndexByte(last, ',')+1:])
+		}
+		if len(hops) == 0 && proto != "" {
+			return forwardedHop{proto: proto}, true
+		}
+	}
+	if len(hops) == 0 {
+		return
+	}
+
+	// 从右向左跳过受信任的代理
+	i := len(hops) - 1
+	for ; i > 0; i-- {
+		if !tp.Trusted(net.ParseIP(hops[i].addr)) {
+			break
+		}
+	}
+	hop = hops[i]
+	// 只使用选中的一跳的协议，不沿用其他跳（可能由客户端伪造）的协议
+	if !forwarded {
+		hop.proto = proto
+	}
+	// 地址不是IP（例如unknown或混淆标识）时不使用
+	if net.ParseIP(hop.addr) == nil {
+		hop.addr, hop.port = "", ""
+	}
+	return hop, true
+}
+
+// parseForwarded 解析RFC 7239 Forwarded头
+// 例如: for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"
+func parseForwarded(values []string) (hops []forwardedHop) {
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			var hop forwardedHop
+			for _, pair := range splitQuoted(element, ';') {
+				eq := strings.IndexByte(pair, '=')
+				if eq < 0 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(pair[:eq]))
+				value := strings.Trim(strings.TrimSpace(pair[eq+1:]), `"`)
+				switch key {
+				case "for":
+					hop.addr, hop.port = splitNode(value)
+				case "proto":
+					hop.proto = value
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return
+}
+
+// splitNode 拆分节点标识中的地址和端口，例如"[2001:db8::1]:4711"、"192.0.2.1:80"
+func splitNode(node string) (addr, port string) {
+	if host, p, err := net.SplitHostPort(node); err == nil {
+		return host, p
+	}
+	return strings.Trim(node, "[]"), ""
+}
+
+// splitQuoted 按sep拆分s，忽略双引号内的分隔符
+func splitQuoted(s string, sep byte) (parts []string) {
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
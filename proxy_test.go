@@ -0,0 +1,85 @@
+package ffcgiclient
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	tp, err := NewTrustedProxies("10.0.0.0/8", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		addr       string
+		port       string
+		scheme     string
+	}{
+		{
+			name:       "untrusted peer",
+			remoteAddr: "203.0.113.9:1234",
+			header:     map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Forwarded-Proto": "https"},
+			addr:       "203.0.113.9",
+			port:       "1234",
+			scheme:     "http",
+		},
+		{
+			name:       "x-forwarded-for chain",
+			remoteAddr: "10.1.1.1:1234",
+			header:     map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4, 10.2.2.2", "X-Forwarded-Proto": "https"},
+			addr:       "1.2.3.4",
+			port:       "",
+			scheme:     "https",
+		},
+		{
+			name:       "forwarded",
+			remoteAddr: "192.0.2.1:1234",
+			header:     map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https, for=10.3.3.3;proto=http`},
+			addr:       "2001:db8:cafe::17",
+			port:       "4711",
+			scheme:     "https",
+		},
+		{
+			name:       "spoofed x-forwarded-proto",
+			remoteAddr: "10.1.1.1:1234",
+			header:     map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Forwarded-Proto": "https, http"},
+			addr:       "1.2.3.4",
+			port:       "",
+			scheme:     "http",
+		},
+		{
+			name:       "spoofed forwarded proto",
+			remoteAddr: "192.0.2.1:1234",
+			header:     map[string]string{"Forwarded": "for=6.6.6.6;proto=https, for=1.2.3.4"},
+			addr:       "1.2.3.4",
+			port:       "",
+			scheme:     "http",
+		},
+		{
+			name:       "forwarded unknown",
+			remoteAddr: "192.0.2.1:1234",
+			header:     map[string]string{"Forwarded": "for=unknown;proto=http"},
+			addr:       "192.0.2.1",
+			port:       "1234",
+			scheme:     "http",
+		},
+	}
+	for _, tt := range tests {
+		var params map[string]string
+		r := httptest.NewRequest("GET", "/index.php", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+		Chain(BasicParamsMapMiddleware, tp.Middleware())(recordHandler(&params))(nil, NewRequest(r))
+		if params["REMOTE_ADDR"] != tt.addr || params["REMOTE_PORT"] != tt.port || params["REQUEST_SCHEME"] != tt.scheme {
+			t.Errorf("%s: got %s %s %s", tt.name, params["REMOTE_ADDR"], params["REMOTE_PORT"], params["REQUEST_SCHEME"])
+		}
+		if (params["HTTPS"] == "on") != (tt.scheme == "https") {
+			t.Errorf("%s: HTTPS=%q", tt.name, params["HTTPS"])
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package ffcgiclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 按租户的配额限制，用于基于网关的共享主机环境
+
+// TenantFunc 从请求中提取租户标识，返回空字符串表示不限制此请求
+type TenantFunc func(r *http.Request) string
+
+// QuotaStore 配额计数器的存储，可以替换为Redis等多个网关实例共享的存储
+type QuotaStore interface {
+
+	// Incr 将key的计数增加n（可以为负数或0），返回增加后的值
+	// window大于0时，计数在第一次增加后window时间到期并重新从0开始；为0时不过期
+	Incr(key string, n int64, window time.Duration) (int64, error)
+}
+
+// MemoryQuotaStore 进程内存中的QuotaStore实现，零值可以直接使用
+type MemoryQuotaStore struct {
+
+	// Clock 判断计数窗口到期使用的时间来源，为nil时使用SystemClock
+	Clock Clock
+
+	mutex   sync.Mutex
+	entries map[string]*quotaEntry
+	ops     int
+}
+
+// quotaEntry 计数项
+type quotaEntry struct {
+	value   int64
+	expires time.Time // 为零值时不过期
+}
+
+// NewMemoryQuotaStore 创建MemoryQuotaStore
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{entries: make(map[string]*quotaEntry)}
+}
+
+// Incr 实现QuotaStore
+func (s *MemoryQuotaStore) Incr(key string, n int64, window time.Duration) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]*quotaEntry)
+	}
+	now := clockOr(s.Clock).Now()
+	// 定期清理过期的计数
+	if s.ops++; s.ops%1024 == 0 {
+		for k, e := range s.entries {
+			if !e.expires.IsZero() && now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	e, ok := s.entries[key]
+	if !ok || (!e.expires.IsZero() && now.After(e.expires)) {
+		e = &quotaEntry{}
+		if window > 0 {
+			e.expires = now.Add(window)
+		}
+		s.entries[key] = e
+	}
+	e.value += n
+	return e.value, nil
+}
+
+// Quota 按租户的配额，值为0的限制项不生效
+// 超出配额时直接返回429，不转发到后端；存储出错时不做限制
+type Quota struct {
+
+	// Tenant 提取租户标识
+	Tenant TenantFunc
+
+	// RequestsPerMinute 每分钟的请求数
+	RequestsPerMinute int64
+
+	// Concurrent 同时处理的请求数
+	Concurrent int64
+
+	// BytesPerDay 每天的响应字节数，超出后拒绝之后的请求
+	BytesPerDay int64
+
+	// Store 计数器存储，为nil时使用进程内存
+	Store QuotaStore
+
+	once sync.Once
+}
+
+// store 返回计数器存储
+func (q *Quota) store() QuotaStore {
+	q.once.Do(func() {
+		if q.Store == nil {
+			q.Store = NewMemoryQuotaStore()
+		}
+	})
+	return q.Store
+}
+
+// Middleware 返回执行配额限制的中间件
+func (q *Quota) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			tenant := ""
+			if q.Tenant != nil {
+				tenant = q.Tenant(req.Raw)
+			}
+			if tenant == "" {
+				return inner(client, req)
+			}
+			store := q.store()
+
+			// 每分钟请求数
+			if q.RequestsPerMinute > 0 {
+				if n, err := store.Incr("rpm:"+tenant, 1, time.Minute); err == nil && n > q.RequestsPerMinute {
+					return tooManyRequests(time.Minute), nil
+				}
+			}
+			// 每天的字节数
+			if q.BytesPerDay > 0 {
+				if n, err := store.Incr("bytes:"+tenant, 0, 24*time.Hour); err == nil && n >= q.BytesPerDay {
+					return tooManyRequests(0), nil
+				}
+			}
+			// 并发数
+			concurrent := false
+			if q.Concurrent > 0 {
+				n, err := store.Incr("conc:"+tenant, 1, 0)
+				if err == nil && n > q.Concurrent {
+					store.Incr("conc:"+tenant, -1, 0)
+					return tooManyRequests(0), nil
+				}
+				concurrent = err == nil
+			}
+
+			// stdout读取结束时统计字节数并释放并发数
+			// WriteTo出错时也会读取完剩余的输出，因此每个请求都会调用一次finish
+			var once sync.Once
+			var written int64
+			finish := func() {
+				once.Do(func() {
+					if concurrent {
+						store.Incr("conc:"+tenant, -1, 0)
+					}
+					if q.BytesPerDay > 0 {
+						store.Incr("bytes:"+tenant, atomic.LoadInt64(&written), 24*time.Hour)
+					}
+				})
+			}
+
+			resp, err := inner(client, req)
+			if err != nil {
+				finish()
+				return resp, err
+			}
+			resp.stdOutReader = &countingReader{r: resp.stdOutReader, n: &written, done: finish}
+			return resp, nil
+		}
+	}
+}
+
+// tooManyRequests 返回429响应，retryAfter大于0时设置Retry-After
+func tooManyRequests(retryAfter time.Duration) *ResponsePipe {
+	code := http.StatusTooManyRequests
+	header := make(http.Header)
+	header.Set("Status", fmt.Sprintf("%d %s", code, http.StatusText(code)))
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if retryAfter > 0 {
+		header.Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	}
+	return newStaticResponse(header, strings.NewReader(http.StatusText(code)+"\n"))
+}
+
+// countingReader 统计读取的字节数，读取结束时调用done
+type countingReader struct {
+	r    io.Reader
+	n    *int64
+	done func()
+}
+
+// Read 实现io.Reader
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	if err != nil {
+		cr.done()
+	}
+	return n, err
+}
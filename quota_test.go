@@ -0,0 +1,90 @@
+package ffcgiclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryQuotaStore(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	// 零值可以直接使用
+	s := &MemoryQuotaStore{Clock: clock}
+	steps := []struct {
+		key     string
+		n       int64
+		window  time.Duration
+		advance time.Duration
+		want    int64
+	}{
+		{"a", 1, time.Minute, 0, 1},
+		{"a", 2, time.Minute, 30 * time.Second, 3},
+		{"b", 5, 0, 0, 5},
+		{"a", 1, time.Minute, 31 * time.Second, 1},
+		{"b", -2, 0, time.Hour, 3},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		got, err := s.Incr(step.key, step.n, step.window)
+		if err != nil || got != step.want {
+			t.Fatalf("step %d: Incr(%s) = %d, %v, want %d", i, step.key, got, err, step.want)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	stub := &stubClient{recorded: map[string][]byte{
+		"": []byte("Content-Type: text/plain\r\n\r\n0123456789"),
+	}}
+	store := &MemoryQuotaStore{}
+	q := &Quota{
+		Tenant:            func(r *http.Request) string { return r.Header.Get("X-Tenant") },
+		RequestsPerMinute: 3,
+		Concurrent:        1,
+		BytesPerDay:       100,
+		Store:             store,
+	}
+	handler := q.Middleware()(BasicHandler)
+	serve := func(tenant string, read bool) (*ResponsePipe, int) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Tenant", tenant)
+		resp, err := handler(stub, NewRequest(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !read {
+			return resp, 0
+		}
+		rec := httptest.NewRecorder()
+		resp.WriteTo(rec, io.Discard)
+		return resp, rec.Code
+	}
+
+	// 未读取完的响应占用并发数
+	pending, _ := serve("a", false)
+	if _, code := serve("a", true); code != http.StatusTooManyRequests {
+		t.Fatalf("concurrent: status = %d", code)
+	}
+	pending.WriteTo(httptest.NewRecorder(), io.Discard)
+	if _, code := serve("a", true); code != 200 {
+		t.Fatalf("after release: status = %d", code)
+	}
+	// 每分钟的请求数，被拒绝的请求也计数
+	if _, code := serve("a", true); code != http.StatusTooManyRequests {
+		t.Fatalf("rpm: status = %d", code)
+	}
+	if n, _ := store.Incr("conc:a", 0, 0); n != 0 {
+		t.Fatalf("concurrent count = %d after all responses", n)
+	}
+	// 其他租户不受影响，响应字节数被统计
+	serve("b", true)
+	if n, _ := store.Incr("bytes:b", 0, 24*time.Hour); n != int64(len(stub.recorded[""])) {
+		t.Fatalf("bytes = %d", n)
+	}
+	// 没有租户的请求不限制
+	if _, code := serve("", true); code != 200 {
+		t.Fatalf("no tenant: status = %d", code)
+	}
+}
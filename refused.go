@@ -0,0 +1,330 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 应用程序以FCGI_CANT_MPX_CONN或FCGI_OVERLOADED拒绝请求时透明地重试，不把空响应返回给用户；
+// 幂等的请求在连接断开等传输错误时也可以重试，重试次数由RetryBudget限制在请求数的一定比例内
+
+// 重试的默认值
+const (
+	DefaultRefusedRetries     = 2
+	DefaultRefusedReplayBytes = 64 * 1024
+)
+
+// RetryRefused 应用程序拒绝请求时重试，需放在中间件链的最后，使重试只重新执行发送请求的部分
+// FCGI_CANT_MPX_CONN：在新的连接上立即重试
+// FCGI_OVERLOADED：按Backoff等待后重试，请求的上下文结束时停止等待
+// 传输错误（连接断开等）：应用程序可能已经处理了请求，只重试Idempotent的请求，在新的连接上立即重试
+// 重试需要重新发送请求体，超过MaxReplayBytes的请求体不重试；
+// 应用程序已输出响应后不再重试，重试次数或Budget用完时由Handler返回502或503
+type RetryRefused struct {
+
+	// MaxRetries 最大重试次数，默认DefaultRefusedRetries
+	MaxRetries int
+
+	// Backoff 因FCGI_OVERLOADED第attempt次（从1开始）重试前的等待时间，为nil时从50ms开始每次加倍
+	Backoff func(attempt int) time.Duration
+
+	// MaxReplayBytes 为重试保留的请求体的最大字节数，默认DefaultRefusedReplayBytes
+	MaxReplayBytes int
+
+	// Idempotent 判断请求能否在传输错误后重试，为nil时使用IdempotentRequest
+	Idempotent func(req *Request) bool
+
+	// Budget 限制重试的总数，可以在多个RetryRefused之间共享，为nil时不限制
+	Budget *RetryBudget
+}
+
+// IdempotentRequest 按RFC 7231判断请求是否幂等：GET、HEAD、OPTIONS、TRACE、PUT、DELETE，
+// 以及带有Idempotency-Key请求头的请求
+func IdempotentRequest(req *Request) bool {
+	if req.Raw == nil {
+		return false
+	}
+	switch req.Raw.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Raw.Header.Get("Idempotency-Key") != ""
+}
+
+// idempotent 判断请求能否在传输错误后重试
+func (r *RetryRefused) idempotent(req *Request) bool {
+	if r.Idempotent != nil {
+		return r.Idempotent(req)
+	}
+	return IdempotentRequest(req)
+}
+
+// Middleware 返回重试被拒绝的请求的中间件
+func (r *RetryRefused) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			r.Budget.request()
+			var body *replayBody
+			if req.Stdin != nil {
+				limit := r.MaxReplayBytes
+				if limit <= 0 {
+					limit = DefaultRefusedReplayBytes
+				}
+				body = &replayBody{ReadCloser: req.Stdin, limit: limit}
+				req.Stdin = body
+			}
+			resp, err := inner(client, req)
+			if err != nil {
+				if body != nil {
+					body.ReadCloser.Close()
+				}
+				return resp, err
+			}
+			p := NewResponsePipe()
+			p.headerLimits = resp.headerLimits
+			p.upstream = resp
+			go r.serve(p, resp, inner, client, req, body)
+			return p, nil
+		}
+	}
+}
+
+// serve 将resp转发到p，应用程序没有输出就拒绝了请求时重试
+func (r *RetryRefused) serve(p, resp *ResponsePipe, inner RequestHandler, client Client, req *Request, body *replayBody) {
+	stderr := make(chan struct{})
+	defer func() {
+		<-stderr
+		p.stdErrWriter.Close()
+		if body != nil {
+			body.ReadCloser.Close()
+		}
+	}()
+	max := r.MaxRetries
+	if max <= 0 {
+		max = DefaultRefusedRetries
+	}
+	buf := make([]byte, 4096)
+	for attempt := 1; ; attempt++ {
+		// 转发stderr，与读取stdout同时进行，避免阻塞上游的读取协程
+		go func(resp *ResponsePipe, done chan struct{}) {
+			io.Copy(p.stdErrWriter, resp.stdErrReader)
+			close(done)
+		}(resp, stderr)
+
+		n, err := io.ReadAtLeast(resp.stdOutReader, buf, 1)
+		if n > 0 {
+			// 应用程序已开始输出，之后不再重试
+			p.stdOutWriter.Write(buf[:n])
+			_, err = io.Copy(p.stdOutWriter, resp.stdOutReader)
+			// 下游停止读取时丢弃剩余数据，避免阻塞上游的读取协程
+			resp.discardStdout()
+			p.setErr(resp.Err())
+			if err != nil {
+				p.stdOutWriter.(*io.PipeWriter).CloseWithError(err)
+				return
+			}
+			p.stdOutWriter.Close()
+			return
+		}
+		refused := resp.Err()
+		if err != io.EOF {
+			resp.discardStdout()
+		}
+		if err != io.EOF || attempt > max || !r.retry(refused, attempt, client, req, body) {
+			p.setErr(refused)
+			p.stdOutWriter.Close()
+			return
+		}
+
+		// 等待上一次的stderr转发结束后重新发送请求
+		<-stderr
+		stderr = make(chan struct{})
+		if resp, err = inner(client, req); err != nil {
+			close(stderr)
+			p.setErr(err)
+			p.stdOutWriter.Close()
+			return
+		}
+		// Timing等返回应答的这一次请求的结果
+		p.setUpstream(resp)
+	}
+}
+
+// retry 检查被拒绝或传输失败的请求能否重试，并准备重试：重新打开连接或等待
+func (r *RetryRefused) retry(refused error, attempt int, client Client, req *Request, body *replayBody) bool {
+	overloaded := errors.Is(refused, ErrOverloaded)
+	switch {
+	case errors.Is(refused, ErrCantMultiplex), overloaded:
+	case transportError(refused) && r.idempotent(req):
+	default:
+		return false
+	}
+	if body != nil && !body.rewind() {
+		return false
+	}
+	if !r.Budget.withdraw() {
+		return false
+	}
+	if !overloaded {
+		return client.NewConn() == nil
+	}
+	var wait time.Duration
+	if r.Backoff != nil {
+		wait = r.Backoff(attempt)
+	} else {
+		wait = 50 * time.Millisecond << uint(attempt-1)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	done := requestDone(req)
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// transportError 检查err是否是连接断开等传输错误，此时无法确定应用程序是否已经处理了请求
+// 请求的上下文结束、应用程序拒绝请求和消息不合法不属于传输错误
+func transportError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) || errors.As(err, &opErr)
+}
+
+// requestDone 返回请求的上下文结束信号，没有上下文时返回nil
+func requestDone(req *Request) <-chan struct{} {
+	return req.Context().Done()
+}
+
+// replayBody 保留已读取的请求体，使请求可以重新发送
+// Close不关闭原始请求体，由RetryRefused在请求结束后关闭
+type replayBody struct {
+	io.ReadCloser
+	buf      []byte // 已读取的数据
+	pos      int    // 下一次读取在buf中的位置
+	limit    int    // buf的最大长度
+	overflow bool   // 超过limit，无法重新发送
+}
+
+// Read 实现io.Reader，重新发送时先读取保留的数据
+func (b *replayBody) Read(p []byte) (int, error) {
+	if b.pos < len(b.buf) {
+		n := copy(p, b.buf[b.pos:])
+		b.pos += n
+		return n, nil
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.overflow {
+		if len(b.buf)+n > b.limit {
+			b.overflow = true
+			b.buf = nil
+		} else {
+			b.buf = append(b.buf, p[:n]...)
+		}
+		b.pos = len(b.buf)
+	}
+	return n, err
+}
+
+// Close 实现io.Closer，不关闭原始请求体
+func (b *replayBody) Close() error {
+	return nil
+}
+
+// rewind 回到请求体的开始，超过limit时返回false
+func (b *replayBody) rewind() bool {
+	if b.overflow {
+		return false
+	}
+	b.pos = 0
+	return true
+}
+
+// RetryBudget 重试预算，每个统计窗口内的重试次数不超过MinRetries加上请求数的Ratio倍，
+// 避免后端故障时重试使负载成倍增加；对nil的*RetryBudget重试总是允许
+//
+//	budget := &ffcgiclient.RetryBudget{Ratio: 0.1, MinRetries: 10}
+type RetryBudget struct {
+
+	// Ratio 允许重试的请求比例，例如0.1表示最多重试10%的请求
+	Ratio float64
+
+	// MinRetries 每个窗口内不受比例限制的重试次数，使请求较少时也能重试
+	MinRetries int64
+
+	// Window 统计窗口，默认10秒
+	Window time.Duration
+
+	// Clock 时间来源，为nil时使用SystemClock
+	Clock Clock
+
+	mutex     sync.Mutex
+	start     time.Time // 当前窗口的开始时间
+	requests  int64     // 当前窗口的请求数
+	retries   int64     // 当前窗口的重试次数
+	exhausted int64     // 因预算不足没有重试的次数
+}
+
+// RetryBudgetStats 重试预算的统计信息
+type RetryBudgetStats struct {
+	Requests  int64 // 当前窗口的请求数
+	Retries   int64 // 当前窗口的重试次数
+	Exhausted int64 // 因预算不足没有重试的次数
+}
+
+// roll 进入新的窗口时清零计数，调用时持有锁
+func (b *RetryBudget) roll() {
+	window := b.Window
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	now := clockOr(b.Clock).Now()
+	if b.start.IsZero() || now.Sub(b.start) >= window {
+		b.start, b.requests, b.retries = now, 0, 0
+	}
+}
+
+// request 记录一个请求
+func (b *RetryBudget) request() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.roll()
+	b.requests++
+}
+
+// withdraw 预算足够时记录一次重试并返回true
+func (b *RetryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.roll()
+	if float64(b.retries) >= float64(b.MinRetries)+b.Ratio*float64(b.requests) {
+		b.exhausted++
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// Stats 返回重试预算的统计信息
+func (b *RetryBudget) Stats() RetryBudgetStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.roll()
+	return RetryBudgetStats{Requests: b.requests, Retries: b.retries, Exhausted: b.exhausted}
+}
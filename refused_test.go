@@ -0,0 +1,249 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// refusingBackend 前refuse个请求以status拒绝，之后返回请求体
+func refusingBackend(refuse int32, status uint8, conns *int32) ConnFactory {
+	var count int32
+	factory := recordBackend(func(sc *conn, reqID uint16, stdin []byte) {
+		if atomic.AddInt32(&count, 1) <= refuse {
+			sc.writeEndRequest(reqID, 0, status)
+			return
+		}
+		sc.writeRecord(typeStdout, reqID, append([]byte("Content-Type: text/plain\r\n\r\n"), stdin...))
+		sc.writeEndRequest(reqID, 0, statusRequestComplete)
+	})
+	return func() (net.Conn, error) {
+		atomic.AddInt32(conns, 1)
+		return factory()
+	}
+}
+
+func TestRetryRefused(t *testing.T) {
+	cases := []struct {
+		name      string
+		status    uint8
+		refuse    int32
+		wantCode  int
+		wantConns int32
+	}{
+		{"cant mpx", statusCantMultiplex, 1, http.StatusOK, 2},
+		{"overloaded", statusOverloaded, 2, http.StatusOK, 1},
+		{"overloaded exhausted", statusOverloaded, 3, http.StatusServiceUnavailable, 1},
+		{"unknown role", statusUnknownRole, 1, http.StatusBadGateway, 1},
+	}
+	for _, c := range cases {
+		var conns int32
+		var waits []int
+		retry := &RetryRefused{Backoff: func(attempt int) time.Duration {
+			waits = append(waits, attempt)
+			return time.Millisecond
+		}}
+		h := NewHandler(retry.Middleware()(BasicHandler), SimpleClientFactory(refusingBackend(c.refuse, c.status, &conns), 0))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+		if rec.Code != c.wantCode {
+			t.Errorf("%s: status = %d, want %d", c.name, rec.Code, c.wantCode)
+			continue
+		}
+		if c.wantCode == http.StatusOK && rec.Body.String() != "hello" {
+			t.Errorf("%s: body = %q", c.name, rec.Body.String())
+		}
+		if conns != c.wantConns {
+			t.Errorf("%s: %d connections, want %d", c.name, conns, c.wantConns)
+		}
+		// 只有FCGI_OVERLOADED等待，最多DefaultRefusedRetries次
+		wantWaits := 0
+		if c.status == statusOverloaded {
+			wantWaits = int(c.refuse)
+			if wantWaits > DefaultRefusedRetries {
+				wantWaits = DefaultRefusedRetries
+			}
+		}
+		if len(waits) != wantWaits {
+			t.Errorf("%s: backoff calls %v, want %d", c.name, waits, wantWaits)
+		}
+	}
+}
+
+func TestRetryRefusedTiming(t *testing.T) {
+	var conns int32
+	client, err := SimpleClientFactory(refusingBackend(1, statusOverloaded, &conns), 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// 记录每次发送请求返回的响应
+	var attempts []*ResponsePipe
+	inner := func(client Client, req *Request) (*ResponsePipe, error) {
+		resp, err := BasicHandler(client, req)
+		attempts = append(attempts, resp)
+		return resp, err
+	}
+	retry := &RetryRefused{Backoff: func(int) time.Duration { return 10 * time.Millisecond }}
+	resp, err := retry.Middleware()(inner)(client, NewRequest(httptest.NewRequest("GET", "/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err := resp.WriteTo(rec, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("%d attempts, want 2", len(attempts))
+	}
+	// Timing返回应答的第二次请求的耗时
+	if got, want := resp.Timing(), attempts[1].Timing(); got != want || got.Total <= 0 {
+		t.Errorf("Timing = %+v, want %+v", got, want)
+	}
+}
+
+// TestRefusedWithoutRetry 测试没有重试时被拒绝的请求返回503而不是空的500
+func TestRefusedWithoutRetry(t *testing.T) {
+	var conns int32
+	h := NewHandler(BasicHandler, SimpleClientFactory(refusingBackend(1, statusOverloaded, &conns), 0))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d", rec.Code)
+	}
+}
+
+func TestReplayBody(t *testing.T) {
+	b := &replayBody{ReadCloser: nopCloser{bytes.NewBufferString("abcdef")}, limit: 4}
+	p := make([]byte, 3)
+	b.Read(p)
+	if !b.rewind() {
+		t.Fatal("rewind failed within limit")
+	}
+	out, _ := io.ReadAll(b)
+	if string(out) != "abcdef" {
+		t.Fatalf("replayed %q", out)
+	}
+	if b.rewind() {
+		t.Fatal("rewind succeeded beyond limit")
+	}
+	if !errors.Is(endRequestError([]byte{0, 0, 0, 0, statusOverloaded, 0, 0, 0}), ErrOverloaded) {
+		t.Fatal("protocol status not mapped")
+	}
+}
+
+// droppingBackend 前drop个请求不回复直接断开连接，之后返回请求体
+func droppingBackend(drop int32, conns *int32) ConnFactory {
+	var count int32
+	factory := recordBackend(func(sc *conn, reqID uint16, stdin []byte) {
+		if atomic.AddInt32(&count, 1) <= drop {
+			sc.Close()
+			return
+		}
+		sc.writeRecord(typeStdout, reqID, append([]byte("Content-Type: text/plain\r\n\r\n"), stdin...))
+		sc.writeEndRequest(reqID, 0, statusRequestComplete)
+	})
+	return func() (net.Conn, error) {
+		atomic.AddInt32(conns, 1)
+		return factory()
+	}
+}
+
+// TestRetryTransportError 测试连接断开时只重试幂等的请求
+func TestRetryTransportError(t *testing.T) {
+	cases := []struct {
+		name      string
+		method    string
+		key       string
+		wantCode  int
+		wantConns int32
+	}{
+		{"get", "GET", "", http.StatusOK, 2},
+		{"put", "PUT", "", http.StatusOK, 2},
+		{"post", "POST", "", http.StatusBadGateway, 1},
+		{"post with idempotency key", "POST", "k1", http.StatusOK, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var conns int32
+			retry := &RetryRefused{}
+			h := NewHandler(retry.Middleware()(BasicHandler), SimpleClientFactory(droppingBackend(1, &conns), 0))
+			r := httptest.NewRequest(c.method, "/", strings.NewReader("hello"))
+			if c.key != "" {
+				r.Header.Set("Idempotency-Key", c.key)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != c.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, c.wantCode)
+			}
+			if c.wantCode == http.StatusOK && rec.Body.String() != "hello" {
+				t.Fatalf("body = %q", rec.Body.String())
+			}
+			if conns != c.wantConns {
+				t.Fatalf("%d connections, want %d", conns, c.wantConns)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	b := &RetryBudget{Ratio: 0.5, MinRetries: 1, Window: time.Minute, Clock: clock}
+	steps := []struct {
+		advance  time.Duration
+		requests int
+		want     bool
+	}{
+		{0, 0, true},  // MinRetries
+		{0, 0, false}, // 没有请求时用完
+		{0, 2, true},  // 2个请求增加1次
+		{0, 0, false},
+		{0, 2, true},
+		// 新的窗口重新计数
+		{time.Minute, 0, true},
+		{0, 0, false},
+	}
+	for i, s := range steps {
+		clock.Advance(s.advance)
+		for j := 0; j < s.requests; j++ {
+			b.request()
+		}
+		if got := b.withdraw(); got != s.want {
+			t.Fatalf("step %d: withdraw() = %v, want %v", i, got, s.want)
+		}
+	}
+	if stats := b.Stats(); stats.Exhausted != 3 || stats.Retries != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	var nilBudget *RetryBudget
+	nilBudget.request()
+	if !nilBudget.withdraw() {
+		t.Fatal("nil budget refused retry")
+	}
+}
+
+// TestRetryRefusedBudget 测试预算用完后不再重试
+func TestRetryRefusedBudget(t *testing.T) {
+	var conns int32
+	retry := &RetryRefused{Budget: &RetryBudget{MinRetries: 1}, Backoff: func(int) time.Duration { return time.Millisecond }}
+	h := NewHandler(retry.Middleware()(BasicHandler), SimpleClientFactory(refusingBackend(2, statusOverloaded, &conns), 0))
+	for i, want := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		// 第一个请求重试一次后预算用完，第二个请求不需要重试
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != want {
+			t.Fatalf("request %d: status = %d, want %d", i, rec.Code, want)
+		}
+	}
+	if stats := retry.Budget.Stats(); stats.Retries != 1 || stats.Exhausted != 1 || stats.Requests != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
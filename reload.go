@@ -0,0 +1,182 @@
+package ffcgiclient
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// 运行时重新加载配置，原子地替换路由、中间件链、DocRoot和后端地址
+// 已经开始的请求继续使用旧的配置，全部结束后再关闭旧配置的Client池
+//
+//  reloader, err := ffcgiclient.NewReloader(func() (*ffcgiclient.Config, error) {
+//      return ffcgiclient.LoadConfig("gateway.json")
+//  })
+//  go reloader.Watch(ctx, syscall.SIGHUP)
+//  http.ListenAndServe(":8080", reloader)
+
+// DefaultDrainTimeout 等待旧配置的请求结束的默认时间
+const DefaultDrainTimeout = time.Minute
+
+// Reloader 可以重新加载配置的http.Handler
+type Reloader struct {
+
+	// DrainTimeout 等待旧配置的请求结束的时间，超时后强制关闭旧的Client池，默认DefaultDrainTimeout
+	DrainTimeout time.Duration
+
+	load     func() (*Config, error)
+	logger   *log.Logger
+	events   *EventBus
+	mutex    sync.RWMutex
+	current  *generation
+	retiring sync.WaitGroup
+}
+
+// generation 一次加载得到的网关及其正在处理的请求
+type generation struct {
+	built    *Built
+	inflight sync.WaitGroup
+}
+
+// NewReloader 调用load加载配置并组装网关，之后每次Reload都重新调用load
+func NewReloader(load func() (*Config, error)) (*Reloader, error) {
+	rl := &Reloader{load: load}
+	built, err := rl.build()
+	if err != nil {
+		return nil, err
+	}
+	rl.current = &generation{built: built}
+	return rl, nil
+}
+
+// SetLogger 设置日志
+func (rl *Reloader) SetLogger(logger *log.Logger) {
+	rl.logger = logger
+}
+
+// SetEventBus 设置发布重新加载（EventConfigReload）事件的EventBus
+func (rl *Reloader) SetEventBus(bus *EventBus) {
+	rl.events = bus
+}
+
+// printf 记录日志
+func (rl *Reloader) printf(format string, v ...interface{}) {
+	if rl.logger != nil {
+		rl.logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// build 加载配置并组装网关
+func (rl *Reloader) build() (*Built, error) {
+	cfg, err := rl.load()
+	if err != nil {
+		return nil, err
+	}
+	return Build(cfg)
+}
+
+// ServeHTTP 实现http.Handler，使用请求开始时的配置处理整个请求
+func (rl *Reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rl.mutex.RLock()
+	g := rl.current
+	g.inflight.Add(1)
+	rl.mutex.RUnlock()
+	defer g.inflight.Done()
+	g.built.Handler.ServeHTTP(w, r)
+}
+
+// Built 返回当前使用的网关
+func (rl *Reloader) Built() *Built {
+	rl.mutex.RLock()
+	defer rl.mutex.RUnlock()
+	return rl.current.built
+}
+
+// Reload 重新加载配置并替换当前的网关，加载或组装失败时继续使用当前的网关并返回错误
+// 旧网关在其请求全部结束后关闭
+func (rl *Reloader) Reload() error {
+	built, err := rl.build()
+	if err != nil {
+		rl.events.Publish(Event{
+			Type:    EventConfigReload,
+			Source:  "reloader",
+			Message: "reload failed, keeping current configuration",
+			Err:     err,
+		})
+		return err
+	}
+	rl.mutex.Lock()
+	old := rl.current
+	rl.current = &generation{built: built}
+	rl.mutex.Unlock()
+	rl.retire(old)
+	rl.events.Publish(Event{
+		Type:    EventConfigReload,
+		Source:  "reloader",
+		Message: fmt.Sprintf("configuration reloaded with %d routes", len(built.Gateway.Routes)),
+	})
+	return nil
+}
+
+// retire 等待旧网关的请求结束后关闭其Client池
+func (rl *Reloader) retire(g *generation) {
+	timeout := rl.DrainTimeout
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	rl.retiring.Add(1)
+	go func() {
+		defer rl.retiring.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		drained := make(chan struct{})
+		go func() {
+			g.inflight.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			rl.printf("reload: old configuration still has requests in flight after %s", timeout)
+		}
+		if err := g.built.Close(ctx); err != nil {
+			rl.printf("reload: unable to close old configuration: %s", err)
+		}
+	}()
+}
+
+// Watch 每收到一个sigs中的信号就调用Reload，例如syscall.SIGHUP，直到ctx结束
+func (rl *Reloader) Watch(ctx context.Context, sigs ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-ch:
+			if err := rl.Reload(); err != nil {
+				rl.printf("reload on %s failed, keeping current configuration: %s", sig, err)
+				continue
+			}
+			rl.printf("reloaded configuration on %s", sig)
+		}
+	}
+}
+
+// Close 关闭当前的网关，并等待旧网关关闭
+func (rl *Reloader) Close(ctx context.Context) error {
+	rl.mutex.RLock()
+	g := rl.current
+	rl.mutex.RUnlock()
+	err := g.built.Close(ctx)
+	rl.retiring.Wait()
+	return err
+}
@@ -0,0 +1,70 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReloader(t *testing.T) {
+	backends := []*Backend{docRootBackend(t, "a"), docRootBackend(t, "b")}
+	var loads int
+	var loadErr error
+	rl, err := NewReloader(func() (*Config, error) {
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		b := backends[loads%len(backends)]
+		loads++
+		return ParseConfig(strings.NewReader(fmt.Sprintf(
+			`{"routes": [{"backends": [{"address": %q}], "doc_root": "/srv/%d"}]}`, b.Address, loads)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close(context.Background())
+	bus := new(EventBus)
+	events, unsubscribe := bus.SubscribeChan(2)
+	defer unsubscribe()
+	rl.SetEventBus(bus)
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		rl.ServeHTTP(rec, httptest.NewRequest("GET", "/index.php", nil))
+		return rec.Body.String()
+	}
+	if got := get(); got != "a /srv/1" {
+		t.Fatalf("before reload: %q", got)
+	}
+	old := rl.Built()
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(); got != "b /srv/2" {
+		t.Fatalf("after reload: %q", got)
+	}
+
+	// 加载失败时保留当前配置
+	loadErr = errors.New("broken config")
+	if err := rl.Reload(); err != loadErr {
+		t.Fatalf("Reload() = %v", err)
+	}
+	if got := get(); got != "b /srv/2" {
+		t.Fatalf("after failed reload: %q", got)
+	}
+	if e := <-events; e.Type != EventConfigReload || e.Err != nil {
+		t.Fatalf("reload event = %+v", e)
+	}
+	if e := <-events; e.Type != EventConfigReload || e.Err != loadErr {
+		t.Fatalf("failed reload event = %+v", e)
+	}
+
+	// 旧配置的Client池在请求结束后关闭
+	rl.retiring.Wait()
+	if err := old.Close(context.Background()); err != ErrPoolClosed {
+		t.Fatalf("old configuration not closed: %v", err)
+	}
+}
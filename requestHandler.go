@@ -1,7 +1,11 @@
 package ffcgiclient
 
 import (
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
 	"net"
+	"net/http"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -68,11 +72,13 @@ func BasicHandler(client Client, req *Request) (*ResponsePipe, error) {
 // CONTENT_TYPE
 // CONTENT_LENGTH
 // HTTPS
+// SSL_PROTOCOL, SSL_CIPHER, SSL_SERVER_NAME, SSL_SESSION_RESUMED, SSL_CLIENT_VERIFY（HTTPS时）
 // GATEWAY_INTERFACE
 // REMOTE_ADDR
 // REMOTE_PORT
 // SERVER_PORT
 // SERVER_NAME
+// HTTP_HOST
 // SERVER_PROTOCOL
 // SERVER_SOFTWARE
 // REDIRECT_STATUS
@@ -87,13 +93,21 @@ func BasicParamsMapMiddleware(inner RequestHandler) RequestHandler {
 		// 根据原始请求的TLS判断是否Https（https在SSL/TLS层上加密传输）
 		isHTTPS := r.TLS != nil
 		if isHTTPS {
-			req.Params["HTTPS"] = "on"
+			req.Params.Set("HTTPS", "on")
+			mapTLSParams(req.Params, r.TLS)
 		}
 		// 解析请求地址
 		remoteAddr, remotePort, _ := net.SplitHostPort(r.RemoteAddr)
-		// 解析server地址
+		// 请求协议，服务端收到的r.URL.Scheme通常为空，根据TLS判断
+		// 位于代理之后时可由TrustedProxies根据转发头覆盖
+		scheme := "http"
+		if isHTTPS {
+			scheme = "https"
+		}
+		// 解析server地址，Host中没有端口时使用协议的默认端口
 		host, serverPort, err := net.SplitHostPort(r.Host)
 		if err != nil {
+			host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
 			if isHTTPS {
 				serverPort = "443"
 			} else {
@@ -102,25 +116,85 @@ func BasicParamsMapMiddleware(inner RequestHandler) RequestHandler {
 		}
 
 		// 填充基础信息
-		req.Params["CONTENT_TYPE"] = r.Header.Get("Content-Type")
-		req.Params["CONTENT_LENGTH"] = r.Header.Get("Content-Length")
-		req.Params["GATEWAY_INTERFACE"] = "CGI/1.1"
-		req.Params["REMOTE_ADDR"] = remoteAddr
-		req.Params["REMOTE_PORT"] = remotePort
-		req.Params["SERVER_PORT"] = serverPort
-		req.Params["SERVER_NAME"] = host
-		req.Params["SERVER_PROTOCOL"] = r.Proto
-		req.Params["SERVER_SOFTWARE"] = "GolangFastcgi"
-		req.Params["REDIRECT_STATUS"] = "200"
-		req.Params["REQUEST_SCHEME"] = r.URL.Scheme
-		req.Params["REQUEST_METHOD"] = r.Method
-		req.Params["REQUEST_URI"] = r.RequestURI
-		req.Params["QUERY_STRING"] = r.URL.RawQuery
+		req.Params.Set("CONTENT_TYPE", r.Header.Get("Content-Type"))
+		req.Params.Set("CONTENT_LENGTH", r.Header.Get("Content-Length"))
+		req.Params.Set("GATEWAY_INTERFACE", "CGI/1.1")
+		req.Params.Set("REMOTE_ADDR", remoteAddr)
+		req.Params.Set("REMOTE_PORT", remotePort)
+		req.Params.Set("SERVER_PORT", serverPort)
+		req.Params.Set("SERVER_NAME", host)
+		// Go会将Host头从r.Header中移到r.Host，MapHeaderMiddleware无法映射
+		req.Params.Set("HTTP_HOST", r.Host)
+		req.Params.Set("SERVER_PROTOCOL", r.Proto)
+		req.Params.Set("SERVER_SOFTWARE", "GolangFastcgi")
+		req.Params.Set("REDIRECT_STATUS", "200")
+		req.Params.Set("REQUEST_SCHEME", scheme)
+		req.Params.Set("REQUEST_METHOD", r.Method)
+		req.Params.Set("REQUEST_URI", r.RequestURI)
+		req.Params.Set("QUERY_STRING", r.URL.RawQuery)
 
 		return inner(client, req)
 	}
 }
 
+// tlsVersionNames TLS版本对应的名称，与mod_ssl的SSL_PROTOCOL一致
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// mapTLSParams 根据TLS连接状态填充SSL_*参数
+func mapTLSParams(params *Params, state *tls.ConnectionState) {
+	params.Set("SSL_PROTOCOL", tlsVersionNames[state.Version])
+	params.Set("SSL_CIPHER", tls.CipherSuiteName(state.CipherSuite))
+	params.Set("SSL_SERVER_NAME", state.ServerName)
+	if state.DidResume {
+		params.Set("SSL_SESSION_RESUMED", "Resumed")
+	} else {
+		params.Set("SSL_SESSION_RESUMED", "Initial")
+	}
+	// 客户端证书验证结果，与nginx的$ssl_client_verify一致
+	switch {
+	case len(state.PeerCertificates) == 0:
+		params.Set("SSL_CLIENT_VERIFY", "NONE")
+	case len(state.VerifiedChains) > 0:
+		params.Set("SSL_CLIENT_VERIFY", "SUCCESS")
+	default:
+		params.Set("SSL_CLIENT_VERIFY", "FAILED:unverified")
+	}
+}
+
+// MapClientCertMiddleware [中间件]映射客户端证书信息，用于应用程序自行处理证书认证
+// 证书内容较大，因此没有包含在BasicParamsMapMiddleware中
+// Parameters included:
+// SSL_CLIENT_CERT
+// SSL_CLIENT_S_DN
+// SSL_CLIENT_I_DN
+// SSL_CLIENT_M_SERIAL
+// SSL_CLIENT_V_START
+// SSL_CLIENT_V_END
+func MapClientCertMiddleware(inner RequestHandler) RequestHandler {
+	return func(client Client, req *Request) (*ResponsePipe, error) {
+		r := req.Raw
+		if r != nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			cert := r.TLS.PeerCertificates[0]
+			// PEM格式的证书
+			req.Params.Set("SSL_CLIENT_CERT", string(pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: cert.Raw,
+			})))
+			req.Params.Set("SSL_CLIENT_S_DN", cert.Subject.String())
+			req.Params.Set("SSL_CLIENT_I_DN", cert.Issuer.String())
+			req.Params.Set("SSL_CLIENT_M_SERIAL", fmt.Sprintf("%X", cert.SerialNumber))
+			req.Params.Set("SSL_CLIENT_V_START", cert.NotBefore.UTC().Format("Jan _2 15:04:05 2006 GMT"))
+			req.Params.Set("SSL_CLIENT_V_END", cert.NotAfter.UTC().Format("Jan _2 15:04:05 2006 GMT"))
+		}
+		return inner(client, req)
+	}
+}
+
 // MapRemoteHostMiddleware [中间件]会对r.RemoteAddr IP地址执行反向DNS查找
 func MapRemoteHostMiddleware(inner RequestHandler) RequestHandler {
 	return func(client Client, req *Request) (*ResponsePipe, error) {
@@ -130,7 +204,7 @@ func MapRemoteHostMiddleware(inner RequestHandler) RequestHandler {
 		names, _ := net.LookupAddr(remoteAddr)
 		if len(names) > 0 {
 			// 去除符号"."后填充到req里
-			req.Params["REMOTE_HOST"] = strings.TrimRight(names[0], ".")
+			req.Params.Set("REMOTE_HOST", strings.TrimRight(names[0], "."))
 		}
 		return inner(client, req)
 	}
@@ -147,6 +221,9 @@ type FileSystemRouter struct {
 
 	// DirIndex 存储Apache DirectoryIndex参数，用于标识要在目录中显示的文件
 	DirIndex []string
+
+	// Listing 目录中没有DirIndex中的文件时生成目录列表，不转发到后端；为nil时不生成
+	Listing *DirListing
 }
 
 // Router 返回一个中间件，用于准备与路径相关的参数
@@ -167,6 +244,19 @@ func (fs *FileSystemRouter) Router() Middleware {
 
 			// 通过给定的request请求，定义cgi需要的参数
 			r := req.Raw
+			// 没有原始请求（例如管理消息）时没有可映射的路径
+			if r == nil {
+				return inner(client, req)
+			}
+			// RequestTarget放行的"OPTIONS *"不对应文件，只设置文档根目录
+			if req.asteriskPassed && r.RequestURI == "*" {
+				req.Params.Set("DOCUMENT_ROOT", fs.DocRoot)
+				return inner(client, req)
+			}
+			// 拒绝可能越出DocRoot的路径，以及不能映射到文件的请求目标（例如OPTIONS *）
+			if badPath(r.URL.Path) || !strings.HasPrefix(r.URL.Path, "/") {
+				return newStatusResponse(http.StatusBadRequest), nil
+			}
 			// 当前脚本的路径
 			fastcgiScriptName := r.URL.Path
 			// 请求路径信息
@@ -179,21 +269,30 @@ func (fs *FileSystemRouter) Router() Middleware {
 			}
 			// 判断是否有后缀"/"，如果包含则添加默认index.php
 			if strings.HasSuffix(fastcgiScriptName, "/") {
+				// 开启目录列表且目录中没有索引文件时生成目录列表
+				if dir := filepath.Join(fs.DocRoot, fastcgiScriptName); fs.Listing != nil && fastcgiPathInfo == "" && containedIn(fs.DocRoot, dir) && !fs.hasIndex(dir) {
+					return fs.Listing.response(dir, fastcgiScriptName, r), nil
+				}
 				fastcgiScriptName = path.Join(fastcgiScriptName, "index.php")
 			}
+			// 当前执行脚本的绝对路径，必须位于DocRoot之内
+			scriptFilename := filepath.Join(fs.DocRoot, fastcgiScriptName)
+			if !containedIn(fs.DocRoot, scriptFilename) {
+				return newStatusResponse(http.StatusBadRequest), nil
+			}
 			// 包含由客户端提供的、跟在真实脚本名称之后并且在查询语句（query string）之前的路径信息
-			req.Params["PATH_INFO"] = fastcgiPathInfo
+			req.Params.Set("PATH_INFO", fastcgiPathInfo)
 			// 当前脚本所在文件系统（非文档根目录）的基本路径
-			// req.Params["PATH_TRANSLATED"] = filepath.Join(fs.DocRoot, fastcgiPathInfo)
-			req.Params["PATH_TRANSLATED"] = filepath.Join(fs.DocRoot, fastcgiScriptName)
+			// req.Params.Set("PATH_TRANSLATED", filepath.Join(fs.DocRoot, fastcgiPathInfo))
+			req.Params.Set("PATH_TRANSLATED", filepath.Join(fs.DocRoot, fastcgiScriptName))
 			// 包含当前脚本的路径
-			req.Params["SCRIPT_NAME"] = fastcgiScriptName
+			req.Params.Set("SCRIPT_NAME", fastcgiScriptName)
 			// 当前执行脚本的绝对路径
-			req.Params["SCRIPT_FILENAME"] = filepath.Join(fs.DocRoot, fastcgiScriptName)
+			req.Params.Set("SCRIPT_FILENAME", scriptFilename)
 			// 请求文档路径
-			req.Params["DOCUMENT_URI"] = r.URL.Path
+			req.Params.Set("DOCUMENT_URI", r.URL.Path)
 			// 当前运行脚本所在的文档根目录
-			req.Params["DOCUMENT_ROOT"] = fs.DocRoot
+			req.Params.Set("DOCUMENT_ROOT", fs.DocRoot)
 
 			return inner(client, req)
 		}
@@ -232,7 +331,7 @@ func MapHeaderMiddleware(inner RequestHandler) RequestHandler {
 				value = strings.Join(v, ",")
 			}
 			// 写入req
-			req.Params[key] = value
+			req.Params.Set(key, value)
 		}
 
 		return inner(client, req)
@@ -254,16 +353,269 @@ func MapEndpoint(endpointFile string) Middleware {
 	return func(inner RequestHandler) RequestHandler {
 		return func(client Client, req *Request) (*ResponsePipe, error) {
 			r := req.Raw
-			req.Params["REQUEST_URI"] = r.URL.RequestURI()
-			req.Params["SCRIPT_NAME"] = webpath
-			req.Params["SCRIPT_FILENAME"] = endpointFile
-			req.Params["DOCUMENT_URI"] = r.URL.Path
-			req.Params["DOCUMENT_ROOT"] = dir
+			// 拒绝可能越出根目录的路径
+			if badPath(r.URL.Path) {
+				return newStatusResponse(http.StatusBadRequest), nil
+			}
+			req.Params.Set("REQUEST_URI", r.URL.RequestURI())
+			req.Params.Set("SCRIPT_NAME", webpath)
+			req.Params.Set("SCRIPT_FILENAME", endpointFile)
+			req.Params.Set("DOCUMENT_URI", r.URL.Path)
+			req.Params.Set("DOCUMENT_ROOT", dir)
+			return inner(client, req)
+		}
+	}
+}
+
+// ParamsFilter 过滤/覆盖fastcgi参数，相当于nginx中的fastcgi_param配置
+// 需要放在其他参数映射中间件之后（Chain中靠后的位置）才能处理它们生成的参数
+// 参数名以"*"结尾时按前缀匹配，例如"HTTP_*"
+type ParamsFilter struct {
+
+	// Allow 白名单，非空时只保留匹配的参数
+	Allow []string
+
+	// Deny 黑名单，移除匹配的参数，例如HTTP_PROXY
+	Deny []string
+
+	// Set 强制设置的参数，覆盖已有的值，不受Allow/Deny影响
+	Set map[string]string
+}
+
+// Middleware 返回过滤/覆盖参数的中间件
+func (f *ParamsFilter) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			req.Params.Filter(func(k, _ string) bool {
+				return (len(f.Allow) == 0 || matchParam(f.Allow, k)) && !matchParam(f.Deny, k)
+			})
+			for k, v := range f.Set {
+				req.Params.Set(k, v)
+			}
+			return inner(client, req)
+		}
+	}
+}
+
+// matchParam 检查参数名是否匹配names中的任意一项
+func matchParam(names []string, key string) bool {
+	for _, name := range names {
+		if strings.HasSuffix(name, "*") {
+			if strings.HasPrefix(key, name[:len(name)-1]) {
+				return true
+			}
+		} else if name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// HttpoxyMiddleware [中间件]移除HTTP_PROXY参数（httpoxy漏洞缓解，见https://httpoxy.org）
+// 客户端发送的Proxy头会被映射为HTTP_PROXY，可能被应用程序当作代理配置使用
+func HttpoxyMiddleware(inner RequestHandler) RequestHandler {
+	return func(client Client, req *Request) (*ResponsePipe, error) {
+		req.Params.Del("HTTP_PROXY")
+		return inner(client, req)
+	}
+}
+
+// ServerProtocol 控制通过HTTP/2、HTTP/3到达的请求的协议参数，需放在BasicParamsMapMiddleware之后
+// 部分PHP框架只认识HTTP/1.x的SERVER_PROTOCOL，遇到"HTTP/2.0"等值会出错
+// Parameters included:
+// HTTP2 请求通过HTTP/2到达时为on
+// HTTP3 请求通过HTTP/3到达时为on
+type ServerProtocol struct {
+
+	// Compat 为true时，HTTP/2和HTTP/3请求的SERVER_PROTOCOL报告为兼容值，而不是实际的协议
+	Compat bool
+
+	// CompatValue 兼容值，为空时使用"HTTP/1.1"
+	CompatValue string
+}
+
+// Middleware 返回设置协议参数的中间件
+func (sp *ServerProtocol) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if req.Raw == nil {
+				return inner(client, req)
+			}
+			major := req.Raw.ProtoMajor
+			switch major {
+			case 2:
+				req.Params.Set("HTTP2", "on")
+			case 3:
+				req.Params.Set("HTTP3", "on")
+			}
+			if sp.Compat && major >= 2 {
+				value := sp.CompatValue
+				if value == "" {
+					value = "HTTP/1.1"
+				}
+				req.Params.Set("SERVER_PROTOCOL", value)
+			}
+			return inner(client, req)
+		}
+	}
+}
+
+// ConnFingerprint 将下游连接的信息映射为参数，供应用程序的反欺诈等逻辑使用，每项可以单独开启
+// Parameters included:
+// SSL_ALPN_PROTOCOL 协商的应用层协议，例如h2（HTTPS时）
+// SSL_VERSION_NUM TLS版本号，例如0x0304（HTTPS时）
+// SSL_JA3_HASH 前置层（CDN、负载均衡）通过请求头提供的JA3指纹
+type ConnFingerprint struct {
+
+	// ALPN 是否映射SSL_ALPN_PROTOCOL
+	ALPN bool
+
+	// TLSVersion 是否映射SSL_VERSION_NUM
+	TLSVersion bool
+
+	// JA3Header 前置层提供JA3指纹的请求头，例如"X-JA3-Fingerprint"，为空时不映射SSL_JA3_HASH
+	JA3Header string
+
+	// Trusted 只接受来自这些代理的指纹请求头；为nil时不信任任何请求，JA3Header被忽略，
+	// 避免客户端直接发送请求头伪造指纹
+	Trusted *TrustedProxies
+}
+
+// Middleware 返回映射连接信息的中间件
+func (cf *ConnFingerprint) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			r := req.Raw
+			if r == nil {
+				return inner(client, req)
+			}
+			if state := r.TLS; state != nil {
+				if cf.ALPN && state.NegotiatedProtocol != "" {
+					req.Params.Set("SSL_ALPN_PROTOCOL", state.NegotiatedProtocol)
+				}
+				if cf.TLSVersion {
+					req.Params.Set("SSL_VERSION_NUM", fmt.Sprintf("0x%04x", state.Version))
+				}
+			}
+			if cf.JA3Header != "" {
+				if hash := r.Header.Get(cf.JA3Header); hash != "" && cf.trusted(r) {
+					req.Params.Set("SSL_JA3_HASH", hash)
+				}
+			}
+			return inner(client, req)
+		}
+	}
+}
+
+// trusted 检查请求是否来自受信任的代理，没有设置Trusted时总是返回false
+func (cf *ConnFingerprint) trusted(r *http.Request) bool {
+	if cf.Trusted == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return cf.Trusted.Trusted(net.ParseIP(host))
+}
+
+// TargetPolicy 对特殊形式的请求目标的处理方式
+type TargetPolicy int
+
+// 处理方式定义
+const (
+	TargetNormalize TargetPolicy = iota // 规范化（默认）
+	TargetReject                        // 返回400
+	TargetPass                          // 原样转发给后端
+)
+
+// RequestTarget 处理"OPTIONS *"和绝对形式（GET http://host/path）的请求目标，
+// 需放在路由中间件之前，例如Chain(rt.Middleware(), NewPHPFS("/srv"))
+type RequestTarget struct {
+
+	// Asterisk 对"OPTIONS *"的处理，规范化时直接应答204并返回Allow头，不转发给后端；
+	// 原样转发时FileSystemRouter不再拒绝，只设置DOCUMENT_ROOT
+	Asterisk TargetPolicy
+
+	// AbsoluteForm 对绝对形式的请求目标的处理，规范化时REQUEST_URI改为路径和查询字符串
+	AbsoluteForm TargetPolicy
+
+	// Allow "OPTIONS *"应答中的Allow头，为空时使用"GET, HEAD, POST, OPTIONS"
+	Allow string
+}
+
+// Middleware 返回处理请求目标的中间件
+func (rt *RequestTarget) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			// 没有原始请求时没有请求目标
+			if req.Raw == nil {
+				return inner(client, req)
+			}
+			r := req.Raw
+			switch {
+			case r.RequestURI == "*":
+				switch rt.Asterisk {
+				case TargetReject:
+					return newStatusResponse(http.StatusBadRequest), nil
+				case TargetNormalize:
+					if r.Method != http.MethodOptions {
+						return newStatusResponse(http.StatusBadRequest), nil
+					}
+					allow := rt.Allow
+					if allow == "" {
+						allow = "GET, HEAD, POST, OPTIONS"
+					}
+					header := make(http.Header)
+					header.Set("Status", "204 No Content")
+					header.Set("Allow", allow)
+					return newStaticResponse(header, strings.NewReader("")), nil
+				case TargetPass:
+					req.asteriskPassed = true
+				}
+			case r.URL.IsAbs() && !strings.HasPrefix(r.RequestURI, "/"):
+				switch rt.AbsoluteForm {
+				case TargetReject:
+					return newStatusResponse(http.StatusBadRequest), nil
+				case TargetNormalize:
+					// 同时修改原始请求，之后执行的BasicParamsMapMiddleware使用规范化的值
+					r = r.WithContext(r.Context())
+					r.RequestURI = r.URL.RequestURI()
+					req.Raw = r
+					req.Params.Set("REQUEST_URI", r.RequestURI)
+				}
+			}
 			return inner(client, req)
 		}
 	}
 }
 
+// badPath 检查URL路径（已解码）中是否包含".."片段或NUL字符
+// 反斜杠同样视为分隔符（Windows）
+func badPath(p string) bool {
+	if strings.IndexByte(p, 0) >= 0 {
+		return true
+	}
+	segments := strings.FieldsFunc(p, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+	for _, seg := range segments {
+		if seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// containedIn 检查filename是否位于root目录之内
+func containedIn(root, filename string) bool {
+	rel, err := filepath.Rel(root, filename)
+	if err != nil || filepath.IsAbs(rel) {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 // NewPHPFS 通过连接BasicParamsMapMiddleware,MapHeaderMiddleware和FileSystemRouter，返回PHP请求所需的中间件
 func NewPHPFS(root string) Middleware {
 	fs := &FileSystemRouter{
@@ -0,0 +1,318 @@
+package ffcgiclient
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// recordHandler 记录收到的请求参数，不访问后端
+func recordHandler(params *map[string]string) RequestHandler {
+	return func(client Client, req *Request) (*ResponsePipe, error) {
+		*params = req.Params.Map()
+		return newStatusResponse(http.StatusOK), nil
+	}
+}
+
+// readStatus 读取ResponsePipe返回的状态码
+func readStatus(t *testing.T, resp *ResponsePipe) int {
+	rec := httptest.NewRecorder()
+	if err := resp.WriteTo(rec, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code
+}
+
+func TestRouterPathTraversal(t *testing.T) {
+	fs := &FileSystemRouter{DocRoot: "/var/www"}
+	tests := []struct {
+		target string
+		code   int
+		script string
+	}{
+		{"/index.php", http.StatusOK, "/var/www/index.php"},
+		{"/a/b.php/c/d", http.StatusOK, "/var/www/a/b.php"},
+		{"/../etc/passwd", http.StatusBadRequest, ""},
+		{"/%2e%2e/%2e%2e/etc/passwd", http.StatusBadRequest, ""},
+		{"/a/..%2f..%2fetc/x.php", http.StatusBadRequest, ""},
+		{"/a/..%5c..%5cetc/x.php", http.StatusBadRequest, ""},
+		{"/x.php/../../etc", http.StatusBadRequest, ""},
+		{"/a%00.php", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		var params map[string]string
+		r := httptest.NewRequest("GET", tt.target, nil)
+		resp, err := fs.Router()(recordHandler(&params))(nil, NewRequest(r))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.target, err)
+		}
+		if code := readStatus(t, resp); code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.target, code, tt.code)
+		}
+		if got := params["SCRIPT_FILENAME"]; got != tt.script {
+			t.Errorf("%s: SCRIPT_FILENAME %q, want %q", tt.target, got, tt.script)
+		}
+	}
+}
+
+func TestBasicParamsMapTLS(t *testing.T) {
+	var params map[string]string
+	r := httptest.NewRequest("GET", "https://example.com/index.php", nil)
+	r.TLS.Version = tls.VersionTLS13
+	r.TLS.CipherSuite = tls.TLS_AES_128_GCM_SHA256
+	BasicParamsMapMiddleware(recordHandler(&params))(nil, NewRequest(r))
+	want := map[string]string{
+		"HTTPS":             "on",
+		"SSL_PROTOCOL":      "TLSv1.3",
+		"SSL_CIPHER":        "TLS_AES_128_GCM_SHA256",
+		"SSL_SERVER_NAME":   "example.com",
+		"SSL_CLIENT_VERIFY": "NONE",
+	}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("%s = %q, want %q", k, params[k], v)
+		}
+	}
+}
+
+func TestBasicParamsMapHost(t *testing.T) {
+	tests := []struct {
+		target, host                   string
+		scheme, serverName, serverPort string
+	}{
+		{"http://example.com/", "example.com", "http", "example.com", "80"},
+		{"https://example.com/", "example.com", "https", "example.com", "443"},
+		{"http://example.com:8080/", "example.com:8080", "http", "example.com", "8080"},
+		{"http://[::1]/", "[::1]", "http", "::1", "80"},
+	}
+	for _, tt := range tests {
+		var params map[string]string
+		r := httptest.NewRequest("GET", tt.target, nil)
+		BasicParamsMapMiddleware(recordHandler(&params))(nil, NewRequest(r))
+		if params["REQUEST_SCHEME"] != tt.scheme || params["SERVER_NAME"] != tt.serverName ||
+			params["SERVER_PORT"] != tt.serverPort || params["HTTP_HOST"] != tt.host {
+			t.Errorf("%s: got scheme=%q name=%q port=%q host=%q", tt.target,
+				params["REQUEST_SCHEME"], params["SERVER_NAME"], params["SERVER_PORT"], params["HTTP_HOST"])
+		}
+	}
+}
+
+func TestServerProtocol(t *testing.T) {
+	tests := []struct {
+		major    int
+		proto    string
+		compat   bool
+		protocol string
+		marker   string
+	}{
+		{1, "HTTP/1.1", true, "HTTP/1.1", ""},
+		{2, "HTTP/2.0", false, "HTTP/2.0", "HTTP2"},
+		{2, "HTTP/2.0", true, "HTTP/1.1", "HTTP2"},
+		{3, "HTTP/3.0", true, "HTTP/1.1", "HTTP3"},
+	}
+	for _, tt := range tests {
+		var params map[string]string
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Proto, r.ProtoMajor, r.ProtoMinor = tt.proto, tt.major, 0
+		sp := &ServerProtocol{Compat: tt.compat}
+		Chain(BasicParamsMapMiddleware, sp.Middleware())(recordHandler(&params))(nil, NewRequest(r))
+		if params["SERVER_PROTOCOL"] != tt.protocol {
+			t.Errorf("%s compat=%t: SERVER_PROTOCOL = %q, want %q", tt.proto, tt.compat, params["SERVER_PROTOCOL"], tt.protocol)
+		}
+		if tt.marker != "" && params[tt.marker] != "on" {
+			t.Errorf("%s: %s not set", tt.proto, tt.marker)
+		}
+	}
+
+	// 没有原始请求时不设置协议参数
+	var params map[string]string
+	(&ServerProtocol{Compat: true}).Middleware()(recordHandler(&params))(nil, NewRequest(nil))
+	if _, ok := params["SERVER_PROTOCOL"]; ok {
+		t.Errorf("SERVER_PROTOCOL set without a raw request: %q", params["SERVER_PROTOCOL"])
+	}
+}
+
+func TestParamsFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter ParamsFilter
+		want   map[string]string
+	}{
+		{
+			name:   "deny prefix",
+			filter: ParamsFilter{Deny: []string{"HTTP_X_*", "HTTP_PROXY"}},
+			want:   map[string]string{"HTTP_HOST": "example.com", "HTTP_ACCEPT": "*/*", "REQUEST_METHOD": "GET"},
+		},
+		{
+			name:   "allow list",
+			filter: ParamsFilter{Allow: []string{"REQUEST_METHOD", "HTTP_*"}, Deny: []string{"HTTP_ACCEPT"}},
+			want:   map[string]string{"REQUEST_METHOD": "GET", "HTTP_HOST": "example.com", "HTTP_PROXY": "http://evil.example", "HTTP_X_DEBUG": "1"},
+		},
+		{
+			name:   "set overrides filter",
+			filter: ParamsFilter{Allow: []string{"REQUEST_METHOD"}, Set: map[string]string{"HTTP_HOST": "internal", "APP_ENV": "prod"}},
+			want:   map[string]string{"REQUEST_METHOD": "GET", "HTTP_HOST": "internal", "APP_ENV": "prod"},
+		},
+	}
+	for _, tt := range tests {
+		var params map[string]string
+		req := NewRequest(httptest.NewRequest("GET", "/", nil))
+		req.Params.Set("REQUEST_METHOD", "GET")
+		req.Params.Set("HTTP_HOST", "example.com")
+		req.Params.Set("HTTP_ACCEPT", "*/*")
+		req.Params.Set("HTTP_PROXY", "http://evil.example")
+		req.Params.Set("HTTP_X_DEBUG", "1")
+		tt.filter.Middleware()(recordHandler(&params))(nil, req)
+		if len(params) != len(tt.want) {
+			t.Errorf("%s: params = %v, want %v", tt.name, params, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if params[k] != v {
+				t.Errorf("%s: %s = %q, want %q", tt.name, k, params[k], v)
+			}
+		}
+	}
+}
+
+func TestHttpoxy(t *testing.T) {
+	var params map[string]string
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Proxy", "http://evil.example")
+	r.Header.Set("Accept", "*/*")
+	Chain(MapHeaderMiddleware, HttpoxyMiddleware)(recordHandler(&params))(nil, NewRequest(r))
+	if _, ok := params["HTTP_PROXY"]; ok {
+		t.Errorf("HTTP_PROXY = %q, want removed", params["HTTP_PROXY"])
+	}
+	if params["HTTP_ACCEPT"] != "*/*" {
+		t.Errorf("HTTP_ACCEPT = %q", params["HTTP_ACCEPT"])
+	}
+}
+
+func TestRequestTarget(t *testing.T) {
+	tests := []struct {
+		method, target string
+		policy         TargetPolicy
+		code           int
+		requestURI     string
+	}{
+		{"OPTIONS", "*", TargetNormalize, http.StatusNoContent, ""},
+		{"GET", "*", TargetNormalize, http.StatusBadRequest, ""},
+		{"OPTIONS", "*", TargetReject, http.StatusBadRequest, ""},
+		{"OPTIONS", "*", TargetPass, http.StatusOK, "*"},
+		{"GET", "http://example.com/a.php?x=1", TargetNormalize, http.StatusOK, "/a.php?x=1"},
+		{"GET", "http://example.com/a.php?x=1", TargetReject, http.StatusBadRequest, ""},
+		{"GET", "http://example.com/a.php?x=1", TargetPass, http.StatusOK, "http://example.com/a.php?x=1"},
+		{"GET", "/a.php?x=1", TargetReject, http.StatusOK, "/a.php?x=1"},
+	}
+	for _, tt := range tests {
+		var params map[string]string
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.RequestURI = tt.target
+		rt := &RequestTarget{Asterisk: tt.policy, AbsoluteForm: tt.policy}
+		resp, _ := Chain(BasicParamsMapMiddleware, rt.Middleware())(recordHandler(&params))(nil, NewRequest(r))
+		if code := readStatus(t, resp); code != tt.code {
+			t.Errorf("%s %s: code = %d, want %d", tt.method, tt.target, code, tt.code)
+		}
+		if tt.requestURI != "" && params["REQUEST_URI"] != tt.requestURI {
+			t.Errorf("%s %s: REQUEST_URI = %q, want %q", tt.method, tt.target, params["REQUEST_URI"], tt.requestURI)
+		}
+	}
+
+	// 路由中间件拒绝不能映射到文件的请求目标
+	fs := &FileSystemRouter{DocRoot: "/var/www"}
+	r := httptest.NewRequest("OPTIONS", "*", nil)
+	resp, _ := fs.Router()(recordHandler(new(map[string]string)))(nil, NewRequest(r))
+	if code := readStatus(t, resp); code != http.StatusBadRequest {
+		t.Errorf("router OPTIONS *: code = %d", code)
+	}
+
+	// 没有原始请求时原样传递
+	for _, policy := range []TargetPolicy{TargetPass, TargetNormalize, TargetReject} {
+		rt := &RequestTarget{Asterisk: policy, AbsoluteForm: policy}
+		resp, _ := Chain(rt.Middleware(), fs.Router())(recordHandler(new(map[string]string)))(nil, NewRequest(nil))
+		if code := readStatus(t, resp); code != http.StatusOK {
+			t.Errorf("policy %d without raw request: code = %d", policy, code)
+		}
+	}
+
+	// 放在NewPHPFS之前
+	phpTests := []struct {
+		method, target string
+		policy         TargetPolicy
+		code           int
+		params         map[string]string
+	}{
+		{"OPTIONS", "*", TargetPass, http.StatusOK, map[string]string{"REQUEST_URI": "*", "DOCUMENT_ROOT": "/srv"}},
+		{"OPTIONS", "*", TargetNormalize, http.StatusNoContent, nil},
+		{"GET", "http://example.com/a.php?x=1", TargetNormalize, http.StatusOK, map[string]string{"REQUEST_URI": "/a.php?x=1", "SCRIPT_NAME": "/a.php"}},
+	}
+	for _, tt := range phpTests {
+		var params map[string]string
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.RequestURI = tt.target
+		rt := &RequestTarget{Asterisk: tt.policy, AbsoluteForm: tt.policy}
+		resp, _ := Chain(rt.Middleware(), NewPHPFS("/srv"))(recordHandler(&params))(nil, NewRequest(r))
+		if code := readStatus(t, resp); code != tt.code {
+			t.Errorf("NewPHPFS %s %s: code = %d, want %d", tt.method, tt.target, code, tt.code)
+		}
+		for k, v := range tt.params {
+			if params[k] != v {
+				t.Errorf("NewPHPFS %s %s: %s = %q, want %q", tt.method, tt.target, k, params[k], v)
+			}
+		}
+	}
+}
+
+func TestMapClientCertMiddleware(t *testing.T) {
+	// 没有原始请求或不是HTTPS请求时不设置证书参数
+	for _, req := range []*Request{NewRequest(nil), NewRequest(httptest.NewRequest("GET", "/", nil))} {
+		var params map[string]string
+		MapClientCertMiddleware(recordHandler(&params))(nil, req)
+		if _, ok := params["SSL_CLIENT_CERT"]; ok {
+			t.Fatal("SSL_CLIENT_CERT set without a client certificate")
+		}
+	}
+}
+
+func TestConnFingerprint(t *testing.T) {
+	trusted, _ := NewTrustedProxies("10.0.0.0/8")
+	cf := &ConnFingerprint{ALPN: true, TLSVersion: true, JA3Header: "X-JA3", Trusted: trusted}
+
+	r := httptest.NewRequest("GET", "https://example.com/", nil)
+	r.TLS.NegotiatedProtocol = "h2"
+	r.TLS.Version = tls.VersionTLS13
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("X-JA3", "e7d705a3286e19ea42f587b344ee6865")
+	var params map[string]string
+	cf.Middleware()(recordHandler(&params))(nil, NewRequest(r))
+	if params["SSL_ALPN_PROTOCOL"] != "h2" || params["SSL_VERSION_NUM"] != "0x0304" || params["SSL_JA3_HASH"] == "" {
+		t.Fatalf("params = %v", params)
+	}
+
+	// 来自不受信任地址的指纹请求头被忽略
+	r.RemoteAddr = "192.0.2.1:4567"
+	params = nil
+	cf.Middleware()(recordHandler(&params))(nil, NewRequest(r))
+	if _, ok := params["SSL_JA3_HASH"]; ok {
+		t.Fatalf("untrusted SSL_JA3_HASH = %q", params["SSL_JA3_HASH"])
+	}
+
+	// 没有设置Trusted时不信任任何请求的指纹请求头
+	cf.Trusted = nil
+	r.RemoteAddr = "10.1.2.3:4567"
+	params = nil
+	cf.Middleware()(recordHandler(&params))(nil, NewRequest(r))
+	if _, ok := params["SSL_JA3_HASH"]; ok {
+		t.Fatalf("SSL_JA3_HASH = %q without Trusted", params["SSL_JA3_HASH"])
+	}
+
+	// 没有原始请求时不映射连接信息
+	params = nil
+	cf.Middleware()(recordHandler(&params))(nil, NewRequest(nil))
+	if len(params) != 0 {
+		t.Fatalf("params = %v without a raw request", params)
+	}
+}
@@ -0,0 +1,353 @@
+package ffcgiclient
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 域名解析相关，用于在consul/k8s等使用非标准DNS服务器的环境中连接后端
+
+// Resolver 域名解析接口，*net.Resolver已实现此接口
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// ResolverConnFactory 返回使用指定Resolver解析address的ConnFactory
+// 依次尝试连接解析得到的地址，直到有一个连接成功；address为IP或unix套接字时不解析
+// 需要控制地址族偏好和并发连接时使用ResolverDialer
+func ResolverConnFactory(network, address string, resolver Resolver) ConnFactory {
+	return (&ResolverDialer{Resolver: resolver}).ConnFactory(network, address)
+}
+
+// dialResolved 使用resolver解析address并连接，resolver为nil时直接连接
+func dialResolved(ctx context.Context, resolver Resolver, network, address string) (net.Conn, error) {
+	if resolver == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+	return (&ResolverDialer{Resolver: resolver}).DialContext(ctx, network, address)
+}
+
+// AddressPreference 解析得到IPv4和IPv6两种地址时优先连接的地址族
+type AddressPreference int
+
+const (
+	PreferFirst AddressPreference = iota // 优先解析结果中第一个地址的地址族
+	PreferIPv6                           // 优先IPv6
+	PreferIPv4                           // 优先IPv4
+)
+
+// DefaultFallbackDelay 首选地址族的连接未完成时开始连接另一地址族的默认等待时间（RFC 8305）
+const DefaultFallbackDelay = 300 * time.Millisecond
+
+// ResolverDialer 解析域名后连接后端
+// 解析得到两种地址族时按Happy Eyeballs（RFC 8305）的方式连接：先依次连接首选地址族的地址，
+// 等待FallbackDelay仍未连接成功（或首选地址全部失败）时同时依次连接另一地址族的地址，使用先成功的连接；
+// 所有地址都失败后才返回错误
+type ResolverDialer struct {
+
+	// Resolver 解析器，为nil时使用net.DefaultResolver；可以使用*CachingResolver缓存解析结果
+	Resolver Resolver
+
+	// Prefer 首选的地址族
+	Prefer AddressPreference
+
+	// FallbackDelay 开始连接另一地址族前的等待时间，0表示DefaultFallbackDelay，负数表示不并发，依次连接所有地址
+	FallbackDelay time.Duration
+
+	// Timeout 连接每个地址的超时时间，0表示不限制
+	Timeout time.Duration
+}
+
+// ConnFactory 返回连接address的ConnFactory
+func (d *ResolverDialer) ConnFactory(network, address string) ConnFactory {
+	return func() (net.Conn, error) {
+		return d.DialContext(context.Background(), network, address)
+	}
+}
+
+// DialContext 解析address中的域名并连接，address为IP或unix套接字时不解析
+func (d *ResolverDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dial(ctx, network, address)
+	}
+	// 解析域名
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	primaries, fallbacks := d.partition(addrs)
+	var conn net.Conn
+	if len(fallbacks) == 0 || d.FallbackDelay < 0 {
+		conn, err = d.dialSerial(ctx, network, port, append(primaries, fallbacks...))
+	} else {
+		conn, err = d.dialParallel(ctx, network, port, primaries, fallbacks)
+	}
+	// 所有地址都无法连接时删除缓存的解析结果，下次重新解析
+	if f, ok := resolver.(interface{ Forget(host string) }); ok && err != nil && ctx.Err() == nil {
+		f.Forget(host)
+	}
+	return conn, err
+}
+
+// partition 按地址族偏好将地址分为首选和备选两组，组内保持解析结果的顺序
+func (d *ResolverDialer) partition(addrs []string) (primaries, fallbacks []string) {
+	isV4 := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		return ip != nil && ip.To4() != nil
+	}
+	var preferV4 bool
+	switch d.Prefer {
+	case PreferIPv4:
+		preferV4 = true
+	case PreferIPv6:
+		preferV4 = false
+	default:
+		preferV4 = isV4(addrs[0])
+	}
+	for _, addr := range addrs {
+		if isV4(addr) == preferV4 {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	if len(primaries) == 0 {
+		primaries, fallbacks = fallbacks, nil
+	}
+	return
+}
+
+// dial 连接单个地址
+func (d *ResolverDialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.Timeout}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// dialSerial 依次连接addrs，返回第一个成功的连接，全部失败时返回第一个错误
+func (d *ResolverDialer) dialSerial(ctx context.Context, network, port string, addrs []string) (net.Conn, error) {
+	var first error
+	for _, addr := range addrs {
+		conn, err := d.dial(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		if first == nil {
+			first = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, first
+}
+
+// dialParallel 先连接primaries，FallbackDelay后或primaries全部失败时同时连接fallbacks，返回先成功的连接
+func (d *ResolverDialer) dialParallel(ctx context.Context, network, port string, primaries, fallbacks []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result)
+	start := func(addrs []string, primary bool) {
+		go func() {
+			conn, err := d.dialSerial(ctx, network, port, addrs)
+			results <- result{conn, err, primary}
+		}()
+	}
+
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = DefaultFallbackDelay
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	start(primaries, true)
+	pending, fallbackStarted := 1, false
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks, false)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 关闭之后才成功的连接
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if r.primary {
+				primaryErr = r.err
+			} else {
+				fallbackErr = r.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks, false)
+			}
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
+
+// ResolverStats 解析统计信息
+type ResolverStats struct {
+	Lookups   uint64        // 实际发起的解析次数
+	Failures  uint64        // 解析失败次数
+	Hits      uint64        // 命中成功缓存的次数
+	NegHits   uint64        // 命中失败缓存的次数
+	TotalTime time.Duration // 实际解析的总耗时
+}
+
+// CachingResolver 包装Resolver，记录每次解析的统计信息，
+// 在TTL内缓存解析成功的结果，过期后重新解析以跟随后端地址的变化；
+// 在NegativeTTL内缓存解析失败的结果，避免后端域名失效时每个请求都去查询DNS
+type CachingResolver struct {
+
+	// 需要原子操作的64位字段放在最前面，保证在32位平台上的对齐
+	lookups   uint64
+	failures  uint64
+	hits      uint64
+	negHits   uint64
+	totalTime int64
+
+	// Resolver 实际的解析器，为nil时使用net.DefaultResolver
+	Resolver Resolver
+
+	// TTL 解析成功结果的缓存时间，0表示不缓存
+	TTL time.Duration
+
+	// NegativeTTL 解析失败结果的缓存时间，0表示不缓存
+	NegativeTTL time.Duration
+
+	// OnLookup 每次实际解析后的回调，可用于记录指标
+	OnLookup func(host string, duration time.Duration, err error)
+
+	// Clock 判断失败缓存过期使用的时间来源，为nil时使用SystemClock
+	Clock Clock
+
+	mutex   sync.Mutex
+	entries map[string]resolverEntry
+}
+
+// resolverEntry 缓存项，err不为nil时是失败结果
+type resolverEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+// LookupHost 实现Resolver接口
+func (cr *CachingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	// 查找缓存
+	if entry, ok := cr.cached(host); ok {
+		if entry.err != nil {
+			atomic.AddUint64(&cr.negHits, 1)
+			return nil, entry.err
+		}
+		atomic.AddUint64(&cr.hits, 1)
+		return append([]string(nil), entry.addrs...), nil
+	}
+
+	resolver := cr.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	start := time.Now()
+	addrs, err := resolver.LookupHost(ctx, host)
+	duration := time.Since(start)
+
+	// 统计
+	atomic.AddUint64(&cr.lookups, 1)
+	atomic.AddInt64(&cr.totalTime, int64(duration))
+	if err != nil {
+		atomic.AddUint64(&cr.failures, 1)
+		cr.store(host, resolverEntry{err: err}, cr.NegativeTTL)
+	} else {
+		cr.store(host, resolverEntry{addrs: append([]string(nil), addrs...)}, cr.TTL)
+	}
+	if cr.OnLookup != nil {
+		cr.OnLookup(host, duration, err)
+	}
+	return addrs, err
+}
+
+// Stats 返回当前的统计信息
+func (cr *CachingResolver) Stats() ResolverStats {
+	return ResolverStats{
+		Lookups:   atomic.LoadUint64(&cr.lookups),
+		Failures:  atomic.LoadUint64(&cr.failures),
+		Hits:      atomic.LoadUint64(&cr.hits),
+		NegHits:   atomic.LoadUint64(&cr.negHits),
+		TotalTime: time.Duration(atomic.LoadInt64(&cr.totalTime)),
+	}
+}
+
+// cached 返回未过期的缓存项
+func (cr *CachingResolver) cached(host string) (resolverEntry, bool) {
+	if cr.TTL <= 0 && cr.NegativeTTL <= 0 {
+		return resolverEntry{}, false
+	}
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	entry, ok := cr.entries[host]
+	if !ok {
+		return resolverEntry{}, false
+	}
+	if clockOr(cr.Clock).Now().After(entry.expires) {
+		delete(cr.entries, host)
+		return resolverEntry{}, false
+	}
+	return entry, true
+}
+
+// store 缓存ttl时间的解析结果，ttl不大于0时不缓存
+func (cr *CachingResolver) store(host string, entry resolverEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if cr.entries == nil {
+		cr.entries = make(map[string]resolverEntry)
+	}
+	entry.expires = clockOr(cr.Clock).Now().Add(ttl)
+	cr.entries[host] = entry
+}
+
+// Forget 删除host的缓存，下次连接时重新解析，例如连接失败之后
+func (cr *CachingResolver) Forget(host string) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	delete(cr.entries, host)
+}
@@ -0,0 +1,212 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubResolver 返回固定结果的Resolver
+type stubResolver struct {
+	addrs []string
+	err   error
+	calls int
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.calls++
+	return r.addrs, r.err
+}
+
+func TestResolverConnFactory(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	tests := []struct {
+		name     string
+		address  string
+		resolver *stubResolver
+		calls    int
+		ok       bool
+	}{
+		{"resolved", net.JoinHostPort("backend.service", port), &stubResolver{addrs: []string{"127.0.0.1"}}, 1, true},
+		{"ip not resolved", ln.Addr().String(), &stubResolver{err: errors.New("unused")}, 0, true},
+		{"lookup error", net.JoinHostPort("backend.service", port), &stubResolver{err: &net.DNSError{Err: "no such host", IsNotFound: true}}, 1, false},
+		{"no addresses", net.JoinHostPort("backend.service", port), &stubResolver{}, 1, false},
+	}
+	for _, tt := range tests {
+		conn, err := ResolverConnFactory("tcp", tt.address, tt.resolver)()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if tt.resolver.calls != tt.calls {
+			t.Errorf("%s: lookups = %d, want %d", tt.name, tt.resolver.calls, tt.calls)
+		}
+	}
+
+	// 第一个地址连接失败时尝试下一个
+	conn, err := ResolverConnFactory("tcp", net.JoinHostPort("backend.service", port), &stubResolver{addrs: []string{"127.0.0.2", "127.0.0.1"}})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestCachingResolver(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	stub := &stubResolver{err: &net.DNSError{Err: "no such host", IsNotFound: true}}
+	var observed int
+	cr := &CachingResolver{
+		Resolver:    stub,
+		NegativeTTL: 10 * time.Second,
+		Clock:       clock,
+		OnLookup:    func(host string, d time.Duration, err error) { observed++ },
+	}
+	ctx := context.Background()
+
+	steps := []struct {
+		advance time.Duration
+		fail    bool
+		stats   ResolverStats
+	}{
+		{0, true, ResolverStats{Lookups: 1, Failures: 1}},
+		{5 * time.Second, true, ResolverStats{Lookups: 1, Failures: 1, NegHits: 1}},
+		{6 * time.Second, true, ResolverStats{Lookups: 2, Failures: 2, NegHits: 1}},
+		{11 * time.Second, false, ResolverStats{Lookups: 3, Failures: 2, NegHits: 1}},
+		{0, false, ResolverStats{Lookups: 4, Failures: 2, NegHits: 1}},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		if !step.fail {
+			stub.addrs, stub.err = []string{"10.0.0.1"}, nil
+		}
+		addrs, err := cr.LookupHost(ctx, "backend.service")
+		if (err != nil) != step.fail {
+			t.Fatalf("step %d: addrs = %v, err = %v", i, addrs, err)
+		}
+		stats := cr.Stats()
+		stats.TotalTime = 0
+		if stats != step.stats {
+			t.Errorf("step %d: stats = %+v, want %+v", i, stats, step.stats)
+		}
+	}
+	if observed != stub.calls {
+		t.Errorf("OnLookup called %d times, want %d", observed, stub.calls)
+	}
+}
+
+func TestCachingResolverTTL(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	stub := new(stubResolver)
+	cr := &CachingResolver{Resolver: stub, TTL: time.Minute, Clock: clock}
+	ctx := context.Background()
+
+	// 后端地址在每一步变为serving
+	steps := []struct {
+		advance time.Duration
+		forget  bool
+		serving string
+		addrs   string
+		calls   int
+	}{
+		{0, false, "10.0.0.1", "10.0.0.1", 1},
+		{30 * time.Second, false, "10.0.0.2", "10.0.0.1", 1},
+		{31 * time.Second, false, "10.0.0.2", "10.0.0.2", 2},
+		{0, true, "10.0.0.3", "10.0.0.3", 3},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		if step.forget {
+			cr.Forget("backend.service")
+		}
+		stub.addrs = []string{step.serving}
+		addrs, err := cr.LookupHost(ctx, "backend.service")
+		if err != nil || len(addrs) != 1 || addrs[0] != step.addrs || stub.calls != step.calls {
+			t.Fatalf("step %d: addrs = %v, err = %v, lookups = %d", i, addrs, err, stub.calls)
+		}
+	}
+	if stats := cr.Stats(); stats.Hits != 1 || stats.Lookups != 3 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestResolverDialerPartition(t *testing.T) {
+	addrs := []string{"2001:db8::1", "10.0.0.1", "2001:db8::2", "10.0.0.2"}
+	tests := []struct {
+		prefer               AddressPreference
+		addrs                []string
+		primaries, fallbacks string
+	}{
+		{PreferFirst, addrs, "2001:db8::1,2001:db8::2", "10.0.0.1,10.0.0.2"},
+		{PreferIPv4, addrs, "10.0.0.1,10.0.0.2", "2001:db8::1,2001:db8::2"},
+		{PreferIPv6, addrs[1:], "2001:db8::2", "10.0.0.1,10.0.0.2"},
+		{PreferIPv6, []string{"10.0.0.1"}, "10.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		d := &ResolverDialer{Prefer: tt.prefer}
+		primaries, fallbacks := d.partition(tt.addrs)
+		if strings.Join(primaries, ",") != tt.primaries || strings.Join(fallbacks, ",") != tt.fallbacks {
+			t.Errorf("prefer %d %v: %v / %v", tt.prefer, tt.addrs, primaries, fallbacks)
+		}
+	}
+}
+
+func TestResolverDialerFailover(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ctx := context.Background()
+
+	// 首选地址迟迟无法连接时，等待FallbackDelay后连接备选地址
+	d := &ResolverDialer{FallbackDelay: 20 * time.Millisecond, Timeout: 5 * time.Second}
+	start := time.Now()
+	conn, err := d.dialParallel(ctx, "tcp", port, []string{"10.255.255.1"}, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("fallback took %s", elapsed)
+	}
+
+	// 所有地址都失败时返回首选地址的错误，并删除缓存的解析结果
+	cr := &CachingResolver{Resolver: &stubResolver{addrs: []string{"127.0.0.2", "127.0.0.3"}}, TTL: time.Minute}
+	d = &ResolverDialer{Resolver: cr}
+	if _, err := d.DialContext(ctx, "tcp", net.JoinHostPort("backend.service", port)); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, ok := cr.cached("backend.service"); ok {
+		t.Fatal("resolution still cached after all addresses failed")
+	}
+}
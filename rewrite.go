@@ -0,0 +1,202 @@
+package ffcgiclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// 重写规则：按正则表达式重写URL、返回重定向、修改请求头和响应头，
+// 相当于nginx中常用的rewrite、return和add_header配置
+// 需放在参数映射（NewPHPFS等）之前，SCRIPT_NAME等参数才能反映重写后的路径；
+// 与nginx相同，REQUEST_URI保持原始请求的值
+//
+//	rw, err := ffcgiclient.NewRewriter([]ffcgiclient.RewriteRule{
+//		{Match: `^/old/(.*)$`, Replace: "/new/$1", Redirect: http.StatusMovedPermanently},
+//		{Match: `^/article/(\d+)$`, Replace: "/article.php?id=$1", Last: true},
+//		{Match: `\.php$`, ResponseHeaders: ffcgiclient.HeaderOps{Set: map[string]string{"Cache-Control": "no-store"}}},
+//	})
+//	handler := ffcgiclient.Chain(rw.Middleware(), ffcgiclient.NewPHPFS("/srv"))(ffcgiclient.BasicHandler)
+
+// RewriteRule 一条重写规则，可以在配置文件中使用
+type RewriteRule struct {
+
+	// Match 匹配URL路径（不包含查询字符串）的正则表达式，为空时匹配所有请求
+	Match string `json:"match"`
+
+	// Replace 匹配时替换整个路径，可以使用$1、${name}引用分组，为空时不重写
+	// 包含"?"时替换查询字符串，原始的查询字符串追加在后面，以"?"结尾时丢弃原始的查询字符串
+	// 重定向时可以是以http://或https://开头的完整URL
+	Replace string `json:"replace"`
+
+	// Redirect 重定向的状态码（301、302、303、307或308），以Replace为Location返回，不转发到后端；0表示内部重写
+	Redirect int `json:"redirect"`
+
+	// Last 匹配时不再执行之后的规则
+	Last bool `json:"last"`
+
+	// RequestHeaders 匹配时作用于原始请求头
+	RequestHeaders HeaderOps `json:"request_headers"`
+
+	// ResponseHeaders 匹配时作用于应用程序返回的响应头
+	ResponseHeaders HeaderOps `json:"response_headers"`
+}
+
+// Rewriter 按顺序执行的重写规则，由NewRewriter创建
+// 每条规则匹配的是之前的规则重写后的路径
+type Rewriter struct {
+	rules []rewriteRule
+}
+
+// rewriteRule 编译后的规则
+type rewriteRule struct {
+	RewriteRule
+	re *regexp.Regexp // Match为空时为nil
+}
+
+// NewRewriter 编译重写规则
+func NewRewriter(rules []RewriteRule) (*Rewriter, error) {
+	rw := &Rewriter{rules: make([]rewriteRule, 0, len(rules))}
+	for i, rule := range rules {
+		compiled := rewriteRule{RewriteRule: rule}
+		if rule.Match != "" {
+			re, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite rule #%d: %w", i, err)
+			}
+			compiled.re = re
+		}
+		switch rule.Redirect {
+		case 0:
+			if isAbsoluteURL(rule.Replace) {
+				return nil, fmt.Errorf("rewrite rule #%d: absolute URL %q requires redirect", i, rule.Replace)
+			}
+			if rule.Replace != "" && !strings.HasPrefix(rule.Replace, "/") {
+				return nil, fmt.Errorf("rewrite rule #%d: replacement %q must start with /", i, rule.Replace)
+			}
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			if rule.Replace == "" {
+				return nil, fmt.Errorf("rewrite rule #%d: redirect without replacement", i)
+			}
+		default:
+			return nil, fmt.Errorf("rewrite rule #%d: unsupported redirect status %d", i, rule.Redirect)
+		}
+		rw.rules = append(rw.rules, compiled)
+	}
+	return rw, nil
+}
+
+// isAbsoluteURL 检查是否为以http://或https://开头的完整URL
+func isAbsoluteURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// rewriteResult 执行规则的结果
+type rewriteResult struct {
+	path     string      // 重写后的路径
+	query    string      // 重写后的查询字符串
+	redirect int         // 重定向的状态码，0表示不重定向
+	location string      // 重定向的Location
+	response []HeaderOps // 匹配的规则的响应头操作
+}
+
+// rewrite 对路径和查询字符串依次执行规则，header为原始请求头
+func (rw *Rewriter) rewrite(path, query string, header http.Header) rewriteResult {
+	result := rewriteResult{path: path, query: query}
+	for _, rule := range rw.rules {
+		var match []int
+		if rule.re != nil {
+			if match = rule.re.FindStringSubmatchIndex(result.path); match == nil {
+				continue
+			}
+		}
+		if header != nil {
+			rule.RequestHeaders.apply(header)
+		}
+		if !rule.ResponseHeaders.empty() {
+			result.response = append(result.response, rule.ResponseHeaders)
+		}
+		if rule.Replace != "" {
+			replaced := rule.Replace
+			if rule.re != nil {
+				replaced = string(rule.re.ExpandString(nil, rule.Replace, result.path, match))
+			}
+			if strings.HasSuffix(replaced, "?") {
+				// 以"?"结尾，丢弃原始的查询字符串
+				replaced = replaced[:len(replaced)-1]
+				result.query = ""
+			}
+			target, targetQuery := replaced, ""
+			i := strings.IndexByte(replaced, '?')
+			if i >= 0 {
+				target, targetQuery = replaced[:i], replaced[i+1:]
+			}
+			switch {
+			case i < 0:
+			case result.query != "":
+				result.query = targetQuery + "&" + result.query
+			default:
+				result.query = targetQuery
+			}
+			if rule.Redirect != 0 {
+				result.redirect = rule.Redirect
+				result.location = target
+				if result.query != "" {
+					result.location += "?" + result.query
+				}
+				return result
+			}
+			result.path = target
+		}
+		if rule.Last {
+			break
+		}
+	}
+	return result
+}
+
+// Middleware 返回执行重写规则的中间件，重定向时不转发到后端
+func (rw *Rewriter) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if req.Raw == nil {
+				return inner(client, req)
+			}
+			result := rw.rewrite(req.Raw.URL.Path, req.Raw.URL.RawQuery, req.Raw.Header)
+			if result.redirect != 0 {
+				header, body := statusResponse(result.redirect)
+				header.Set("Location", result.location)
+				resp := newStaticResponse(header, body)
+				return applyResponseHeaders(resp, result.response), nil
+			}
+			if result.path != req.Raw.URL.Path || result.query != req.Raw.URL.RawQuery {
+				// 不修改原始请求的URL，REQUEST_URI仍使用原始请求的值
+				u := *req.Raw.URL
+				u.Path, u.RawPath, u.RawQuery = result.path, "", result.query
+				req.Raw = req.Raw.WithContext(req.Raw.Context())
+				req.Raw.URL = &u
+			}
+			resp, err := inner(client, req)
+			if err != nil {
+				return resp, err
+			}
+			return applyResponseHeaders(resp, result.response), nil
+		}
+	}
+}
+
+// applyResponseHeaders 按顺序执行响应头操作
+func applyResponseHeaders(resp *ResponsePipe, ops []HeaderOps) *ResponsePipe {
+	if len(ops) == 0 {
+		return resp
+	}
+	return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+		for i := range ops {
+			ops[i].apply(header)
+		}
+		return body, nil
+	})
+}
@@ -0,0 +1,128 @@
+package ffcgiclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRewriterRules(t *testing.T) {
+	rw, err := NewRewriter([]RewriteRule{
+		{Match: `^/old/(.*)$`, Replace: "/new/$1", Redirect: http.StatusMovedPermanently},
+		{Match: `^/go/(?P<name>\w+)$`, Replace: "https://example.com/${name}?", Redirect: http.StatusFound},
+		{Match: `^/article/(\d+)$`, Replace: "/article.php?id=$1", Last: true},
+		{Match: `^/static/`, Replace: "/assets/"},
+		{Match: `^/assets/$`, Replace: "/assets/index.html"},
+		{Match: `^/app/.*$`, Replace: "/index.php?route=$0?"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path, query string
+		wantPath    string
+		wantQuery   string
+		wantStatus  int
+		wantLoc     string
+	}{
+		{path: "/index.php", query: "a=1", wantPath: "/index.php", wantQuery: "a=1"},
+		{path: "/old/x/y", query: "a=1", wantStatus: 301, wantLoc: "/new/x/y?a=1"},
+		{path: "/go/docs", query: "a=1", wantStatus: 302, wantLoc: "https://example.com/docs"},
+		{path: "/article/42", query: "page=2", wantPath: "/article.php", wantQuery: "id=42&page=2"},
+		// 之后的规则匹配重写后的路径
+		{path: "/static/", wantPath: "/assets/index.html"},
+		{path: "/app/users", query: "a=1", wantPath: "/index.php", wantQuery: "route=/app/users"},
+	}
+	for _, tt := range tests {
+		result := rw.rewrite(tt.path, tt.query, nil)
+		if result.redirect != tt.wantStatus || result.location != tt.wantLoc {
+			t.Errorf("%s: redirect %d %q, want %d %q", tt.path, result.redirect, result.location, tt.wantStatus, tt.wantLoc)
+			continue
+		}
+		if tt.wantStatus == 0 && (result.path != tt.wantPath || result.query != tt.wantQuery) {
+			t.Errorf("%s: rewritten to %q?%q, want %q?%q", tt.path, result.path, result.query, tt.wantPath, tt.wantQuery)
+		}
+	}
+}
+
+func TestNewRewriterInvalid(t *testing.T) {
+	invalid := []RewriteRule{
+		{Match: `(`},
+		{Replace: "https://example.com/"},
+		{Replace: "relative"},
+		{Match: `^/`, Redirect: http.StatusMovedPermanently},
+		{Match: `^/`, Replace: "/x", Redirect: http.StatusOK},
+	}
+	for _, rule := range invalid {
+		if _, err := NewRewriter([]RewriteRule{rule}); err == nil {
+			t.Errorf("expected error for %+v", rule)
+		}
+	}
+}
+
+func TestRewriterMiddleware(t *testing.T) {
+	rw, err := NewRewriter([]RewriteRule{
+		{Match: `^/old$`, Replace: "/new", Redirect: http.StatusPermanentRedirect,
+			ResponseHeaders: HeaderOps{Set: map[string]string{"Cache-Control": "max-age=60"}}},
+		{Match: `^/article/(\d+)$`, Replace: "/article.php?id=$1",
+			RequestHeaders:  HeaderOps{Set: map[string]string{"X-Rewritten": "1"}, Remove: []string{"X-Debug"}},
+			ResponseHeaders: HeaderOps{Add: map[string]string{"X-Frame-Options": "DENY"}, Remove: []string{"X-Powered-By"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params *Params
+	backend := func(client Client, req *Request) (*ResponsePipe, error) {
+		params = req.Params
+		header := http.Header{"Content-Type": {"text/plain"}, "X-Powered-By": {"PHP"}}
+		return newStaticResponse(header, strings.NewReader("ok")), nil
+	}
+	handler := Chain(rw.Middleware(), NewPHPFS("/srv"))(backend)
+	serve := func(target string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		params = nil
+		resp, err := handler(nil, NewRequest(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		resp.WriteTo(rec, io.Discard)
+		return rec
+	}
+
+	// 内部重写：参数映射使用重写后的路径，REQUEST_URI保持原始请求的值
+	rec := serve("/article/7?page=2", http.Header{"X-Debug": {"1"}})
+	if params == nil {
+		t.Fatal("request not forwarded")
+	}
+	want := map[string]string{
+		"SCRIPT_NAME":      "/article.php",
+		"SCRIPT_FILENAME":  "/srv/article.php",
+		"QUERY_STRING":     "id=7&page=2",
+		"REQUEST_URI":      "/article/7?page=2",
+		"HTTP_X_REWRITTEN": "1",
+		"HTTP_X_DEBUG":     "",
+	}
+	for k, v := range want {
+		if got := params.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+	if got := rec.Header(); got.Get("X-Frame-Options") != "DENY" || got.Get("X-Powered-By") != "" {
+		t.Errorf("response header = %v", got)
+	}
+
+	// 重定向不转发到后端
+	rec = serve("/old?a=1", nil)
+	if params != nil {
+		t.Fatal("redirect forwarded to backend")
+	}
+	if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "/new?a=1" || rec.Header().Get("Cache-Control") != "max-age=60" {
+		t.Fatalf("redirect: %d %v", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,107 @@
+package ffcgiclient
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 在一个http.Handler中按主机名和路径前缀将请求分发到不同的中间件链和后端
+// 例如 /blog/ 交给WordPress的php-fpm池，/api/ 交给另一个池
+
+// Router 按主机名和URL路径前缀分发请求的http.Handler
+// 匹配时带主机名的路由优先，其次选择最长的路径前缀
+type Router struct {
+
+	// NotFound 没有匹配的路由时使用，为nil时返回404
+	NotFound http.Handler
+
+	mutex  sync.RWMutex
+	routes []routerEntry // 按匹配优先级排序
+}
+
+// routerEntry 一条路由
+type routerEntry struct {
+	host    string // 主机名，为空时匹配所有主机
+	prefix  string // 路径前缀
+	handler http.Handler
+}
+
+// Handle 注册一条路由，由requestHandler和clientFactory组成的Handler处理，返回该Handler以便设置日志等
+// pattern为路径前缀，可以带主机名，例如"/blog/"、"example.com/api/"；
+// 以/结尾的前缀匹配其下的所有路径，否则匹配该路径本身及以"/"分隔的子路径
+func (rt *Router) Handle(pattern string, requestHandler RequestHandler, clientFactory ClientFactory) *DefaultHandler {
+	h := NewHandler(requestHandler, clientFactory)
+	rt.Mount(pattern, h)
+	return h
+}
+
+// Mount 注册一条由任意http.Handler处理的路由，pattern的格式与Handle相同，重复注册时替换
+func (rt *Router) Mount(pattern string, handler http.Handler) {
+	host, prefix := pattern, "/"
+	if i := strings.IndexByte(pattern, '/'); i >= 0 {
+		host, prefix = pattern[:i], pattern[i:]
+	}
+	entry := routerEntry{host: strings.ToLower(host), prefix: prefix, handler: handler}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	for i := range rt.routes {
+		if rt.routes[i].host == entry.host && rt.routes[i].prefix == entry.prefix {
+			rt.routes[i] = entry
+			return
+		}
+	}
+	rt.routes = append(rt.routes, entry)
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		a, b := rt.routes[i], rt.routes[j]
+		if (a.host != "") != (b.host != "") {
+			return a.host != ""
+		}
+		return len(a.prefix) > len(b.prefix)
+	})
+}
+
+// match 返回处理r的Handler，没有匹配时返回nil
+func (rt *Router) match(r *http.Request) http.Handler {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	for _, entry := range rt.routes {
+		if entry.host != "" && entry.host != host {
+			continue
+		}
+		if matchPrefix(r.URL.Path, entry.prefix) {
+			return entry.handler
+		}
+	}
+	return nil
+}
+
+// matchPrefix 检查path是否在prefix之下
+func matchPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return strings.HasSuffix(prefix, "/") || len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// ServeHTTP 实现http.Handler
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h := rt.match(r); h != nil {
+		h.ServeHTTP(w, r)
+		return
+	}
+	if rt.NotFound != nil {
+		rt.NotFound.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
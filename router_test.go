@@ -0,0 +1,50 @@
+package ffcgiclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// routeStub 返回固定内容的ClientFactory
+func routeStub(body string) ClientFactory {
+	stub := &stubClient{recorded: map[string][]byte{"": []byte("Content-Type: text/plain\r\n\r\n" + body)}}
+	return func() (Client, error) { return stub, nil }
+}
+
+func TestRouter(t *testing.T) {
+	rt := &Router{}
+	rt.Handle("/", BasicHandler, routeStub("default"))
+	rt.Handle("/blog/", NewPHPFS("/var/www/wordpress")(BasicHandler), routeStub("blog"))
+	rt.Handle("/api", BasicHandler, routeStub("api"))
+	rt.Handle("admin.example.com/", BasicHandler, routeStub("admin"))
+
+	cases := []struct {
+		host, path, want string
+	}{
+		{"example.com", "/", "default"},
+		{"example.com", "/blog/index.php", "blog"},
+		{"example.com", "/blog", "default"},
+		{"example.com", "/api", "api"},
+		{"example.com", "/api/users", "api"},
+		{"example.com", "/apis", "default"},
+		{"Admin.Example.com:8080", "/api", "admin"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.Host = c.host
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, r)
+		if rec.Body.String() != c.want {
+			t.Errorf("%s%s: got %q, want %q", c.host, c.path, rec.Body.String(), c.want)
+		}
+	}
+
+	// 没有匹配的路由
+	empty := &Router{}
+	rec := httptest.NewRecorder()
+	empty.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d", rec.Code)
+	}
+}
@@ -0,0 +1,86 @@
+package ffcgiclient
+
+import (
+	"errors"
+	"net/http"
+)
+
+// 按请求选择后端，用于会话保持、灰度发布（一部分流量发到新版本的php-fpm）、按用户分片等
+//
+//	selector := &ffcgiclient.CanarySelector{Canary: canary, Percent: 5}
+//	h := router.Handle("/", handler, pools.ClientFactory(backends...))
+//	h.SetRequestClientFactory(pools.RequestClientFactory(selector, append(backends, canary)...))
+
+// BackendSelector 为每个请求选择后端
+type BackendSelector interface {
+
+	// SelectBackend 从candidates中选择处理r的后端，返回nil时按轮询选择
+	// candidates为可用的后端（全部不可用时为全部后端），不能修改
+	SelectBackend(r *http.Request, candidates []*Backend) *Backend
+}
+
+// BackendSelectorFunc 函数形式的BackendSelector
+type BackendSelectorFunc func(r *http.Request, candidates []*Backend) *Backend
+
+// SelectBackend 实现BackendSelector
+func (f BackendSelectorFunc) SelectBackend(r *http.Request, candidates []*Backend) *Backend {
+	return f(r, candidates)
+}
+
+// RequestClientFactory 返回按selector为每个请求选择后端的RequestClientFactory
+// 从选中的后端获取Client失败时，按ClientFactory的轮询顺序尝试其他后端
+func (s *PoolSet) RequestClientFactory(selector BackendSelector, backends ...*Backend) RequestClientFactory {
+	return func(r *http.Request) (Client, error) {
+		if len(backends) == 0 {
+			return nil, errors.New("no backends")
+		}
+		candidates := s.candidates(backends)
+		selected := selector.SelectBackend(r, candidates)
+		if selected == nil {
+			return s.borrow(candidates)
+		}
+		ordered := make([]*Backend, 0, len(candidates)+1)
+		ordered = append(ordered, selected)
+		for _, b := range candidates {
+			if b != selected {
+				ordered = append(ordered, b)
+			}
+		}
+		return s.borrow(ordered)
+	}
+}
+
+// CanarySelector 把Percent%的请求发送到Canary，其余请求按轮询发送到其他后端；
+// Canary不可用时所有请求发送到其他后端
+type CanarySelector struct {
+
+	// Canary 灰度发布的后端，需要同时包含在RequestClientFactory的backends中，按地址比较
+	Canary *Backend
+
+	// Percent 发送到Canary的请求比例，0到100
+	Percent float64
+
+	// Rand 随机数来源，为nil时使用math/rand
+	Rand Rand
+}
+
+// SelectBackend 实现BackendSelector
+func (cs *CanarySelector) SelectBackend(r *http.Request, candidates []*Backend) *Backend {
+	var canary *Backend
+	var others []*Backend
+	for _, b := range candidates {
+		if b.String() == cs.Canary.String() {
+			canary = b
+		} else {
+			others = append(others, b)
+		}
+	}
+	if canary == nil || len(others) == 0 {
+		return nil
+	}
+	if randOr(cs.Rand).Float64()*100 < cs.Percent {
+		return canary
+	}
+	// 其他后端中按轮询顺序的第一个
+	return others[0]
+}
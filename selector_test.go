@@ -0,0 +1,77 @@
+package ffcgiclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestClientFactory(t *testing.T) {
+	a, b := acceptBackend(t), acceptBackend(t)
+	set := NewPoolSet(PoolConfig{MaxActive: 1, Expires: time.Hour}, 0)
+	defer set.Close(context.Background())
+	// 按请求头分片，没有请求头时按轮询
+	shard := BackendSelectorFunc(func(r *http.Request, candidates []*Backend) *Backend {
+		for _, c := range candidates {
+			if c.Address == r.Header.Get("X-Shard") {
+				return c
+			}
+		}
+		return nil
+	})
+	factory := set.RequestClientFactory(shard, a, b)
+
+	borrowed := func(shardHeader string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Shard", shardHeader)
+		c, err := factory(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		for k, stats := range set.Stats() {
+			if stats.Outstanding > 0 {
+				return k
+			}
+		}
+		return ""
+	}
+	for i := 0; i < 3; i++ {
+		if got := borrowed(b.Address); got != b.String() {
+			t.Fatalf("shard b: borrowed from %s", got)
+		}
+		if got := borrowed(a.Address); got != a.String() {
+			t.Fatalf("shard a: borrowed from %s", got)
+		}
+	}
+	// 选中的后端不可用时使用其他后端
+	set.SetHealthy(b, false)
+	if got := borrowed(b.Address); got != a.String() {
+		t.Fatalf("shard b down: borrowed from %s", got)
+	}
+}
+
+func TestCanarySelector(t *testing.T) {
+	a, b, canary := &Backend{Network: "tcp", Address: "a:9000"}, &Backend{Network: "tcp", Address: "b:9000"}, &Backend{Network: "tcp", Address: "c:9000"}
+	r := httptest.NewRequest("GET", "/", nil)
+	tests := []struct {
+		name       string
+		percent    float64
+		candidates []*Backend
+		want       *Backend
+	}{
+		{"canary", 5, []*Backend{a, canary, b}, canary},
+		{"stable", 0, []*Backend{canary, b, a}, b},
+		{"canary down", 100, []*Backend{a, b}, nil},
+		{"only canary", 0, []*Backend{canary}, nil},
+	}
+	for _, tt := range tests {
+		// fixedRand的Float64总是返回0
+		cs := &CanarySelector{Canary: &Backend{Network: "tcp", Address: "c:9000"}, Percent: tt.percent, Rand: fixedRand(0)}
+		if got := cs.SelectBackend(r, tt.candidates); got != tt.want {
+			t.Errorf("%s: SelectBackend() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package ffcgiclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"sync"
+
+	"suilz/ffcgi-client/fcgiproto"
+)
+
+// FastCGI应用程序（响应器）的实现，与client配合可以在不依赖PHP的情况下进行回环测试，
+// 也可以用Go编写由nginx等网关调用的FastCGI应用程序
+//
+//	ln, _ := net.Listen("tcp", "127.0.0.1:9000")
+//	ffcgiclient.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//		fmt.Fprintf(w, "hello %s", r.URL.Path)
+//	}))
+
+// Serve 接受l上的FastCGI连接，将每个请求转换为*http.Request交给handler处理
+// handler为nil时使用http.DefaultServeMux；l.Accept返回错误时返回该错误
+func Serve(l net.Listener, handler http.Handler) error {
+	return (&Server{Handler: handler}).Serve(l)
+}
+
+// Server FastCGI应用程序，只支持响应器角色，一个连接上的请求并发处理
+type Server struct {
+
+	// Handler 处理请求，为nil时使用http.DefaultServeMux
+	Handler http.Handler
+
+	// ErrorLog 记录连接错误和handler的panic，为nil时使用log包的默认logger
+	ErrorLog *log.Logger
+}
+
+// Serve 接受l上的FastCGI连接并在单独的协程中处理，l.Accept返回错误时返回该错误
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(rwc)
+	}
+}
+
+// ServeConn 处理一个连接上的请求，直到连接关闭或最后一个请求没有要求保持连接
+func (s *Server) ServeConn(rwc io.ReadWriteCloser) {
+	sc := &serverConn{
+		server:   s,
+		conn:     newConn(rwc),
+		requests: make(map[uint16]*serverRequest),
+	}
+	defer sc.close()
+	var rec record
+	for {
+		if err := sc.conn.readRecord(&rec); err != nil {
+			if err != io.EOF && !sc.conn.isClosed() {
+				s.logf("fcgi server: %v", err)
+			}
+			return
+		}
+		if err := sc.handleRecord(&rec); err != nil {
+			s.logf("fcgi server: %v", err)
+			return
+		}
+	}
+}
+
+// logf 记录日志，没有设置ErrorLog时使用log包的默认logger
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// serverConn 应用程序一侧的连接
+type serverConn struct {
+	server *Server
+	conn   *conn
+
+	mutex    sync.Mutex
+	requests map[uint16]*serverRequest // 进行中的请求
+}
+
+// serverRequest 应用程序一侧进行中的请求
+type serverRequest struct {
+	id       uint16
+	keepConn bool
+	params   *PairDecoder   // 解码已收到的参数
+	started  bool           // 参数已接收完毕，handler已开始处理
+	stdin    *io.PipeWriter // 写入请求体
+	cancel   context.CancelFunc
+}
+
+// handleRecord 处理收到的一个消息，返回错误时关闭连接
+func (sc *serverConn) handleRecord(rec *record) error {
+	if rec.h.RequestID == 0 {
+		return sc.handleManagement(rec)
+	}
+	sc.mutex.Lock()
+	req := sc.requests[rec.h.RequestID]
+	sc.mutex.Unlock()
+
+	switch rec.h.Type {
+	case typeBeginRequest:
+		if req != nil {
+			return fmt.Errorf("duplicate request id %d", rec.h.RequestID)
+		}
+		content := rec.content()
+		if len(content) != 8 {
+			return fmt.Errorf("invalid begin request length %d", len(content))
+		}
+		if role(uint16(content[0])<<8|uint16(content[1])) != roleResponder {
+			return sc.conn.writeEndRequest(rec.h.RequestID, 0, statusUnknownRole)
+		}
+		sc.mutex.Lock()
+		sc.requests[rec.h.RequestID] = &serverRequest{id: rec.h.RequestID, keepConn: content[2]&1 != 0, params: NewPairDecoder()}
+		sc.mutex.Unlock()
+	case typeParams:
+		if req == nil || req.started {
+			return nil
+		}
+		if len(rec.content()) > 0 {
+			req.params.Write(rec.content())
+			return nil
+		}
+		sc.start(req)
+	case typeStdin:
+		if req == nil || req.stdin == nil {
+			return nil
+		}
+		if len(rec.content()) == 0 {
+			req.stdin.Close()
+			return nil
+		}
+		// handler不再读取请求体时丢弃剩余的数据
+		req.stdin.Write(rec.content())
+	case typeAbortRequest:
+		if req == nil {
+			return nil
+		}
+		if !req.started {
+			sc.finish(req)
+			return sc.conn.writeEndRequest(req.id, 0, statusRequestComplete)
+		}
+		req.cancel()
+		req.stdin.CloseWithError(context.Canceled)
+	}
+	return nil
+}
+
+// handleManagement 回复管理消息，FCGI_GET_VALUES之外的类型回复FCGI_UNKNOWN_TYPE
+func (sc *serverConn) handleManagement(rec *record) error {
+	if rec.h.Type != typeGetValues {
+		return sc.conn.writeUnknownType(rec.h.Type)
+	}
+	var b []byte
+	pairs, _ := DecodePairs(rec.content())
+	for name := range pairs {
+		if name != "FCGI_MPXS_CONNS" {
+			continue
+		}
+		b = fcgiproto.AppendPair(b, name, "1")
+	}
+	return sc.conn.writeRecord(typeGetValuesResult, 0, b)
+}
+
+// start 参数接收完毕后在单独的协程中执行handler
+func (sc *serverConn) start(req *serverRequest) {
+	var body *io.PipeReader
+	body, req.stdin = io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	req.cancel = cancel
+	req.started = true
+	params := req.params.Pairs()
+	req.params = nil
+	go sc.serve(ctx, req, params, body)
+}
+
+// serve 执行handler并结束请求
+func (sc *serverConn) serve(ctx context.Context, req *serverRequest, params map[string]string, body *io.PipeReader) {
+	w := &serverResponse{header: make(http.Header), w: newWriter(sc.conn, typeStdout, req.id)}
+	r, err := cgi.RequestFromMap(params)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		sc.server.logf("fcgi server: %v", err)
+	} else {
+		r.Body = body
+		handler := sc.server.Handler
+		if handler == nil {
+			handler = http.DefaultServeMux
+		}
+		err = catchPanic(func() error {
+			handler.ServeHTTP(w, r.WithContext(ctx))
+			return nil
+		})
+		if err != nil {
+			if !w.wroteHeader {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			sc.server.logf("fcgi server: %s %s: %v", r.Method, r.URL, err)
+		}
+	}
+	body.Close()
+	w.close()
+	sc.finish(req)
+	sc.conn.writeEndRequest(req.id, 0, statusRequestComplete)
+	if !req.keepConn {
+		sc.conn.Close()
+	}
+}
+
+// finish 移除结束的请求并释放其上下文
+func (sc *serverConn) finish(req *serverRequest) {
+	sc.mutex.Lock()
+	delete(sc.requests, req.id)
+	sc.mutex.Unlock()
+	if req.cancel != nil {
+		req.cancel()
+	}
+}
+
+// close 关闭连接，取消进行中的请求
+func (sc *serverConn) close() {
+	sc.mutex.Lock()
+	for _, req := range sc.requests {
+		if req.started {
+			req.cancel()
+			req.stdin.CloseWithError(io.ErrUnexpectedEOF)
+		}
+	}
+	sc.mutex.Unlock()
+	sc.conn.Close()
+}
+
+// serverResponse 将handler的输出按CGI响应格式写入stdout流
+type serverResponse struct {
+	header      http.Header
+	w           *bufWriter
+	wroteHeader bool
+}
+
+// Header 实现http.ResponseWriter
+func (w *serverResponse) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader 实现http.ResponseWriter，写出Status和响应头
+func (w *serverResponse) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusNotModified {
+		// 304响应不能有实体头
+		w.header.Del("Content-Type")
+		w.header.Del("Content-Length")
+		w.header.Del("Transfer-Encoding")
+	}
+	fmt.Fprintf(w.w, "Status: %d %s\r\n", code, http.StatusText(code))
+	w.header.Write(w.w)
+	w.w.WriteString("\r\n")
+}
+
+// Write 实现http.ResponseWriter，没有设置Content-Type时根据内容判断
+func (w *serverResponse) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if _, ok := w.header["Content-Type"]; !ok {
+			w.header.Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.w.Write(p)
+}
+
+// Flush 实现http.Flusher，立即发送已写入的数据
+func (w *serverResponse) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.w.Flush()
+}
+
+// close 写出剩余的数据并结束stdout流
+func (w *serverResponse) close() {
+	if !w.wroteHeader {
+		w.header.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+	}
+	w.w.Close()
+}
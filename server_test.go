@@ -0,0 +1,129 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveBackend 在回环地址上启动FastCGI应用程序，返回连接它的ConnFactory
+func serveBackend(t *testing.T, handler http.Handler) ConnFactory {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go (&Server{Handler: handler, ErrorLog: log.New(io.Discard, "", 0)}).Serve(ln)
+	return SimpleConnFactory("tcp", ln.Addr().String())
+}
+
+func TestServe(t *testing.T) {
+	factory := serveBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/panic.php":
+			panic("boom")
+		case "/empty.php":
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Script", r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL.Query().Get("q"), r.Header.Get("X-Test"), body)
+	}))
+	h := NewHandler(NewPHPFS("/srv")(BasicHandler), SimpleClientFactory(factory, 0))
+
+	tests := []struct {
+		method, target, body string
+		status               int
+		want                 string
+	}{
+		{"POST", "/index.php?q=1", "hello", http.StatusCreated, "POST 1 test hello"},
+		{"GET", "/index.php", strings.Repeat("x", 70000), http.StatusCreated, "GET  test " + strings.Repeat("x", 70000)},
+		{"GET", "/panic.php", "", http.StatusInternalServerError, ""},
+		{"GET", "/empty.php", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		r.Header.Set("X-Test", "test")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, rec.Code, tt.status)
+		}
+		if tt.want != "" && rec.Body.String() != tt.want {
+			t.Errorf("%s %s: body %.40q, want %.40q", tt.method, tt.target, rec.Body.String(), tt.want)
+		}
+		if tt.status == http.StatusCreated && rec.Header().Get("X-Script") != "/index.php" {
+			t.Errorf("%s %s: X-Script = %q", tt.method, tt.target, rec.Header().Get("X-Script"))
+		}
+	}
+}
+
+func TestServeManagement(t *testing.T) {
+	factory := serveBackend(t, http.NotFoundHandler())
+
+	// FCGI_GET_VALUES
+	c, err := NewClientFactory(factory, ClientConfig{AutoTune: true})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if limits, ok := c.(*client).backendLimits(); !ok || !limits.Multiplex {
+		t.Fatalf("backendLimits() = %+v, %v", limits, ok)
+	}
+
+	// 不支持的角色
+	req := NewRequest(nil)
+	req.Role = roleAuthorizer
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.stdOutReader)
+	if err := resp.Err(); !errors.Is(err, ErrUnknownRole) {
+		t.Fatalf("Err() = %v, want ErrUnknownRole", err)
+	}
+}
+
+func TestServeAbort(t *testing.T) {
+	started, canceled := make(chan struct{}), make(chan struct{})
+	factory := serveBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	// 终止后client继续读取到FCGI_END_REQUEST，此处不关闭连接以免与读取协程竞争
+	c, err := SimpleClientFactory(factory, 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := NewRequest(nil)
+	req.Params.Set("REQUEST_METHOD", "GET")
+	req.Params.Set("SERVER_PROTOCOL", "HTTP/1.1")
+	req.Params.Set("REQUEST_URI", "/")
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	cancel()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("handler context not canceled by FCGI_ABORT_REQUEST")
+	}
+	io.Copy(io.Discard, resp.stdOutReader)
+	if err := resp.Err(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Err() = %v, want context.Canceled", err)
+	}
+}
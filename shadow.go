@@ -0,0 +1,250 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 影子流量：把请求异步复制一份发送到另一个后端，丢弃其响应，只记录错误和统计信息，
+// 用于以生产流量验证新版本的PHP或FastCGI应用程序，不影响用户
+//
+//	shadow := &ffcgiclient.Shadow{NewClient: pools.ClientFactory(php83), SampleRate: 0.1}
+//	handler := ffcgiclient.Chain(ffcgiclient.NewPHPFS("/srv"), shadow.Middleware())(ffcgiclient.BasicHandler)
+
+// DefaultShadowMaxBody 默认复制的请求体的最大字节数
+const DefaultShadowMaxBody = 64 << 10
+
+// Shadow 复制请求到影子后端的策略
+// 需放在中间件链的最后，使影子请求的参数与原始请求相同
+type Shadow struct {
+
+	// NewClient 创建发送影子请求的Client，请求结束后关闭；为nil时不复制
+	NewClient ClientFactory
+
+	// SampleRate 复制的请求比例，0到1之间
+	SampleRate float64
+
+	// Rand 抽样使用的随机数来源，为nil时使用GlobalRand
+	Rand Rand
+
+	// MaxBody 复制的请求体的最大字节数，超过时不复制该请求，0表示DefaultShadowMaxBody
+	// 请求体在原始请求读取时缓存，读取完毕后才发送影子请求
+	MaxBody int
+
+	// Timeout 影子请求的超时时间，0表示默认的10秒
+	Timeout time.Duration
+
+	// MaxConcurrent 同时进行的影子请求的最大数量，超过时丢弃新的影子请求，0表示默认的64
+	MaxConcurrent int
+
+	// OnResult 每个影子请求结束后调用，可以为nil
+	OnResult func(result ShadowResult)
+
+	// ErrorLog 记录影子请求的错误，为nil时使用log包的默认logger
+	ErrorLog *log.Logger
+
+	once  sync.Once
+	slots chan struct{} // 影子请求的名额
+
+	mirrored int64 // 发送的影子请求数，原子操作
+	dropped  int64 // 因请求体过大、原始请求未读完请求体或名额已满而未发送的数量，原子操作
+	failed   int64 // 出错的影子请求数，原子操作
+}
+
+// ShadowResult 一个影子请求的结果
+type ShadowResult struct {
+	Method   string        // 请求方法
+	URI      string        // 请求URI
+	Status   int           // 影子后端的响应状态码，出错时可能为0
+	Duration time.Duration // 从发送到响应读取结束的耗时
+	Err      error         // 创建Client、传输或应用程序的错误
+}
+
+// ShadowStats 影子请求的统计信息
+type ShadowStats struct {
+	Mirrored int64 // 发送的影子请求数
+	Dropped  int64 // 未发送的影子请求数
+	Failed   int64 // 出错的影子请求数
+}
+
+// Stats 返回影子请求的统计信息
+func (s *Shadow) Stats() ShadowStats {
+	return ShadowStats{
+		Mirrored: atomic.LoadInt64(&s.mirrored),
+		Dropped:  atomic.LoadInt64(&s.dropped),
+		Failed:   atomic.LoadInt64(&s.failed),
+	}
+}
+
+// init 初始化影子请求的名额
+func (s *Shadow) init() {
+	s.once.Do(func() {
+		n := s.MaxConcurrent
+		if n <= 0 {
+			n = 64
+		}
+		s.slots = make(chan struct{}, n)
+	})
+}
+
+// logf 记录日志，没有设置ErrorLog时使用log包的默认logger
+func (s *Shadow) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Middleware 返回复制请求到影子后端的中间件，原始请求的响应不受影响
+func (s *Shadow) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if s.NewClient == nil || req.Raw == nil || s.SampleRate <= 0 || randOr(s.Rand).Float64() >= s.SampleRate {
+				return inner(client, req)
+			}
+			s.init()
+			// 原始请求之后可能被修改，发送前复制参数
+			shadow := req.WithContext(context.Background())
+			shadow.Params = req.Params.Clone()
+			shadow.Stdin, shadow.Data, shadow.onOutput = nil, nil, nil
+			if req.Stdin == nil || req.Stdin == http.NoBody {
+				s.dispatch(inner, shadow, nil)
+				return inner(client, req)
+			}
+			max := s.MaxBody
+			if max <= 0 {
+				max = DefaultShadowMaxBody
+			}
+			req.Stdin = &shadowBody{ReadCloser: req.Stdin, max: max, done: func(body []byte, ok bool) {
+				if !ok {
+					atomic.AddInt64(&s.dropped, 1)
+					return
+				}
+				s.dispatch(inner, shadow, body)
+			}}
+			return inner(client, req)
+		}
+	}
+}
+
+// dispatch 在名额未满时在后台发送影子请求
+func (s *Shadow) dispatch(inner RequestHandler, req *Request, body []byte) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+		return
+	}
+	atomic.AddInt64(&s.mirrored, 1)
+	go func() {
+		defer func() { <-s.slots }()
+		s.mirror(inner, req, body)
+	}()
+}
+
+// mirror 发送影子请求，读取并丢弃响应，记录结果
+func (s *Shadow) mirror(inner RequestHandler, req *Request, body []byte) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	result := ShadowResult{Method: req.Raw.Method, URI: req.Raw.RequestURI}
+	result.Status, result.Err = s.send(inner, req.WithContext(ctx), body)
+	result.Duration = time.Since(start)
+	if result.Err != nil {
+		atomic.AddInt64(&s.failed, 1)
+		s.logf("shadow %s %s: %v", result.Method, result.URI, result.Err)
+	}
+	if s.OnResult != nil {
+		s.OnResult(result)
+	}
+}
+
+// send 使用新的Client发送请求，返回响应状态码
+func (s *Shadow) send(inner RequestHandler, req *Request, body []byte) (status int, err error) {
+	c, err := s.NewClient()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if body != nil {
+		req.Stdin = io.NopCloser(bytes.NewReader(body))
+	}
+	resp, err := inner(c, req)
+	if err != nil {
+		return 0, err
+	}
+	go io.Copy(io.Discard, resp.stdErrReader)
+	header, br, err := readCGIHeader(resp.stdOutReader, resp.headerLimits)
+	if err == nil {
+		status = captureStatus(header)
+		io.Copy(io.Discard, br)
+	}
+	// stdout读取结束时请求已经结束，可以关闭Client
+	resp.discardStdout()
+	if rerr := resp.Err(); rerr != nil {
+		err = rerr
+	}
+	return status, err
+}
+
+// errShadowBodyTooLarge 请求体超过Shadow.MaxBody
+var errShadowBodyTooLarge = errors.New("shadow: request body too large")
+
+// shadowBody 在原始请求读取请求体时缓存最多max字节，读到EOF时以缓存的内容调用done，
+// 超过max、读取出错或未读完就关闭时以ok为false调用done；done只调用一次
+type shadowBody struct {
+	io.ReadCloser
+	max  int
+	buf  bytes.Buffer
+	err  error
+	once sync.Once
+	done func(body []byte, ok bool)
+}
+
+// Read 读取并缓存请求体
+func (b *shadowBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.err == nil && n > 0 {
+		if b.buf.Len()+n > b.max {
+			b.err = errShadowBodyTooLarge
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.finish(b.err == nil)
+	} else if err != nil {
+		b.finish(false)
+	}
+	return n, err
+}
+
+// Close 关闭请求体，未读到EOF时不发送影子请求
+func (b *shadowBody) Close() error {
+	b.finish(false)
+	return b.ReadCloser.Close()
+}
+
+// finish 调用done
+func (b *shadowBody) finish(ok bool) {
+	b.once.Do(func() {
+		if ok {
+			b.done(b.buf.Bytes(), true)
+		} else {
+			b.done(nil, false)
+		}
+	})
+}
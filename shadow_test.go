@@ -0,0 +1,150 @@
+package ffcgiclient
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShadow(t *testing.T) {
+	reply := func(body string, stdin chan<- string) ConnFactory {
+		return recordBackend(func(sc *conn, reqID uint16, in []byte) {
+			if stdin != nil {
+				stdin <- string(in)
+			}
+			sc.writeRecord(typeStdout, reqID, []byte("Status: 201 Created\r\nContent-Type: text/plain\r\n\r\n"+body))
+			sc.writeEndRequest(reqID, 0, statusRequestComplete)
+		})
+	}
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		sampleRate float64
+		maxBody    int
+		shadowErr  bool // 无法创建影子请求的Client
+		wantStats  ShadowStats
+		wantStatus int
+	}{
+		{name: "get", method: "GET", sampleRate: 1, wantStats: ShadowStats{Mirrored: 1}, wantStatus: 201},
+		{name: "post body", method: "POST", body: "a=1&b=2", sampleRate: 1, wantStats: ShadowStats{Mirrored: 1}, wantStatus: 201},
+		{name: "not sampled", method: "GET"},
+		{name: "body too large", method: "POST", body: "0123456789", sampleRate: 1, maxBody: 4, wantStats: ShadowStats{Dropped: 1}},
+		{name: "client error", method: "GET", sampleRate: 1, shadowErr: true, wantStats: ShadowStats{Mirrored: 1, Failed: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, err := SimpleClientFactory(reply("primary", nil), 0)()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer primary.Close()
+			stdin := make(chan string, 1)
+			results := make(chan ShadowResult, 1)
+			s := &Shadow{
+				SampleRate: tt.sampleRate,
+				MaxBody:    tt.maxBody,
+				OnResult:   func(r ShadowResult) { results <- r },
+				ErrorLog:   log.New(io.Discard, "", 0),
+				NewClient: func() (Client, error) {
+					if tt.shadowErr {
+						return nil, errors.New("no backend")
+					}
+					return SimpleClientFactory(reply("shadow", stdin), 0)()
+				},
+			}
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req := NewRequest(httptest.NewRequest(tt.method, "/", body))
+			resp, err := s.Middleware()(BasicHandler)(primary, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			if err := resp.WriteTo(rec, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			// 原始请求的响应不受影响
+			if got := rec.Body.String(); got != "primary" {
+				t.Fatalf("body = %q, want primary", got)
+			}
+
+			if tt.wantStats.Mirrored > 0 {
+				select {
+				case r := <-results:
+					if r.Status != tt.wantStatus || (r.Err != nil) != tt.shadowErr {
+						t.Fatalf("result = %+v", r)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("shadow request not finished")
+				}
+				if !tt.shadowErr {
+					if got := <-stdin; got != tt.body {
+						t.Fatalf("shadow stdin = %q, want %q", got, tt.body)
+					}
+				}
+			}
+			if stats := s.Stats(); stats != tt.wantStats {
+				t.Fatalf("stats = %+v, want %+v", stats, tt.wantStats)
+			}
+		})
+	}
+}
+
+func TestShadowMaxConcurrent(t *testing.T) {
+	primary, err := SimpleClientFactory(recordBackend(func(sc *conn, reqID uint16, _ []byte) {
+		sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\nprimary"))
+		sc.writeEndRequest(reqID, 0, statusRequestComplete)
+	}), 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	results := make(chan ShadowResult, 1)
+	s := &Shadow{
+		SampleRate:    1,
+		MaxConcurrent: 1,
+		OnResult:      func(r ShadowResult) { results <- r },
+		NewClient: SimpleClientFactory(recordBackend(func(sc *conn, reqID uint16, _ []byte) {
+			started <- struct{}{}
+			<-release
+			sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\nshadow"))
+			sc.writeEndRequest(reqID, 0, statusRequestComplete)
+		}), 0),
+	}
+	handler := s.Middleware()(BasicHandler)
+	serve := func() {
+		resp, err := handler(primary, NewRequest(httptest.NewRequest("GET", "/", nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resp.WriteTo(httptest.NewRecorder(), io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 第一个影子请求未结束时丢弃第二个
+	serve()
+	<-started
+	serve()
+	if stats := s.Stats(); stats != (ShadowStats{Mirrored: 1, Dropped: 1}) {
+		t.Fatalf("stats = %+v", stats)
+	}
+	close(release)
+	select {
+	case r := <-results:
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow request not finished")
+	}
+}
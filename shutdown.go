@@ -0,0 +1,92 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Handler的优雅关闭，与http.Server.Shutdown配合使用：
+// 先调用server.Shutdown停止接受连接，再调用handler.Shutdown等待FastCGI请求结束并关闭Client池
+//
+//  pool := ffcgiclient.NewClientPool(...)
+//  handler := ffcgiclient.NewHandler(requestHandler, pool.CreateClient)
+//  handler.RegisterOnShutdown(pool.Close)
+
+// ErrHandlerShutdown Handler已开始关闭，不再接受新请求
+var ErrHandlerShutdown = errors.New("ffcgi: handler is shutting down")
+
+// RegisterOnShutdown 注册Shutdown在请求全部结束后调用的函数，例如ClientPool.Close
+func (h *DefaultHandler) RegisterOnShutdown(fn func(ctx context.Context) error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.onShutdown = append(h.onShutdown, fn)
+}
+
+// track 登记一个正在处理的请求，返回可以被Shutdown终止的请求和结束时调用的函数
+// 已开始Shutdown时ok为false
+func (h *DefaultHandler) track(r *http.Request) (tracked *http.Request, done func(), ok bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closing {
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	tracked = r.WithContext(ctx)
+	if h.aborts == nil {
+		h.aborts = make(map[*http.Request]context.CancelFunc)
+	}
+	h.aborts[tracked] = cancel
+	h.inflight.Add(1)
+	return tracked, func() {
+		h.mutex.Lock()
+		delete(h.aborts, tracked)
+		h.mutex.Unlock()
+		cancel()
+		h.inflight.Done()
+	}, true
+}
+
+// Shutdown 停止接受新请求（返回503），等待正在处理的请求结束，
+// ctx结束时通过FCGI_ABORT_REQUEST终止剩余的请求，不再等待它们结束，最后调用RegisterOnShutdown注册的函数
+// 请求被终止时注册的函数收到已结束的ctx，不应再等待（ClientPool.Close此时关闭空闲的Client后返回，
+// 被终止的请求归还Client时关闭）
+// 请求被终止时返回ctx.Err()，否则返回注册的函数的第一个错误
+func (h *DefaultHandler) Shutdown(ctx context.Context) error {
+	h.mutex.Lock()
+	if h.closing {
+		h.mutex.Unlock()
+		return ErrHandlerShutdown
+	}
+	h.closing = true
+	h.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		h.inflight.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// 取消请求的Context，client随后发送FCGI_ABORT_REQUEST；
+		// 服务器不响应时请求可能在abortDrainTimeout之后才结束，不再等待
+		h.mutex.Lock()
+		for _, cancel := range h.aborts {
+			cancel()
+		}
+		h.mutex.Unlock()
+	}
+
+	h.mutex.Lock()
+	hooks := h.onShutdown
+	h.mutex.Unlock()
+	for _, fn := range hooks {
+		if ferr := fn(ctx); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stallBackend 收到请求后通知started，release关闭时正常响应，收到FCGI_ABORT_REQUEST时结束请求并通知aborted
+func stallBackend(started chan<- struct{}, release <-chan struct{}, aborted chan<- struct{}) ConnFactory {
+	return func() (net.Conn, error) {
+		cli, srv := net.Pipe()
+		go func() {
+			defer srv.Close()
+			sc := newConn(srv)
+			var rec record
+			for {
+				if err := sc.readRecord(&rec); err != nil {
+					return
+				}
+				reqID := rec.h.RequestID
+				switch {
+				case rec.h.Type == typeStdin && rec.h.ContentLength == 0:
+					started <- struct{}{}
+					go func() {
+						<-release
+						sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\ndone"))
+						sc.writeEndRequest(reqID, 0, statusRequestComplete)
+					}()
+				case rec.h.Type == typeAbortRequest:
+					sc.writeEndRequest(reqID, 0, statusRequestComplete)
+					aborted <- struct{}{}
+				}
+			}
+		}()
+		return cli, nil
+	}
+}
+
+func TestHandlerShutdownDrain(t *testing.T) {
+	started, release, aborted := make(chan struct{}, 1), make(chan struct{}), make(chan struct{}, 1)
+	h := NewHandler(NewPHPFS("/srv")(BasicHandler), SimpleClientFactory(stallBackend(started, release, aborted), 0))
+	hooked := make(chan struct{})
+	h.RegisterOnShutdown(func(ctx context.Context) error {
+		close(hooked)
+		return nil
+	})
+
+	first := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		h.ServeHTTP(first, httptest.NewRequest("GET", "/index.php", nil))
+		close(served)
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- h.Shutdown(context.Background()) }()
+
+	// 开始关闭后的新请求返回503
+	dh := h
+	for {
+		dh.mutex.Lock()
+		closing := dh.closing
+		dh.mutex.Unlock()
+		if closing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/index.php", nil))
+	if rec.Code != 503 {
+		t.Fatalf("new request during shutdown: status %d", rec.Code)
+	}
+	select {
+	case <-hooked:
+		t.Fatal("shutdown hook called before in-flight request finished")
+	default:
+	}
+
+	close(release)
+	<-served
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	<-hooked
+	if first.Code != 200 || first.Body.String() != "done" {
+		t.Fatalf("in-flight request: %d %q", first.Code, first.Body.String())
+	}
+	if err := h.Shutdown(context.Background()); err != ErrHandlerShutdown {
+		t.Fatalf("second Shutdown() = %v", err)
+	}
+}
+
+func TestHandlerShutdownAbort(t *testing.T) {
+	started, release, aborted := make(chan struct{}, 1), make(chan struct{}), make(chan struct{}, 1)
+	defer close(release)
+	h := NewHandler(NewPHPFS("/srv")(BasicHandler), SimpleClientFactory(stallBackend(started, release, aborted), 0))
+
+	served := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/index.php", nil))
+		close(served)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	<-served
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("FCGI_ABORT_REQUEST not sent")
+	}
+}
+
+// TestHandlerShutdownStalledStdin 测试服务器不再读取请求体时，ctx结束后Shutdown立即返回
+func TestHandlerShutdownStalledStdin(t *testing.T) {
+	stalled, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	h := NewHandler(NewPHPFS("/srv")(BasicHandler), SimpleClientFactory(deafBackend(typeParams, stalled, release), 0))
+	hooked := make(chan struct{})
+	h.RegisterOnShutdown(func(ctx context.Context) error {
+		close(hooked)
+		return nil
+	})
+
+	served := make(chan struct{})
+	go func() {
+		body := bytes.NewReader(make([]byte, 1<<20))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/index.php", body))
+		close(served)
+	}()
+	<-stalled
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	shut := make(chan error, 1)
+	go func() { shut <- h.Shutdown(ctx) }()
+	select {
+	case err := <-shut:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("Shutdown() = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return after ctx ended")
+	}
+	select {
+	case <-hooked:
+	default:
+		t.Fatal("shutdown hook not called")
+	}
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("terminated request still running")
+	}
+}
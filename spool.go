@@ -0,0 +1,142 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// 缓冲没有Content-Length的请求体（chunked），使CONTENT_LENGTH可以在发送请求前确定
+// PHP等应用程序在CONTENT_LENGTH为空时不读取请求体，$_POST为空
+
+// DefaultBufferMemory 在内存中缓冲的请求体的默认最大字节数
+const DefaultBufferMemory = 1024 * 1024
+
+// BufferBody 完整读取没有Content-Length的请求体并设置CONTENT_LENGTH，需放在参数映射中间件之后
+// 请求体先缓冲在内存中，超过MaxMemory或Budget不足时写入临时文件，请求结束后删除
+type BufferBody struct {
+
+	// MaxMemory 每个请求在内存中缓冲的最大字节数，默认DefaultBufferMemory
+	MaxMemory int64
+
+	// MaxBytes 请求体的最大字节数，超过时返回413，0表示不限制
+	MaxBytes int64
+
+	// TempDir 临时文件的目录，为空时使用os.TempDir()
+	TempDir string
+
+	// Budget 所有请求的内存缓冲共享的预算，为nil时不限制
+	Budget *ByteBudget
+}
+
+// Middleware 返回缓冲请求体的中间件
+func (b *BufferBody) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			// 已知长度或没有请求体时不需要缓冲
+			if req.Stdin == nil || req.Raw == nil || req.Raw.ContentLength >= 0 {
+				return inner(client, req)
+			}
+			body, err := b.spool(req.Stdin)
+			req.Stdin.Close()
+			if errors.Is(err, ErrBodyTooLarge) {
+				return newStatusResponse(http.StatusRequestEntityTooLarge), nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			req.Stdin = body
+			req.Params.Set("CONTENT_LENGTH", strconv.FormatInt(body.size, 10))
+			resp, err := inner(client, req)
+			if err != nil {
+				body.Close()
+			}
+			return resp, err
+		}
+	}
+}
+
+// spool 读取r的全部内容，超过MaxBytes时返回ErrBodyTooLarge
+func (b *BufferBody) spool(r io.Reader) (*spooledBody, error) {
+	max := b.MaxMemory
+	if max <= 0 {
+		max = DefaultBufferMemory
+	}
+	s := &spooledBody{budget: b.Budget}
+	chunk := make([]byte, 32*1024)
+	for {
+		n, rerr := r.Read(chunk)
+		if n > 0 {
+			s.size += int64(n)
+			if b.MaxBytes > 0 && s.size > b.MaxBytes {
+				s.Close()
+				return nil, ErrBodyTooLarge
+			}
+			if err := s.write(chunk[:n], max, b.TempDir); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			s.Close()
+			return nil, rerr
+		}
+	}
+	// 从头读取内存和临时文件中的内容
+	s.Reader = bytes.NewReader(s.mem)
+	if s.file != nil {
+		if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.Reader = io.MultiReader(s.Reader, s.file)
+	}
+	return s, nil
+}
+
+// spooledBody 缓冲的请求体，Close时释放预算并删除临时文件
+type spooledBody struct {
+	io.Reader
+	size   int64       // 请求体的字节数
+	mem    []byte      // 内存中的部分
+	file   *os.File    // 超过内存限制的部分
+	budget *ByteBudget // 内存占用的预算
+	once   sync.Once
+}
+
+// write 追加p，内存中放不下时写入临时文件
+func (s *spooledBody) write(p []byte, max int64, dir string) error {
+	if s.file == nil && int64(len(s.mem)+len(p)) <= max && s.budget.Acquire(int64(len(p))) {
+		s.mem = append(s.mem, p...)
+		return nil
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp(dir, "ffcgi-body-")
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+	_, err := s.file.Write(p)
+	return err
+}
+
+// Close 实现io.Closer，重复调用只有第一次有效
+func (s *spooledBody) Close() error {
+	s.once.Do(func() {
+		s.budget.Release(int64(len(s.mem)))
+		s.mem = nil
+		if s.file != nil {
+			s.file.Close()
+			os.Remove(s.file.Name())
+		}
+	})
+	return nil
+}
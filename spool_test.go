@@ -0,0 +1,69 @@
+package ffcgiclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBufferBody(t *testing.T) {
+	dir := t.TempDir()
+	var length, stdin string
+	var spilled int
+	echo := func(client Client, req *Request) (*ResponsePipe, error) {
+		length = req.Params.Get("CONTENT_LENGTH")
+		files, _ := os.ReadDir(dir)
+		spilled = len(files)
+		b, _ := io.ReadAll(req.Stdin)
+		req.Stdin.Close()
+		stdin = string(b)
+		return newStatusResponse(http.StatusOK), nil
+	}
+	budget := NewByteBudget(1024)
+	cases := []struct {
+		name        string
+		body        string
+		chunked     bool
+		wantLength  string
+		wantSpilled int
+		wantCode    int
+	}{
+		{"content length", "abc", false, "3", 0, http.StatusOK},
+		{"memory", "hello", true, "5", 0, http.StatusOK},
+		{"temp file", strings.Repeat("x", 100), true, "100", 1, http.StatusOK},
+		{"too large", strings.Repeat("x", 300), true, "", 0, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		length, stdin, spilled = "", "", 0
+		b := &BufferBody{MaxMemory: 64, MaxBytes: 200, TempDir: dir, Budget: budget}
+		handler := Chain(BasicParamsMapMiddleware, b.Middleware())(echo)
+		r := httptest.NewRequest("POST", "/", strings.NewReader(c.body))
+		if c.chunked {
+			r.ContentLength = -1
+			r.Header.Del("Content-Length")
+		} else {
+			r.Header.Set("Content-Length", "3")
+		}
+		req := NewRequest(r)
+		if code := readStatus(t, mustDo(t, handler, req)); code != c.wantCode {
+			t.Errorf("%s: status = %d, want %d", c.name, code, c.wantCode)
+			continue
+		}
+		if length != c.wantLength || spilled != c.wantSpilled {
+			t.Errorf("%s: CONTENT_LENGTH = %q, %d temp files", c.name, length, spilled)
+		}
+		if c.wantCode == http.StatusOK && stdin != c.body {
+			t.Errorf("%s: stdin = %q", c.name, stdin)
+		}
+	}
+	// 临时文件和预算在请求结束后释放
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d temp files left", len(files))
+	}
+	if st := budget.Stats(); st.InUse != 0 {
+		t.Errorf("budget in use = %d", st.InUse)
+	}
+}
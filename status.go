@@ -0,0 +1,76 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// 请求失败时按错误的原因选择响应状态码
+
+// ErrMalformedResponse 应用程序的CGI响应不合法，例如Status格式错误或缺少Content-Type
+var ErrMalformedResponse = errors.New("malformed CGI response")
+
+// ErrorStatusFunc 自定义请求失败时的响应状态码，status为ErrorStatus映射的结果，返回0时使用status
+type ErrorStatusFunc func(r *http.Request, err error, status int) int
+
+// ErrorHandlerFunc 生成请求失败时的错误响应，例如自定义的错误页面或JSON格式的错误信息
+// err为*StatusError，Status为应返回的状态码
+type ErrorHandlerFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// StatusError 请求失败的原因和对应的响应状态码
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+// Error 实现error接口
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s: %v", e.Status, http.StatusText(e.Status), e.Err)
+}
+
+// Unwrap 返回原始错误
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorStatus 返回err对应的响应状态码，无法识别的错误返回fallback
+// 池已借出或已关闭、应用程序过载：503
+// 连接FastCGI应用程序失败：502
+// 超过请求的期限或读写超时：504
+// 响应头或消息不合法、应用程序拒绝请求：502
+// 处理请求时发生panic：500
+func ErrorStatus(err error, fallback int) int {
+	var opErr *net.OpError
+	var headerErr *HeaderError
+	var recErr *RecordError
+	var netErr net.Error
+	var panicErr *PanicError
+	switch {
+	case errors.As(err, &panicErr):
+		return http.StatusInternalServerError
+	case errors.Is(err, ErrPoolTimeout), errors.Is(err, ErrPoolClosed), errors.Is(err, ErrOverloaded):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return http.StatusBadGateway
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrMalformedResponse), errors.As(err, &headerErr), errors.As(err, &recErr),
+		errors.Is(err, ErrCantMultiplex), errors.Is(err, ErrUnknownRole):
+		return http.StatusBadGateway
+	}
+	return fallback
+}
+
+// errorStatus 按ErrorStatus和自定义的ErrorStatusFunc返回响应状态码
+func errorStatus(fn ErrorStatusFunc, r *http.Request, err error, fallback int) int {
+	status := ErrorStatus(err, fallback)
+	if fn != nil {
+		if s := fn(r, err, status); s != 0 {
+			status = s
+		}
+	}
+	return status
+}
@@ -0,0 +1,101 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorStatus(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("%w: %v", ErrPoolTimeout, context.DeadlineExceeded), http.StatusServiceUnavailable},
+		{ErrPoolClosed, http.StatusServiceUnavailable},
+		{ErrOverloaded, http.StatusServiceUnavailable},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, http.StatusBadGateway},
+		{fmt.Errorf("timeout or canceled: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{&HeaderError{Err: ErrNoHeaders}, http.StatusBadGateway},
+		{fmt.Errorf("%w: bogus status", ErrMalformedResponse), http.StatusBadGateway},
+		{&RecordError{Err: errInvalidVersion}, http.StatusBadGateway},
+		{errors.New("other"), http.StatusTeapot},
+	}
+	for _, c := range cases {
+		if got := ErrorStatus(c.err, http.StatusTeapot); got != c.want {
+			t.Errorf("ErrorStatus(%v) = %d, want %d", c.err, got, c.want)
+		}
+	}
+}
+
+func TestHandlerErrorStatus(t *testing.T) {
+	// 缺少Content-Type的响应
+	stub := &stubClient{recorded: map[string][]byte{"": []byte("X-Foo: bar\r\n\r\nok")}}
+	h := NewHandler(BasicHandler, func() (Client, error) { return stub, nil })
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", rec.Code)
+	}
+
+	// 自定义映射
+	var seen error
+	h.SetErrorStatus(func(r *http.Request, err error, status int) int {
+		seen = err
+		if errors.Is(err, ErrMalformedResponse) {
+			return http.StatusInternalServerError
+		}
+		return 0
+	})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError || !errors.Is(seen, ErrMalformedResponse) {
+		t.Fatalf("status = %d, err = %v", rec.Code, seen)
+	}
+
+	// 连接失败
+	h = NewHandler(BasicHandler, func() (Client, error) {
+		return nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", rec.Code)
+	}
+}
+
+func TestHandlerErrorHandler(t *testing.T) {
+	stub := &stubClient{recorded: map[string][]byte{"": []byte("X-Foo: bar\r\n\r\nok")}}
+	h := NewHandler(BasicHandler, func() (Client, error) { return stub, nil })
+	h.SetErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+		var se *StatusError
+		if !errors.As(err, &se) {
+			t.Errorf("err = %T, want *StatusError", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(se.Status)
+		fmt.Fprintf(w, `{"status":%d}`, se.Status)
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusBadGateway || rec.Body.String() != `{"status":502}` {
+		t.Fatalf("status = %d, body = %q", rec.Code, rec.Body.String())
+	}
+
+	// 连接失败同样使用自定义的响应
+	h = NewHandler(BasicHandler, func() (Client, error) { return nil, ErrPoolTimeout })
+	h.SetErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+		w.WriteHeader(err.(*StatusError).Status)
+		w.Write([]byte("busy"))
+	})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "busy" {
+		t.Fatalf("status = %d, body = %q", rec.Code, rec.Body.String())
+	}
+}
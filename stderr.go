@@ -0,0 +1,122 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// 应用程序stderr输出的处理策略
+
+// StderrMode stderr的记录方式
+type StderrMode int
+
+// 记录方式定义
+const (
+	StderrBuffer  StderrMode = iota // 请求结束后作为一条日志记录（默认）
+	StderrStream                    // 每收到一行记录一条日志
+	StderrDiscard                   // 不记录日志，仍可通过Callback获取
+)
+
+// StderrPolicy stderr的处理策略，通过Handler.SetStderrPolicy设置
+type StderrPolicy struct {
+
+	// Mode 记录日志的方式
+	Mode StderrMode
+
+	// MaxBytes 每个请求保留的最大字节数，超过的部分被丢弃，0表示不限制
+	MaxBytes int
+
+	// Debug 为true时，响应状态码为5xx且没有Content-Length时将stderr附加到响应体，只应在开发环境中使用
+	Debug bool
+
+	// Callback 请求结束后以保留的stderr调用，没有stderr输出时不调用，truncated表示超过了MaxBytes
+	Callback func(r *http.Request, stderr []byte, truncated bool)
+}
+
+// stderrCollector 按StderrPolicy处理一个请求的stderr，实现io.Writer
+type stderrCollector struct {
+	policy    StderrPolicy
+	logf      func(format string, v ...interface{})
+	buf       bytes.Buffer // 保留的stderr
+	truncated bool
+	line      []byte // StderrStream时未结束的行
+}
+
+// Write 实现io.Writer
+func (c *stderrCollector) Write(p []byte) (int, error) {
+	n := len(p)
+	if max := c.policy.MaxBytes; max > 0 && c.buf.Len()+len(p) > max {
+		p = p[:max-c.buf.Len()]
+		c.truncated = true
+	}
+	c.buf.Write(p)
+	if c.policy.Mode == StderrStream {
+		c.line = append(c.line, p...)
+		for {
+			i := bytes.IndexByte(c.line, '\n')
+			if i < 0 {
+				break
+			}
+			c.logLine(c.line[:i])
+			c.line = c.line[i+1:]
+		}
+	}
+	return n, nil
+}
+
+// logLine 记录一行stderr
+func (c *stderrCollector) logLine(line []byte) {
+	line = bytes.TrimRight(line, "\r")
+	if len(line) > 0 {
+		c.logf("stderr from application process: %s", line)
+	}
+}
+
+// finish 请求结束时调用，记录剩余的输出并调用Callback
+func (c *stderrCollector) finish(r *http.Request) {
+	if c.buf.Len() == 0 {
+		return
+	}
+	switch c.policy.Mode {
+	case StderrBuffer:
+		c.logf("error stream from application process %s", c.buf.String())
+	case StderrStream:
+		c.logLine(c.line)
+		c.line = nil
+	}
+	if c.truncated && c.policy.Mode != StderrDiscard {
+		c.logf("stderr from application process truncated to %d bytes", c.policy.MaxBytes)
+	}
+	if c.policy.Callback != nil {
+		c.policy.Callback(r, c.buf.Bytes(), c.truncated)
+	}
+}
+
+// statusWriter 记录响应状态码的http.ResponseWriter
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+// WriteHeader 实现http.ResponseWriter
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write 实现http.ResponseWriter
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush 实现http.Flusher
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
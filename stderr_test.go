@@ -0,0 +1,88 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStderrPolicy(t *testing.T) {
+	stub := &stderrStub{stdout: "Status: 500\r\nContent-Type: text/plain\r\n\r\nfailed", stderr: "line 1\nline 2\nline 3"}
+	h := NewHandler(BasicHandler, func() (Client, error) { return stub, nil })
+	var logs bytes.Buffer
+	h.SetLogger(log.New(&logs, "", 0))
+
+	var got string
+	var truncated bool
+	h.SetStderrPolicy(StderrPolicy{
+		Mode:     StderrStream,
+		MaxBytes: 10,
+		Debug:    true,
+		Callback: func(r *http.Request, stderr []byte, t bool) {
+			got, truncated = string(stderr), t
+		},
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if got != "line 1\nlin" || !truncated {
+		t.Fatalf("callback got %q, truncated = %v", got, truncated)
+	}
+	if lines := strings.Count(logs.String(), "stderr from application process: "); lines != 2 {
+		t.Fatalf("logged %d lines:\n%s", lines, logs.String())
+	}
+	if rec.Code != 500 || !strings.HasSuffix(rec.Body.String(), "--- stderr ---\nline 1\nlin") {
+		t.Fatalf("status = %d, body = %q", rec.Code, rec.Body.String())
+	}
+}
+
+// stderrStub 返回固定stdout和stderr的Client
+type stderrStub struct {
+	stubClient
+	stdout, stderr string
+}
+
+// Do 实现Client
+func (c *stderrStub) Do(req *Request) (*ResponsePipe, error) {
+	p := NewResponsePipe()
+	go func() {
+		p.stdErrWriter.Write([]byte(c.stderr))
+		p.stdErrWriter.Close()
+	}()
+	go func() {
+		p.stdOutWriter.Write([]byte(c.stdout))
+		p.stdOutWriter.Close()
+	}()
+	return p, nil
+}
+
+func TestResponsePipeErr(t *testing.T) {
+	stub := &errStub{}
+	h := NewHandler(Chain(NewPHPFS("/var/www"), (&BodyLimit{MaxResponse: 100}).Middleware())(BasicHandler), func() (Client, error) { return stub, nil })
+	var logs bytes.Buffer
+	h.SetLogger(log.New(&logs, "", 0))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusBadGateway || !strings.Contains(logs.String(), "connection reset") {
+		t.Fatalf("status = %d, logs = %q", rec.Code, logs.String())
+	}
+	if strings.Contains(logs.String(), "error stream") {
+		t.Fatalf("transport error logged as stderr: %q", logs.String())
+	}
+}
+
+// errStub 模拟连接断开的Client
+type errStub struct {
+	stubClient
+}
+
+// Do 实现Client
+func (c *errStub) Do(req *Request) (*ResponsePipe, error) {
+	p := NewResponsePipe()
+	go p.CloseWithError(errors.New("connection reset"))
+	return p, nil
+}
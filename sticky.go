@@ -0,0 +1,102 @@
+package ffcgiclient
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// 会话保持：同一个客户端的请求总是发送到同一个后端，使用本地文件保存会话的PHP应用程序不会丢失会话
+// 按cookie或来源IP计算标识，用最高随机权重（rendezvous）哈希在可用的后端中选择，
+// 一个后端不可用时只有原来发送到该后端的客户端会改变后端
+//
+//	sticky := &ffcgiclient.StickySelector{Cookie: "FCGI_AFFINITY"}
+//	h := router.Handle("/", ffcgiclient.Chain(sticky.Middleware(), ffcgiclient.NewPHPFS("/srv"))(ffcgiclient.BasicHandler), pools.ClientFactory(backends...))
+//	h.SetRequestClientFactory(pools.RequestClientFactory(sticky, backends...))
+
+// StickySelector 按客户端标识选择后端的BackendSelector
+type StickySelector struct {
+
+	// Cookie 保存客户端标识的cookie名称，由Middleware在第一次响应时设置；为空时只按来源IP选择
+	Cookie string
+
+	// MaxAge cookie的有效期，0表示浏览器关闭时失效
+	MaxAge time.Duration
+
+	// Proxies 受信任的代理，来自受信任代理的请求按转发头中的客户端地址计算来源IP，为nil时使用RemoteAddr
+	Proxies *TrustedProxies
+}
+
+// key 返回请求的客户端标识：cookie的值，没有时为来源IP的哈希
+// fromCookie 表示标识来自cookie
+func (s *StickySelector) key(r *http.Request) (key string, fromCookie bool) {
+	if s.Cookie != "" {
+		if c, err := r.Cookie(s.Cookie); err == nil && c.Value != "" {
+			return c.Value, true
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if s.Proxies != nil {
+		if hop, ok := s.Proxies.clientHop(r); ok && hop.addr != "" {
+			ip = hop.addr
+		}
+	}
+	// 不在cookie中暴露客户端的IP
+	h := fnv.New64a()
+	io.WriteString(h, ip)
+	return fmt.Sprintf("%016x", h.Sum64()), false
+}
+
+// SelectBackend 实现BackendSelector，选择与客户端标识组合后哈希值最大的后端
+func (s *StickySelector) SelectBackend(r *http.Request, candidates []*Backend) *Backend {
+	key, _ := s.key(r)
+	var selected *Backend
+	var max uint64
+	for _, b := range candidates {
+		h := fnv.New64a()
+		io.WriteString(h, key)
+		h.Write([]byte{0})
+		io.WriteString(h, b.String())
+		if sum := h.Sum64(); selected == nil || sum > max {
+			selected, max = b, sum
+		}
+	}
+	return selected
+}
+
+// Middleware 返回在请求没有携带Cookie时，在响应中设置Cookie的中间件，
+// 使客户端之后的请求（即使来源IP改变）发送到同一个后端；Cookie为空时不做任何事
+func (s *StickySelector) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if s.Cookie == "" || req.Raw == nil {
+				return inner(client, req)
+			}
+			key, fromCookie := s.key(req.Raw)
+			resp, err := inner(client, req)
+			if err != nil || fromCookie {
+				return resp, err
+			}
+			cookie := &http.Cookie{
+				Name:     s.Cookie,
+				Value:    key,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			}
+			if s.MaxAge > 0 {
+				cookie.MaxAge = int(s.MaxAge / time.Second)
+			}
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+				header.Add("Set-Cookie", cookie.String())
+				return body, nil
+			}), nil
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package ffcgiclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStickySelector(t *testing.T) {
+	backends := []*Backend{
+		{Network: "tcp", Address: "10.0.0.1:9000"},
+		{Network: "tcp", Address: "10.0.0.2:9000"},
+		{Network: "tcp", Address: "10.0.0.3:9000"},
+	}
+	s := &StickySelector{Cookie: "affinity"}
+	request := func(ip, cookie string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "affinity", Value: cookie})
+		}
+		return r
+	}
+
+	used := make(map[*Backend]int)
+	for i := 0; i < 100; i++ {
+		r := request(fmt.Sprintf("192.0.2.%d", i), "")
+		selected := s.SelectBackend(r, backends)
+		used[selected]++
+		// 同一个客户端总是选择同一个后端
+		if again := s.SelectBackend(request(fmt.Sprintf("192.0.2.%d", i), ""), backends); again != selected {
+			t.Fatalf("client %d: selected %v then %v", i, selected, again)
+		}
+		// 一个后端不可用时，其他后端的客户端不改变后端
+		for j, down := range backends {
+			if down == selected {
+				continue
+			}
+			rest := append(append([]*Backend{}, backends[:j]...), backends[j+1:]...)
+			if got := s.SelectBackend(r, rest); got != selected {
+				t.Fatalf("client %d: %v down, selected %v instead of %v", i, down, got, selected)
+			}
+		}
+	}
+	for _, b := range backends {
+		if used[b] == 0 {
+			t.Errorf("backend %v never selected: %v", b, used)
+		}
+	}
+
+	// cookie优先于来源IP
+	a := s.SelectBackend(request("192.0.2.1", "session-a"), backends)
+	if got := s.SelectBackend(request("198.51.100.7", "session-a"), backends); got != a {
+		t.Fatalf("same cookie from another IP selected %v, want %v", got, a)
+	}
+}
+
+func TestStickyMiddleware(t *testing.T) {
+	stub := &stubClient{recorded: map[string][]byte{
+		"": []byte("Content-Type: text/plain\r\n\r\nok"),
+	}}
+	backends := []*Backend{{Network: "tcp", Address: "a:9000"}, {Network: "tcp", Address: "b:9000"}}
+	s := &StickySelector{Cookie: "affinity", MaxAge: time.Hour}
+	handler := s.Middleware()(BasicHandler)
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		resp, err := handler(stub, NewRequest(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		resp.WriteTo(rec, io.Discard)
+		return rec
+	}
+
+	// 第一次请求设置cookie，携带cookie的请求与原来选择同一个后端
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.10:1234"
+	first := s.SelectBackend(r, backends)
+	cookies := serve(r).Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "affinity" || cookies[0].MaxAge != 3600 {
+		t.Fatalf("cookies = %v", cookies)
+	}
+	next := httptest.NewRequest("GET", "/", nil)
+	next.RemoteAddr = "203.0.113.5:4321"
+	next.AddCookie(cookies[0])
+	if got := s.SelectBackend(next, backends); got != first {
+		t.Fatalf("with cookie selected %v, want %v", got, first)
+	}
+	if got := serve(next).Result().Cookies(); len(got) != 0 {
+		t.Fatalf("cookie set again: %v", got)
+	}
+}
+
+func TestStickyTrustedProxy(t *testing.T) {
+	proxies, err := NewTrustedProxies("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &StickySelector{Proxies: proxies}
+	direct := httptest.NewRequest("GET", "/", nil)
+	direct.RemoteAddr = "192.0.2.44:1000"
+	proxied := httptest.NewRequest("GET", "/", nil)
+	proxied.RemoteAddr = "127.0.0.1:2000"
+	proxied.Header.Set("X-Forwarded-For", "192.0.2.44")
+	k1, _ := s.key(direct)
+	k2, _ := s.key(proxied)
+	if k1 != k2 {
+		t.Fatal("forwarded client address not used")
+	}
+}
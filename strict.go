@@ -0,0 +1,159 @@
+package ffcgiclient
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 按RFC 3875检查和规范化生成的CGI元变量，使参数在PHP以外的FastCGI应用程序之间可移植
+
+// rfc3875Required RFC 3875要求必须设置的元变量（QUERY_STRING可以为空但必须存在）
+var rfc3875Required = []string{
+	"GATEWAY_INTERFACE",
+	"QUERY_STRING",
+	"REMOTE_ADDR",
+	"REQUEST_METHOD",
+	"SCRIPT_NAME",
+	"SERVER_NAME",
+	"SERVER_PORT",
+	"SERVER_PROTOCOL",
+	"SERVER_SOFTWARE",
+}
+
+// StrictCGI 按RFC 3875检查并规范化参数，需放在参数映射中间件之后
+// 规范化：
+// 空的CONTENT_LENGTH、CONTENT_TYPE、PATH_INFO被删除
+// 没有PATH_INFO时删除PATH_TRANSLATED，有PATH_INFO时根据DOCUMENT_ROOT补充PATH_TRANSLATED
+// 根据Authorization头补充AUTH_TYPE，删除未经ident查询得到的REMOTE_IDENT
+// 检查：
+// 必需的元变量是否存在，GATEWAY_INTERFACE、SERVER_PORT、SCRIPT_NAME、PATH_INFO等的格式，元变量名是否合法
+type StrictCGI struct {
+
+	// Reject 为true时存在违规的请求返回500，否则只报告违规
+	Reject bool
+
+	// OnViolation 报告违规，为nil时使用log.Printf
+	OnViolation func(req *Request, violations []string)
+}
+
+// Middleware 返回检查参数的中间件
+func (s *StrictCGI) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			violations := normalizeRFC3875(req)
+			if len(violations) > 0 {
+				if s.OnViolation != nil {
+					s.OnViolation(req, violations)
+				} else {
+					log.Printf("RFC 3875 violations for %s: %s",
+						req.Params.Get("REQUEST_URI"), strings.Join(violations, "; "))
+				}
+				if s.Reject {
+					return newStatusResponse(http.StatusInternalServerError), nil
+				}
+			}
+			return inner(client, req)
+		}
+	}
+}
+
+// normalizeRFC3875 规范化req.Params，返回无法规范化的违规
+func normalizeRFC3875(req *Request) (violations []string) {
+	params := req.Params
+
+	// 没有请求体时不应设置CONTENT_LENGTH和CONTENT_TYPE（RFC 3875 4.1.2、4.1.3）
+	for _, name := range []string{"CONTENT_LENGTH", "CONTENT_TYPE", "PATH_INFO"} {
+		if v, ok := params.Lookup(name); ok && v == "" {
+			params.Del(name)
+		}
+	}
+	if v, ok := params.Lookup("CONTENT_LENGTH"); ok {
+		if n, err := strconv.ParseUint(v, 10, 63); err != nil || strconv.FormatUint(n, 10) != v {
+			violations = append(violations, fmt.Sprintf("CONTENT_LENGTH %q is not a decimal number", v))
+		}
+	}
+
+	// PATH_INFO和PATH_TRANSLATED（RFC 3875 4.1.5、4.1.6）
+	if pathInfo, ok := params.Lookup("PATH_INFO"); ok {
+		if !strings.HasPrefix(pathInfo, "/") {
+			violations = append(violations, fmt.Sprintf("PATH_INFO %q does not start with /", pathInfo))
+		} else if !params.Has("PATH_TRANSLATED") && params.Get("DOCUMENT_ROOT") != "" {
+			params.Set("PATH_TRANSLATED", path.Join(params.Get("DOCUMENT_ROOT"), pathInfo))
+		}
+	} else {
+		params.Del("PATH_TRANSLATED")
+	}
+
+	// SCRIPT_NAME为空或以/开头（RFC 3875 4.1.13）
+	if name := params.Get("SCRIPT_NAME"); name != "" && !strings.HasPrefix(name, "/") {
+		violations = append(violations, fmt.Sprintf("SCRIPT_NAME %q does not start with /", name))
+	}
+
+	// AUTH_TYPE为请求使用的认证方案（RFC 3875 4.1.1）
+	if !params.Has("AUTH_TYPE") && req.Raw != nil {
+		if auth := req.Raw.Header.Get("Authorization"); auth != "" {
+			scheme := strings.SplitN(auth, " ", 2)[0]
+			switch strings.ToLower(scheme) {
+			case "basic":
+				params.Set("AUTH_TYPE", "Basic")
+			case "digest":
+				params.Set("AUTH_TYPE", "Digest")
+			default:
+				params.Set("AUTH_TYPE", scheme)
+			}
+		}
+	}
+	if params.Get("REMOTE_USER") != "" && params.Get("AUTH_TYPE") == "" {
+		violations = append(violations, "REMOTE_USER is set without AUTH_TYPE")
+	}
+	// REMOTE_IDENT只能来自ident（RFC 1413）查询，网关不做此查询
+	params.Del("REMOTE_IDENT")
+
+	// 必需的元变量
+	for _, name := range rfc3875Required {
+		if !params.Has(name) {
+			violations = append(violations, name+" is missing")
+		}
+	}
+	if v, ok := params.Lookup("GATEWAY_INTERFACE"); ok && v != "CGI/1.1" {
+		violations = append(violations, fmt.Sprintf("GATEWAY_INTERFACE %q is not CGI/1.1", v))
+	}
+	if v, ok := params.Lookup("SERVER_PORT"); ok {
+		if _, err := strconv.ParseUint(v, 10, 16); err != nil {
+			violations = append(violations, fmt.Sprintf("SERVER_PORT %q is not a port number", v))
+		}
+	}
+
+	// 元变量名只能包含大写字母、数字和下划线（RFC 3875 4.1）
+	var invalid []string
+	params.Range(func(name, _ string) bool {
+		if !validMetaVariable(name) {
+			invalid = append(invalid, name)
+		}
+		return true
+	})
+	sort.Strings(invalid)
+	for _, name := range invalid {
+		violations = append(violations, fmt.Sprintf("invalid meta-variable name %q", name))
+	}
+	return violations
+}
+
+// validMetaVariable 检查元变量名是否合法
+func validMetaVariable(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
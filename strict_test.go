@@ -0,0 +1,53 @@
+package ffcgiclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStrictCGI(t *testing.T) {
+	var violations []string
+	s := &StrictCGI{Reject: true, OnViolation: func(req *Request, v []string) {
+		violations = v
+	}}
+
+	// 规范化后符合要求的请求
+	var params map[string]string
+	r := httptest.NewRequest("GET", "/app.cgi/extra?x=1", nil)
+	r.Header.Set("Authorization", "basic dXNlcjpwYXNz")
+	Chain(BasicParamsMapMiddleware, NewPHPFS("/srv"), s.Middleware())(recordHandler(&params))(nil, NewRequest(r))
+	if violations != nil {
+		t.Fatalf("unexpected violations: %v", violations)
+	}
+	if _, ok := params["CONTENT_LENGTH"]; ok {
+		t.Error("empty CONTENT_LENGTH not removed")
+	}
+	if params["AUTH_TYPE"] != "Basic" {
+		t.Errorf("AUTH_TYPE = %q, want Basic", params["AUTH_TYPE"])
+	}
+
+	// 缺少必需的元变量时拒绝
+	params = nil
+	r = httptest.NewRequest("GET", "/", nil)
+	handler := s.Middleware()(recordHandler(&params))
+	req := NewRequest(r)
+	req.Params.Set("PATH_INFO", "extra")
+	req.Params.Set("remote_user", "x")
+	if code := readStatus(t, mustDo(t, handler, req)); code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", code)
+	}
+	if params != nil || len(violations) != len(rfc3875Required)+2 {
+		t.Fatalf("violations = %v", violations)
+	}
+}
+
+// mustDo 执行handler并检查错误
+func mustDo(t *testing.T, handler RequestHandler, req *Request) *ResponsePipe {
+	t.Helper()
+	resp, err := handler(nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
@@ -0,0 +1,68 @@
+package ffcgiclient
+
+import (
+	"io"
+	"sync"
+)
+
+// 将转发到stdin的请求体复制一份，用于审计、类似WAF的检查或计算校验和，不需要再次读取请求体
+
+// TeeBody 在请求体被转发时将读取到的内容写入Writer返回的io.Writer
+type TeeBody struct {
+
+	// Writer 返回接收请求体副本的io.Writer，返回nil时不复制
+	// Write返回错误时读取请求体失败，client终止FastCGI请求；
+	// 实现io.Closer时在请求体读取完毕或被关闭时调用Close，可以在Close中完成校验和的计算
+	Writer func(req *Request) io.Writer
+}
+
+// Middleware 返回复制请求体的中间件
+func (t *TeeBody) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			if req.Stdin != nil && t.Writer != nil {
+				if w := t.Writer(req); w != nil {
+					req.Stdin = &teeBody{ReadCloser: req.Stdin, w: w}
+				}
+			}
+			return inner(client, req)
+		}
+	}
+}
+
+// teeBody 读取时将内容写入w
+type teeBody struct {
+	io.ReadCloser
+	w    io.Writer
+	once sync.Once
+}
+
+// Read 实现io.Reader
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		if _, werr := t.w.Write(p[:n]); werr != nil {
+			t.finish()
+			return n, werr
+		}
+	}
+	if err == io.EOF {
+		t.finish()
+	}
+	return n, err
+}
+
+// Close 实现io.Closer
+func (t *teeBody) Close() error {
+	t.finish()
+	return t.ReadCloser.Close()
+}
+
+// finish 关闭w，重复调用只有第一次有效
+func (t *teeBody) finish() {
+	t.once.Do(func() {
+		if c, ok := t.w.(io.Closer); ok {
+			c.Close()
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package ffcgiclient
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// checksumWriter Close时记录请求体的sha256
+type checksumWriter struct {
+	hash.Hash
+	sum *string
+}
+
+func (c checksumWriter) Close() error {
+	*c.sum = fmt.Sprintf("%x", c.Sum(nil))
+	return nil
+}
+
+// rejectWriter 请求体包含指定内容时返回错误
+type rejectWriter string
+
+func (r rejectWriter) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), string(r)) {
+		return 0, errors.New("rejected")
+	}
+	return len(p), nil
+}
+
+func TestTeeBody(t *testing.T) {
+	var stdin string
+	var readErr error
+	echo := func(client Client, req *Request) (*ResponsePipe, error) {
+		b, err := io.ReadAll(req.Stdin)
+		req.Stdin.Close()
+		stdin, readErr = string(b), err
+		return newStatusResponse(http.StatusOK), nil
+	}
+
+	var sum string
+	tee := &TeeBody{Writer: func(req *Request) io.Writer {
+		return checksumWriter{sha256.New(), &sum}
+	}}
+	mustDo(t, tee.Middleware()(echo), NewRequest(httptest.NewRequest("POST", "/", strings.NewReader("hello"))))
+	if stdin != "hello" || sum != fmt.Sprintf("%x", sha256.Sum256([]byte("hello"))) {
+		t.Fatalf("stdin = %q, sum = %q", stdin, sum)
+	}
+
+	// Write返回错误时读取失败
+	tee = &TeeBody{Writer: func(req *Request) io.Writer { return rejectWriter("<script>") }}
+	mustDo(t, tee.Middleware()(echo), NewRequest(httptest.NewRequest("POST", "/", strings.NewReader("a<script>"))))
+	if readErr == nil || readErr.Error() != "rejected" {
+		t.Fatalf("read error = %v", readErr)
+	}
+}
@@ -0,0 +1,144 @@
+package ffcgiclient
+
+import (
+	"io"
+	"time"
+)
+
+// 按请求限制上传（发送到stdin）和下载（从stdout读取）的速率，避免一个大文件上传或下载
+// 占满与后端共享的连接或网卡，影响同时进行的其他请求
+//
+//	throttle := &ffcgiclient.Throttle{UploadRate: 1 << 20, DownloadRate: 4 << 20}
+//	handler := ffcgiclient.Chain(throttle.Middleware(), ffcgiclient.NewPHPFS("/srv"))(ffcgiclient.BasicHandler)
+
+// Throttle 按令牌桶限制每个请求的传输速率，每个请求使用独立的令牌桶
+type Throttle struct {
+
+	// UploadRate 每秒发送到stdin的最大字节数，0表示不限制
+	UploadRate int64
+
+	// DownloadRate 每秒从stdout读取的最大字节数（包括响应头），0表示不限制
+	DownloadRate int64
+
+	// Burst 令牌桶的容量，即不受限制连续传输的字节数，0表示速率的1/10（至少defaultThrottleBurst）
+	Burst int64
+
+	// Clock 计算令牌使用的时间来源，为nil时使用SystemClock
+	Clock Clock
+}
+
+// defaultThrottleBurst 令牌桶的最小默认容量
+const defaultThrottleBurst = 4096
+
+// Middleware 返回限制传输速率的中间件
+// 请求的上下文结束（例如客户端断开、请求被终止）后不再等待，剩余的数据以正常速度读取
+func (t *Throttle) Middleware() Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			done := req.Context().Done()
+			if t.UploadRate > 0 && req.Stdin != nil {
+				req.Stdin = &throttledBody{
+					throttledReader: t.reader(req.Stdin, t.UploadRate, done),
+					Closer:          req.Stdin,
+				}
+			}
+			resp, err := inner(client, req)
+			if err != nil || resp == nil || t.DownloadRate <= 0 {
+				return resp, err
+			}
+			resp.stdOutReader = t.reader(resp.stdOutReader, t.DownloadRate, done)
+			return resp, nil
+		}
+	}
+}
+
+// reader 返回以rate限制r的throttledReader
+func (t *Throttle) reader(r io.Reader, rate int64, done <-chan struct{}) *throttledReader {
+	burst := t.Burst
+	if burst <= 0 {
+		burst = rate / 10
+		if burst < defaultThrottleBurst {
+			burst = defaultThrottleBurst
+		}
+	}
+	return &throttledReader{
+		r:      r,
+		bucket: newTokenBucket(rate, burst, clockOr(t.Clock)),
+		done:   done,
+	}
+}
+
+// tokenBucket 令牌桶，令牌数可以为负数，表示需要等待的字节数
+type tokenBucket struct {
+	rate   float64 // 每秒增加的令牌数
+	burst  float64 // 令牌数上限
+	tokens float64
+	last   time.Time
+	clock  Clock
+}
+
+// newTokenBucket 创建装满令牌的令牌桶
+func newTokenBucket(rate, burst int64, clock Clock) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clock.Now(),
+		clock:  clock,
+	}
+}
+
+// take 取出n个令牌，返回令牌不足时需要等待的时间
+func (b *tokenBucket) take(n int) time.Duration {
+	now := b.clock.Now()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttledReader 按令牌桶限制读取速率，每次读取不超过令牌桶的容量
+type throttledReader struct {
+	r      io.Reader
+	bucket *tokenBucket
+	done   <-chan struct{} // 关闭后不再等待
+}
+
+// Read 实现io.Reader，读取后等待令牌补足
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if max := int(r.bucket.burst); len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.wait(r.bucket.take(n))
+	}
+	return n, err
+}
+
+// wait 等待d，done关闭时立即返回
+func (r *throttledReader) wait(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.done:
+	}
+}
+
+// throttledBody 限速的请求体
+type throttledBody struct {
+	*throttledReader
+	io.Closer
+}
@@ -0,0 +1,93 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	b := newTokenBucket(100, 50, clock)
+	steps := []struct {
+		advance time.Duration
+		take    int
+		want    time.Duration
+	}{
+		{0, 50, 0},
+		{0, 10, 100 * time.Millisecond},
+		{100 * time.Millisecond, 0, 0},
+		// 令牌数不超过容量
+		{time.Hour, 50, 0},
+		{0, 25, 250 * time.Millisecond},
+	}
+	for i, s := range steps {
+		clock.Advance(s.advance)
+		if got := b.take(s.take); got != s.want {
+			t.Errorf("step %d: take(%d) = %v, want %v", i, s.take, got, s.want)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	body := strings.Repeat("x", 5000)
+	stub := &stubClient{recorded: map[string][]byte{
+		"large": []byte("Content-Type: text/plain\r\n\r\n" + body),
+	}}
+	tests := []struct {
+		name     string
+		throttle Throttle
+		upload   string
+		cancel   bool
+		min, max time.Duration
+	}{
+		{"unlimited", Throttle{}, body, false, 0, 100 * time.Millisecond},
+		// 5000字节，容量1000，每秒20000字节：约200ms
+		{"upload", Throttle{UploadRate: 20000, Burst: 1000}, body, false, 150 * time.Millisecond, time.Second},
+		{"download", Throttle{DownloadRate: 20000, Burst: 1000}, "", false, 150 * time.Millisecond, time.Second},
+		// 请求已结束时不再等待
+		{"canceled", Throttle{UploadRate: 100, DownloadRate: 100, Burst: 100}, body, true, 0, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/?size=large", strings.NewReader(tt.upload))
+			if tt.cancel {
+				ctx, cancel := context.WithCancel(r.Context())
+				cancel()
+				r = r.WithContext(ctx)
+			}
+			req := NewRequest(r)
+			req.Stdin = io.NopCloser(r.Body)
+			start := time.Now()
+			resp, err := tt.throttle.Middleware()(BasicHandler)(stub, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			if err := resp.WriteTo(rec, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(start)
+			if rec.Body.String() != body {
+				t.Fatalf("body = %d bytes, want %d", rec.Body.Len(), len(body))
+			}
+			if elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("took %v, want between %v and %v", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+// TestThrottledReaderChunks 测试每次读取不超过令牌桶的容量
+func TestThrottledReaderChunks(t *testing.T) {
+	th := &Throttle{Burst: 16}
+	r := th.reader(bytes.NewReader(make([]byte, 100)), 1<<30, nil)
+	p := make([]byte, 64)
+	if n, _ := r.Read(p); n != 16 {
+		t.Fatalf("read %d bytes, want 16", n)
+	}
+}
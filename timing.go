@@ -0,0 +1,61 @@
+package ffcgiclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Server-Timing响应头，使前端开发者不查看网关日志也能了解耗时的分布
+
+// Timing 一次请求各阶段的耗时，由ResponsePipe.Timing返回
+// 除Queue和Dial外都从Client.Do开始计算，尚未到达的阶段为0
+type Timing struct {
+	Queue     time.Duration // 等待Client池名额的耗时，仅Client来自ClientPool时提供
+	Dial      time.Duration // 借出时建立连接（含检查）的耗时，仅Client来自ClientPool时提供
+	Write     time.Duration // 发送参数和stdin完成的耗时
+	FirstByte time.Duration // 收到第一个stdout消息的耗时
+	Total     time.Duration // 请求结束（收到EndRequest或发生传输错误）的耗时
+}
+
+// ServerTimingMiddleware 在响应头中追加Server-Timing，包含以下指标（毫秒）：
+// queue 等待Client池名额的耗时，dial 建立连接的耗时（仅Client来自ClientPool时提供），
+// write 发送参数和stdin的耗时（仅在收到响应头前发送完成时提供），
+// app 从发送请求到收到响应头的耗时，ttfb 以上之和（不含write）
+func ServerTimingMiddleware(inner RequestHandler) RequestHandler {
+	return func(client Client, req *Request) (*ResponsePipe, error) {
+		var waited, dialed time.Duration
+		timed, pooled := client.(interface {
+			checkoutTiming() (waited, dialed time.Duration)
+		})
+		if pooled {
+			waited, dialed = timed.checkoutTiming()
+		}
+
+		start := time.Now()
+		resp, err := inner(client, req)
+		if err != nil {
+			return resp, err
+		}
+		return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+			app := time.Since(start)
+			var metrics []string
+			if pooled {
+				metrics = append(metrics, serverTimingMetric("queue", waited), serverTimingMetric("dial", dialed))
+			}
+			if write := resp.Timing().Write; write > 0 {
+				metrics = append(metrics, serverTimingMetric("write", write))
+			}
+			metrics = append(metrics, serverTimingMetric("app", app), serverTimingMetric("ttfb", waited+dialed+app))
+			header.Add("Server-Timing", strings.Join(metrics, ", "))
+			return body, nil
+		}), nil
+	}
+}
+
+// serverTimingMetric 返回Server-Timing中的一项指标
+func serverTimingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond))
+}
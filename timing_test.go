@@ -0,0 +1,70 @@
+package ffcgiclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseTiming(t *testing.T) {
+	factory := serveBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, "second")
+	}))
+	pool := NewClientPoolConfig(SimpleClientFactoryNoConn(factory, 0), PoolConfig{MaxActive: 1})
+	defer pool.Close(context.Background())
+
+	c, err := pool.CreateClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := httptest.NewRequest("POST", "/index.php", strings.NewReader("body"))
+	req := NewRequest(r)
+	req.Stdin = io.NopCloser(r.Body)
+	// 经过改写响应的中间件后仍能取得耗时
+	resp, err := ServerTimingMiddleware(NewPHPFS("/srv")(BasicHandler))(c, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err := resp.WriteTo(rec, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Body.String() != "firstsecond" {
+		t.Fatalf("body = %q", rec.Body.String())
+	}
+	timing := resp.Timing()
+	if timing.Dial <= 0 {
+		t.Errorf("Dial = %v, want > 0", timing.Dial)
+	}
+	if timing.Write <= 0 || timing.Write > timing.FirstByte {
+		t.Errorf("Write = %v, want between 0 and FirstByte %v", timing.Write, timing.FirstByte)
+	}
+	if timing.FirstByte < 20*time.Millisecond {
+		t.Errorf("FirstByte = %v, want at least 20ms", timing.FirstByte)
+	}
+	if timing.Total < timing.FirstByte+20*time.Millisecond {
+		t.Errorf("Total = %v, want at least FirstByte+20ms", timing.Total)
+	}
+	header := rec.Header().Get("Server-Timing")
+	for _, name := range []string{"queue;", "dial;", "write;", "app;", "ttfb;"} {
+		if !strings.Contains(header, name) {
+			t.Errorf("Server-Timing = %q, missing %s", header, name)
+		}
+	}
+
+	// 不是由Client.Do创建的响应没有耗时
+	if timing := newStatusResponse(http.StatusOK).Timing(); timing != (Timing{}) {
+		t.Errorf("static response Timing = %+v", timing)
+	}
+}
@@ -0,0 +1,82 @@
+package ffcgiclient
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"suilz/ffcgi-client/fcgiproto"
+)
+
+// 记录连接上的每个FastCGI消息，用于排查与php-fpm、uwsgi或自定义FastCGI应用程序的兼容问题
+//
+//	factory := ffcgiclient.TraceConnFactory(ffcgiclient.SimpleConnFactory("unix", "/run/php-fpm.sock"),
+//		ffcgiclient.TraceConfig{Logger: log.Default(), DumpBytes: 256})
+
+// TraceConfig 消息跟踪的配置
+type TraceConfig struct {
+
+	// Logger 输出跟踪记录，为nil时使用log包的默认logger
+	Logger *log.Logger
+
+	// DumpBytes 大于0时以十六进制和ASCII输出每个消息内容的前DumpBytes字节，0表示不输出内容
+	DumpBytes int
+}
+
+// traceConns 跟踪的连接序号
+var traceConns int64
+
+// TraceConnFactory 返回包装factory的ConnFactory，按config记录每个连接上发送和接收的消息
+// 每行记录连接序号、方向（>为发送，<为接收）、消息类型、请求ID、内容和填充长度
+func TraceConnFactory(factory ConnFactory, config TraceConfig) ConnFactory {
+	logger := config.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func() (net.Conn, error) {
+		conn, err := factory()
+		if err != nil {
+			return nil, err
+		}
+		id := atomic.AddInt64(&traceConns, 1)
+		logger.Printf("fcgi[%d] connected to %s", id, conn.RemoteAddr())
+		trace := func(dir string) func(h header, content []byte) {
+			return func(h header, content []byte) {
+				logger.Print(traceLine(id, dir, h, content, config.DumpBytes))
+			}
+		}
+		rc := &recordingConn{Conn: conn}
+		rc.send.emit = trace(">")
+		rc.recv.emit = trace("<")
+		return rc, nil
+	}
+}
+
+// traceLine 返回一个消息的跟踪记录
+func traceLine(conn int64, dir string, h header, content []byte, dump int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "fcgi[%d] %s %s id=%d len=%d pad=%d",
+		conn, dir, h.Type, h.RequestID, h.ContentLength, h.PaddingLength)
+	switch {
+	case h.Type == typeEndRequest && len(content) == 8:
+		fmt.Fprintf(&b, " appStatus=%d protocolStatus=%d", binary.BigEndian.Uint32(content), content[4])
+	case h.Type == typeUnknownType && len(content) == 8:
+		fmt.Fprintf(&b, " unknown=%s", fcgiproto.RecType(content[0]))
+	}
+	if dump > 0 && len(content) > 0 {
+		n := len(content)
+		if n > dump {
+			n = dump
+		}
+		b.WriteString("\n")
+		b.WriteString(strings.TrimSuffix(hex.Dump(content[:n]), "\n"))
+		if n < len(content) {
+			fmt.Fprintf(&b, "\n... %d more bytes", len(content)-n)
+		}
+	}
+	return b.String()
+}
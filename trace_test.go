@@ -0,0 +1,41 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestTraceConnFactory(t *testing.T) {
+	backend := recordBackend(func(sc *conn, reqID uint16, _ []byte) {
+		sc.writeRecord(typeStdout, reqID, []byte("Content-Type: text/plain\r\n\r\n"+strings.Repeat("x", 40)))
+		sc.writeEndRequest(reqID, 3, statusRequestComplete)
+	})
+	var buf bytes.Buffer
+	factory := TraceConnFactory(backend, TraceConfig{Logger: log.New(&buf, "", 0), DumpBytes: 16})
+	c, err := SimpleClientFactory(factory, 0)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(NewRequest(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.stdOutReader)
+
+	out := buf.String()
+	for _, want := range []string{
+		"> FCGI_BEGIN_REQUEST id=1 len=8 pad=0",
+		"> FCGI_STDIN id=1 len=0 pad=0",
+		"< FCGI_STDOUT id=1 len=68 pad=4",
+		"Content-Type: te",
+		"... 52 more bytes",
+		"< FCGI_END_REQUEST id=1 len=8 pad=0 appStatus=3 protocolStatus=0",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("trace missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package ffcgiclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// 响应改写的辅助实现，供需要处理响应头/响应体的中间件使用
+
+// responseRewriter 改写响应的函数定义
+// header为已解析的CGI响应头，可直接修改；body为剩余的响应体，返回改写后的响应体
+// 返回的响应体实现了io.Closer时，写回结束后（包括出错时）被关闭
+type responseRewriter func(header http.Header, body io.Reader) (io.Reader, error)
+
+// rewriteResponse 解析resp中的CGI响应头，经fn改写后写入新的ResponsePipe
+// stderr流原样转发
+func rewriteResponse(resp *ResponsePipe, fn responseRewriter) *ResponsePipe {
+	p := NewResponsePipe()
+	p.headerLimits = resp.headerLimits
+	p.upstream = resp
+
+	// 转发stderr
+	go func() {
+		io.Copy(p.stdErrWriter, resp.stdErrReader)
+		p.stdErrWriter.Close()
+	}()
+
+	// 改写stdout
+	go func() {
+		header, br, err := readCGIHeader(resp.stdOutReader, resp.headerLimits)
+		err = func() error {
+			// 读取CGI响应头失败
+			if err != nil {
+				return err
+			}
+			// 改写，fn中的panic作为错误返回
+			var body io.Reader
+			if err := catchPanic(func() (err error) {
+				body, err = fn(header, br)
+				return err
+			}); err != nil {
+				return err
+			}
+			// 写回响应头
+			if err = writeCGIHeader(p.stdOutWriter, header); err != nil {
+				return err
+			}
+			// 写回响应体
+			_, err = io.Copy(p.stdOutWriter, body)
+			if closer, ok := body.(io.Closer); ok {
+				closer.Close()
+			}
+			return err
+		}()
+		// 丢弃剩余数据，避免阻塞上游的读取协程
+		resp.discardStdout()
+		// 传递上游的传输错误
+		p.setErr(resp.Err())
+		if err != nil {
+			p.stdOutWriter.(*io.PipeWriter).CloseWithError(err)
+			return
+		}
+		p.stdOutWriter.Close()
+	}()
+	return p
+}
+
+// ResponseTransformer 改写应用程序响应的函数，用于TransformResponse
+// header为CGI响应头（包括Status），可直接修改；body为流式读取的响应体，返回改写后的响应体
+// 改变了响应体的长度时应删除Content-Length；返回的响应体实现了io.Closer时在写回结束后被关闭
+type ResponseTransformer func(req *Request, header http.Header, body io.Reader) (io.Reader, error)
+
+// TransformResponse 返回以fn改写响应的中间件，fn在读取到应用程序的响应头后调用
+// 多个改写按Chain的顺序嵌套，靠后的中间件先改写
+func TransformResponse(fn ResponseTransformer) Middleware {
+	return func(inner RequestHandler) RequestHandler {
+		return func(client Client, req *Request) (*ResponsePipe, error) {
+			resp, err := inner(client, req)
+			if err != nil {
+				return resp, err
+			}
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) {
+				return fn(req, header, body)
+			}), nil
+		}
+	}
+}
+
+// StripHeaders 返回删除指定响应头的ResponseTransformer，例如X-Powered-By
+func StripHeaders(names ...string) ResponseTransformer {
+	return func(req *Request, header http.Header, body io.Reader) (io.Reader, error) {
+		for _, name := range names {
+			header.Del(name)
+		}
+		return body, nil
+	}
+}
+
+// ReplaceBody 返回将响应体中的old替换为new的ResponseTransformer
+// 只处理Content-Type以contentType开头（如"text/html"）且没有Content-Encoding的响应，替换后删除Content-Length
+func ReplaceBody(contentType, old, new string) ResponseTransformer {
+	return func(req *Request, header http.Header, body io.Reader) (io.Reader, error) {
+		if !strings.HasPrefix(header.Get("Content-Type"), contentType) || header.Get("Content-Encoding") != "" {
+			return body, nil
+		}
+		header.Del("Content-Length")
+		return NewReplaceReader(body, []byte(old), []byte(new)), nil
+	}
+}
+
+// NewReplaceReader 返回读取r时将old替换为new的io.Reader
+// 跨越两次读取的old同样被替换，最多额外缓冲len(old)-1字节
+func NewReplaceReader(r io.Reader, old, new []byte) io.Reader {
+	if len(old) == 0 {
+		return r
+	}
+	return &replaceReader{r: r, old: old, new: new, chunk: make([]byte, 32*1024)}
+}
+
+// replaceReader NewReplaceReader的实现
+type replaceReader struct {
+	r        io.Reader
+	old, new []byte
+	chunk    []byte // 读取缓冲
+	in       []byte // 尚未处理的输入，可能是old的前缀
+	out      []byte // 已处理待返回的输出
+	err      error  // r返回的错误
+}
+
+// Read 实现io.Reader
+func (rr *replaceReader) Read(p []byte) (int, error) {
+	for len(rr.out) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		n, err := rr.r.Read(rr.chunk)
+		rr.in = append(rr.in, rr.chunk[:n]...)
+		rr.err = err
+		rr.process(err != nil)
+	}
+	n := copy(p, rr.out)
+	rr.out = rr.out[n:]
+	return n, nil
+}
+
+// process 替换in中的old并移入out，final为false时保留可能是old前缀的末尾部分
+func (rr *replaceReader) process(final bool) {
+	for {
+		i := bytes.Index(rr.in, rr.old)
+		if i < 0 {
+			break
+		}
+		rr.out = append(rr.out, rr.in[:i]...)
+		rr.out = append(rr.out, rr.new...)
+		rr.in = rr.in[i+len(rr.old):]
+	}
+	keep := 0
+	if !final {
+		keep = len(rr.old) - 1
+		if keep > len(rr.in) {
+			keep = len(rr.in)
+		}
+	}
+	rr.out = append(rr.out, rr.in[:len(rr.in)-keep]...)
+	rr.in = append([]byte(nil), rr.in[len(rr.in)-keep:]...)
+}
+
+// writeCGIHeader 将header以CGI响应头的格式写入w，以空行结束
+func writeCGIHeader(w io.Writer, header http.Header) error {
+	var buf bytes.Buffer
+	for k, vv := range header {
+		for _, v := range vv {
+			buf.WriteString(k)
+			buf.WriteString(": ")
+			buf.WriteString(v)
+			buf.WriteString("\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// newStaticResponse 返回内容固定的ResponsePipe，用于中间件不经过后端直接应答
+func newStaticResponse(header http.Header, body io.Reader) *ResponsePipe {
+	p := NewResponsePipe()
+	go func() {
+		if err := writeCGIHeader(p.stdOutWriter, header); err == nil {
+			io.Copy(p.stdOutWriter, body)
+		}
+		p.Close()
+	}()
+	return p
+}
+
+// newStatusResponse 返回只包含状态码及其描述文本的ResponsePipe
+func newStatusResponse(code int) *ResponsePipe {
+	return newStaticResponse(statusResponse(code))
+}
+
+// statusResponse 返回只包含状态码及其描述文本的响应头和响应体
+func statusResponse(code int) (http.Header, io.Reader) {
+	header := make(http.Header)
+	header.Set("Status", fmt.Sprintf("%d %s", code, http.StatusText(code)))
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	return header, strings.NewReader(http.StatusText(code) + "\n")
+}
+
+// responseRecorder 在内存中记录响应的http.ResponseWriter实现，用于子请求等
+type responseRecorder struct {
+	header http.Header  // 响应头
+	code   int          // 状态码
+	body   bytes.Buffer // 响应体
+}
+
+// newResponseRecorder 创建一个responseRecorder
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header)}
+}
+
+// Header 实现http.ResponseWriter
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+// WriteHeader 实现http.ResponseWriter，仅记录第一次设置的状态码
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.code == 0 {
+		rec.code = code
+	}
+}
+
+// Write 实现http.ResponseWriter
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(p)
+}
+
+// Code 返回状态码，未设置时为200
+func (rec *responseRecorder) Code() int {
+	if rec.code == 0 {
+		return http.StatusOK
+	}
+	return rec.code
+}
@@ -0,0 +1,81 @@
+package ffcgiclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestReplaceReader(t *testing.T) {
+	cases := []struct {
+		in, old, new, want string
+	}{
+		{"hello world", "world", "gopher", "hello gopher"},
+		{"aaaa", "aa", "b", "bb"},
+		{"abcabc", "bca", "", "abc"},
+		{"no match", "xyz", "!", "no match"},
+		{"tail ab", "abc", "!", "tail ab"},
+	}
+	for _, c := range cases {
+		// 每次只读取一个字节，匹配跨越读取边界
+		r := NewReplaceReader(iotest.OneByteReader(strings.NewReader(c.in)), []byte(c.old), []byte(c.new))
+		got, err := io.ReadAll(r)
+		if err != nil || string(got) != c.want {
+			t.Errorf("replace %q in %q = %q, %v, want %q", c.old, c.in, got, err, c.want)
+		}
+	}
+}
+
+func TestTransformResponse(t *testing.T) {
+	stub := &stubClient{recorded: map[string][]byte{
+		"": []byte("Content-Type: text/html\r\nContent-Length: 26\r\nX-Powered-By: PHP/8.2\r\n\r\n<p>Powered by PHP/8.2</p>\n"),
+	}}
+	handler := Chain(
+		TransformResponse(StripHeaders("X-Powered-By")),
+		TransformResponse(ReplaceBody("text/html", "PHP/8.2", "PHP")),
+	)(BasicHandler)
+	h := NewHandler(handler, func() (Client, error) { return stub, nil })
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "<p>Powered by PHP</p>\n" {
+		t.Fatalf("status = %d, body = %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("X-Powered-By") != "" || rec.Header().Get("Content-Length") != "" {
+		t.Fatalf("header = %v", rec.Header())
+	}
+}
+
+func TestRewriteResponseDrainsAfterError(t *testing.T) {
+	rewrites := map[string]func(resp *ResponsePipe) *ResponsePipe{
+		"header error": func(resp *ResponsePipe) *ResponsePipe {
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) { return body, nil })
+		},
+		"transform error": func(resp *ResponsePipe) *ResponsePipe {
+			return rewriteResponse(resp, func(header http.Header, body io.Reader) (io.Reader, error) { return nil, io.ErrUnexpectedEOF })
+		},
+		"body limit": func(resp *ResponsePipe) *ResponsePipe {
+			l := &BodyLimit{MaxResponse: 8}
+			return l.limitResponse(resp, new(int32), func() {})
+		},
+	}
+	for name, rewrite := range rewrites {
+		header := "Content-Type: text/plain\r\n\r\n"
+		if name == "header error" {
+			header = "X-Big: " + strings.Repeat("a", 64*1024) + "\r\n\r\n"
+		}
+		done := make(chan struct{})
+		go func() {
+			rewrite(stalledBodyPipe(header)).WriteTo(httptest.NewRecorder(), io.Discard)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: WriteTo did not return", name)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package ffcgiclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoBackend 原样返回收到的数据的后端
+func echoBackend(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// fakeProxy 启动代理，handshake完成握手并返回要连接的地址，返回空地址时关闭连接
+func fakeProxy(t *testing.T, handshake func(conn net.Conn, br *bufio.Reader) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				address := handshake(conn, br)
+				if address == "" {
+					return
+				}
+				upstream, err := net.Dial("tcp", address)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, br)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// socks5Handshake 只接受用户名user、密码pass的SOCKS5代理握手
+func socks5Handshake(conn net.Conn, br *bufio.Reader) string {
+	head := make([]byte, 2)
+	io.ReadFull(br, head)
+	methods := make([]byte, head[1])
+	io.ReadFull(br, methods)
+	if !strings.Contains(string(methods), "\x02") {
+		conn.Write([]byte{5, 0xff})
+		return ""
+	}
+	conn.Write([]byte{5, 2})
+	ver, _ := br.ReadByte()
+	n, _ := br.ReadByte()
+	user := make([]byte, n)
+	io.ReadFull(br, user)
+	n, _ = br.ReadByte()
+	pass := make([]byte, n)
+	io.ReadFull(br, pass)
+	if ver != 1 || string(user) != "user" || string(pass) != "pass" {
+		conn.Write([]byte{1, 1})
+		return ""
+	}
+	conn.Write([]byte{1, 0})
+
+	req := make([]byte, 4)
+	io.ReadFull(br, req)
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n, _ := br.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(br, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(br, port)
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	if host != "127.0.0.1" {
+		conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+		return ""
+	}
+	conn.Write([]byte{5, 0, 0, 3, 5, 'p', 'r', 'o', 'x', 'y', 0, 80})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+}
+
+// connectHandshake 只接受用户名user、密码pass的HTTP CONNECT代理握手
+func connectHandshake(conn net.Conn, br *bufio.Reader) string {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return ""
+	}
+	if user, pass, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization")); !ok || user != "user" || pass != "pass" {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+		return ""
+	}
+	if req.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+		return ""
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host
+}
+
+// parseProxyAuth 解析Proxy-Authorization中的用户名和密码
+func parseProxyAuth(auth string) (user, pass string, ok bool) {
+	r := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	return r.BasicAuth()
+}
+
+func TestProxyDialer(t *testing.T) {
+	backend := echoBackend(t)
+	_, port, _ := net.SplitHostPort(backend)
+	socks := fakeProxy(t, socks5Handshake)
+	connect := fakeProxy(t, connectHandshake)
+
+	tests := []struct {
+		proxy   string
+		address string
+		ok      bool
+	}{
+		{"socks5://user:pass@" + socks, backend, true},
+		{"socks5://user:pass@" + socks, net.JoinHostPort("localhost", port), true},
+		{"socks5://user:wrong@" + socks, backend, false},
+		{"socks5://" + socks, backend, false},
+		{"socks5://user:pass@" + socks, "10.255.255.1:9000", false},
+		{"http://user:pass@" + connect, backend, true},
+		{"http://user:wrong@" + connect, backend, false},
+	}
+	for _, tt := range tests {
+		d, err := NewProxyDialer(tt.proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Timeout = time.Second
+		conn, err := d.ConnFactory(tt.address)()
+		if !tt.ok {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%s -> %s: expected error", tt.proxy, tt.address)
+			} else if strings.Contains(err.Error(), "wrong") || strings.Contains(err.Error(), ":pass@") {
+				t.Errorf("%s: error leaks password: %v", tt.proxy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s -> %s: %v", tt.proxy, tt.address, err)
+			continue
+		}
+		io.WriteString(conn, "ping")
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+			t.Errorf("%s: echo = %q, %v", tt.proxy, b, err)
+		}
+		conn.Close()
+	}
+
+	for _, invalid := range []string{"ftp://bastion:21", "socks5://", "://"} {
+		if _, err := NewProxyDialer(invalid); err == nil {
+			t.Errorf("NewProxyDialer(%q): expected error", invalid)
+		}
+	}
+}
+
+func TestProxyDialerCanceled(t *testing.T) {
+	// 接受连接但不应答的代理
+	stalled := fakeProxy(t, func(conn net.Conn, br *bufio.Reader) string {
+		io.Copy(io.Discard, br)
+		return ""
+	})
+	d, err := NewProxyDialer("socks5://" + stalled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := d.DialContext(ctx, "127.0.0.1:9000"); err == nil {
+		t.Fatal("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handshake not canceled, took %s", elapsed)
+	}
+}
@@ -0,0 +1,166 @@
+package ffcgiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// 按Host头分发请求的虚拟主机，每个主机有自己的文档根目录、中间件链和后端，用于在一个进程中托管多个PHP站点
+
+// VirtualHost 一个虚拟主机
+type VirtualHost struct {
+
+	// Names 主机名，可以使用"*.example.com"匹配所有子域名
+	Names []string
+
+	// DocRoot 文档根目录
+	DocRoot string
+
+	// Backend 处理此主机请求的FastCGI后端
+	Backend *Backend
+
+	// Middlewares 在NewPHPFS映射参数之后执行的中间件
+	Middlewares []Middleware
+
+	// Pool 连接后端的Client池的配置
+	Pool PoolConfig
+
+	// Default 为true时处理没有匹配到其他主机的请求
+	Default bool
+}
+
+// VirtualHosts 按Host头分发请求的http.Handler
+// 精确的主机名优先，其次是最长的通配符后缀，最后是Default主机
+type VirtualHosts struct {
+
+	// NotFound 没有匹配的主机且没有Default主机时使用，为nil时返回404
+	NotFound http.Handler
+
+	mutex     sync.RWMutex
+	exact     map[string]*vhostEntry
+	wildcards []*vhostEntry // 按后缀长度降序
+	fallback  *vhostEntry
+	entries   []*vhostEntry
+}
+
+// vhostEntry 已创建的虚拟主机
+type vhostEntry struct {
+	suffix  string // 通配符主机名的后缀，例如".example.com"
+	handler *DefaultHandler
+	pool    *ClientPool
+}
+
+// Add 添加虚拟主机，为其创建Client池和Handler，返回该Handler以便设置日志等
+// 主机名与已添加的主机重复时返回错误
+func (v *VirtualHosts) Add(vh *VirtualHost) (*DefaultHandler, error) {
+	if vh.Backend == nil {
+		return nil, errors.New("virtual host without backend")
+	}
+	if len(vh.Names) == 0 && !vh.Default {
+		return nil, errors.New("virtual host without names")
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if vh.Default && v.fallback != nil {
+		return nil, errors.New("duplicate default virtual host")
+	}
+	for _, name := range vh.Names {
+		name = strings.ToLower(name)
+		if v.exact[name] != nil || v.wildcard(name) != nil {
+			return nil, fmt.Errorf("duplicate virtual host %q", name)
+		}
+	}
+
+	pool := NewClientPoolConfig(SimpleClientFactoryNoConn(vh.Backend.ConnFactory(), 0), vh.Pool)
+	chain := append([]Middleware{NewPHPFS(vh.DocRoot)}, vh.Middlewares...)
+	handler := NewHandler(Chain(chain...)(BasicHandler), pool.CreateClient)
+	entry := &vhostEntry{handler: handler, pool: pool}
+	v.entries = append(v.entries, entry)
+	if vh.Default {
+		v.fallback = entry
+	}
+	if v.exact == nil {
+		v.exact = make(map[string]*vhostEntry)
+	}
+	for _, name := range vh.Names {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "*.") {
+			v.addWildcard(&vhostEntry{suffix: name[1:], handler: handler, pool: pool})
+			continue
+		}
+		v.exact[name] = entry
+	}
+	return handler, nil
+}
+
+// wildcard 返回与通配符主机名name相同的已有主机
+func (v *VirtualHosts) wildcard(name string) *vhostEntry {
+	for _, entry := range v.wildcards {
+		if "*"+entry.suffix == name {
+			return entry
+		}
+	}
+	return nil
+}
+
+// addWildcard 按后缀长度降序插入
+func (v *VirtualHosts) addWildcard(entry *vhostEntry) {
+	i := 0
+	for i < len(v.wildcards) && len(v.wildcards[i].suffix) >= len(entry.suffix) {
+		i++
+	}
+	v.wildcards = append(v.wildcards, nil)
+	copy(v.wildcards[i+1:], v.wildcards[i:])
+	v.wildcards[i] = entry
+}
+
+// match 返回处理host的虚拟主机
+func (v *VirtualHosts) match(host string) *vhostEntry {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	if entry := v.exact[host]; entry != nil {
+		return entry
+	}
+	for _, entry := range v.wildcards {
+		if strings.HasSuffix(host, entry.suffix) {
+			return entry
+		}
+	}
+	return v.fallback
+}
+
+// ServeHTTP 实现http.Handler
+func (v *VirtualHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if entry := v.match(r.Host); entry != nil {
+		entry.handler.ServeHTTP(w, r)
+		return
+	}
+	if v.NotFound != nil {
+		v.NotFound.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// Close 关闭所有虚拟主机的Client池，返回第一个错误
+func (v *VirtualHosts) Close(ctx context.Context) (err error) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	for _, entry := range v.entries {
+		if cerr := entry.pool.Close(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return
+}
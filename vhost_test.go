@@ -0,0 +1,58 @@
+package ffcgiclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"testing"
+)
+
+// docRootBackend 启动返回backend名称和DOCUMENT_ROOT的FastCGI后端
+func docRootBackend(t *testing.T, name string) *Backend {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go fcgi.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s %s", name, fcgi.ProcessEnv(r)["DOCUMENT_ROOT"])
+	}))
+	return &Backend{Network: "tcp", Address: ln.Addr().String()}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	a, b := docRootBackend(t, "a"), docRootBackend(t, "b")
+	v := &VirtualHosts{}
+	defer v.Close(context.Background())
+	if _, err := v.Add(&VirtualHost{Names: []string{"a.example.com"}, DocRoot: "/srv/a", Backend: a, Default: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Add(&VirtualHost{Names: []string{"b.example.com", "*.b.example.com"}, DocRoot: "/srv/b", Backend: b}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Add(&VirtualHost{Names: []string{"*.B.example.com"}, Backend: b}); err == nil {
+		t.Fatal("expected error for duplicate host")
+	}
+
+	cases := map[string]string{
+		"a.example.com":          "a /srv/a",
+		"B.example.com:8080":     "b /srv/b",
+		"www.b.example.com":      "b /srv/b",
+		"unknown.example.com":    "a /srv/a",
+		"b.example.com.":         "b /srv/b",
+		"deep.www.b.example.com": "b /srv/b",
+	}
+	for host, want := range cases {
+		r := httptest.NewRequest("GET", "/index.php", nil)
+		r.Host = host
+		rec := httptest.NewRecorder()
+		v.ServeHTTP(rec, r)
+		if rec.Body.String() != want {
+			t.Errorf("%s: got %q (status %d), want %q", host, rec.Body.String(), rec.Code, want)
+		}
+	}
+}